@@ -0,0 +1,67 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WidgetQuotaName is the name of the WidgetQuota that limits the widgets of its workspace. WidgetQuotas with any
+// other name are ignored.
+const WidgetQuotaName = "default"
+
+// WidgetQuotaSpec defines the desired state of WidgetQuota
+type WidgetQuotaSpec struct {
+	// MaxWidgets is the maximum number of widgets in the workspace. It overrides the default of the
+	// controller-manager.
+	// +kubebuilder:validation:Minimum=0
+	MaxWidgets int `json:"maxWidgets"`
+}
+
+// WidgetQuotaStatus defines the observed state of WidgetQuota
+type WidgetQuotaStatus struct {
+	// Used is the number of widgets in the workspace.
+	Used int `json:"used,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Max",type=integer,JSONPath=`.spec.maxWidgets`
+// +kubebuilder:printcolumn:name="Used",type=integer,JSONPath=`.status.used`
+
+// WidgetQuota is the Schema for the widgetquotas API
+type WidgetQuota struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   WidgetQuotaSpec   `json:"spec,omitempty"`
+	Status WidgetQuotaStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// WidgetQuotaList contains a list of WidgetQuota
+type WidgetQuotaList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []WidgetQuota `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&WidgetQuota{}, &WidgetQuotaList{})
+}
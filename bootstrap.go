@@ -0,0 +1,174 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+
+	"github.com/kcp-dev/controller-runtime-example/internal/schemacompat"
+)
+
+// kcpManifests are the APIExport and the APIResourceSchemas that --bootstrap applies.
+//
+//go:embed config/kcp/apiexport.yaml config/kcp/*.apiresourceschemas.yaml
+var kcpManifests embed.FS
+
+// bootstrapFieldManager is the field manager of the server-side applies of --bootstrap.
+const bootstrapFieldManager = "controller-runtime-example"
+
+// +kubebuilder:rbac:groups="apis.kcp.io",resources=apiresourceschemas,verbs=get;create;patch
+// +kubebuilder:rbac:groups="apis.kcp.io",resources=apiexports,verbs=create;patch
+
+// bootstrapAPIExport creates or updates the APIExport named apiExportName and the APIResourceSchemas it exports in the
+// workspace of cfg, from the config/kcp manifests in manifests, with server-side apply. claims are added to the
+// permission claims of the manifest. Unless allowDowngrade is set, it refuses to replace a schema the APIExport already
+// exports with one that would break the workspaces bound to it, or to stop exporting a resource, such as with the older
+// manifests of a manager that is being rolled back.
+func bootstrapAPIExport(ctx context.Context, cfg *rest.Config, manifests fs.FS, apiExportName string, claims []apisv1alpha1.PermissionClaim, allowDowngrade bool) error {
+	apiExport, schemas, err := readKCPManifests(manifests)
+	if err != nil {
+		return err
+	}
+	apiExport.Name = apiExportName
+	withClaims(apiExport, claims)
+
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+	if !allowDowngrade {
+		if err := checkSchemaDowngrades(ctx, c, apiExportName, schemas); err != nil {
+			return err
+		}
+	}
+
+	for _, schema := range schemas {
+		if err := c.Patch(ctx, schema, client.Apply, client.FieldOwner(bootstrapFieldManager), client.ForceOwnership); err != nil {
+			return fmt.Errorf("error applying APIResourceSchema %s: %w", schema.Name, err)
+		}
+	}
+	if err := c.Patch(ctx, apiExport, client.Apply, client.FieldOwner(bootstrapFieldManager), client.ForceOwnership); err != nil {
+		return fmt.Errorf("error applying APIExport %s: %w", apiExportName, err)
+	}
+	setupLog.Info("Bootstrapped APIExport", "schemas", apiExport.Spec.LatestResourceSchemas)
+	return nil
+}
+
+// checkSchemaDowngrades returns an error if the APIExport exists and one of its APIResourceSchemas has breaking
+// changes in the schema for the same resource among schemas, or is for a resource that none of schemas is for.
+func checkSchemaDowngrades(ctx context.Context, c client.Client, apiExportName string, schemas []*apisv1alpha1.APIResourceSchema) error {
+	apiExport := &apisv1alpha1.APIExport{}
+	if err := c.Get(ctx, client.ObjectKey{Name: apiExportName}, apiExport); apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error getting APIExport %s: %w", apiExportName, err)
+	}
+
+	byResource := map[string]*apisv1alpha1.APIResourceSchema{}
+	for _, schema := range schemas {
+		byResource[schemacompat.Resource(schema)] = schema
+	}
+	for _, name := range apiExport.Spec.LatestResourceSchemas {
+		existing := &apisv1alpha1.APIResourceSchema{}
+		if err := c.Get(ctx, client.ObjectKey{Name: name}, existing); apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error getting APIResourceSchema %s: %w", name, err)
+		}
+		schema, ok := byResource[schemacompat.Resource(existing)]
+		if !ok {
+			return fmt.Errorf("refusing to stop exporting %s of APIResourceSchema %s, which would break the workspaces bound to it",
+				schemacompat.Resource(existing), existing.Name)
+		}
+		if schema.Name == existing.Name {
+			continue
+		}
+		changes, err := schemacompat.Compare(existing, schema)
+		if err != nil {
+			return err
+		}
+		if breaking := schemacompat.BreakingChanges(changes); len(breaking) > 0 {
+			messages := make([]string, 0, len(breaking))
+			for _, c := range breaking {
+				messages = append(messages, c.String())
+			}
+			return fmt.Errorf("refusing to replace APIResourceSchema %s with %s, which would break the workspaces bound to it: %s",
+				existing.Name, schema.Name, strings.Join(messages, "; "))
+		}
+	}
+	return nil
+}
+
+// readKCPManifests returns the APIExport in config/kcp/apiexport.yaml of manifests, and the APIResourceSchemas of
+// config/kcp/*.apiresourceschemas.yaml that it exports, ready to be applied.
+func readKCPManifests(manifests fs.FS) (*apisv1alpha1.APIExport, []*apisv1alpha1.APIResourceSchema, error) {
+	data, err := fs.ReadFile(manifests, "config/kcp/apiexport.yaml")
+	if err != nil {
+		return nil, nil, err
+	}
+	apiExport := &apisv1alpha1.APIExport{}
+	if err := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096).Decode(apiExport); err != nil {
+		return nil, nil, fmt.Errorf("error decoding config/kcp/apiexport.yaml: %w", err)
+	}
+
+	files, err := fs.Glob(manifests, "config/kcp/*.apiresourceschemas.yaml")
+	if err != nil {
+		return nil, nil, err
+	}
+	all := map[string]*apisv1alpha1.APIResourceSchema{}
+	for _, file := range files {
+		data, err := fs.ReadFile(manifests, file)
+		if err != nil {
+			return nil, nil, err
+		}
+		decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+		for {
+			schema := &apisv1alpha1.APIResourceSchema{}
+			if err := decoder.Decode(schema); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, nil, fmt.Errorf("error decoding %s: %w", file, err)
+			}
+			if schema.Kind == "APIResourceSchema" {
+				all[schema.Name] = schema
+			}
+		}
+	}
+
+	schemas := make([]*apisv1alpha1.APIResourceSchema, 0, len(apiExport.Spec.LatestResourceSchemas))
+	for _, name := range apiExport.Spec.LatestResourceSchemas {
+		schema, ok := all[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("APIResourceSchema %s of the APIExport is not in config/kcp", name)
+		}
+		schemas = append(schemas, schema)
+	}
+	return apiExport, schemas, nil
+}
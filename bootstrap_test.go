@@ -0,0 +1,183 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/go-cmp/cmp"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+// revisedManifests returns the embedded manifests with the widgets schema renamed to prefix, and its spec modified by
+// mutate. The other schemas are left as they are.
+func revisedManifests(t *testing.T, prefix string, mutate func(spec *apiextensionsv1.JSONSchemaProps)) fstest.MapFS {
+	t.Helper()
+	apiExport, schemas, err := readKCPManifests(kcpManifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	widgets := schemas[0]
+	widgets.Name = prefix + ".widgets.data.my.domain"
+	schema, err := widgets.Spec.Versions[0].GetSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := schema.Properties["spec"]
+	mutate(&spec)
+	schema.Properties["spec"] = spec
+	if err := widgets.Spec.Versions[0].SetSchema(schema); err != nil {
+		t.Fatal(err)
+	}
+	apiExport.Spec.LatestResourceSchemas[0] = widgets.Name
+	return manifestsFS(t, prefix, apiExport, schemas)
+}
+
+// withoutWidgetQuotas returns manifests without the widgetquotas schema.
+func withoutWidgetQuotas(t *testing.T, manifests fs.FS) fstest.MapFS {
+	t.Helper()
+	apiExport, schemas, err := readKCPManifests(manifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiExport.Spec.LatestResourceSchemas = apiExport.Spec.LatestResourceSchemas[:1]
+	return manifestsFS(t, "without-quotas", apiExport, schemas[:1])
+}
+
+// manifestsFS returns config/kcp manifests with apiExport and schemas, in prefix.apiresourceschemas.yaml.
+func manifestsFS(t *testing.T, prefix string, apiExport *apisv1alpha1.APIExport, schemas []*apisv1alpha1.APIResourceSchema) fstest.MapFS {
+	t.Helper()
+	var schemaData []byte
+	for _, schema := range schemas {
+		data, err := yaml.Marshal(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schemaData = append(schemaData, "---\n"...)
+		schemaData = append(schemaData, data...)
+	}
+	apiExportData, err := yaml.Marshal(apiExport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fstest.MapFS{
+		"config/kcp/apiexport.yaml":                         &fstest.MapFile{Data: apiExportData},
+		"config/kcp/" + prefix + ".apiresourceschemas.yaml": &fstest.MapFile{Data: schemaData},
+	}
+}
+
+func latestResourceSchemas(t *testing.T, c client.Client) []string {
+	t.Helper()
+	apiExport := &apisv1alpha1.APIExport{}
+	if err := c.Get(context.Background(), client.ObjectKey{Name: testAPIExportName}, apiExport); err != nil {
+		t.Fatal(err)
+	}
+	return apiExport.Spec.LatestResourceSchemas
+}
+
+func TestReadKCPManifests(t *testing.T) {
+	apiExport, schemas, err := readKCPManifests(kcpManifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiExport.Name != testAPIExportName {
+		t.Errorf("expected the APIExport %s, got %s", testAPIExportName, apiExport.Name)
+	}
+	var names []string
+	for _, schema := range schemas {
+		names = append(names, schema.Name)
+	}
+	if diff := cmp.Diff(apiExport.Spec.LatestResourceSchemas, names); diff != "" {
+		t.Errorf("expected the schemas of the APIExport (-want +got):\n%s", diff)
+	}
+
+	missing := fstest.MapFS{"config/kcp/apiexport.yaml": &fstest.MapFile{Data: []byte(
+		"apiVersion: apis.kcp.io/v1alpha1\nkind: APIExport\nmetadata:\n  name: data.my.domain\nspec:\n  latestResourceSchemas:\n  - today.widgets.data.my.domain\n")}}
+	if _, _, err := readKCPManifests(missing); err == nil {
+		t.Error("expected an error for a schema that is not in config/kcp")
+	}
+}
+
+func TestBootstrapAPIExport(t *testing.T) {
+	s := fake.NewServer("root")
+	defer s.Close()
+	ctx := context.Background()
+	c, err := client.New(s.Config(), client.Options{Scheme: scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh workspace gets the embedded APIExport and schemas, and bootstrapping again changes nothing
+	for i := 0; i < 2; i++ {
+		if err := bootstrapAPIExport(ctx, s.Config(), kcpManifests, testAPIExportName, nil, false); err != nil {
+			t.Fatalf("failed to bootstrap: %v", err)
+		}
+	}
+	if diff := cmp.Diff([]string{"today.widgets.data.my.domain", "today.widgetquotas.data.my.domain"}, latestResourceSchemas(t, c)); diff != "" {
+		t.Errorf("unexpected schemas of the APIExport (-want +got):\n%s", diff)
+	}
+	if err := c.Get(ctx, client.ObjectKey{Name: "today.widgets.data.my.domain"}, &apisv1alpha1.APIResourceSchema{}); err != nil {
+		t.Errorf("expected the APIResourceSchema to be created: %v", err)
+	}
+
+	// A compatible revision replaces the schema
+	upgrade := revisedManifests(t, "v2", func(spec *apiextensionsv1.JSONSchemaProps) {
+		spec.Properties["bar"] = apiextensionsv1.JSONSchemaProps{Type: "string"}
+	})
+	if err := bootstrapAPIExport(ctx, s.Config(), upgrade, testAPIExportName, nil, false); err != nil {
+		t.Fatalf("failed to bootstrap a compatible revision: %v", err)
+	}
+	if diff := cmp.Diff([]string{"v2.widgets.data.my.domain", "today.widgetquotas.data.my.domain"}, latestResourceSchemas(t, c)); diff != "" {
+		t.Errorf("unexpected schemas of the APIExport after the upgrade (-want +got):\n%s", diff)
+	}
+
+	// The previous revision lacks the new field, so going back to it is refused
+	err = bootstrapAPIExport(ctx, s.Config(), kcpManifests, testAPIExportName, nil, false)
+	if err == nil || !strings.Contains(err.Error(), ".spec.bar: field removed") {
+		t.Errorf("expected the downgrade to be refused, got %v", err)
+	}
+	if diff := cmp.Diff([]string{"v2.widgets.data.my.domain", "today.widgetquotas.data.my.domain"}, latestResourceSchemas(t, c)); diff != "" {
+		t.Errorf("expected the APIExport to be left alone after the downgrade (-want +got):\n%s", diff)
+	}
+
+	// Manifests without a resource the APIExport exports are refused as well
+	err = bootstrapAPIExport(ctx, s.Config(), withoutWidgetQuotas(t, upgrade), testAPIExportName, nil, false)
+	if err == nil || !strings.Contains(err.Error(), "refusing to stop exporting widgetquotas.data.my.domain") {
+		t.Errorf("expected the removal of a resource to be refused, got %v", err)
+	}
+	if diff := cmp.Diff([]string{"v2.widgets.data.my.domain", "today.widgetquotas.data.my.domain"}, latestResourceSchemas(t, c)); diff != "" {
+		t.Errorf("expected the APIExport to be left alone after the removal (-want +got):\n%s", diff)
+	}
+
+	// Unless downgrades are allowed
+	if err := bootstrapAPIExport(ctx, s.Config(), withoutWidgetQuotas(t, upgrade), testAPIExportName, nil, true); err != nil {
+		t.Fatalf("failed to bootstrap with downgrades allowed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"v2.widgets.data.my.domain"}, latestResourceSchemas(t, c)); diff != "" {
+		t.Errorf("unexpected schemas of the APIExport after the allowed downgrade (-want +got):\n%s", diff)
+	}
+}
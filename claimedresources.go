@@ -0,0 +1,169 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+
+	"github.com/kcp-dev/controller-runtime-example/controllers"
+)
+
+// claimedResourcesConfig is the content of the file given by --claimed-resources.
+type claimedResourcesConfig struct {
+	// ClaimedResources are the resources of other APIExports that the APIExport claims.
+	ClaimedResources []controllers.ClaimedResource `json:"claimedResources"`
+}
+
+// readClaimedResources returns the claimed resources of the file.
+func readClaimedResources(path string) ([]controllers.ClaimedResource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config claimedResourcesConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %w", path, err)
+	}
+
+	seen := map[string]bool{}
+	for i, resource := range config.ClaimedResources {
+		gr := resource.GroupVersionResource().GroupResource().String()
+		switch {
+		case resource.Group == "":
+			return nil, fmt.Errorf("claimed resource %d of %s: core resources are claimed in config/kcp/apiexport.yaml", i, path)
+		case resource.Version == "" || resource.Resource == "":
+			return nil, fmt.Errorf("claimed resource %d of %s: version and resource are required", i, path)
+		case resource.APIExport.Name == "":
+			return nil, fmt.Errorf("claimed resource %s of %s: the name of its APIExport is required", gr, path)
+		case seen[gr]:
+			return nil, fmt.Errorf("claimed resource %s of %s is claimed twice", gr, path)
+		}
+		seen[gr] = true
+	}
+	return config.ClaimedResources, nil
+}
+
+// +kubebuilder:rbac:groups="apis.kcp.io",resources=apiexports,verbs=get
+
+// resolveIdentityHashes sets the identity hash of the claimed resources that have none to the one of their APIExport,
+// read through cfg, the config of the workspace of our APIExport.
+func resolveIdentityHashes(ctx context.Context, cfg *rest.Config, resources []controllers.ClaimedResource) error {
+	for i := range resources {
+		resource := &resources[i]
+		if resource.IdentityHash != "" {
+			continue
+		}
+		exportConfig, err := workspaceConfig(cfg, logicalcluster.NewPath(resource.APIExport.Path))
+		if err != nil {
+			return err
+		}
+		c, err := client.New(exportConfig, client.Options{Scheme: scheme})
+		if err != nil {
+			return fmt.Errorf("error creating client: %w", err)
+		}
+		apiExport := &apisv1alpha1.APIExport{}
+		if err := c.Get(ctx, client.ObjectKey{Name: resource.APIExport.Name}, apiExport); err != nil {
+			return fmt.Errorf("error getting APIExport %s|%s of %s: %w", resource.APIExport.Path, resource.APIExport.Name, resource.Resource, err)
+		}
+		if apiExport.Status.IdentityHash == "" {
+			return fmt.Errorf("APIExport %s|%s of %s has no identity hash yet", resource.APIExport.Path, resource.APIExport.Name, resource.Resource)
+		}
+		resource.IdentityHash = apiExport.Status.IdentityHash
+		setupLog.Info("Resolved identity hash", "resource", resource.GroupVersionResource().GroupResource().String(), "identityHash", resource.IdentityHash)
+	}
+	return nil
+}
+
+// workspaceConfig returns a copy of cfg for the workspace at path, or cfg itself for an empty path. The workspace of
+// cfg, if any, is replaced.
+func workspaceConfig(cfg *rest.Config, path logicalcluster.Path) (*rest.Config, error) {
+	if path.Empty() {
+		return cfg, nil
+	}
+	u, err := url.Parse(cfg.Host)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the host %q: %w", cfg.Host, err)
+	}
+	if i := strings.Index(u.Path, "/clusters/"); i >= 0 {
+		u.Path = u.Path[:i]
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path.RequestPath()
+	workspaceConfig := rest.CopyConfig(cfg)
+	workspaceConfig.Host = u.String()
+	return workspaceConfig, nil
+}
+
+// claimedResourceClaims returns the permission claims of the claimed resources.
+func claimedResourceClaims(resources []controllers.ClaimedResource) []apisv1alpha1.PermissionClaim {
+	claims := make([]apisv1alpha1.PermissionClaim, 0, len(resources))
+	for _, resource := range resources {
+		claims = append(claims, resource.PermissionClaim())
+	}
+	return claims
+}
+
+// checkAPIExportClaims returns an error if the APIExport does not have the permission claims, which it needs for the
+// claimed resources to be served in its virtual workspace.
+func checkAPIExportClaims(ctx context.Context, cfg *rest.Config, apiExportName string, claims []apisv1alpha1.PermissionClaim) error {
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+	apiExport := &apisv1alpha1.APIExport{}
+	if err := c.Get(ctx, client.ObjectKey{Name: apiExportName}, apiExport); err != nil {
+		return fmt.Errorf("error getting APIExport %s: %w", apiExportName, err)
+	}
+	var missing []string
+	for _, claim := range claims {
+		if !hasClaim(apiExport.Spec.PermissionClaims, claim) {
+			missing = append(missing, claim.String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("APIExport %s does not claim %s, add the claims or use --bootstrap", apiExportName, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// withClaims adds the permission claims the APIExport does not have yet.
+func withClaims(apiExport *apisv1alpha1.APIExport, claims []apisv1alpha1.PermissionClaim) {
+	for _, claim := range claims {
+		if !hasClaim(apiExport.Spec.PermissionClaims, claim) {
+			apiExport.Spec.PermissionClaims = append(apiExport.Spec.PermissionClaims, claim)
+		}
+	}
+}
+
+func hasClaim(claims []apisv1alpha1.PermissionClaim, claim apisv1alpha1.PermissionClaim) bool {
+	for _, c := range claims {
+		if c.Equal(claim) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kcp-dev/logicalcluster/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+
+	"github.com/kcp-dev/controller-runtime-example/controllers"
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+func certificates(hash string) controllers.ClaimedResource {
+	return controllers.ClaimedResource{
+		Group:        "certificates.example.io",
+		Version:      "v1",
+		Resource:     "certificates",
+		APIExport:    apisv1alpha1.ExportBindingReference{Path: "root:certs", Name: "certificates.example.io"},
+		IdentityHash: hash,
+	}
+}
+
+func TestReadClaimedResources(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []controllers.ClaimedResource
+		wantErr string
+	}{
+		{
+			name: "claimed resources",
+			content: `claimedResources:
+- group: certificates.example.io
+  version: v1
+  resource: certificates
+  apiExport:
+    path: root:certs
+    name: certificates.example.io
+`,
+			want: []controllers.ClaimedResource{certificates("")},
+		},
+		{
+			name:    "core resource",
+			content: "claimedResources:\n- version: v1\n  resource: secrets\n  apiExport:\n    name: kubernetes\n",
+			wantErr: "core resources are claimed in config/kcp/apiexport.yaml",
+		},
+		{
+			name:    "missing APIExport",
+			content: "claimedResources:\n- group: certificates.example.io\n  version: v1\n  resource: certificates\n",
+			wantErr: "the name of its APIExport is required",
+		},
+		{
+			name: "claimed twice",
+			content: `claimedResources:
+- {group: certificates.example.io, version: v1, resource: certificates, apiExport: {name: certificates.example.io}}
+- {group: certificates.example.io, version: v2, resource: certificates, apiExport: {name: certificates.example.io}}
+`,
+			wantErr: "claimed twice",
+		},
+		{
+			name:    "unknown field",
+			content: "claimedResources:\n- group: certificates.example.io\n  kind: Certificate\n",
+			wantErr: "error decoding",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "claimedresources.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readClaimedResources(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("unexpected claimed resources (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWorkspaceConfig(t *testing.T) {
+	tests := []struct {
+		host string
+		path string
+		want string
+	}{
+		{host: "https://kcp:6443", path: "root:certs", want: "https://kcp:6443/clusters/root:certs"},
+		{host: "https://kcp:6443/clusters/root:org:ws", path: "root:certs", want: "https://kcp:6443/clusters/root:certs"},
+		{host: "https://kcp:6443/prefix/clusters/root:org:ws", path: "root:certs", want: "https://kcp:6443/prefix/clusters/root:certs"},
+		{host: "https://kcp:6443/clusters/root:org:ws", path: "", want: "https://kcp:6443/clusters/root:org:ws"},
+	}
+	for _, tt := range tests {
+		cfg, err := workspaceConfig(&rest.Config{Host: tt.host}, logicalcluster.NewPath(tt.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Host != tt.want {
+			t.Errorf("expected %s in %q to be %q, got %q", tt.path, tt.host, tt.want, cfg.Host)
+		}
+	}
+}
+
+func TestResolveIdentityHashes(t *testing.T) {
+	s := fake.NewServer("root")
+	defer s.Close()
+	ctx := context.Background()
+
+	resources := []controllers.ClaimedResource{certificates(""), certificates("known")}
+	if err := resolveIdentityHashes(ctx, s.Config(), resources); err == nil {
+		t.Error("expected an error for a missing APIExport")
+	}
+
+	c, err := client.New(s.ClusterConfig("root:certs"), client.Options{Scheme: scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiExport := &apisv1alpha1.APIExport{ObjectMeta: metav1.ObjectMeta{Name: "certificates.example.io"}}
+	if err := c.Create(ctx, apiExport); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveIdentityHashes(ctx, s.Config(), resources); err == nil || !strings.Contains(err.Error(), "no identity hash yet") {
+		t.Errorf("expected an error for an APIExport without identity hash, got %v", err)
+	}
+
+	apiExport.Status.IdentityHash = "abc123"
+	if err := c.Status().Update(ctx, apiExport); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveIdentityHashes(ctx, s.Config(), resources); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]controllers.ClaimedResource{certificates("abc123"), certificates("known")}, resources); diff != "" {
+		t.Errorf("unexpected identity hashes (-want +got):\n%s", diff)
+	}
+}
+
+func TestAPIExportClaims(t *testing.T) {
+	s := fake.NewServer("root")
+	defer s.Close()
+	ctx := context.Background()
+	claims := claimedResourceClaims([]controllers.ClaimedResource{certificates("abc123")})
+
+	if err := bootstrapAPIExport(ctx, s.Config(), kcpManifests, testAPIExportName, nil, false); err != nil {
+		t.Fatalf("failed to bootstrap: %v", err)
+	}
+	err := checkAPIExportClaims(ctx, s.Config(), testAPIExportName, claims)
+	if err == nil || !strings.Contains(err.Error(), "does not claim certificates.certificates.example.io:abc123") {
+		t.Errorf("expected the claim to be missing, got %v", err)
+	}
+
+	// Bootstrapping adds the claims next to the ones of the manifest
+	if err := bootstrapAPIExport(ctx, s.Config(), kcpManifests, testAPIExportName, claims, false); err != nil {
+		t.Fatalf("failed to bootstrap: %v", err)
+	}
+	if err := checkAPIExportClaims(ctx, s.Config(), testAPIExportName, claims); err != nil {
+		t.Errorf("expected the APIExport to claim the claimed resources: %v", err)
+	}
+	c, err := client.New(s.Config(), client.Options{Scheme: scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiExport := &apisv1alpha1.APIExport{}
+	if err := c.Get(ctx, client.ObjectKey{Name: testAPIExportName}, apiExport); err != nil {
+		t.Fatal(err)
+	}
+	if len(apiExport.Spec.PermissionClaims) != 6 {
+		t.Errorf("expected the 5 claims of the manifest and the claimed resource, got %v", apiExport.Spec.PermissionClaims)
+	}
+}
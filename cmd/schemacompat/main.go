@@ -0,0 +1,137 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command schemacompat compares two revisions of the APIResourceSchemas of the APIExport, e.g. the today.* schemas and
+// the ones generated with a new prefix, and reports which changes are safe for the workspaces bound to the old
+// revision and which break them. The schemas of both files are matched by resource and group, so their prefixes may
+// differ.
+//
+// Usage:
+//
+//	schemacompat OLD NEW
+//
+// It exits with 1 if there are breaking changes, and with 2 if the schemas cannot be compared.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+
+	"github.com/kcp-dev/controller-runtime-example/internal/schemacompat"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s OLD NEW\n\n"+
+			"Compares the APIResourceSchemas in the files OLD and NEW, and exits with 1 if there are breaking changes.\n",
+			os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	breaking, err := run(flag.Arg(0), flag.Arg(1), os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "schemacompat: %v\n", err)
+		os.Exit(2)
+	}
+	if breaking {
+		os.Exit(1)
+	}
+}
+
+// run writes the changes from the APIResourceSchemas in oldPath to the ones in newPath to out, and returns whether
+// any of them is breaking.
+func run(oldPath, newPath string, out io.Writer) (bool, error) {
+	oldSchemas, err := readSchemas(oldPath)
+	if err != nil {
+		return false, err
+	}
+	newSchemas, err := readSchemas(newPath)
+	if err != nil {
+		return false, err
+	}
+
+	var changes []schemacompat.Change
+	for resource, old := range oldSchemas {
+		new, ok := newSchemas[resource]
+		if !ok {
+			changes = append(changes, schemacompat.Change{Severity: schemacompat.Breaking, Resource: resource, Message: "resource removed"})
+			continue
+		}
+		resourceChanges, err := schemacompat.Compare(old, new)
+		if err != nil {
+			return false, err
+		}
+		changes = append(changes, resourceChanges...)
+	}
+	for resource := range newSchemas {
+		if _, ok := oldSchemas[resource]; !ok {
+			changes = append(changes, schemacompat.Change{Severity: schemacompat.Safe, Resource: resource, Message: "resource added"})
+		}
+	}
+	// The changes of a resource are already sorted
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Resource < changes[j].Resource })
+
+	for _, c := range changes {
+		fmt.Fprintln(out, c)
+	}
+	breaking := len(schemacompat.BreakingChanges(changes))
+	fmt.Fprintf(out, "%d changes, %d breaking\n", len(changes), breaking)
+	return breaking > 0, nil
+}
+
+// readSchemas returns the APIResourceSchemas in the YAML file by <resource>.<group>. Other objects are skipped.
+func readSchemas(path string) (map[string]*apisv1alpha1.APIResourceSchema, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	schemas := map[string]*apisv1alpha1.APIResourceSchema{}
+	decoder := utilyaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		schema := &apisv1alpha1.APIResourceSchema{}
+		if err := decoder.Decode(schema); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error decoding %s: %w", path, err)
+		}
+		if schema.Kind != "APIResourceSchema" {
+			continue
+		}
+		resource := schemacompat.Resource(schema)
+		if other, ok := schemas[resource]; ok {
+			return nil, fmt.Errorf("%s and %s in %s both define %s", other.Name, schema.Name, path, resource)
+		}
+		schemas[resource] = schema
+	}
+	if len(schemas) == 0 {
+		return nil, fmt.Errorf("no APIResourceSchemas in %s", path)
+	}
+	return schemas, nil
+}
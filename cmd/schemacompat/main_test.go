@@ -0,0 +1,151 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"sigs.k8s.io/yaml"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+const widgetsSchemas = "../../config/kcp/today.apiresourceschemas.yaml"
+
+// widgets returns the APIResourceSchema of the widgets in config/kcp.
+func widgets(t *testing.T) *apisv1alpha1.APIResourceSchema {
+	t.Helper()
+	schemas, err := readSchemas(filepath.FromSlash(widgetsSchemas))
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, ok := schemas["widgets.data.my.domain"]
+	if !ok {
+		t.Fatalf("no widgets in %s", widgetsSchemas)
+	}
+	return schema
+}
+
+// writeSchemas writes the APIResourceSchemas to a YAML file in dir, and returns its path.
+func writeSchemas(t *testing.T, dir, name string, schemas ...*apisv1alpha1.APIResourceSchema) string {
+	t.Helper()
+	var out bytes.Buffer
+	for _, schema := range schemas {
+		data, err := yaml.Marshal(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.WriteString("---\n")
+		out.Write(data)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	renamed := widgets(t)
+	renamed.Name = "v221018.widgets.data.my.domain"
+	gadgets := widgets(t)
+	gadgets.Name = "today.gadgets.data.my.domain"
+	gadgets.Spec.Names.Plural = "gadgets"
+	withoutFoo := widgets(t)
+	schema, err := withoutFoo.Spec.Versions[0].GetSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(schema.Properties["spec"].Properties, "foo")
+	if err := withoutFoo.Spec.Versions[0].SetSchema(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	// The other resources of config/kcp are left out, so that they do not show up as removed
+	original := writeSchemas(t, dir, "widgets.yaml", widgets(t))
+
+	tests := []struct {
+		name     string
+		old      string
+		new      string
+		breaking bool
+		expected string
+	}{{
+		name:     "new prefix",
+		old:      original,
+		new:      writeSchemas(t, dir, "renamed.yaml", renamed),
+		expected: "0 changes, 0 breaking\n",
+	}, {
+		name:     "resource added",
+		old:      original,
+		new:      writeSchemas(t, dir, "added.yaml", renamed, gadgets),
+		expected: "safe: gadgets.data.my.domain: resource added\n1 changes, 0 breaking\n",
+	}, {
+		name:     "resource removed",
+		old:      writeSchemas(t, dir, "removed.yaml", renamed, gadgets),
+		new:      original,
+		breaking: true,
+		expected: "breaking: gadgets.data.my.domain: resource removed\n1 changes, 1 breaking\n",
+	}, {
+		name:     "field removed",
+		old:      original,
+		new:      writeSchemas(t, dir, "without-foo.yaml", withoutFoo),
+		breaking: true,
+		expected: "breaking: widgets.data.my.domain v1alpha1 .spec.foo: field removed\n1 changes, 1 breaking\n",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			breaking, err := run(filepath.FromSlash(tt.old), tt.new, &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if breaking != tt.breaking {
+				t.Errorf("expected breaking %t, got %t", tt.breaking, breaking)
+			}
+			if diff := cmp.Diff(tt.expected, out.String()); diff != "" {
+				t.Errorf("unexpected output (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	dir := t.TempDir()
+	duplicate := widgets(t)
+	duplicate.Name = "v221018.widgets.data.my.domain"
+	tests := []struct {
+		name string
+		new  string
+	}{
+		{name: "missing file", new: filepath.Join(dir, "missing.yaml")},
+		{name: "no schemas", new: writeSchemas(t, dir, "empty.yaml")},
+		{name: "duplicate resource", new: writeSchemas(t, dir, "duplicate.yaml", widgets(t), duplicate)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := run(filepath.FromSlash(widgetsSchemas), tt.new, &bytes.Buffer{}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
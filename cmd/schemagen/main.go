@@ -0,0 +1,243 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command schemagen converts the CustomResourceDefinitions generated by controller-gen into kcp APIResourceSchemas,
+// and points the APIExport at them. It replaces `kustomize build config/crd | kubectl kcp crd snapshot`.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	sigsyaml "sigs.k8s.io/yaml"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+const (
+	// PrefixModeHash prefixes each APIResourceSchema with a hash of its content, so that its name only changes when the
+	// schema does.
+	PrefixModeHash = "hash"
+	// PrefixModeDate prefixes all APIResourceSchemas with the date they were generated on.
+	PrefixModeDate = "date"
+)
+
+type options struct {
+	// CRDDir is the directory of the CustomResourceDefinition manifests.
+	CRDDir string
+	// Prefix is the prefix of the names of the APIResourceSchemas. If empty, it is derived according to PrefixMode.
+	Prefix string
+	// PrefixMode is PrefixModeHash or PrefixModeDate.
+	PrefixMode string
+	// Output is the file the APIResourceSchemas are written to.
+	Output string
+	// APIExport is the APIExport manifest whose spec.latestResourceSchemas is updated. It is left alone if empty.
+	APIExport string
+	// Now is the time that PrefixModeDate uses.
+	Now time.Time
+}
+
+func main() {
+	opts := options{Now: time.Now()}
+	flag.StringVar(&opts.CRDDir, "crd-dir", "config/crd/bases", "The directory of the CustomResourceDefinition manifests.")
+	flag.StringVar(&opts.Prefix, "prefix", "",
+		"The prefix of the names of the APIResourceSchemas. If empty, it is derived according to --prefix-mode.")
+	flag.StringVar(&opts.PrefixMode, "prefix-mode", PrefixModeHash,
+		"How the prefix is derived if --prefix is empty: hash, from the content of each schema, or date, from today's date.")
+	flag.StringVar(&opts.Output, "output", "config/kcp/apiresourceschemas.yaml", "The file the APIResourceSchemas are written to.")
+	flag.StringVar(&opts.APIExport, "apiexport", "config/kcp/apiexport.yaml",
+		"The APIExport manifest whose spec.latestResourceSchemas is updated. Not updated if empty.")
+	flag.Parse()
+
+	if err := run(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "schemagen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(opts options) error {
+	crds, err := readCRDs(opts.CRDDir)
+	if err != nil {
+		return err
+	}
+	if len(crds) == 0 {
+		return fmt.Errorf("no CustomResourceDefinitions in %s", opts.CRDDir)
+	}
+
+	schemas := make([]*apisv1alpha1.APIResourceSchema, 0, len(crds))
+	for _, crd := range crds {
+		schema, err := toAPIResourceSchema(crd, opts)
+		if err != nil {
+			return fmt.Errorf("error converting %s: %w", crd.Name, err)
+		}
+		schema.SetGroupVersionKind(apisv1alpha1.SchemeGroupVersion.WithKind("APIResourceSchema"))
+		schemas = append(schemas, schema)
+	}
+
+	var out bytes.Buffer
+	for _, schema := range schemas {
+		data, err := sigsyaml.Marshal(schema)
+		if err != nil {
+			return fmt.Errorf("error encoding %s: %w", schema.Name, err)
+		}
+		out.WriteString("---\n")
+		out.Write(data)
+	}
+	if err := os.WriteFile(opts.Output, out.Bytes(), 0o644); err != nil {
+		return err
+	}
+
+	if opts.APIExport == "" {
+		return nil
+	}
+	data, err := os.ReadFile(opts.APIExport)
+	if err != nil {
+		return err
+	}
+	data, err = updateLatestResourceSchemas(data, schemas)
+	if err != nil {
+		return fmt.Errorf("error updating %s: %w", opts.APIExport, err)
+	}
+	return os.WriteFile(opts.APIExport, data, 0o644)
+}
+
+// readCRDs returns the CustomResourceDefinitions of the YAML files in dir, sorted by name.
+func readCRDs(dir string) ([]*apiextensionsv1.CustomResourceDefinition, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	var crds []*apiextensionsv1.CustomResourceDefinition
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		decoder := utilyaml.NewYAMLOrJSONDecoder(f, 4096)
+		for {
+			crd := &apiextensionsv1.CustomResourceDefinition{}
+			if err := decoder.Decode(crd); err == io.EOF {
+				break
+			} else if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("error decoding %s: %w", file, err)
+			}
+			if crd.Kind != "CustomResourceDefinition" {
+				continue
+			}
+			crds = append(crds, crd)
+		}
+		f.Close()
+	}
+	sort.Slice(crds, func(i, j int) bool { return crds[i].Name < crds[j].Name })
+	return crds, nil
+}
+
+// toAPIResourceSchema converts the CRD into an APIResourceSchema named with the prefix chosen by opts.
+func toAPIResourceSchema(crd *apiextensionsv1.CustomResourceDefinition, opts options) (*apisv1alpha1.APIResourceSchema, error) {
+	prefix := opts.Prefix
+	if prefix == "" {
+		switch opts.PrefixMode {
+		case PrefixModeHash:
+			// The name does not take part in the hash, so any valid prefix does for the first conversion
+			schema, err := apisv1alpha1.CRDToAPIResourceSchema(crd, "hash")
+			if err != nil {
+				return nil, err
+			}
+			spec, err := json.Marshal(schema.Spec)
+			if err != nil {
+				return nil, err
+			}
+			sum := sha256.Sum256(spec)
+			prefix = hex.EncodeToString(sum[:])[:8]
+		case PrefixModeDate:
+			prefix = "v" + opts.Now.UTC().Format("060102")
+		default:
+			return nil, fmt.Errorf("unknown prefix mode %q", opts.PrefixMode)
+		}
+	}
+	return apisv1alpha1.CRDToAPIResourceSchema(crd, prefix)
+}
+
+// updateLatestResourceSchemas points spec.latestResourceSchemas of the APIExport manifest at the schemas: an entry
+// for the same resource is replaced, and the others are appended. Everything else, including comments, is kept.
+func updateLatestResourceSchemas(data []byte, schemas []*apisv1alpha1.APIResourceSchema) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("expected a single YAML object")
+	}
+	spec := mappingValue(doc.Content[0], "spec", yaml.MappingNode)
+	latest := mappingValue(spec, "latestResourceSchemas", yaml.SequenceNode)
+
+	for _, schema := range schemas {
+		// The name of an APIResourceSchema is <prefix>.<resource>.<group>
+		resource := strings.SplitN(schema.Name, ".", 2)[1]
+		replaced := false
+		for _, item := range latest.Content {
+			parts := strings.SplitN(item.Value, ".", 2)
+			if len(parts) == 2 && parts[1] == resource {
+				item.Value = schema.Name
+				replaced = true
+			}
+		}
+		if !replaced {
+			latest.Content = append(latest.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: schema.Name})
+		}
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// mappingValue returns the value of the key in the mapping. A missing or null value is replaced with an empty node of
+// the given kind.
+func mappingValue(mapping *yaml.Node, key string, kind yaml.Kind) *yaml.Node {
+	value := &yaml.Node{Kind: kind}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			if mapping.Content[i+1].Kind != kind {
+				mapping.Content[i+1] = value
+			}
+			return mapping.Content[i+1]
+		}
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	return value
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata/golden.")
+
+// copyFile copies src to a file named after it in dir, and returns its path.
+func copyFile(t *testing.T, src, dir string) string {
+	t.Helper()
+	data, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(dir, filepath.Base(src))
+	if err := os.WriteFile(dst, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dst
+}
+
+// checkGolden compares the file at path to the golden file, or updates the golden file with -update.
+func checkGolden(t *testing.T, path, golden string) {
+	t.Helper()
+	actual, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := os.WriteFile(golden, actual, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("failed to read golden file, run the tests with -update to create it: %v", err)
+	}
+	if diff := cmp.Diff(string(expected), string(actual)); diff != "" {
+		t.Errorf("%s does not match %s (-want +got):\n%s", filepath.Base(path), golden, diff)
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name string
+		opts options
+	}{
+		{name: "prefix", opts: options{Prefix: "today"}},
+		{name: "hash", opts: options{PrefixMode: PrefixModeHash}},
+		{name: "date", opts: options{PrefixMode: PrefixModeDate, Now: time.Date(2022, time.October, 18, 23, 0, 0, 0, time.UTC)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := tt.opts
+			opts.CRDDir = filepath.Join("testdata", "crds")
+			opts.Output = filepath.Join(dir, "apiresourceschemas.yaml")
+			opts.APIExport = copyFile(t, filepath.Join("testdata", "apiexport.yaml"), dir)
+			if err := run(opts); err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, opts.Output, filepath.Join("testdata", "golden", tt.name+".apiresourceschemas.yaml"))
+			checkGolden(t, opts.APIExport, filepath.Join("testdata", "golden", tt.name+".apiexport.yaml"))
+
+			// Generating again from the same CRDs changes nothing
+			schemas, err := os.ReadFile(opts.Output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			apiExport, err := os.ReadFile(opts.APIExport)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := run(opts); err != nil {
+				t.Fatal(err)
+			}
+			for path, expected := range map[string][]byte{opts.Output: schemas, opts.APIExport: apiExport} {
+				actual, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(string(expected), string(actual)); diff != "" {
+					t.Errorf("%s changed when generated again (-want +got):\n%s", filepath.Base(path), diff)
+				}
+			}
+		})
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		opts options
+	}{
+		{name: "no CRDs", opts: options{CRDDir: dir, Prefix: "today"}},
+		{name: "unknown prefix mode", opts: options{CRDDir: filepath.Join("testdata", "crds"), PrefixMode: "weekday"}},
+		{name: "invalid prefix", opts: options{CRDDir: filepath.Join("testdata", "crds"), Prefix: "To_Day"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Output = filepath.Join(dir, "apiresourceschemas.yaml")
+			if err := run(opts); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+// TestConfigUpToDate checks that the APIResourceSchemas in config/kcp were generated from the current CRDs, see make
+// apiresourceschemas.
+func TestConfigUpToDate(t *testing.T) {
+	root := filepath.Join("..", "..")
+	dir := t.TempDir()
+	opts := options{
+		CRDDir:    filepath.Join(root, "config", "crd", "bases"),
+		Prefix:    "today",
+		Output:    filepath.Join(dir, "today.apiresourceschemas.yaml"),
+		APIExport: copyFile(t, filepath.Join(root, "config", "kcp", "apiexport.yaml"), dir),
+	}
+	if err := run(opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"today.apiresourceschemas.yaml", "apiexport.yaml"} {
+		expected, err := os.ReadFile(filepath.Join(root, "config", "kcp", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(string(expected), string(actual)); diff != "" {
+			t.Errorf("config/kcp/%s is out of date, run make apiresourceschemas (-want +got):\n%s", name, diff)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/homedir"
+)
+
+// connectionOptions configures how the controller-manager connects to the workspace of the APIExport, or to the
+// cluster without kcp, and to the workspace of the leases.
+type connectionOptions struct {
+	// Kubeconfig is the path of the kubeconfig. If empty, the kubeconfig is looked up, see configLoader.
+	Kubeconfig string
+	// Context is the context of the kubeconfig. If empty, the current context is used.
+	Context string
+	// LeaderElectionKubeconfig is the path of the kubeconfig of the workspace of the leases. If both it and
+	// LeaderElectionContext are empty, the leases live in the workspace of the APIExport.
+	LeaderElectionKubeconfig string
+	// LeaderElectionContext is the context of the kubeconfig of the workspace of the leases. If empty, the current
+	// context is used.
+	LeaderElectionContext string
+	// QPS and Burst limit the requests of every client of the controller-manager. Zero means the client-go default.
+	QPS   float64
+	Burst int
+}
+
+// validate returns an error if the options are inconsistent.
+func (o connectionOptions) validate() error {
+	if o.QPS < 0 {
+		return fmt.Errorf("--kube-api-qps must not be negative")
+	}
+	if o.Burst < 0 {
+		return fmt.Errorf("--kube-api-burst must not be negative")
+	}
+	if o.QPS > 0 && o.Burst > 0 && float64(o.Burst) < o.QPS {
+		return fmt.Errorf("--kube-api-burst must be at least --kube-api-qps")
+	}
+	for _, path := range []string{o.Kubeconfig, o.LeaderElectionKubeconfig} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("kubeconfig %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// restConfig returns the config of the workspace of the APIExport, or of the cluster without kcp, and where it was
+// loaded from.
+func (o connectionOptions) restConfig(loader configLoader) (*rest.Config, string, error) {
+	cfg, source, err := loader.load(o.Kubeconfig, o.Context)
+	if err != nil {
+		return nil, "", err
+	}
+	o.throttle(cfg)
+	return cfg, source, nil
+}
+
+// leaderElectionConfig returns the config of the workspace of the leases, which is cfg unless the leases live
+// elsewhere, and where it was loaded from.
+func (o connectionOptions) leaderElectionConfig(loader configLoader, cfg *rest.Config) (*rest.Config, string, error) {
+	if o.LeaderElectionKubeconfig == "" && o.LeaderElectionContext == "" {
+		return cfg, "", nil
+	}
+	kubeconfig := o.LeaderElectionKubeconfig
+	if kubeconfig == "" {
+		// Another context of the same kubeconfig
+		kubeconfig = o.Kubeconfig
+	}
+	leaseConfig, source, err := loader.load(kubeconfig, o.LeaderElectionContext)
+	if err != nil {
+		return nil, "", fmt.Errorf("error loading the kubeconfig of the leases: %w", err)
+	}
+	o.throttle(leaseConfig)
+	return leaseConfig, source, nil
+}
+
+// throttle sets the QPS and Burst of cfg, if given.
+func (o connectionOptions) throttle(cfg *rest.Config) {
+	if o.QPS > 0 {
+		cfg.QPS = float32(o.QPS)
+	}
+	if o.Burst > 0 {
+		cfg.Burst = o.Burst
+	}
+}
+
+// configLoader looks up the kubeconfig, in order of precedence:
+//
+//  1. the given path;
+//  2. the files listed in $KUBECONFIG;
+//  3. the service account of the pod, when running in a cluster and no context is given;
+//  4. $HOME/.kube/config.
+//
+// The context, if given, is selected in the kubeconfig.
+type configLoader struct {
+	getenv          func(string) string
+	inClusterConfig func() (*rest.Config, error)
+	homeDir         string
+}
+
+// defaultConfigLoader loads the kubeconfig of the environment of the process.
+var defaultConfigLoader = configLoader{
+	getenv:          os.Getenv,
+	inClusterConfig: rest.InClusterConfig,
+	homeDir:         homedir.HomeDir(),
+}
+
+// load returns the config of the context of the kubeconfig, and where it was loaded from.
+func (l configLoader) load(kubeconfig, context string) (*rest.Config, string, error) {
+	rules := &clientcmd.ClientConfigLoadingRules{}
+	switch {
+	case kubeconfig != "":
+		rules.ExplicitPath = kubeconfig
+	case l.getenv(clientcmd.RecommendedConfigPathEnvVar) != "":
+		rules.Precedence = filepath.SplitList(l.getenv(clientcmd.RecommendedConfigPathEnvVar))
+		kubeconfig = "$" + clientcmd.RecommendedConfigPathEnvVar
+	default:
+		if context == "" {
+			cfg, err := l.inClusterConfig()
+			if err == nil {
+				return cfg, "in-cluster", nil
+			}
+			if !errors.Is(err, rest.ErrNotInCluster) {
+				return nil, "", fmt.Errorf("error loading the in-cluster config: %w", err)
+			}
+		}
+		kubeconfig = filepath.Join(l.homeDir, clientcmd.RecommendedHomeDir, clientcmd.RecommendedFileName)
+		if _, err := os.Stat(kubeconfig); err != nil {
+			if context != "" {
+				return nil, "", fmt.Errorf("no kubeconfig to select context %s from, set --kubeconfig or $%s", context, clientcmd.RecommendedConfigPathEnvVar)
+			}
+			return nil, "", fmt.Errorf("no kubeconfig found, set --kubeconfig or $%s, or run in a cluster", clientcmd.RecommendedConfigPathEnvVar)
+		}
+		rules.ExplicitPath = kubeconfig
+	}
+
+	cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: context}).ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("error loading %s: %w", kubeconfig, err)
+	}
+	if context != "" {
+		return cfg, kubeconfig + " (context " + context + ")", nil
+	}
+	return cfg, kubeconfig, nil
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+// writeTestKubeconfig writes a kubeconfig with a context for each of the hosts, named after the host, and returns its
+// path.
+func writeTestKubeconfig(t *testing.T, path, current string, hosts ...string) string {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("apiVersion: v1\nkind: Config\nusers:\n- name: user\n  user:\n    token: token\nclusters:\n")
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "- name: %s\n  cluster:\n    server: https://%s\n", host, host)
+	}
+	b.WriteString("contexts:\n")
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "- name: %s\n  context:\n    cluster: %s\n    user: user\n", host, host)
+	}
+	fmt.Fprintf(&b, "current-context: %s\n", current)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigLoaderPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	explicit := writeTestKubeconfig(t, filepath.Join(dir, "explicit"), "explicit", "explicit", "explicit-other")
+	env := writeTestKubeconfig(t, filepath.Join(dir, "env"), "env", "env", "env-other")
+	home := filepath.Join(dir, "home")
+	writeTestKubeconfig(t, filepath.Join(home, ".kube", "config"), "home", "home", "home-other")
+	emptyHome := filepath.Join(dir, "empty")
+
+	inCluster := func() (*rest.Config, error) { return &rest.Config{Host: "https://in-cluster"}, nil }
+	notInCluster := func() (*rest.Config, error) { return nil, rest.ErrNotInCluster }
+
+	tests := []struct {
+		name       string
+		kubeconfig string
+		context    string
+		env        string
+		inCluster  func() (*rest.Config, error)
+		home       string
+		wantHost   string
+		wantErr    string
+	}{
+		{name: "--kubeconfig wins", kubeconfig: explicit, env: env, inCluster: inCluster, home: home, wantHost: "https://explicit"},
+		{name: "--kubeconfig with --context", kubeconfig: explicit, context: "explicit-other", env: env, home: home, wantHost: "https://explicit-other"},
+		{name: "$KUBECONFIG before in-cluster", env: env, inCluster: inCluster, home: home, wantHost: "https://env"},
+		{name: "$KUBECONFIG with --context", env: env, context: "env-other", inCluster: inCluster, home: home, wantHost: "https://env-other"},
+		{name: "in-cluster before home", inCluster: inCluster, home: home, wantHost: "https://in-cluster"},
+		{name: "--context skips in-cluster", context: "home-other", inCluster: inCluster, home: home, wantHost: "https://home-other"},
+		{name: "home", inCluster: notInCluster, home: home, wantHost: "https://home"},
+		{name: "unknown context", kubeconfig: explicit, context: "missing", wantErr: "missing"},
+		{name: "missing --kubeconfig", kubeconfig: filepath.Join(dir, "missing"), inCluster: inCluster, wantErr: "error loading"},
+		{name: "nothing found", inCluster: notInCluster, home: emptyHome, wantErr: "no kubeconfig found"},
+		{name: "--context without kubeconfig", context: "home", inCluster: inCluster, home: emptyHome, wantErr: "no kubeconfig to select context home from"},
+		{name: "broken in-cluster", inCluster: func() (*rest.Config, error) { return nil, fmt.Errorf("no token") }, home: home, wantErr: "no token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loader := configLoader{
+				getenv: func(key string) string {
+					if key == "KUBECONFIG" {
+						return tt.env
+					}
+					return ""
+				},
+				inClusterConfig: tt.inCluster,
+				homeDir:         tt.home,
+			}
+			cfg, source, err := loader.load(tt.kubeconfig, tt.context)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Host != tt.wantHost {
+				t.Errorf("expected host %s, got %s from %s", tt.wantHost, cfg.Host, source)
+			}
+			if source == "" {
+				t.Error("expected the source of the config")
+			}
+		})
+	}
+}
+
+func TestConnectionOptions(t *testing.T) {
+	dir := t.TempDir()
+	kubeconfig := writeTestKubeconfig(t, filepath.Join(dir, "kubeconfig"), "workspace", "workspace", "leases")
+	leases := writeTestKubeconfig(t, filepath.Join(dir, "leases"), "other-leases", "other-leases")
+	loader := configLoader{
+		getenv:          func(string) string { return "" },
+		inClusterConfig: func() (*rest.Config, error) { return nil, rest.ErrNotInCluster },
+		homeDir:         filepath.Join(dir, "home"),
+	}
+
+	o := connectionOptions{Kubeconfig: kubeconfig, QPS: 50, Burst: 100}
+	cfg, _, err := o.restConfig(loader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "https://workspace" || cfg.QPS != 50 || cfg.Burst != 100 {
+		t.Errorf("unexpected config %s with QPS %v and burst %d", cfg.Host, cfg.QPS, cfg.Burst)
+	}
+
+	leaseConfig, _, err := o.leaderElectionConfig(loader, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaseConfig != cfg {
+		t.Errorf("expected the leases in the workspace of the APIExport, got %s", leaseConfig.Host)
+	}
+
+	o.LeaderElectionContext = "leases"
+	if leaseConfig, _, err = o.leaderElectionConfig(loader, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if leaseConfig.Host != "https://leases" || leaseConfig.QPS != 50 {
+		t.Errorf("expected the leases in another context of the kubeconfig, got %s with QPS %v", leaseConfig.Host, leaseConfig.QPS)
+	}
+
+	o.LeaderElectionKubeconfig, o.LeaderElectionContext = leases, ""
+	if leaseConfig, _, err = o.leaderElectionConfig(loader, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if leaseConfig.Host != "https://other-leases" {
+		t.Errorf("expected the leases in the other kubeconfig, got %s", leaseConfig.Host)
+	}
+}
+
+func TestConnectionOptionsValidate(t *testing.T) {
+	kubeconfig := writeTestKubeconfig(t, filepath.Join(t.TempDir(), "kubeconfig"), "a", "a")
+	tests := []struct {
+		name    string
+		options connectionOptions
+		wantErr string
+	}{
+		{name: "defaults", options: connectionOptions{QPS: 20, Burst: 30}},
+		{name: "client-go defaults", options: connectionOptions{}},
+		{name: "kubeconfigs", options: connectionOptions{Kubeconfig: kubeconfig, LeaderElectionKubeconfig: kubeconfig}},
+		{name: "negative QPS", options: connectionOptions{QPS: -1}, wantErr: "--kube-api-qps"},
+		{name: "negative burst", options: connectionOptions{Burst: -1}, wantErr: "--kube-api-burst"},
+		{name: "burst below QPS", options: connectionOptions{QPS: 50, Burst: 10}, wantErr: "at least --kube-api-qps"},
+		{name: "missing kubeconfig", options: connectionOptions{Kubeconfig: kubeconfig + "-missing"}, wantErr: "kubeconfig"},
+		{name: "missing leader election kubeconfig", options: connectionOptions{LeaderElectionKubeconfig: kubeconfig + "-missing"}, wantErr: "kubeconfig"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.options.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+)
+
+const (
+	// tenantFinalizer is set on the APIBindings of the APIExport, so that the workspace can still be reached through
+	// the virtual workspace to clean up after the tenant when the APIBinding is deleted.
+	tenantFinalizer = "data.my.domain/tenant"
+
+	// tenantLabel marks the ConfigMaps that hold the state of a tenant in the workspace of the APIExport.
+	tenantLabel = "data.my.domain/tenant"
+	// tenantClusterKey, tenantBindingKey, tenantPhaseKey and the timestamps are the data keys of the state of a tenant.
+	tenantClusterKey      = "cluster"
+	tenantBindingKey      = "binding"
+	tenantPhaseKey        = "phase"
+	tenantOnboardedAtKey  = "onboardedAt"
+	tenantOffboardedAtKey = "offboardedAt"
+
+	// TenantPhaseOnboarded is the phase of a tenant whose workspace binds the APIExport and was onboarded.
+	TenantPhaseOnboarded = "Onboarded"
+	// TenantPhaseOffboarded is the phase of a tenant whose APIBinding was deleted.
+	TenantPhaseOffboarded = "Offboarded"
+
+	// createdByLabel marks the objects the controllers create in the workspaces of the tenants, other than published
+	// secrets, so that they are cleaned up when the tenant is offboarded.
+	createdByLabel = "data.my.domain/created-by"
+	// createdByConfigMaps is the createdByLabel of the Namespaces the ConfigMap reconciler creates, the only ones
+	// offboarding deletes.
+	createdByConfigMaps = "configmap-controller"
+
+	// defaultWidgetName is the name of the Widget created in the default namespace of every new tenant.
+	defaultWidgetName = "default"
+)
+
+// APIBindingReconciler onboards the workspaces that bind the APIExport, and offboards them when their APIBinding is
+// deleted:
+//
+//   - On onboarding, it creates a Widget named default in the default namespace and emits a Welcome event on the
+//     APIBinding.
+//   - On offboarding, it deletes the Namespaces and Secrets the controllers created in the workspace, and releases the
+//     ConfigMaps they hold finalizers on.
+//   - It records the permission claims of the APIExport that the APIBinding does not accept in Claims, and emits a
+//     PermissionClaimsNotAccepted event naming them on the APIBinding.
+//
+// The state of each tenant is kept in a ConfigMap in the workspace of the APIExport, so that a tenant is only onboarded
+// once per binding even if its default Widget is later deleted.
+type APIBindingReconciler struct {
+	ClusterClient
+	// StateClient is a client for the workspace of the APIExport.
+	StateClient client.Client
+	// StateNamespace is the namespace of the state of the tenants in the workspace of the APIExport.
+	StateNamespace string
+	// APIExportName is the name of the APIExport. APIBindings of other APIExports are ignored.
+	APIExportName string
+	Recorder      record.EventRecorder
+	// Claims records the permission claims each APIBinding does not accept. If nil, the claims are not checked.
+	Claims *ClaimTracker
+	// Clock defaults to the real clock.
+	Clock clock.PassiveClock
+	// Sharder restricts the reconciler to the logical clusters owned by this replica. If nil, it reconciles all of
+	// them.
+	Sharder *Sharder
+	// Drainer lets in-flight reconciles finish when the manager stops. If nil, they are canceled right away.
+	Drainer *Drainer
+}
+
+// +kubebuilder:rbac:groups="apis.kcp.io",resources=apibindings,verbs=get;list;watch;update;patch
+
+func (r *APIBindingReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, err error) {
+	if !r.Sharder.Owns(logicalcluster.Name(req.ClusterName)) {
+		// Another replica took the logical cluster over since the request was queued
+		return ctrl.Result{}, nil
+	}
+
+	log := log.FromContext(ctx).WithValues("cluster", req.ClusterName)
+
+	cluster := logicalcluster.Name(req.ClusterName)
+	defer func() { clusterMetrics.reconcileError("apibinding", cluster, err) }()
+	c := r.ForCluster(cluster)
+
+	var binding apisv1alpha1.APIBinding
+	if err := c.Get(ctx, req.NamespacedName, &binding); err != nil {
+		if apierrors.IsNotFound(err) {
+			// Gone without going through the finalizer, e.g. before this controller was deployed
+			r.Claims.forget(cluster)
+			clusterMetrics.forget(cluster)
+			return ctrl.Result{}, r.setPhase(ctx, cluster, req.Name, TenantPhaseOffboarded)
+		}
+		return ctrl.Result{}, err
+	}
+	if !r.bindsAPIExport(&binding) {
+		return ctrl.Result{}, nil
+	}
+	r.recordClaims(ctx, cluster, &binding)
+
+	if !binding.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(&binding, tenantFinalizer) {
+			return ctrl.Result{}, nil
+		}
+		if err := offboard(ctx, c, func(resource schema.GroupResource) bool { return r.Claims.Accepted(cluster, resource) }); err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.setPhase(ctx, cluster, binding.Name, TenantPhaseOffboarded); err != nil {
+			return ctrl.Result{}, err
+		}
+		controllerutil.RemoveFinalizer(&binding, tenantFinalizer)
+		if err := c.Update(ctx, &binding); err != nil {
+			return ctrl.Result{}, err
+		}
+		r.Claims.forget(cluster)
+		clusterMetrics.forget(cluster)
+		log.Info("Offboarded tenant", "binding", binding.Name)
+		return ctrl.Result{}, nil
+	}
+
+	if !controllerutil.ContainsFinalizer(&binding, tenantFinalizer) {
+		controllerutil.AddFinalizer(&binding, tenantFinalizer)
+		if err := c.Update(ctx, &binding); err != nil {
+			return ctrl.Result{}, err
+		}
+		log.Info("Update: added finalizer", "finalizer", tenantFinalizer)
+		return ctrl.Result{}, nil
+	}
+	if binding.Status.Phase != apisv1alpha1.APIBindingPhaseBound {
+		// The Widgets are not served in the workspace until the APIBinding is bound, which updates it
+		log.Info("Waiting for the APIBinding to be bound", "binding", binding.Name, "phase", binding.Status.Phase)
+		return ctrl.Result{}, nil
+	}
+
+	state, err := r.getState(ctx, cluster)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if state != nil && state.Data[tenantPhaseKey] == TenantPhaseOnboarded {
+		return ctrl.Result{}, nil
+	}
+
+	widget := &datav1alpha1.Widget{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Name:      defaultWidgetName,
+		Labels:    map[string]string{createdByLabel: "apibinding-controller"},
+	}}
+	if err := c.Create(ctx, widget); err != nil && !apierrors.IsAlreadyExists(err) {
+		return ctrl.Result{}, fmt.Errorf("error creating the default widget: %w", err)
+	}
+	if err := r.setPhase(ctx, cluster, binding.Name, TenantPhaseOnboarded); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.Recorder.Eventf(&binding, corev1.EventTypeNormal, "Welcome", "Onboarded the workspace, created widget %s/%s", widget.Namespace, widget.Name)
+	log.Info("Onboarded tenant", "binding", binding.Name)
+	return ctrl.Result{}, nil
+}
+
+// bindsAPIExport returns whether the APIBinding binds the APIExport of the reconciler.
+func (r *APIBindingReconciler) bindsAPIExport(binding *apisv1alpha1.APIBinding) bool {
+	return binding.Spec.Reference.Export != nil && binding.Spec.Reference.Export.Name == r.APIExportName
+}
+
+// recordClaims records the permission claims of the APIExport that the APIBinding does not accept, and reports when
+// they change.
+func (r *APIBindingReconciler) recordClaims(ctx context.Context, cluster logicalcluster.Name, binding *apisv1alpha1.APIBinding) {
+	if r.Claims == nil {
+		return
+	}
+	missing := missingClaims(binding)
+	if !r.Claims.set(cluster, missing) {
+		return
+	}
+	if len(missing) > 0 {
+		log.FromContext(ctx).Info("Permission claims are not accepted", "binding", binding.Name, "claims", claimsString(missing))
+		r.Recorder.Eventf(binding, corev1.EventTypeWarning, "PermissionClaimsNotAccepted",
+			"The permission claims for %s are not accepted, the objects that need them are not reconciled", claimsString(missing))
+		return
+	}
+	r.Recorder.Event(binding, corev1.EventTypeNormal, "PermissionClaimsAccepted", "All permission claims are accepted")
+}
+
+// offboard deletes the Namespaces created by the ConfigMap reconciler and the Secrets it published in the workspace of c, and removes the finalizers set on its
+// ConfigMaps, which would otherwise never be removed. The resources whose permission claim is not accepted are left
+// alone, they cannot be accessed.
+func offboard(ctx context.Context, c client.Client, accepted func(schema.GroupResource) bool) error {
+	if accepted(secretsResource) {
+		var secrets corev1.SecretList
+		if err := c.List(ctx, &secrets, client.HasLabels{sourceUIDLabel}); err != nil {
+			return err
+		}
+		for i := range secrets.Items {
+			if err := c.Delete(ctx, &secrets.Items[i]); err != nil && !apierrors.IsNotFound(err) {
+				return fmt.Errorf("error deleting secret %s/%s: %w", secrets.Items[i].Namespace, secrets.Items[i].Name, err)
+			}
+		}
+	}
+
+	if accepted(configMapsResource) {
+		if err := releaseConfigMaps(ctx, c); err != nil {
+			return err
+		}
+	}
+
+	if !accepted(namespacesResource) {
+		return nil
+	}
+	var namespaces corev1.NamespaceList
+	if err := c.List(ctx, &namespaces, client.MatchingLabels{createdByLabel: createdByConfigMaps}); err != nil {
+		return err
+	}
+	for i := range namespaces.Items {
+		if err := c.Delete(ctx, &namespaces.Items[i]); err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting namespace %s: %w", namespaces.Items[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// releaseConfigMaps removes the finalizers set on the ConfigMaps in the workspace of c.
+func releaseConfigMaps(ctx context.Context, c client.Client) error {
+	var configMaps corev1.ConfigMapList
+	if err := c.List(ctx, &configMaps); err != nil {
+		return err
+	}
+	for i := range configMaps.Items {
+		configMap := &configMaps.Items[i]
+		if controllerutil.RemoveFinalizer(configMap, secretTargetFinalizer) {
+			if err := c.Update(ctx, configMap); err != nil && !apierrors.IsNotFound(err) {
+				return fmt.Errorf("error removing the finalizer of configmap %s/%s: %w", configMap.Namespace, configMap.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// tenantStateName returns the name of the ConfigMap holding the state of the tenant of the logical cluster.
+func tenantStateName(cluster logicalcluster.Name) string {
+	return "tenant-" + strings.ReplaceAll(cluster.String(), ":", "-")
+}
+
+// getState returns the state of the tenant of the logical cluster, or nil if there is none.
+func (r *APIBindingReconciler) getState(ctx context.Context, cluster logicalcluster.Name) (*corev1.ConfigMap, error) {
+	state := &corev1.ConfigMap{}
+	err := r.StateClient.Get(ctx, client.ObjectKey{Namespace: r.StateNamespace, Name: tenantStateName(cluster)}, state)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting the state of the tenant: %w", err)
+	}
+	return state, nil
+}
+
+// setPhase records the phase of the tenant of the logical cluster. Offboarding a tenant without state is a no-op.
+func (r *APIBindingReconciler) setPhase(ctx context.Context, cluster logicalcluster.Name, binding, phase string) error {
+	state, err := r.getState(ctx, cluster)
+	if err != nil {
+		return err
+	}
+	if state == nil && phase == TenantPhaseOffboarded {
+		return nil
+	}
+	if state != nil && state.Data[tenantPhaseKey] == phase {
+		return nil
+	}
+
+	timestampKey := tenantOnboardedAtKey
+	if phase == TenantPhaseOffboarded {
+		timestampKey = tenantOffboardedAtKey
+	}
+	now := r.clock().Now().UTC().Format(time.RFC3339)
+	if state == nil {
+		state = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: r.StateNamespace,
+				Name:      tenantStateName(cluster),
+				Labels:    map[string]string{tenantLabel: "true"},
+			},
+			Data: map[string]string{
+				tenantClusterKey: cluster.String(),
+				tenantBindingKey: binding,
+				tenantPhaseKey:   phase,
+				timestampKey:     now,
+			},
+		}
+		if err := r.StateClient.Create(ctx, state); err != nil {
+			return fmt.Errorf("error creating the state of the tenant: %w", err)
+		}
+		return nil
+	}
+	if state.Data == nil {
+		state.Data = map[string]string{}
+	}
+	state.Data[tenantBindingKey] = binding
+	state.Data[tenantPhaseKey] = phase
+	state.Data[timestampKey] = now
+	if err := r.StateClient.Update(ctx, state); err != nil {
+		return fmt.Errorf("error updating the state of the tenant: %w", err)
+	}
+	return nil
+}
+
+func (r *APIBindingReconciler) clock() clock.PassiveClock {
+	if r.Clock == nil {
+		return clock.RealClock{}
+	}
+	return r.Clock
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *APIBindingReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	name := r.Drainer.ControllerName("apibinding")
+	return ctrl.NewControllerManagedBy(mgr).
+		Named(name).
+		For(&apisv1alpha1.APIBinding{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			binding, ok := obj.(*apisv1alpha1.APIBinding)
+			return ok && r.bindsAPIExport(binding)
+		}), r.Sharder.Predicate())).
+		Complete(r.Drainer.Wrap(name, r))
+}
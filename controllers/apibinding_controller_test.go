@@ -0,0 +1,302 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	clocktesting "k8s.io/utils/clock/testing"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+const testAPIExportName = "data.my.domain"
+
+func apiBinding(export string, phase apisv1alpha1.APIBindingPhaseType, finalizers ...string) *apisv1alpha1.APIBinding {
+	return &apisv1alpha1.APIBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "binding", Finalizers: finalizers},
+		Spec: apisv1alpha1.APIBindingSpec{
+			Reference: apisv1alpha1.BindingReference{Export: &apisv1alpha1.ExportBindingReference{Path: "root", Name: export}},
+		},
+		Status: apisv1alpha1.APIBindingStatus{Phase: phase},
+	}
+}
+
+func tenantState(phase string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenants", Name: tenantStateName(clusterA), Labels: map[string]string{tenantLabel: "true"}},
+		Data:       map[string]string{tenantClusterKey: clusterA.String(), tenantBindingKey: "binding", tenantPhaseKey: phase},
+	}
+}
+
+func TestAPIBindingReconcile(t *testing.T) {
+	deleted := func(binding *apisv1alpha1.APIBinding) *apisv1alpha1.APIBinding {
+		binding.DeletionTimestamp = &metav1.Time{Time: now}
+		return binding
+	}
+	createdNamespace := namespace("created")
+	createdNamespace.Labels = map[string]string{createdByLabel: createdByConfigMaps}
+	// A namespace labelled by something else than the controllers is the tenant's
+	labelledNamespace := namespace("labelled")
+	labelledNamespace.Labels = map[string]string{createdByLabel: "someone-else"}
+	crossNamespace := configMap("cm", nil, map[string]string{"secretData": "data", secretTargetNamespaceKey: "created"})
+	crossNamespace.Finalizers = []string{secretTargetFinalizer}
+
+	tests := []struct {
+		name    string
+		objects []client.Object
+		state   []client.Object
+		// wantPhase is the phase of the tenant afterwards, or empty for no state.
+		wantPhase  string
+		wantEvents []string
+		// wantMissingClaims are the claims recorded as not accepted afterwards.
+		wantMissingClaims string
+		check             func(t *testing.T, c client.Client)
+	}{
+		{
+			name:    "ignores the bindings of other APIExports",
+			objects: []client.Object{apiBinding("other.domain", apisv1alpha1.APIBindingPhaseBound)},
+			check: func(t *testing.T, c client.Client) {
+				if binding := getAPIBinding(t, c); len(binding.Finalizers) != 0 {
+					t.Errorf("expected no finalizer, got %v", binding.Finalizers)
+				}
+			},
+		},
+		{
+			name:    "adds the finalizer",
+			objects: []client.Object{apiBinding(testAPIExportName, apisv1alpha1.APIBindingPhaseBound)},
+			check: func(t *testing.T, c client.Client) {
+				if binding := getAPIBinding(t, c); !containsString(binding.Finalizers, tenantFinalizer) {
+					t.Errorf("expected the finalizer to be added, got %v", binding.Finalizers)
+				}
+				expectNoDefaultWidget(t, c)
+			},
+		},
+		{
+			name:    "waits for the binding to be bound",
+			objects: []client.Object{apiBinding(testAPIExportName, apisv1alpha1.APIBindingPhaseBinding, tenantFinalizer)},
+			check:   expectNoDefaultWidget,
+		},
+		{
+			name:       "onboards a new tenant",
+			objects:    []client.Object{apiBinding(testAPIExportName, apisv1alpha1.APIBindingPhaseBound, tenantFinalizer)},
+			wantPhase:  TenantPhaseOnboarded,
+			wantEvents: []string{"Normal Welcome"},
+			check: func(t *testing.T, c client.Client) {
+				var w datav1alpha1.Widget
+				if err := c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: defaultWidgetName}, &w); err != nil {
+					t.Errorf("expected the default widget to be created: %v", err)
+				}
+			},
+		},
+		{
+			name:      "onboards a tenant only once",
+			objects:   []client.Object{apiBinding(testAPIExportName, apisv1alpha1.APIBindingPhaseBound, tenantFinalizer)},
+			state:     []client.Object{tenantState(TenantPhaseOnboarded)},
+			wantPhase: TenantPhaseOnboarded,
+			check:     expectNoDefaultWidget,
+		},
+		{
+			name:       "onboards a tenant that binds again",
+			objects:    []client.Object{apiBinding(testAPIExportName, apisv1alpha1.APIBindingPhaseBound, tenantFinalizer)},
+			state:      []client.Object{tenantState(TenantPhaseOffboarded)},
+			wantPhase:  TenantPhaseOnboarded,
+			wantEvents: []string{"Normal Welcome"},
+		},
+		{
+			name: "offboards a tenant",
+			objects: []client.Object{
+				deleted(apiBinding(testAPIExportName, apisv1alpha1.APIBindingPhaseBound, tenantFinalizer)),
+				crossNamespace,
+				createdNamespace,
+				namespace("own"),
+				labelledNamespace,
+				publishedSecret(crossNamespace, types.NamespacedName{Namespace: "created", Name: "cm"}, "data"),
+				&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "own"}},
+			},
+			state:     []client.Object{tenantState(TenantPhaseOnboarded)},
+			wantPhase: TenantPhaseOffboarded,
+			check: func(t *testing.T, c client.Client) {
+				ctx := context.Background()
+				expectNoSecret(t, c, types.NamespacedName{Namespace: "created", Name: "cm"})
+				if err := c.Get(ctx, types.NamespacedName{Namespace: "default", Name: "own"}, &corev1.Secret{}); err != nil {
+					t.Errorf("expected the secret of the tenant to be kept: %v", err)
+				}
+				if err := c.Get(ctx, types.NamespacedName{Name: "created"}, &corev1.Namespace{}); !apierrors.IsNotFound(err) {
+					t.Errorf("expected the created namespace to be deleted, got %v", err)
+				}
+				for _, name := range []string{"own", "labelled"} {
+					if err := c.Get(ctx, types.NamespacedName{Name: name}, &corev1.Namespace{}); err != nil {
+						t.Errorf("expected the namespace %s of the tenant to be kept: %v", name, err)
+					}
+				}
+				if cm := getConfigMap(t, c, "cm"); len(cm.Finalizers) != 0 {
+					t.Errorf("expected the finalizer of the configmap to be removed, got %v", cm.Finalizers)
+				}
+				var binding apisv1alpha1.APIBinding
+				if err := c.Get(ctx, types.NamespacedName{Name: "binding"}, &binding); err == nil && containsString(binding.Finalizers, tenantFinalizer) {
+					t.Errorf("expected the finalizer of the binding to be removed, got %v", binding.Finalizers)
+				}
+			},
+		},
+		{
+			name: "reports the permission claims that are not accepted",
+			objects: []client.Object{
+				withClaims(apiBinding(testAPIExportName, apisv1alpha1.APIBindingPhaseBound, tenantFinalizer), []string{"secrets", "configmaps", "namespaces"}, "secrets", "namespaces"),
+			},
+			state:             []client.Object{tenantState(TenantPhaseOnboarded)},
+			wantPhase:         TenantPhaseOnboarded,
+			wantEvents:        []string{"Warning PermissionClaimsNotAccepted The permission claims for secrets, namespaces are not accepted"},
+			wantMissingClaims: "secrets, namespaces",
+		},
+		{
+			name: "offboards a tenant without the resources whose claim is not accepted",
+			objects: []client.Object{
+				deleted(withClaims(apiBinding(testAPIExportName, apisv1alpha1.APIBindingPhaseBound, tenantFinalizer), []string{"secrets", "namespaces"}, "secrets")),
+				createdNamespace,
+				publishedSecret(crossNamespace, types.NamespacedName{Namespace: "created", Name: "cm"}, "data"),
+			},
+			state:      []client.Object{tenantState(TenantPhaseOnboarded)},
+			wantPhase:  TenantPhaseOffboarded,
+			wantEvents: []string{"Warning PermissionClaimsNotAccepted"},
+			check: func(t *testing.T, c client.Client) {
+				if err := c.Get(context.Background(), types.NamespacedName{Namespace: "created", Name: "cm"}, &corev1.Secret{}); err != nil {
+					t.Errorf("expected the secret to be left alone: %v", err)
+				}
+				if err := c.Get(context.Background(), types.NamespacedName{Name: "created"}, &corev1.Namespace{}); !apierrors.IsNotFound(err) {
+					t.Errorf("expected the created namespace to be deleted, got %v", err)
+				}
+			},
+		},
+		{
+			name:      "records a binding deleted without the finalizer",
+			state:     []client.Object{tenantState(TenantPhaseOnboarded)},
+			wantPhase: TenantPhaseOffboarded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clusters := fake.NewClusterClient(newTestScheme(t)).
+				WithObjects(clusterA, tt.objects...).
+				WithObjects(clusterB, apiBinding(testAPIExportName, apisv1alpha1.APIBindingPhaseBound, tenantFinalizer))
+			before := listAll(t, clusters.ForCluster(clusterB))
+			state := fakeclient.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(tt.state...).Build()
+
+			configureClusterMetrics(t, ClusterMetricsOptions{})
+			clusterMetrics.setWidgets("widget", map[logicalcluster.Name]int{clusterA: 1})
+
+			recorder := record.NewFakeRecorder(10)
+			r := &APIBindingReconciler{
+				ClusterClient:  clusters,
+				StateClient:    state,
+				StateNamespace: "tenants",
+				APIExportName:  testAPIExportName,
+				Recorder:       recorder,
+				Claims:         NewClaimTracker(),
+				Clock:          clocktesting.NewFakePassiveClock(now),
+			}
+			result, err := r.Reconcile(context.Background(), ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: "binding"},
+				ClusterName:    clusterA.String(),
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !result.IsZero() {
+				t.Errorf("expected no requeue, got %+v", result)
+			}
+
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			if len(events) != len(tt.wantEvents) {
+				t.Errorf("expected events %v, got %v", tt.wantEvents, events)
+			}
+			for i := range tt.wantEvents {
+				if i < len(events) && !strings.HasPrefix(events[i], tt.wantEvents[i]) {
+					t.Errorf("expected event %q, got %q", tt.wantEvents[i], events[i])
+				}
+			}
+
+			var phase string
+			var cm corev1.ConfigMap
+			if err := state.Get(context.Background(), types.NamespacedName{Namespace: "tenants", Name: tenantStateName(clusterA)}, &cm); err == nil {
+				phase = cm.Data[tenantPhaseKey]
+			} else if !apierrors.IsNotFound(err) {
+				t.Fatal(err)
+			}
+			if phase != tt.wantPhase {
+				t.Errorf("expected the tenant to be in phase %q, got %q", tt.wantPhase, phase)
+			}
+
+			// The metrics of an offboarded tenant are dropped
+			wantSeries := 1
+			if tt.wantPhase == TenantPhaseOffboarded {
+				wantSeries = 0
+			}
+			if got := testutil.CollectAndCount(widgetsPerCluster); got != wantSeries {
+				t.Errorf("expected %d widget series, got %d", wantSeries, got)
+			}
+
+			if got := claimsString(r.Claims.Missing(clusterA)); got != tt.wantMissingClaims {
+				t.Errorf("expected the missing claims %q, got %q", tt.wantMissingClaims, got)
+			}
+
+			if tt.check != nil {
+				tt.check(t, clusters.ForCluster(clusterA))
+			}
+			if after := listAll(t, clusters.ForCluster(clusterB)); after != before {
+				t.Errorf("expected %s to be untouched, got resource versions %s, want %s", clusterB, after, before)
+			}
+		})
+	}
+}
+
+func getAPIBinding(t *testing.T, c client.Client) *apisv1alpha1.APIBinding {
+	t.Helper()
+	var binding apisv1alpha1.APIBinding
+	if err := c.Get(context.Background(), types.NamespacedName{Name: "binding"}, &binding); err != nil {
+		t.Fatalf("failed to get the binding: %v", err)
+	}
+	return &binding
+}
+
+func expectNoDefaultWidget(t *testing.T, c client.Client) {
+	t.Helper()
+	var w datav1alpha1.Widget
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: defaultWidgetName}, &w); !apierrors.IsNotFound(err) {
+		t.Errorf("expected no default widget, got %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"go.opentelemetry.io/otel/trace"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+// ClaimedResource is a resource of another APIExport that the APIExport claims. Unlike the core resources, such a
+// claim has to name the identity hash of the APIExport that provides the resource.
+type ClaimedResource struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	// APIExport is the APIExport that provides the resource. An empty path is the workspace of our APIExport.
+	APIExport apisv1alpha1.ExportBindingReference `json:"apiExport"`
+	// IdentityHash is the identity hash of the APIExport that provides the resource. It is looked up from the
+	// APIExport if empty.
+	IdentityHash string `json:"identityHash,omitempty"`
+}
+
+// GroupVersionResource returns the GroupVersionResource of the claimed resource.
+func (r ClaimedResource) GroupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
+}
+
+// PermissionClaim returns the claim of the APIExport on all objects of the resource.
+func (r ClaimedResource) PermissionClaim() apisv1alpha1.PermissionClaim {
+	return apisv1alpha1.PermissionClaim{
+		GroupResource: apisv1alpha1.GroupResource{Group: r.Group, Resource: r.Resource},
+		All:           true,
+		IdentityHash:  r.IdentityHash,
+	}
+}
+
+// ClaimedResourceHook integrates the controllers with a resource of another APIExport. It is called by the
+// ClaimedResourceReconciler of the resource with every object of the resource that changes, in any logical cluster
+// whose APIBinding accepts the claim on the resource.
+type ClaimedResourceHook interface {
+	// Reconcile reconciles the object. c is a client for the logical cluster of the object.
+	Reconcile(ctx context.Context, c client.Client, obj *unstructured.Unstructured) (ctrl.Result, error)
+}
+
+// ClaimedResourceHookFunc adapts a function to a ClaimedResourceHook.
+type ClaimedResourceHookFunc func(ctx context.Context, c client.Client, obj *unstructured.Unstructured) (ctrl.Result, error)
+
+// Reconcile calls f.
+func (f ClaimedResourceHookFunc) Reconcile(ctx context.Context, c client.Client, obj *unstructured.Unstructured) (ctrl.Result, error) {
+	return f(ctx, c, obj)
+}
+
+var (
+	claimedResourceHooksLock sync.RWMutex
+	claimedResourceHooks     = map[schema.GroupResource][]ClaimedResourceHook{}
+)
+
+// RegisterClaimedResourceHook registers the hook for the objects of the claimed resource. It is meant to be called
+// from the init function of an integration, before the controllers are set up.
+func RegisterClaimedResourceHook(resource schema.GroupResource, hook ClaimedResourceHook) {
+	claimedResourceHooksLock.Lock()
+	defer claimedResourceHooksLock.Unlock()
+	claimedResourceHooks[resource] = append(claimedResourceHooks[resource], hook)
+}
+
+// ClaimedResourceHooks returns the hooks registered for the claimed resource, in the order of registration.
+func ClaimedResourceHooks(resource schema.GroupResource) []ClaimedResourceHook {
+	claimedResourceHooksLock.RLock()
+	defer claimedResourceHooksLock.RUnlock()
+	return append([]ClaimedResourceHook(nil), claimedResourceHooks[resource]...)
+}
+
+// ClaimedResourceReconciler watches a resource of another APIExport and passes its objects to the hooks of the
+// resource.
+type ClaimedResourceReconciler struct {
+	ClusterClient
+	// Resource is the claimed resource.
+	Resource ClaimedResource
+	// Hooks are called in order with every object of the resource. The first error stops the reconcile.
+	Hooks []ClaimedResourceHook
+	// TracerProvider records the span of each reconcile. It defaults to the global TracerProvider.
+	TracerProvider trace.TracerProvider
+	// Claims tells in which logical clusters the claim on the resource is not accepted, which are skipped. If nil,
+	// the claim is assumed to be accepted everywhere.
+	Claims *ClaimTracker
+	// Sharder restricts the reconciler to the logical clusters owned by this replica. If nil, it reconciles all of
+	// them.
+	Sharder *Sharder
+	// Drainer lets in-flight reconciles finish when the manager stops. If nil, they are canceled right away.
+	Drainer *Drainer
+
+	// kind is the kind of the resource, resolved when the controller is set up.
+	kind string
+}
+
+// name returns the name of the controller, which is unique across the groups of the claimed resources.
+func (r *ClaimedResourceReconciler) name() string {
+	return "claimed-" + r.Resource.GroupVersionResource().GroupResource().String()
+}
+
+func (r *ClaimedResourceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, err error) {
+	if !r.Sharder.Owns(logicalcluster.Name(req.ClusterName)) {
+		// Another replica took the logical cluster over since the request was queued
+		return ctrl.Result{}, nil
+	}
+
+	ctx, span := startReconcileSpan(ctx, r.TracerProvider, r.name(), req)
+	defer func() { endSpan(span, err) }()
+
+	log := log.FromContext(ctx).WithValues("cluster", req.ClusterName)
+
+	cluster := logicalcluster.Name(req.ClusterName)
+	defer func() { clusterMetrics.reconcileError(r.name(), cluster, err) }()
+	c := r.ForCluster(cluster)
+
+	gvr := r.Resource.GroupVersionResource()
+	if !r.Claims.Accepted(cluster, gvr.GroupResource()) {
+		log.Info("Skipping, the permission claim is not accepted", "resource", gvr.GroupResource().String())
+		return ctrl.Result{}, nil
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvr.GroupVersion().WithKind(r.kind))
+	if err := c.Get(ctx, req.NamespacedName, obj); err != nil {
+		// The hooks clean up after deleted objects with finalizers
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	var result ctrl.Result
+	for i, hook := range r.Hooks {
+		hookResult, err := hook.Reconcile(ctx, c, obj)
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("hook %d of %s: %w", i, gvr.GroupResource(), err)
+		}
+		result = earliest(result, hookResult)
+	}
+	return result, nil
+}
+
+// earliest returns the result that requeues first.
+func earliest(a, b ctrl.Result) ctrl.Result {
+	switch {
+	case a.IsZero():
+		return b
+	case b.IsZero():
+		return a
+	case a.Requeue && a.RequeueAfter == 0:
+		return a
+	case b.Requeue && b.RequeueAfter == 0:
+		return b
+	case b.RequeueAfter < a.RequeueAfter:
+		return b
+	}
+	return a
+}
+
+// SetupWithManager sets up the controller with the Manager. The resource must be served by the manager's
+// APIExport virtual workspace, which requires the claim on it.
+func (r *ClaimedResourceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	gvr := r.Resource.GroupVersionResource()
+	gvk, err := mgr.GetRESTMapper().KindFor(gvr)
+	if err != nil {
+		return fmt.Errorf("error looking up the kind of %s: %w", gvr, err)
+	}
+	r.kind = gvk.Kind
+
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	name := r.Drainer.ControllerName(r.name())
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named(name).
+		For(obj, builder.WithPredicates(r.Sharder.Predicate()))
+	if resync := r.Claims.Resync(); resync != nil {
+		// The objects skipped for a missing permission claim have to be caught up with once it is accepted
+		b = b.Watches(resync, handler.EnqueueRequestsFromMapFunc(r.clusterObjects))
+	}
+	return b.Complete(r.Drainer.Wrap(name, r))
+}
+
+// clusterObjects maps an event in a logical cluster to all objects of the resource in it, if it is owned by this
+// replica.
+func (r *ClaimedResourceReconciler) clusterObjects(obj client.Object) []reconcile.Request {
+	ctx := context.Background()
+	cluster := logicalcluster.From(obj)
+	if !r.Sharder.Owns(cluster) {
+		return nil
+	}
+
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(r.Resource.GroupVersionResource().GroupVersion().WithKind(r.kind + "List"))
+	if err := r.ForCluster(cluster).List(ctx, list); err != nil && !apierrors.IsNotFound(err) {
+		log.FromContext(ctx).Error(err, "unable to list claimed objects", "cluster", cluster, "resource", r.Resource.GroupVersionResource())
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for i := range list.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: client.ObjectKeyFromObject(&list.Items[i]),
+			ClusterName:    cluster.String(),
+		})
+	}
+	return requests
+}
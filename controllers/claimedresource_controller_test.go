@@ -0,0 +1,194 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+var testClaimedResource = ClaimedResource{
+	Group:        "certificates.example.io",
+	Version:      "v1",
+	Resource:     "certificates",
+	APIExport:    apisv1alpha1.ExportBindingReference{Path: "root:certs", Name: "certificates.example.io"},
+	IdentityHash: "abc123",
+}
+
+func certificate(name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(schema.GroupVersionKind{Group: "certificates.example.io", Version: "v1", Kind: "Certificate"})
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	return obj
+}
+
+func TestClaimedResourcePermissionClaim(t *testing.T) {
+	claim := testClaimedResource.PermissionClaim()
+	if got := claim.String(); got != "certificates.certificates.example.io:abc123" {
+		t.Errorf("unexpected claim %s", got)
+	}
+	if !claim.All {
+		t.Error("expected the claim to claim all objects")
+	}
+}
+
+func TestRegisterClaimedResourceHook(t *testing.T) {
+	gr := schema.GroupResource{Group: "test.example.io", Resource: "things"}
+	var calls []string
+	for _, name := range []string{"first", "second"} {
+		name := name
+		RegisterClaimedResourceHook(gr, ClaimedResourceHookFunc(func(context.Context, client.Client, *unstructured.Unstructured) (ctrl.Result, error) {
+			calls = append(calls, name)
+			return ctrl.Result{}, nil
+		}))
+	}
+	hooks := ClaimedResourceHooks(gr)
+	if len(hooks) != 2 {
+		t.Fatalf("expected 2 hooks, got %d", len(hooks))
+	}
+	for _, hook := range hooks {
+		if _, err := hook.Reconcile(context.Background(), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(calls) != 2 || calls[0] != "first" || calls[1] != "second" {
+		t.Errorf("expected the hooks in the order of registration, got %v", calls)
+	}
+	if hooks := ClaimedResourceHooks(schema.GroupResource{Group: "test.example.io", Resource: "others"}); len(hooks) != 0 {
+		t.Errorf("expected no hooks for another resource, got %d", len(hooks))
+	}
+}
+
+func TestClaimedResourceReconcile(t *testing.T) {
+	type call struct {
+		cluster string
+		name    string
+	}
+	recording := func(calls *[]call, result ctrl.Result, err error) ClaimedResourceHook {
+		return ClaimedResourceHookFunc(func(ctx context.Context, c client.Client, obj *unstructured.Unstructured) (ctrl.Result, error) {
+			// The client is scoped to the logical cluster of the object
+			if err := c.Get(ctx, client.ObjectKeyFromObject(obj), certificate("")); err != nil {
+				return ctrl.Result{}, err
+			}
+			*calls = append(*calls, call{cluster: logicalcluster.From(obj).String(), name: obj.GetName()})
+			return result, err
+		})
+	}
+
+	tests := []struct {
+		name          string
+		objects       []client.Object
+		missingClaims bool
+		results       []ctrl.Result
+		errs          []error
+		wantCalls     int
+		wantResult    ctrl.Result
+		wantErr       bool
+	}{
+		{
+			name:      "passes the object to every hook",
+			objects:   []client.Object{certificate("cert")},
+			results:   []ctrl.Result{{}, {}},
+			errs:      []error{nil, nil},
+			wantCalls: 2,
+		},
+		{
+			name:       "requeues at the earliest result",
+			objects:    []client.Object{certificate("cert")},
+			results:    []ctrl.Result{{RequeueAfter: time.Minute}, {RequeueAfter: time.Second}, {}},
+			errs:       []error{nil, nil, nil},
+			wantCalls:  3,
+			wantResult: ctrl.Result{RequeueAfter: time.Second},
+		},
+		{
+			name:      "stops at the first error",
+			objects:   []client.Object{certificate("cert")},
+			results:   []ctrl.Result{{}, {}},
+			errs:      []error{errors.New("boom"), nil},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:    "object not found",
+			results: []ctrl.Result{{}},
+			errs:    []error{nil},
+		},
+		{
+			name:          "skips logical clusters without the claim",
+			objects:       []client.Object{certificate("cert")},
+			missingClaims: true,
+			results:       []ctrl.Result{{}},
+			errs:          []error{nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clusters := fake.NewClusterClient(newTestScheme(t)).
+				WithObjects(clusterA, tt.objects...).
+				WithObjects(clusterB, certificate("other"))
+
+			claims := NewClaimTracker()
+			if tt.missingClaims {
+				claims.set(clusterA, []apisv1alpha1.PermissionClaim{testClaimedResource.PermissionClaim()})
+			}
+			var calls []call
+			r := &ClaimedResourceReconciler{
+				ClusterClient: clusters,
+				Resource:      testClaimedResource,
+				Claims:        claims,
+				kind:          "Certificate",
+			}
+			for i := range tt.results {
+				r.Hooks = append(r.Hooks, recording(&calls, tt.results[i], tt.errs[i]))
+			}
+
+			result, err := r.Reconcile(context.Background(), ctrl.Request{
+				NamespacedName: types.NamespacedName{Namespace: "default", Name: "cert"},
+				ClusterName:    clusterA.String(),
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected an error: %v, got %v", tt.wantErr, err)
+			}
+			if result != tt.wantResult {
+				t.Errorf("expected result %+v, got %+v", tt.wantResult, result)
+			}
+			if len(calls) != tt.wantCalls {
+				t.Fatalf("expected %d calls of the hooks, got %v", tt.wantCalls, calls)
+			}
+			for _, c := range calls {
+				if c.cluster != clusterA.String() || c.name != "cert" {
+					t.Errorf("expected the hooks to be called with %s|default/cert, got %v", clusterA, c)
+				}
+			}
+		})
+	}
+}
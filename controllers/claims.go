@@ -0,0 +1,253 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+var (
+	// secretsResource, configMapsResource and namespacesResource are the resources of the permission claims the
+	// controllers rely on.
+	secretsResource    = schema.GroupResource{Resource: "secrets"}
+	configMapsResource = schema.GroupResource{Resource: "configmaps"}
+	namespacesResource = schema.GroupResource{Resource: "namespaces"}
+)
+
+// ClaimTracker records which permission claims of the APIExport the APIBinding of each logical cluster does not
+// accept, so that the controllers can skip the resources they cannot access there instead of failing on forbidden
+// errors. The APIBindingReconciler keeps it up to date.
+//
+// A logical cluster whose APIBinding has not been seen yet accepts every claim, and so does every logical cluster of a
+// nil *ClaimTracker.
+type ClaimTracker struct {
+	lock        sync.RWMutex
+	missing     map[logicalcluster.Name][]apisv1alpha1.PermissionClaim
+	subscribers []*claimSubscriber
+}
+
+// claimSubscriber holds the logical clusters to resync for a controller, see Resync.
+type claimSubscriber struct {
+	// pending holds the logical clusters to resync, at most once each however many claims they accepted meanwhile.
+	pending map[logicalcluster.Name]struct{}
+	// wake signals that pending is not empty.
+	wake chan struct{}
+}
+
+// NewClaimTracker returns a ClaimTracker that knows of no logical clusters yet.
+func NewClaimTracker() *ClaimTracker {
+	return &ClaimTracker{missing: map[logicalcluster.Name][]apisv1alpha1.PermissionClaim{}}
+}
+
+// Accepted returns whether the APIBinding of the logical cluster accepts the claim on the resource, if the APIExport
+// claims it.
+func (t *ClaimTracker) Accepted(cluster logicalcluster.Name, resource schema.GroupResource) bool {
+	if t == nil {
+		return true
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for _, claim := range t.missing[cluster] {
+		if claim.Group == resource.Group && claim.Resource == resource.Resource {
+			return false
+		}
+	}
+	return true
+}
+
+// Missing returns the permission claims that the APIBinding of the logical cluster does not accept.
+func (t *ClaimTracker) Missing(cluster logicalcluster.Name) []apisv1alpha1.PermissionClaim {
+	if t == nil {
+		return nil
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return append([]apisv1alpha1.PermissionClaim(nil), t.missing[cluster]...)
+}
+
+// set records the permission claims the APIBinding of the logical cluster does not accept, and returns whether they
+// changed. A logical cluster seen for the first time is only considered changed if it misses claims. The subscribers
+// are notified when a claim is newly accepted.
+func (t *ClaimTracker) set(cluster logicalcluster.Name, missing []apisv1alpha1.PermissionClaim) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	previous, known := t.missing[cluster]
+	if known && equalClaims(previous, missing) {
+		return false
+	}
+	t.missing[cluster] = missing
+	t.updateMetric()
+
+	for _, claim := range previous {
+		if !containsClaim(missing, claim) {
+			t.notify(cluster)
+			break
+		}
+	}
+	return known || len(missing) > 0
+}
+
+// forget drops the logical cluster, whose APIBinding is gone.
+func (t *ClaimTracker) forget(cluster logicalcluster.Name) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.missing, cluster)
+	t.updateMetric()
+}
+
+// updateMetric sets the number of logical clusters with incomplete claims. The lock must be held.
+func (t *ClaimTracker) updateMetric() {
+	incomplete := 0
+	for _, missing := range t.missing {
+		if len(missing) > 0 {
+			incomplete++
+		}
+	}
+	incompleteClaimsWorkspaces.Set(float64(incomplete))
+}
+
+// notify queues a resync of the logical cluster for the subscribers, without waiting for them. The lock must be held.
+func (t *ClaimTracker) notify(cluster logicalcluster.Name) {
+	for _, subscriber := range t.subscribers {
+		subscriber.pending[cluster] = struct{}{}
+		// A wake-up that is still pending covers this logical cluster as well
+		select {
+		case subscriber.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// takePending returns the logical clusters to resync for the subscriber and clears them.
+func (t *ClaimTracker) takePending(subscriber *claimSubscriber) []logicalcluster.Name {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	clusters := make([]logicalcluster.Name, 0, len(subscriber.pending))
+	for cluster := range subscriber.pending {
+		clusters = append(clusters, cluster)
+	}
+	subscriber.pending = map[logicalcluster.Name]struct{}{}
+	return clusters
+}
+
+// Resync returns a source that emits an event in a logical cluster whenever its APIBinding accepts a claim it did not
+// accept before, so that a controller can enqueue the objects it skipped there. Each controller needs its own source.
+// The logical clusters are held until the controller starts, and the events stop with it. It returns nil for a nil
+// *ClaimTracker.
+func (t *ClaimTracker) Resync() source.Source {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	subscriber := &claimSubscriber{pending: map[logicalcluster.Name]struct{}{}, wake: make(chan struct{}, 1)}
+	t.subscribers = append(t.subscribers, subscriber)
+	return source.Func(func(ctx context.Context, h handler.EventHandler, queue workqueue.RateLimitingInterface, predicates ...predicate.Predicate) error {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-subscriber.wake:
+				}
+				for _, cluster := range t.takePending(subscriber) {
+					e := event.GenericEvent{Object: &apisv1alpha1.APIBinding{ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{logicalcluster.AnnotationKey: cluster.String()},
+					}}}
+					if predicateGeneric(predicates, e) {
+						h.Generic(e, queue)
+					}
+				}
+			}
+		}()
+		return nil
+	})
+}
+
+// predicateGeneric returns whether all predicates let the generic event through.
+func predicateGeneric(predicates []predicate.Predicate, e event.GenericEvent) bool {
+	for _, p := range predicates {
+		if !p.Generic(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// missingClaims returns the permission claims of the APIExport that the APIBinding does not accept.
+func missingClaims(binding *apisv1alpha1.APIBinding) []apisv1alpha1.PermissionClaim {
+	var missing []apisv1alpha1.PermissionClaim
+	for _, claim := range binding.Status.ExportPermissionClaims {
+		accepted := false
+		for _, acceptable := range binding.Spec.PermissionClaims {
+			if acceptable.State == apisv1alpha1.ClaimAccepted && acceptable.PermissionClaim.Equal(claim) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			missing = append(missing, claim)
+		}
+	}
+	return missing
+}
+
+// claimsString returns the claims as a comma-separated list of their resources.
+func claimsString(claims []apisv1alpha1.PermissionClaim) string {
+	names := make([]string, 0, len(claims))
+	for _, claim := range claims {
+		names = append(names, claim.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+func containsClaim(claims []apisv1alpha1.PermissionClaim, claim apisv1alpha1.PermissionClaim) bool {
+	for _, c := range claims {
+		if c.Equal(claim) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalClaims(a, b []apisv1alpha1.PermissionClaim) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+func claim(resource string) apisv1alpha1.PermissionClaim {
+	return apisv1alpha1.PermissionClaim{GroupResource: apisv1alpha1.GroupResource{Resource: resource}, All: true}
+}
+
+// withClaims makes the APIExport of the binding claim the resources, and the binding accept all of them but the
+// rejected ones.
+func withClaims(binding *apisv1alpha1.APIBinding, resources []string, rejected ...string) *apisv1alpha1.APIBinding {
+	for _, resource := range resources {
+		binding.Status.ExportPermissionClaims = append(binding.Status.ExportPermissionClaims, claim(resource))
+		state := apisv1alpha1.ClaimAccepted
+		if containsString(rejected, resource) {
+			state = apisv1alpha1.ClaimRejected
+		}
+		binding.Spec.PermissionClaims = append(binding.Spec.PermissionClaims,
+			apisv1alpha1.AcceptablePermissionClaim{PermissionClaim: claim(resource), State: state})
+	}
+	return binding
+}
+
+func TestMissingClaims(t *testing.T) {
+	resources := []string{"secrets", "configmaps", "namespaces"}
+	tests := []struct {
+		name    string
+		binding *apisv1alpha1.APIBinding
+		want    string
+	}{
+		{
+			name:    "all claims accepted",
+			binding: withClaims(apiBinding(testAPIExportName, apisv1alpha1.APIBindingPhaseBound), resources),
+		},
+		{
+			name:    "rejected claims",
+			binding: withClaims(apiBinding(testAPIExportName, apisv1alpha1.APIBindingPhaseBound), resources, "secrets", "namespaces"),
+			want:    "secrets, namespaces",
+		},
+		{
+			name: "claims neither accepted nor rejected",
+			binding: func() *apisv1alpha1.APIBinding {
+				binding := withClaims(apiBinding(testAPIExportName, apisv1alpha1.APIBindingPhaseBound), resources)
+				binding.Spec.PermissionClaims = binding.Spec.PermissionClaims[1:]
+				return binding
+			}(),
+			want: "secrets",
+		},
+		{
+			name: "accepted claims with another identity",
+			binding: func() *apisv1alpha1.APIBinding {
+				binding := withClaims(apiBinding(testAPIExportName, apisv1alpha1.APIBindingPhaseBound), resources)
+				binding.Spec.PermissionClaims[2].IdentityHash = "other"
+				return binding
+			}(),
+			want: "namespaces",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := claimsString(missingClaims(tt.binding)); got != tt.want {
+				t.Errorf("expected missing claims %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// startResync starts the source as a controller does, and returns the logical clusters of its events.
+func startResync(ctx context.Context, t *testing.T, resync source.Source) <-chan logicalcluster.Name {
+	t.Helper()
+	clusters := make(chan logicalcluster.Name, 10)
+	h := handler.Funcs{GenericFunc: func(e event.GenericEvent, _ workqueue.RateLimitingInterface) {
+		clusters <- logicalcluster.From(e.Object)
+	}}
+	if err := resync.Start(ctx, h, nil); err != nil {
+		t.Fatal(err)
+	}
+	return clusters
+}
+
+func TestClaimTracker(t *testing.T) {
+	var nilTracker *ClaimTracker
+	if !nilTracker.Accepted(clusterA, secretsResource) {
+		t.Error("expected a nil tracker to accept every claim")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tracker := NewClaimTracker()
+	resync := startResync(ctx, t, tracker.Resync())
+	if !tracker.Accepted(clusterA, secretsResource) {
+		t.Error("expected an unknown logical cluster to accept every claim")
+	}
+	if tracker.set(clusterA, nil) {
+		t.Error("expected a new logical cluster with every claim accepted to be unchanged")
+	}
+
+	if !tracker.set(clusterA, []apisv1alpha1.PermissionClaim{claim("secrets"), claim("namespaces")}) {
+		t.Error("expected rejecting claims to be a change")
+	}
+	if !tracker.set(clusterB, []apisv1alpha1.PermissionClaim{claim("secrets")}) {
+		t.Error("expected a new logical cluster with missing claims to be a change")
+	}
+	if tracker.set(clusterA, []apisv1alpha1.PermissionClaim{claim("secrets"), claim("namespaces")}) {
+		t.Error("expected the same claims to be unchanged")
+	}
+	if tracker.Accepted(clusterA, secretsResource) || tracker.Accepted(clusterA, namespacesResource) {
+		t.Error("expected the claims for secrets and namespaces not to be accepted")
+	}
+	if !tracker.Accepted(clusterA, configMapsResource) {
+		t.Error("expected the claim for configmaps to be accepted")
+	}
+	if got := testutil.ToFloat64(incompleteClaimsWorkspaces); got != 2 {
+		t.Errorf("expected 2 workspaces with incomplete claims, got %v", got)
+	}
+
+	// Accepting a claim lets the controllers catch up with the logical cluster
+	if !tracker.set(clusterA, []apisv1alpha1.PermissionClaim{claim("secrets")}) {
+		t.Error("expected accepting a claim to be a change")
+	}
+	select {
+	case cluster := <-resync:
+		if cluster != clusterA {
+			t.Errorf("expected a resync of %s, got %s", clusterA, cluster)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("expected a resync when a claim is accepted")
+	}
+	if got := claimsString(tracker.Missing(clusterA)); got != "secrets" {
+		t.Errorf("expected the claim for secrets to be missing, got %q", got)
+	}
+
+	tracker.forget(clusterA)
+	tracker.forget(clusterB)
+	if !tracker.Accepted(clusterB, secretsResource) {
+		t.Error("expected a forgotten logical cluster to accept every claim")
+	}
+	if got := testutil.ToFloat64(incompleteClaimsWorkspaces); got != 0 {
+		t.Errorf("expected no workspaces with incomplete claims, got %v", got)
+	}
+}
+
+func TestClaimTrackerResyncBeforeStart(t *testing.T) {
+	tracker := NewClaimTracker()
+	resync := tracker.Resync()
+	missing := []apisv1alpha1.PermissionClaim{claim("secrets")}
+
+	// The resyncs of a controller that has not started are held without blocking, once per logical cluster
+	for i := 0; i < 100; i++ {
+		tracker.set(clusterA, missing)
+		tracker.set(clusterA, nil)
+	}
+	tracker.set(clusterB, missing)
+	tracker.set(clusterB, nil)
+	if got := len(tracker.subscribers[0].pending); got != 2 {
+		t.Fatalf("expected the resyncs of 2 logical clusters to be pending, got %d", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	clusters := startResync(ctx, t, resync)
+	var got []string
+	for len(got) < 2 {
+		select {
+		case cluster := <-clusters:
+			got = append(got, cluster.String())
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("expected the pending resyncs once started, got %v", got)
+		}
+	}
+	sort.Strings(got)
+	if got[0] != clusterA.String() || got[1] != clusterB.String() {
+		t.Errorf("expected a resync of %s and %s, got %v", clusterA, clusterB, got)
+	}
+	select {
+	case cluster := <-clusters:
+		t.Errorf("expected a single resync per logical cluster, got another one of %s", cluster)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once the controller stops, the resyncs are held again
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	tracker.set(clusterA, missing)
+	tracker.set(clusterA, nil)
+	select {
+	case cluster := <-clusters:
+		t.Errorf("expected no resync after the controller stopped, got one of %s", cluster)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
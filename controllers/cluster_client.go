@@ -0,0 +1,49 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/kcp-dev/logicalcluster/v3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kcp-dev/controller-runtime-example/internal/scopedclient"
+)
+
+// ClusterClient is a client for all logical clusters, such as the client of a kcp cluster-aware manager, that can be
+// scoped to a single logical cluster. Requests made through the ClusterClient itself span all logical clusters.
+//
+// test/fake provides an implementation backed by one fake client per logical cluster.
+type ClusterClient interface {
+	client.Client
+
+	// ForCluster returns a client whose requests only ever touch the given logical cluster.
+	ForCluster(cluster logicalcluster.Name) client.Client
+}
+
+// NewClusterClient returns a ClusterClient for a client that routes requests to the logical cluster in their
+// context, see kontext.WithCluster.
+func NewClusterClient(c client.Client) ClusterClient {
+	return &kontextClient{Client: c}
+}
+
+type kontextClient struct {
+	client.Client
+}
+
+func (c *kontextClient) ForCluster(cluster logicalcluster.Name) client.Client {
+	return scopedclient.New(c.Client, cluster)
+}
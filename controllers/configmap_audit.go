@@ -0,0 +1,128 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/kontext"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// AuditFindingDuplicate is reported when a list scoped to a logical cluster returns the same namespace and name
+	// more than once.
+	AuditFindingDuplicate = "duplicate"
+	// AuditFindingLeak is reported when a list scoped to a logical cluster returns an object from another logical
+	// cluster.
+	AuditFindingLeak = "leak"
+)
+
+// ConfigMapAuditor periodically checks, for every logical cluster with ConfigMaps, that a list scoped to that logical
+// cluster returns each ConfigMap once and only ConfigMaps from that logical cluster. Findings are reported as metrics
+// and as events on the offending ConfigMaps.
+type ConfigMapAuditor struct {
+	client.Client
+	Recorder record.EventRecorder
+
+	// Interval is the time between two audits.
+	Interval time.Duration
+}
+
+// Start runs the audit every Interval until ctx is done.
+func (a *ConfigMapAuditor) Start(ctx context.Context) error {
+	wait.UntilWithContext(ctx, a.audit, a.Interval)
+	return nil
+}
+
+// NeedLeaderElection makes sure only the active replica audits.
+func (a *ConfigMapAuditor) NeedLeaderElection() bool {
+	return true
+}
+
+func (a *ConfigMapAuditor) audit(ctx context.Context) {
+	logger := log.FromContext(ctx).WithName("configmap-audit")
+
+	// Without a logical cluster in the context, the list spans all logical clusters
+	var all corev1.ConfigMapList
+	if err := a.List(ctx, &all); err != nil {
+		logger.Error(err, "unable to list configmaps across all workspaces")
+		return
+	}
+
+	clusters := map[logicalcluster.Name]struct{}{}
+	for i := range all.Items {
+		clusters[logicalcluster.From(&all.Items[i])] = struct{}{}
+	}
+
+	findings := map[string]int{AuditFindingDuplicate: 0, AuditFindingLeak: 0}
+	for cluster := range clusters {
+		if cluster.Empty() {
+			continue
+		}
+		for kind, count := range a.auditCluster(ctx, cluster) {
+			findings[kind] += count
+		}
+	}
+
+	for kind, count := range findings {
+		configMapAuditFindings.WithLabelValues(kind).Set(float64(count))
+	}
+	configMapAuditsTotal.Inc()
+	logger.Info("Audited configmaps", "workspaces", len(clusters), "duplicates", findings[AuditFindingDuplicate], "leaks", findings[AuditFindingLeak])
+}
+
+func (a *ConfigMapAuditor) auditCluster(ctx context.Context, cluster logicalcluster.Name) map[string]int {
+	logger := log.FromContext(ctx).WithName("configmap-audit").WithValues("cluster", cluster)
+	ctx = kontext.WithCluster(ctx, cluster)
+
+	var list corev1.ConfigMapList
+	if err := a.List(ctx, &list); err != nil {
+		logger.Error(err, "unable to list configmaps")
+		return nil
+	}
+
+	findings := map[string]int{}
+	seen := map[types.NamespacedName]bool{}
+	for i := range list.Items {
+		cm := &list.Items[i]
+		if from := logicalcluster.From(cm); !from.Empty() && from != cluster {
+			findings[AuditFindingLeak]++
+			logger.Info("Listed configmap from another workspace", "namespace", cm.Namespace, "name", cm.Name, "from", from)
+			a.Recorder.Eventf(cm, corev1.EventTypeWarning, "CrossClusterConfigMap", "ConfigMap was listed in workspace %s", cluster)
+			continue
+		}
+
+		key := client.ObjectKeyFromObject(cm)
+		if seen[key] {
+			findings[AuditFindingDuplicate]++
+			logger.Info("Listed configmap more than once", "namespace", cm.Namespace, "name", cm.Name)
+			a.Recorder.Event(cm, corev1.EventTypeWarning, "DuplicateConfigMap", "ConfigMap was listed more than once in its workspace")
+			continue
+		}
+		seen[key] = true
+	}
+	return findings
+}
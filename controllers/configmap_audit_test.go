@@ -0,0 +1,147 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/kontext"
+)
+
+// auditListClient serves configmap lists the way a broken cluster-aware client could: the list of a logical cluster
+// is returned as is, so it may hold duplicates or objects of other logical clusters.
+type auditListClient struct {
+	client.Client
+	clusters map[logicalcluster.Name][]corev1.ConfigMap
+}
+
+func (c *auditListClient) List(ctx context.Context, list client.ObjectList, _ ...client.ListOption) error {
+	configMaps := list.(*corev1.ConfigMapList)
+	if cluster, ok := kontext.ClusterFrom(ctx); ok {
+		configMaps.Items = append([]corev1.ConfigMap(nil), c.clusters[cluster]...)
+		return nil
+	}
+	configMaps.Items = nil
+	for cluster, items := range c.clusters {
+		for _, cm := range items {
+			if logicalcluster.From(&cm) == cluster {
+				configMaps.Items = append(configMaps.Items, cm)
+			}
+		}
+	}
+	return nil
+}
+
+// auditedConfigMap returns a configmap of the default namespace annotated with its logical cluster.
+func auditedConfigMap(cluster logicalcluster.Name, name string) corev1.ConfigMap {
+	return corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "default",
+		Name:        name,
+		Annotations: map[string]string{logicalcluster.AnnotationKey: cluster.String()},
+	}}
+}
+
+func TestConfigMapAudit(t *testing.T) {
+	tests := []struct {
+		name           string
+		clusters       map[logicalcluster.Name][]corev1.ConfigMap
+		wantDuplicates int
+		wantLeaks      int
+		wantEvents     []string
+	}{
+		{
+			name: "consistent lists",
+			clusters: map[logicalcluster.Name][]corev1.ConfigMap{
+				clusterA: {auditedConfigMap(clusterA, "a"), auditedConfigMap(clusterA, "b")},
+				clusterB: {auditedConfigMap(clusterB, "a")},
+			},
+		},
+		{
+			name: "a configmap listed twice",
+			clusters: map[logicalcluster.Name][]corev1.ConfigMap{
+				clusterA: {auditedConfigMap(clusterA, "a"), auditedConfigMap(clusterA, "a"), auditedConfigMap(clusterA, "b")},
+				clusterB: {auditedConfigMap(clusterB, "a")},
+			},
+			wantDuplicates: 1,
+			wantEvents:     []string{"Warning DuplicateConfigMap ConfigMap was listed more than once in its workspace"},
+		},
+		{
+			name: "a configmap of another workspace",
+			clusters: map[logicalcluster.Name][]corev1.ConfigMap{
+				clusterA: {auditedConfigMap(clusterA, "a"), auditedConfigMap(clusterB, "a")},
+				clusterB: {auditedConfigMap(clusterB, "a")},
+			},
+			wantLeaks:  1,
+			wantEvents: []string{"Warning CrossClusterConfigMap ConfigMap was listed in workspace " + clusterA.String()},
+		},
+		{
+			name: "duplicates and leaks in several workspaces",
+			clusters: map[logicalcluster.Name][]corev1.ConfigMap{
+				clusterA: {auditedConfigMap(clusterA, "a"), auditedConfigMap(clusterA, "a"), auditedConfigMap(clusterB, "b")},
+				clusterB: {auditedConfigMap(clusterB, "b"), auditedConfigMap(clusterB, "b"), auditedConfigMap(clusterA, "a")},
+			},
+			wantDuplicates: 2,
+			wantLeaks:      2,
+			wantEvents: []string{
+				"Warning CrossClusterConfigMap ConfigMap was listed in workspace " + clusterA.String(),
+				"Warning CrossClusterConfigMap ConfigMap was listed in workspace " + clusterB.String(),
+				"Warning DuplicateConfigMap ConfigMap was listed more than once in its workspace",
+				"Warning DuplicateConfigMap ConfigMap was listed more than once in its workspace",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			a := &ConfigMapAuditor{Client: &auditListClient{clusters: tt.clusters}, Recorder: recorder}
+			audits := testutil.ToFloat64(configMapAuditsTotal)
+
+			a.audit(context.Background())
+
+			if got := testutil.ToFloat64(configMapAuditsTotal) - audits; got != 1 {
+				t.Errorf("expected one more audit, got %v", got)
+			}
+			if got := testutil.ToFloat64(configMapAuditFindings.WithLabelValues(AuditFindingDuplicate)); got != float64(tt.wantDuplicates) {
+				t.Errorf("expected %d duplicates, got %v", tt.wantDuplicates, got)
+			}
+			if got := testutil.ToFloat64(configMapAuditFindings.WithLabelValues(AuditFindingLeak)); got != float64(tt.wantLeaks) {
+				t.Errorf("expected %d leaks, got %v", tt.wantLeaks, got)
+			}
+
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			// The logical clusters are audited in no particular order
+			sort.Strings(events)
+			if strings.Join(events, "\n") != strings.Join(tt.wantEvents, "\n") {
+				t.Errorf("expected events %q, got %q", tt.wantEvents, events)
+			}
+		})
+	}
+}
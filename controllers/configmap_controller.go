@@ -17,25 +17,92 @@ limitations under the License.
 package controllers
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"reflect"
+	"sort"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/kcp-dev/logicalcluster/v3"
+	"go.opentelemetry.io/otel/trace"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
-	"sigs.k8s.io/controller-runtime/pkg/kontext"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// secretTargetNamespaceKey and secretTargetNameKey are the optional configmap data keys that publish the secret
+	// into another namespace of the same logical cluster, or under another name.
+	secretTargetNamespaceKey = "secretTargetNamespace"
+	secretTargetNameKey      = "secretTargetName"
+
+	// sourceUIDLabel is set on every published secret to the UID of its configmap, so that secrets outside the
+	// configmap's namespace can be tracked without owner references.
+	sourceUIDLabel = "data.my.domain/source-uid"
+	// sourceNamespaceAnnotation and sourceNameAnnotation identify the configmap a published secret belongs to.
+	sourceNamespaceAnnotation = "data.my.domain/source-namespace"
+	sourceNameAnnotation      = "data.my.domain/source-name"
+
+	// secretTargetFinalizer is set on configmaps whose secret lives in another namespace.
+	secretTargetFinalizer = "data.my.domain/secret-target"
+	// publishedSecretAnnotation records the namespace/name of the secret last published for a configmap, so that
+	// published secrets only have to be listed when the target changes.
+	publishedSecretAnnotation = "data.my.domain/published-secret"
+
+	// secretSyncModeKey is the optional configmap data key that overrides the reconciler's SecretSyncMode.
+	secretSyncModeKey = "secretSyncMode"
+	// secretDataHashAnnotation records the hash of the data last written to a published secret, which tells drift
+	// apart from changes to the configmap.
+	secretDataHashAnnotation = "data.my.domain/secret-data-hash"
+
+	// namespaceSettleDelay is how long a namespace created for a configmap is given to settle before the configmap is
+	// reconciled any further.
+	namespaceSettleDelay = time.Second * 5
+)
+
+// SecretSyncMode controls how much of a published secret the ConfigMapReconciler manages.
+type SecretSyncMode string
+
+const (
+	// SecretSyncModeStrict makes the secret exactly match the desired state: extra keys and labels are removed, and a
+	// secret of the wrong type is recreated.
+	SecretSyncModeStrict SecretSyncMode = "Strict"
+	// SecretSyncModeLenient only manages the keys and labels owned by the controller.
+	SecretSyncModeLenient SecretSyncMode = "Lenient"
 )
 
 type ConfigMapReconciler struct {
-	client.Client
+	ClusterClient
+	Recorder record.EventRecorder
+	// TracerProvider records the span of each reconcile. It defaults to the global TracerProvider.
+	TracerProvider trace.TracerProvider
+	// Sharder restricts the reconciler to the logical clusters owned by this replica. If nil, it reconciles all of
+	// them.
+	Sharder *Sharder
+	// Drainer lets in-flight reconciles finish when the manager stops. If nil, they are canceled right away.
+	Drainer *Drainer
+	// Claims tells which permission claims are not accepted in each logical cluster. The parts of a configmap that
+	// need them are skipped. If nil, every claim is assumed to be accepted.
+	Claims *ClaimTracker
+
+	// SecretSyncMode is the default SecretSyncMode for published secrets. It defaults to SecretSyncModeLenient.
+	SecretSyncMode SecretSyncMode
 }
 
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
@@ -50,20 +117,46 @@ type ConfigMapReconciler struct {
 // +kubebuilder:rbac:groups="",resources=namespaces/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups="",resources=namespaces/finalizers,verbs=update
 
-func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, err error) {
+	if !r.Sharder.Owns(logicalcluster.Name(req.ClusterName)) {
+		// Another replica took the logical cluster over since the request was queued
+		return ctrl.Result{}, nil
+	}
+
+	ctx, span := startReconcileSpan(ctx, r.TracerProvider, "configmap", req)
+	defer func() { endSpan(span, err) }()
+
 	log := log.FromContext(ctx).WithValues("cluster", req.ClusterName)
 
-	ctx = kontext.WithCluster(ctx, logicalcluster.Name(req.ClusterName))
+	cluster := logicalcluster.Name(req.ClusterName)
+	defer func() { clusterMetrics.reconcileError("configmap", cluster, err) }()
+	c := r.ForCluster(cluster)
+
+	if !r.Claims.Accepted(cluster, configMapsResource) {
+		log.Info("Skipping, the permission claim for configmaps is not accepted")
+		return ctrl.Result{}, nil
+	}
 
 	// Test get
 	var configMap corev1.ConfigMap
 
-	if err := r.Get(ctx, req.NamespacedName, &configMap); err != nil {
+	if err := c.Get(ctx, req.NamespacedName, &configMap); err != nil {
 		log.Error(err, "unable to get configmap")
 		return ctrl.Result{}, nil
 	}
 
 	log.Info("Get: retrieved configMap")
+
+	if !configMap.GetDeletionTimestamp().IsZero() {
+		if err := r.finalize(ctx, c, &configMap); err != nil {
+			log.Error(err, "unable to finalize configmap")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
 	labels := configMap.Labels
 
 	if labels["name"] != "" {
@@ -73,7 +166,7 @@ func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 			labels["response"] = response
 
 			// Test Update
-			if err := r.Update(ctx, &configMap); err != nil {
+			if err := c.Update(ctx, &configMap); err != nil {
 				return ctrl.Result{}, err
 			}
 			log.Info("Update: updated configMap")
@@ -81,35 +174,13 @@ func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		}
 	}
 
-	// Test list
-	var configMapList corev1.ConfigMapList
-	if err := r.List(ctx, &configMapList); err != nil {
-		log.Error(err, "unable to list configmaps")
-		return ctrl.Result{}, nil
-	}
-	log.Info("List: got", "itemCount", len(configMapList.Items))
-	found := false
-	for _, cm := range configMapList.Items {
-		if !logicalcluster.From(&cm).Empty() {
-			log.Info("List: got", "clusterName", logicalcluster.From(&cm).String(), "namespace", cm.Namespace, "name", cm.Name)
-		} else {
-			if cm.Name == configMap.Name && cm.Namespace == configMap.Namespace {
-				if found {
-					return ctrl.Result{}, fmt.Errorf("there should be listed only one configmap with the given name '%s' for the given namespace '%s' when the clusterName is not available", cm.Name, cm.Namespace)
-				}
-				found = true
-				log.Info("Found in listed configmaps", "namespace", cm.Namespace, "name", cm.Name)
-			}
-		}
-	}
-
 	// If the configmap has a namespace field, create the corresponding namespace
 	nsName, exists := configMap.Data["namespace"]
-	if exists {
+	if exists && r.claimAccepted(ctx, &configMap, namespacesResource) {
 		var namespace corev1.Namespace
 		nsKey := types.NamespacedName{Name: nsName}
 
-		if err := r.Get(ctx, nsKey, &namespace); err != nil {
+		if err := c.Get(ctx, nsKey, &namespace); err != nil {
 			if !apierrors.IsNotFound(err) {
 				log.Error(err, "unable to get namespace")
 				return ctrl.Result{}, err
@@ -117,50 +188,390 @@ func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 
 			// Need to create ns
 			namespace.SetName(nsName)
-			if err = r.Create(ctx, &namespace); err != nil {
+			namespace.SetLabels(map[string]string{createdByLabel: createdByConfigMaps})
+			if err = c.Create(ctx, &namespace); err != nil {
 				log.Error(err, "unable to create namespace")
 				return ctrl.Result{}, err
 			}
 			log.Info("Create: created ", "namespace", nsName)
-			return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+			clusterMetrics.namespaceCreated(cluster)
+			return ctrl.Result{RequeueAfter: namespaceSettleDelay}, nil
 		}
 		log.Info("Exists", "namespace", nsName)
 	}
 
-	// If the configmap has a secretData field, create a secret in the same namespace
-	// If the secret already exists but is out of sync, it will be non-destructively patched
+	// If the configmap has a secretData field, create a secret in the same namespace, or in the namespace and with the
+	// name given by the secretTargetNamespace and secretTargetName fields.
+	// If the secret already exists but is out of sync, it will be patched according to the secret sync mode
 	secretData, exists := configMap.Data["secretData"]
+	target := secretTarget(&configMap)
+	if (exists || controllerutil.ContainsFinalizer(&configMap, secretTargetFinalizer) || configMap.Annotations[publishedSecretAnnotation] != "") &&
+		!r.claimAccepted(ctx, &configMap, secretsResource) {
+		return ctrl.Result{}, nil
+	}
 	if exists {
-		var secret corev1.Secret
-
-		secret.SetName(configMap.GetName())
-		secret.SetNamespace(configMap.GetNamespace())
-		secret.SetOwnerReferences([]metav1.OwnerReference{{
-			Name:       configMap.GetName(),
-			UID:        configMap.GetUID(),
-			APIVersion: "v1",
-			Kind:       "ConfigMap",
-			Controller: func() *bool { x := true; return &x }(),
-		}})
-		secret.Data = map[string][]byte{"dataFromCM": []byte(secretData)}
-
-		operationResult, err := controllerutil.CreateOrPatch(ctx, r, &secret, func() error {
-			secret.Data["dataFromCM"] = []byte(secretData)
-			return nil
-		})
+		crossNamespace := target.Namespace != configMap.GetNamespace()
+
+		// Owner references cannot cross namespaces, so a finalizer makes sure secrets in other namespaces are cleaned up
+		if crossNamespace && !controllerutil.ContainsFinalizer(&configMap, secretTargetFinalizer) {
+			controllerutil.AddFinalizer(&configMap, secretTargetFinalizer)
+			if err := c.Update(ctx, &configMap); err != nil {
+				return ctrl.Result{}, err
+			}
+			log.Info("Update: added finalizer", "finalizer", secretTargetFinalizer)
+			return ctrl.Result{}, nil
+		}
+
+		result, err := r.reconcileSecret(ctx, c, &configMap, target, secretData)
 		if err != nil {
 			log.Error(err, "unable to create or patch secret")
 			return ctrl.Result{}, err
 		}
-		log.Info(string(operationResult), "secret", secret.GetName())
+		if !result.IsZero() {
+			return result, nil
+		}
+	}
+
+	// Remove secrets published for a previous target, or for a secretData field that has since been removed. The
+	// configmap records the secret it was published to, so they only have to be listed when that changes.
+	var keep *types.NamespacedName
+	published := ""
+	if exists {
+		keep, published = &target, target.String()
+	}
+	removeFinalizer := (!exists || target.Namespace == configMap.GetNamespace()) && controllerutil.ContainsFinalizer(&configMap, secretTargetFinalizer)
+	if configMap.Annotations[publishedSecretAnnotation] == published && !removeFinalizer {
+		return ctrl.Result{}, nil
+	}
+	if err := deletePublishedSecrets(ctx, c, &configMap, keep); err != nil {
+		log.Error(err, "unable to delete stale secrets")
+		return ctrl.Result{}, err
 	}
 
+	if published == "" {
+		delete(configMap.Annotations, publishedSecretAnnotation)
+	} else {
+		metav1.SetMetaDataAnnotation(&configMap.ObjectMeta, publishedSecretAnnotation, published)
+	}
+	if removeFinalizer {
+		controllerutil.RemoveFinalizer(&configMap, secretTargetFinalizer)
+	}
+	if err := c.Update(ctx, &configMap); err != nil {
+		return ctrl.Result{}, err
+	}
+	log.Info("Update: recorded published secret", "secret", published, "removedFinalizer", removeFinalizer)
+
 	return ctrl.Result{}, nil
 }
 
+// reconcileSecret makes the secret at target match the desired state for the configmap, according to the configmap's
+// SecretSyncMode. Corrections to a secret that had already been brought to the desired state are reported as drift.
+func (r *ConfigMapReconciler) reconcileSecret(ctx context.Context, c client.Client, configMap *corev1.ConfigMap, target types.NamespacedName, secretData string) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	mode := r.secretSyncMode(configMap)
+	desiredData := map[string][]byte{"dataFromCM": []byte(secretData)}
+	hash := secretDataHash(desiredData)
+
+	var secret corev1.Secret
+	found := true
+	if err := c.Get(ctx, target, &secret); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		found = false
+	}
+
+	// The type of a secret is immutable, so a secret of the wrong type has to be recreated
+	if mode == SecretSyncModeStrict && found && secret.Type != corev1.SecretTypeOpaque {
+		if uid := secret.Labels[sourceUIDLabel]; uid != string(configMap.GetUID()) {
+			return ctrl.Result{}, fmt.Errorf("secret %s/%s of type %s is not published by this configmap", secret.GetNamespace(), secret.GetName(), secret.Type)
+		}
+		if err := c.Delete(ctx, &secret); err != nil && !apierrors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		clusterMetrics.secretManaged(logicalcluster.From(configMap), "deleted")
+		r.recordSecretDrift(configMap, &secret, mode)
+		log.Info("Delete: deleted secret of wrong type", "secret", secret.GetName(), "namespace", secret.GetNamespace(), "type", secret.Type)
+		return ctrl.Result{Requeue: true}, nil
+	}
+
+	secret = corev1.Secret{}
+	secret.SetName(target.Name)
+	secret.SetNamespace(target.Namespace)
+
+	drifted := false
+	operationResult, err := controllerutil.CreateOrPatch(ctx, c, &secret, func() error {
+		if uid, ok := secret.Labels[sourceUIDLabel]; ok && uid != string(configMap.GetUID()) {
+			return fmt.Errorf("secret %s/%s is already published by another configmap", secret.GetNamespace(), secret.GetName())
+		} else if !ok && secret.GetResourceVersion() != "" &&
+			(target.Namespace != configMap.GetNamespace() || !metav1.IsControlledBy(&secret, configMap)) {
+			// Only the secrets published into the configmap's own namespace before they were labelled are taken over,
+			// anything else would let a configmap overwrite and then delete any secret of the logical cluster
+			return fmt.Errorf("secret %s/%s already exists and is not published by this configmap", secret.GetNamespace(), secret.GetName())
+		}
+		// Only a secret that was already written with the current desired data can have drifted; otherwise the
+		// change comes from the configmap
+		if secret.Annotations[secretDataHashAnnotation] == hash {
+			drifted = secretDrifted(&secret, configMap, desiredData, mode)
+		}
+
+		if mode == SecretSyncModeStrict {
+			secret.SetLabels(nil)
+			secret.Data = map[string][]byte{}
+		}
+		setSecretSource(&secret, configMap)
+		secret.Annotations[secretDataHashAnnotation] = hash
+		if target.Namespace == configMap.GetNamespace() {
+			secret.SetOwnerReferences([]metav1.OwnerReference{{
+				Name:       configMap.GetName(),
+				UID:        configMap.GetUID(),
+				APIVersion: "v1",
+				Kind:       "ConfigMap",
+				Controller: func() *bool { x := true; return &x }(),
+			}})
+		}
+		if secret.Type == "" {
+			secret.Type = corev1.SecretTypeOpaque
+		}
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		for k, v := range desiredData {
+			secret.Data[k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	log.Info(string(operationResult), "secret", secret.GetName(), "namespace", secret.GetNamespace(), "mode", mode)
+	if operationResult != controllerutil.OperationResultNone {
+		clusterMetrics.secretManaged(logicalcluster.From(configMap), string(operationResult))
+	}
+
+	if drifted && operationResult == controllerutil.OperationResultUpdated {
+		r.recordSecretDrift(configMap, &secret, mode)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// secretSyncMode returns the SecretSyncMode for the configmap, which may override the reconciler's default.
+func (r *ConfigMapReconciler) secretSyncMode(configMap *corev1.ConfigMap) SecretSyncMode {
+	switch mode := SecretSyncMode(configMap.Data[secretSyncModeKey]); mode {
+	case SecretSyncModeStrict, SecretSyncModeLenient:
+		return mode
+	}
+	if r.SecretSyncMode == "" {
+		return SecretSyncModeLenient
+	}
+	return r.SecretSyncMode
+}
+
+// claimAccepted returns whether the APIBinding of the configmap's logical cluster accepts the permission claim on the
+// resource, and emits a PermissionClaimNotAccepted event on the configmap otherwise.
+func (r *ConfigMapReconciler) claimAccepted(ctx context.Context, configMap *corev1.ConfigMap, resource schema.GroupResource) bool {
+	if r.Claims.Accepted(logicalcluster.From(configMap), resource) {
+		return true
+	}
+	log.FromContext(ctx).Info("Skipping, the permission claim is not accepted", "resource", resource.String())
+	r.Recorder.Eventf(configMap, corev1.EventTypeWarning, "PermissionClaimNotAccepted",
+		"Not managing %s for the configmap, the APIBinding of the workspace does not accept the permission claim for them", resource.String())
+	return false
+}
+
+func (r *ConfigMapReconciler) recordSecretDrift(configMap *corev1.ConfigMap, secret *corev1.Secret, mode SecretSyncMode) {
+	secretDriftTotal.WithLabelValues(string(mode)).Inc()
+	r.Recorder.Eventf(configMap, corev1.EventTypeWarning, "SecretDrift", "Corrected drift of secret %s/%s (mode %s)", secret.GetNamespace(), secret.GetName(), mode)
+}
+
+// secretDrifted reports whether the parts of the secret managed in the given mode differ from the desired state.
+func secretDrifted(secret *corev1.Secret, configMap *corev1.ConfigMap, desiredData map[string][]byte, mode SecretSyncMode) bool {
+	if secret.Labels[sourceUIDLabel] != string(configMap.GetUID()) {
+		return true
+	}
+	if mode == SecretSyncModeStrict {
+		return len(secret.Labels) != 1 || !reflect.DeepEqual(secret.Data, desiredData)
+	}
+	for k, v := range desiredData {
+		if !bytes.Equal(secret.Data[k], v) {
+			return true
+		}
+	}
+	return false
+}
+
+// secretDataHash returns a stable hash of the desired secret data.
+func secretDataHash(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%x;", k, data[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// finalize deletes every secret published for the configmap and then releases the configmap for deletion.
+func (r *ConfigMapReconciler) finalize(ctx context.Context, c client.Client, configMap *corev1.ConfigMap) error {
+	if !controllerutil.ContainsFinalizer(configMap, secretTargetFinalizer) {
+		return nil
+	}
+	// The secrets cannot be deleted until the claim is accepted, or the APIBinding is deleted, which releases the
+	// configmap
+	if !r.claimAccepted(ctx, configMap, secretsResource) {
+		return nil
+	}
+	if err := deletePublishedSecrets(ctx, c, configMap, nil); err != nil {
+		return err
+	}
+	controllerutil.RemoveFinalizer(configMap, secretTargetFinalizer)
+	return c.Update(ctx, configMap)
+}
+
+// deletePublishedSecrets deletes the secrets in the configmap's logical cluster that were published for it, except for
+// the one identified by keep, if any.
+func deletePublishedSecrets(ctx context.Context, c client.Client, configMap *corev1.ConfigMap, keep *types.NamespacedName) error {
+	log := log.FromContext(ctx)
+
+	var secrets corev1.SecretList
+	if err := c.List(ctx, &secrets, client.MatchingLabels{sourceUIDLabel: string(configMap.GetUID())}); err != nil {
+		return err
+	}
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		if keep != nil && client.ObjectKeyFromObject(secret) == *keep {
+			continue
+		}
+		if err := c.Delete(ctx, secret); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		log.Info("Delete: deleted stale", "secret", secret.GetName(), "namespace", secret.GetNamespace())
+		clusterMetrics.secretManaged(logicalcluster.From(configMap), "deleted")
+	}
+	return nil
+}
+
+// secretTarget returns where the secret for the configmap is published. It defaults to the configmap's own namespace
+// and name.
+func secretTarget(configMap *corev1.ConfigMap) types.NamespacedName {
+	target := types.NamespacedName{Namespace: configMap.GetNamespace(), Name: configMap.GetName()}
+	if ns := configMap.Data[secretTargetNamespaceKey]; ns != "" {
+		target.Namespace = ns
+	}
+	if name := configMap.Data[secretTargetNameKey]; name != "" {
+		target.Name = name
+	}
+	return target
+}
+
+// setSecretSource records which configmap the secret was published for, so that it can be found and cleaned up
+// without owner references.
+func setSecretSource(secret *corev1.Secret, configMap *corev1.ConfigMap) {
+	labels := secret.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[sourceUIDLabel] = string(configMap.GetUID())
+	secret.SetLabels(labels)
+
+	annotations := secret.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[sourceNamespaceAnnotation] = configMap.GetNamespace()
+	annotations[sourceNameAnnotation] = configMap.GetName()
+	secret.SetAnnotations(annotations)
+}
+
+// secretToSourceConfigMap maps a published secret back to the configmap it was published for.
+func secretToSourceConfigMap(obj client.Object) []reconcile.Request {
+	annotations := obj.GetAnnotations()
+	namespace, name := annotations[sourceNamespaceAnnotation], annotations[sourceNameAnnotation]
+	if namespace == "" || name == "" {
+		return nil
+	}
+	return []reconcile.Request{{
+		NamespacedName: types.NamespacedName{Namespace: namespace, Name: name},
+		ClusterName:    logicalcluster.From(obj).String(),
+	}}
+}
+
 func (r *ConfigMapReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.ConfigMap{}).
-		Owns(&corev1.Secret{}).
-		Complete(r)
+	name := r.Drainer.ControllerName("configmap")
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named(name).
+		For(&corev1.ConfigMap{}, builder.WithPredicates(r.Sharder.Predicate())).
+		Owns(&corev1.Secret{}, builder.WithPredicates(r.Sharder.Predicate())).
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			handler.EnqueueRequestsFromMapFunc(secretToSourceConfigMap),
+			builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+				_, ok := obj.GetLabels()[sourceUIDLabel]
+				return ok
+			}), r.Sharder.Predicate()),
+		)
+	if resync := r.Sharder.Resync(); resync != nil {
+		// The logical clusters this replica gained from a change of membership have to be caught up with
+		b = b.Watches(resync, handler.EnqueueRequestsFromMapFunc(r.ownedConfigMaps))
+	}
+	if resync := r.Claims.Resync(); resync != nil {
+		// The configmaps skipped for a missing permission claim have to be caught up with once it is accepted
+		b = b.Watches(resync, handler.EnqueueRequestsFromMapFunc(r.clusterConfigMaps))
+	}
+	return b.Complete(r.Drainer.Wrap(name, r))
+}
+
+// ownedConfigMaps maps a change of the shard membership to all configmaps in the logical clusters owned by this
+// replica.
+func (r *ConfigMapReconciler) ownedConfigMaps(client.Object) []reconcile.Request {
+	ctx := context.Background()
+
+	var list corev1.ConfigMapList
+	if err := r.List(ctx, &list); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list configmaps across all workspaces")
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for i := range list.Items {
+		cluster := logicalcluster.From(&list.Items[i])
+		if !r.Sharder.Owns(cluster) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{
+			NamespacedName: client.ObjectKeyFromObject(&list.Items[i]),
+			ClusterName:    cluster.String(),
+		})
+	}
+	return requests
+}
+
+// clusterConfigMaps maps an event in a logical cluster to all configmaps in it, if it is owned by this replica.
+func (r *ConfigMapReconciler) clusterConfigMaps(obj client.Object) []reconcile.Request {
+	ctx := context.Background()
+	cluster := logicalcluster.From(obj)
+	if !r.Sharder.Owns(cluster) {
+		return nil
+	}
+
+	var list corev1.ConfigMapList
+	if err := r.ForCluster(cluster).List(ctx, &list); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list configmaps", "cluster", cluster)
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(list.Items))
+	for i := range list.Items {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: client.ObjectKeyFromObject(&list.Items[i]),
+			ClusterName:    cluster.String(),
+		})
+	}
+	return requests
 }
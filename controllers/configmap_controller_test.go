@@ -0,0 +1,164 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	timeout  = time.Second * 10
+	interval = time.Millisecond * 250
+)
+
+// createNamespace creates a namespace with a generated name for a single spec.
+func createNamespace(ctx context.Context) string {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "test-"}}
+	Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+	return namespace.Name
+}
+
+var _ = Describe("ConfigMap controller", func() {
+	var (
+		ctx       context.Context
+		namespace string
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		namespace = createNamespace(ctx)
+	})
+
+	It("sets a response label for the name label", func() {
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "greeting", Labels: map[string]string{"name": "timothy"}},
+		}
+		Expect(k8sClient.Create(ctx, configMap)).To(Succeed())
+
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, client.ObjectKeyFromObject(configMap), configMap); err != nil {
+				return ""
+			}
+			return configMap.Labels["response"]
+		}, timeout, interval).Should(Equal("hello-timothy"))
+
+		By("updating the name label")
+		configMap.Labels["name"] = "tom"
+		Expect(k8sClient.Update(ctx, configMap)).To(Succeed())
+
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, client.ObjectKeyFromObject(configMap), configMap); err != nil {
+				return ""
+			}
+			return configMap.Labels["response"]
+		}, timeout, interval).Should(Equal("hello-tom"))
+	})
+
+	It("creates the namespace in its data", func() {
+		nsName := namespace + "-created"
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "namespace"},
+			Data:       map[string]string{"namespace": nsName},
+		}
+		Expect(k8sClient.Create(ctx, configMap)).To(Succeed())
+
+		Eventually(func() error {
+			return k8sClient.Get(ctx, client.ObjectKey{Name: nsName}, &corev1.Namespace{})
+		}, timeout, interval).Should(Succeed())
+	})
+
+	It("publishes its secret data into an owned secret", func() {
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "secret"},
+			Data:       map[string]string{"secretData": "first"},
+		}
+		Expect(k8sClient.Create(ctx, configMap)).To(Succeed())
+
+		secret := &corev1.Secret{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, client.ObjectKeyFromObject(configMap), secret); err != nil {
+				return ""
+			}
+			return string(secret.Data["dataFromCM"])
+		}, timeout, interval).Should(Equal("first"))
+
+		Expect(secret.OwnerReferences).To(HaveLen(1))
+		Expect(secret.OwnerReferences[0].Kind).To(Equal("ConfigMap"))
+		Expect(secret.OwnerReferences[0].Name).To(Equal(configMap.Name))
+		Expect(secret.OwnerReferences[0].UID).To(Equal(configMap.UID))
+		Expect(secret.OwnerReferences[0].Controller).To(HaveValue(BeTrue()))
+
+		By("adding a key to the secret")
+		secret.Data["extra"] = []byte("kept")
+		Expect(k8sClient.Update(ctx, secret)).To(Succeed())
+
+		By("updating the secret data")
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(configMap), configMap)).To(Succeed())
+		configMap.Data["secretData"] = "second"
+		Expect(k8sClient.Update(ctx, configMap)).To(Succeed())
+
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, client.ObjectKeyFromObject(configMap), secret); err != nil {
+				return ""
+			}
+			return string(secret.Data["dataFromCM"])
+		}, timeout, interval).Should(Equal("second"))
+		Expect(string(secret.Data["extra"])).To(Equal("kept"))
+	})
+
+	It("publishes its secret data into another namespace and cleans it up", func() {
+		targetNamespace := createNamespace(ctx)
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "target"},
+			Data: map[string]string{
+				"secretData":            "data",
+				"secretTargetNamespace": targetNamespace,
+				"secretTargetName":      "published",
+			},
+		}
+		Expect(k8sClient.Create(ctx, configMap)).To(Succeed())
+
+		secretKey := client.ObjectKey{Namespace: targetNamespace, Name: "published"}
+		secret := &corev1.Secret{}
+		Eventually(func() string {
+			if err := k8sClient.Get(ctx, secretKey, secret); err != nil {
+				return ""
+			}
+			return string(secret.Data["dataFromCM"])
+		}, timeout, interval).Should(Equal("data"))
+		Expect(secret.OwnerReferences).To(BeEmpty())
+		Expect(secret.Labels).To(HaveKeyWithValue(sourceUIDLabel, string(configMap.UID)))
+
+		By("deleting the configmap")
+		Expect(k8sClient.Delete(ctx, configMap)).To(Succeed())
+
+		Eventually(func() bool {
+			return apierrors.IsNotFound(k8sClient.Get(ctx, secretKey, secret))
+		}, timeout, interval).Should(BeTrue())
+		Eventually(func() bool {
+			return apierrors.IsNotFound(k8sClient.Get(ctx, client.ObjectKeyFromObject(configMap), configMap))
+		}, timeout, interval).Should(BeTrue())
+	})
+})
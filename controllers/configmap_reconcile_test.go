@@ -0,0 +1,531 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+const (
+	clusterA = logicalcluster.Name("cluster-a")
+	clusterB = logicalcluster.Name("cluster-b")
+)
+
+var now = time.Date(2022, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := datav1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := apisv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+func configMap(name string, labels map[string]string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name + "-uid"), Labels: labels},
+		Data:       data,
+	}
+}
+
+func namespace(name string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+// publishedSecret returns the secret the configmap publishes at target with the given data, as the reconciler writes it.
+func publishedSecret(cm *corev1.ConfigMap, target types.NamespacedName, data string) *corev1.Secret {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: target.Namespace, Name: target.Name},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       map[string][]byte{"dataFromCM": []byte(data)},
+	}
+	setSecretSource(secret, cm)
+	secret.Annotations[secretDataHashAnnotation] = secretDataHash(secret.Data)
+	return secret
+}
+
+// foreignSecret returns a secret at target that the reconciler did not publish.
+func foreignSecret(target types.NamespacedName) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: target.Namespace, Name: target.Name, Labels: map[string]string{"app": "mine"}},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       map[string][]byte{"dataFromCM": []byte("mine"), "password": []byte("hunter2")},
+	}
+}
+
+// expectForeignSecret fails unless the secret returned by foreignSecret is untouched.
+func expectForeignSecret(t *testing.T, c client.Client, target types.NamespacedName) {
+	t.Helper()
+	secret := expectSecretData(t, c, target, "mine")
+	if string(secret.Data["password"]) != "hunter2" || len(secret.Labels) != 1 || secret.Labels["app"] != "mine" {
+		t.Errorf("expected secret %s to be left alone, got labels %v and data %v", target, secret.Labels, secret.Data)
+	}
+}
+
+func TestConfigMapReconcile(t *testing.T) {
+	withFinalizer := func(cm *corev1.ConfigMap) *corev1.ConfigMap {
+		cm.Finalizers = []string{secretTargetFinalizer}
+		return cm
+	}
+	deleted := func(cm *corev1.ConfigMap) *corev1.ConfigMap {
+		cm.DeletionTimestamp = &metav1.Time{Time: now}
+		return cm
+	}
+
+	crossNamespace := map[string]string{"secretData": "data", secretTargetNamespaceKey: "other", secretTargetNameKey: "published"}
+	crossNamespaceTarget := types.NamespacedName{Namespace: "other", Name: "published"}
+	sameNamespaceTarget := types.NamespacedName{Namespace: "default", Name: "cm"}
+
+	tests := []struct {
+		name    string
+		mode    SecretSyncMode
+		objects []client.Object
+		// others are the objects of another logical cluster, which must never be touched.
+		others []client.Object
+		// missingClaims are the resources whose permission claim is not accepted in the logical cluster.
+		missingClaims []string
+		request       string
+		wantResult    ctrl.Result
+		wantErr       string
+		wantEvents    []string
+		check         func(t *testing.T, c client.Client)
+	}{
+		{
+			name:    "configmap not found",
+			request: "missing",
+		},
+		{
+			name:    "sets the response label",
+			objects: []client.Object{configMap("cm", map[string]string{"name": "timothy"}, nil)},
+			check: func(t *testing.T, c client.Client) {
+				cm := getConfigMap(t, c, "cm")
+				if got := cm.Labels["response"]; got != "hello-timothy" {
+					t.Errorf("expected response label hello-timothy, got %q", got)
+				}
+			},
+		},
+		{
+			name: "response label already set",
+			objects: []client.Object{
+				configMap("cm", map[string]string{"name": "timothy", "response": "hello-timothy"}, map[string]string{"namespace": "created"}),
+			},
+			others:     []client.Object{configMap("cm", map[string]string{"name": "timothy"}, nil)},
+			wantResult: ctrl.Result{RequeueAfter: namespaceSettleDelay},
+		},
+		{
+			name:       "creates the namespace",
+			objects:    []client.Object{configMap("cm", nil, map[string]string{"namespace": "created"})},
+			wantResult: ctrl.Result{RequeueAfter: namespaceSettleDelay},
+			check: func(t *testing.T, c client.Client) {
+				var ns corev1.Namespace
+				if err := c.Get(context.Background(), client.ObjectKey{Name: "created"}, &ns); err != nil {
+					t.Errorf("expected namespace to be created: %v", err)
+				}
+				if _, ok := ns.Labels[createdByLabel]; !ok {
+					t.Errorf("expected namespace to be labelled as created by the controller, got %v", ns.Labels)
+				}
+			},
+		},
+		{
+			name:    "publishes the secret into the same namespace",
+			objects: []client.Object{configMap("cm", nil, map[string]string{"secretData": "data"})},
+			others:  []client.Object{configMap("cm", nil, map[string]string{"secretData": "other"})},
+			check: func(t *testing.T, c client.Client) {
+				secret := expectSecretData(t, c, sameNamespaceTarget, "data")
+				if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].UID != "cm-uid" {
+					t.Errorf("expected the configmap to own the secret, got %v", secret.OwnerReferences)
+				}
+				if secret.Labels[sourceUIDLabel] != "cm-uid" {
+					t.Errorf("expected source label cm-uid, got %q", secret.Labels[sourceUIDLabel])
+				}
+			},
+		},
+		{
+			name: "patches the secret when the secret data changes",
+			objects: []client.Object{
+				configMap("cm", nil, map[string]string{"secretData": "new"}),
+				publishedSecret(configMap("cm", nil, nil), sameNamespaceTarget, "old"),
+			},
+			check: func(t *testing.T, c client.Client) {
+				expectSecretData(t, c, sameNamespaceTarget, "new")
+			},
+		},
+		{
+			name:    "adds a finalizer before publishing into another namespace",
+			objects: []client.Object{configMap("cm", nil, crossNamespace)},
+			check: func(t *testing.T, c client.Client) {
+				if cm := getConfigMap(t, c, "cm"); !containsString(cm.Finalizers, secretTargetFinalizer) {
+					t.Errorf("expected finalizer %s, got %v", secretTargetFinalizer, cm.Finalizers)
+				}
+				expectNoSecret(t, c, crossNamespaceTarget)
+			},
+		},
+		{
+			name:    "publishes the secret into another namespace",
+			objects: []client.Object{withFinalizer(configMap("cm", nil, crossNamespace))},
+			check: func(t *testing.T, c client.Client) {
+				secret := expectSecretData(t, c, crossNamespaceTarget, "data")
+				if len(secret.OwnerReferences) != 0 {
+					t.Errorf("expected no owner references across namespaces, got %v", secret.OwnerReferences)
+				}
+			},
+		},
+		{
+			name: "deletes the secret of a previous target",
+			objects: []client.Object{
+				configMap("cm", nil, map[string]string{"secretData": "data"}),
+				publishedSecret(configMap("cm", nil, nil), crossNamespaceTarget, "data"),
+			},
+			check: func(t *testing.T, c client.Client) {
+				expectSecretData(t, c, sameNamespaceTarget, "data")
+				expectNoSecret(t, c, crossNamespaceTarget)
+			},
+		},
+		{
+			name: "cleans up when the secret data is removed",
+			objects: []client.Object{
+				withFinalizer(configMap("cm", nil, nil)),
+				publishedSecret(configMap("cm", nil, nil), crossNamespaceTarget, "data"),
+			},
+			check: func(t *testing.T, c client.Client) {
+				expectNoSecret(t, c, crossNamespaceTarget)
+				if cm := getConfigMap(t, c, "cm"); len(cm.Finalizers) != 0 {
+					t.Errorf("expected finalizer to be removed, got %v", cm.Finalizers)
+				}
+			},
+		},
+		{
+			name: "finalizes a deleted configmap",
+			objects: []client.Object{
+				deleted(withFinalizer(configMap("cm", nil, crossNamespace))),
+				publishedSecret(configMap("cm", nil, nil), crossNamespaceTarget, "data"),
+			},
+			others: []client.Object{publishedSecret(configMap("cm", nil, nil), crossNamespaceTarget, "data")},
+			check: func(t *testing.T, c client.Client) {
+				expectNoSecret(t, c, crossNamespaceTarget)
+				if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "cm"}, &corev1.ConfigMap{}); !apierrors.IsNotFound(err) {
+					t.Errorf("expected configmap to be gone, got %v", err)
+				}
+			},
+		},
+		{
+			name: "refuses a secret published by another configmap",
+			objects: []client.Object{
+				configMap("cm", nil, map[string]string{"secretData": "data"}),
+				publishedSecret(configMap("other", nil, nil), sameNamespaceTarget, "data"),
+			},
+			wantErr: "already published by another configmap",
+		},
+		{
+			name: "refuses an existing secret in another namespace",
+			objects: []client.Object{
+				withFinalizer(configMap("cm", nil, crossNamespace)),
+				foreignSecret(crossNamespaceTarget),
+			},
+			wantErr: "already exists and is not published by this configmap",
+			check: func(t *testing.T, c client.Client) {
+				expectForeignSecret(t, c, crossNamespaceTarget)
+			},
+		},
+		{
+			name: "refuses an existing secret of its namespace that it does not own",
+			mode: SecretSyncModeStrict,
+			objects: []client.Object{
+				configMap("cm", nil, map[string]string{"secretData": "data"}),
+				foreignSecret(sameNamespaceTarget),
+			},
+			wantErr: "already exists and is not published by this configmap",
+			check: func(t *testing.T, c client.Client) {
+				expectForeignSecret(t, c, sameNamespaceTarget)
+			},
+		},
+		{
+			name: "takes over a secret it owns that was published before secrets were labelled",
+			objects: []client.Object{
+				configMap("cm", nil, map[string]string{"secretData": "data"}),
+				func() client.Object {
+					secret := foreignSecret(sameNamespaceTarget)
+					controller := true
+					secret.OwnerReferences = []metav1.OwnerReference{{APIVersion: "v1", Kind: "ConfigMap", Name: "cm", UID: "cm-uid", Controller: &controller}}
+					return secret
+				}(),
+			},
+			check: func(t *testing.T, c client.Client) {
+				expectPublished(t, c, sameNamespaceTarget, "data")
+			},
+		},
+		{
+			name: "corrects drift in lenient mode",
+			objects: []client.Object{
+				configMap("cm", nil, map[string]string{"secretData": "data"}),
+				func() client.Object {
+					secret := publishedSecret(configMap("cm", nil, nil), sameNamespaceTarget, "data")
+					secret.Data["dataFromCM"] = []byte("tampered")
+					secret.Data["extra"] = []byte("kept")
+					return secret
+				}(),
+			},
+			wantEvents: []string{"Warning SecretDrift"},
+			check: func(t *testing.T, c client.Client) {
+				secret := expectSecretData(t, c, sameNamespaceTarget, "data")
+				if string(secret.Data["extra"]) != "kept" {
+					t.Errorf("expected extra key to be kept in lenient mode, got %v", secret.Data)
+				}
+			},
+		},
+		{
+			name: "corrects drift in strict mode",
+			mode: SecretSyncModeStrict,
+			objects: []client.Object{
+				configMap("cm", nil, map[string]string{"secretData": "data"}),
+				func() client.Object {
+					secret := publishedSecret(configMap("cm", nil, nil), sameNamespaceTarget, "data")
+					secret.Data["extra"] = []byte("removed")
+					return secret
+				}(),
+			},
+			wantEvents: []string{"Warning SecretDrift"},
+			check: func(t *testing.T, c client.Client) {
+				secret := expectSecretData(t, c, sameNamespaceTarget, "data")
+				if _, ok := secret.Data["extra"]; ok {
+					t.Errorf("expected extra key to be removed in strict mode, got %v", secret.Data)
+				}
+			},
+		},
+		{
+			name: "recreates a secret of the wrong type in strict mode",
+			objects: []client.Object{
+				configMap("cm", nil, map[string]string{"secretData": "data", secretSyncModeKey: string(SecretSyncModeStrict)}),
+				func() client.Object {
+					secret := publishedSecret(configMap("cm", nil, nil), sameNamespaceTarget, "data")
+					secret.Type = corev1.SecretTypeDockerConfigJson
+					return secret
+				}(),
+			},
+			wantResult: ctrl.Result{Requeue: true},
+			wantEvents: []string{"Warning SecretDrift"},
+			check: func(t *testing.T, c client.Client) {
+				expectNoSecret(t, c, sameNamespaceTarget)
+			},
+		},
+		{
+			name:          "skips configmaps without the claim for configmaps",
+			objects:       []client.Object{configMap("cm", map[string]string{"name": "timothy"}, nil)},
+			missingClaims: []string{"configmaps"},
+			check: func(t *testing.T, c client.Client) {
+				if cm := getConfigMap(t, c, "cm"); cm.Labels["response"] != "" {
+					t.Errorf("expected no response label, got %q", cm.Labels["response"])
+				}
+			},
+		},
+		{
+			name:          "skips the namespace without the claim for namespaces",
+			objects:       []client.Object{configMap("cm", nil, map[string]string{"namespace": "created", "secretData": "data"})},
+			missingClaims: []string{"namespaces"},
+			wantEvents:    []string{"Warning PermissionClaimNotAccepted"},
+			check: func(t *testing.T, c client.Client) {
+				if err := c.Get(context.Background(), types.NamespacedName{Name: "created"}, &corev1.Namespace{}); !apierrors.IsNotFound(err) {
+					t.Errorf("expected no namespace to be created, got %v", err)
+				}
+				expectSecretData(t, c, sameNamespaceTarget, "data")
+			},
+		},
+		{
+			name:          "skips the secret without the claim for secrets",
+			objects:       []client.Object{configMap("cm", nil, map[string]string{"secretData": "data"})},
+			missingClaims: []string{"secrets"},
+			wantEvents:    []string{"Warning PermissionClaimNotAccepted"},
+			check: func(t *testing.T, c client.Client) {
+				expectNoSecret(t, c, sameNamespaceTarget)
+			},
+		},
+		{
+			name:          "keeps the finalizer without the claim for secrets",
+			objects:       []client.Object{deleted(withFinalizer(configMap("cm", nil, crossNamespace)))},
+			missingClaims: []string{"secrets"},
+			wantEvents:    []string{"Warning PermissionClaimNotAccepted"},
+			check: func(t *testing.T, c client.Client) {
+				if cm := getConfigMap(t, c, "cm"); !containsString(cm.Finalizers, secretTargetFinalizer) {
+					t.Errorf("expected the finalizer to be kept, got %v", cm.Finalizers)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clusters := fake.NewClusterClient(newTestScheme(t)).
+				WithObjects(clusterA, tt.objects...).
+				WithObjects(clusterB, tt.others...)
+			before := listAll(t, clusters.ForCluster(clusterB))
+
+			claims := NewClaimTracker()
+			var missing []apisv1alpha1.PermissionClaim
+			for _, resource := range tt.missingClaims {
+				missing = append(missing, claim(resource))
+			}
+			claims.set(clusterA, missing)
+
+			recorder := record.NewFakeRecorder(10)
+			r := &ConfigMapReconciler{
+				ClusterClient:  clusters,
+				Recorder:       recorder,
+				SecretSyncMode: tt.mode,
+				Claims:         claims,
+			}
+
+			request := tt.request
+			if request == "" {
+				request = "cm"
+			}
+			result, err := r.Reconcile(context.Background(), ctrl.Request{
+				NamespacedName: types.NamespacedName{Namespace: "default", Name: request},
+				ClusterName:    clusterA.String(),
+			})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+			if result != tt.wantResult {
+				t.Errorf("expected result %+v, got %+v", tt.wantResult, result)
+			}
+
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			if len(events) != len(tt.wantEvents) {
+				t.Errorf("expected events %v, got %v", tt.wantEvents, events)
+			}
+			for i := range tt.wantEvents {
+				if i < len(events) && !strings.HasPrefix(events[i], tt.wantEvents[i]) {
+					t.Errorf("expected event %q, got %q", tt.wantEvents[i], events[i])
+				}
+			}
+
+			if tt.check != nil {
+				tt.check(t, clusters.ForCluster(clusterA))
+			}
+			if after := listAll(t, clusters.ForCluster(clusterB)); after != before {
+				t.Errorf("expected %s to be untouched, got resource versions %s, want %s", clusterB, after, before)
+			}
+		})
+	}
+}
+
+func getConfigMap(t *testing.T, c client.Client, name string) *corev1.ConfigMap {
+	t.Helper()
+	var cm corev1.ConfigMap
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: name}, &cm); err != nil {
+		t.Fatalf("failed to get configmap %s: %v", name, err)
+	}
+	return &cm
+}
+
+func expectSecretData(t *testing.T, c client.Client, key types.NamespacedName, data string) *corev1.Secret {
+	t.Helper()
+	var secret corev1.Secret
+	if err := c.Get(context.Background(), key, &secret); err != nil {
+		t.Fatalf("failed to get secret %s: %v", key, err)
+	}
+	if got := string(secret.Data["dataFromCM"]); got != data {
+		t.Errorf("expected secret %s to have data %q, got %q", key, data, got)
+	}
+	return &secret
+}
+
+// expectPublished fails unless the secret at key holds data and is published for the configmap cm of the default
+// namespace.
+func expectPublished(t *testing.T, c client.Client, key types.NamespacedName, data string) *corev1.Secret {
+	t.Helper()
+	secret := expectSecretData(t, c, key, data)
+	if secret.Labels[sourceUIDLabel] != "cm-uid" || secret.Annotations[sourceNamespaceAnnotation] != "default" || secret.Annotations[sourceNameAnnotation] != "cm" {
+		t.Errorf("expected secret %s to record its source, got labels %v and annotations %v", key, secret.Labels, secret.Annotations)
+	}
+	return secret
+}
+
+func expectNoSecret(t *testing.T, c client.Client, key types.NamespacedName) {
+	t.Helper()
+	if err := c.Get(context.Background(), key, &corev1.Secret{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected secret %s not to exist, got %v", key, err)
+	}
+}
+
+// listAll returns the names and resource versions of the configmaps, secrets and namespaces in the logical cluster.
+func listAll(t *testing.T, c client.Client) string {
+	t.Helper()
+	var versions []string
+	for _, list := range []client.ObjectList{&corev1.ConfigMapList{}, &corev1.SecretList{}, &corev1.NamespaceList{}} {
+		if err := c.List(context.Background(), list); err != nil {
+			t.Fatal(err)
+		}
+		switch list := list.(type) {
+		case *corev1.ConfigMapList:
+			for _, item := range list.Items {
+				versions = append(versions, "configmap/"+item.Name+"@"+item.ResourceVersion)
+			}
+		case *corev1.SecretList:
+			for _, item := range list.Items {
+				versions = append(versions, "secret/"+item.Namespace+"/"+item.Name+"@"+item.ResourceVersion)
+			}
+		case *corev1.NamespaceList:
+			for _, item := range list.Items {
+				versions = append(versions, "namespace/"+item.Name+"@"+item.ResourceVersion)
+			}
+		}
+	}
+	return strings.Join(versions, ",")
+}
+
+func containsString(s []string, v string) bool {
+	for _, item := range s {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
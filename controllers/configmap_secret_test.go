@@ -0,0 +1,360 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+// reconcileSource reconciles the source configmap until it settles, and returns it, or nil once it is gone.
+func reconcileSource(t *testing.T, r *ConfigMapReconciler) *corev1.ConfigMap {
+	t.Helper()
+	key := types.NamespacedName{Namespace: "default", Name: "cm"}
+	for i := 0; i < 3; i++ {
+		result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key, ClusterName: clusterA.String()})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !result.IsZero() {
+			t.Fatalf("expected empty result, got %+v", result)
+		}
+	}
+	var cm corev1.ConfigMap
+	if err := r.ForCluster(clusterA).Get(context.Background(), key, &cm); apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return &cm
+}
+
+func TestConfigMapSecretRetarget(t *testing.T) {
+	cm := configMap("cm", nil, map[string]string{"secretData": "s3cr3t", secretTargetNamespaceKey: "other"})
+	clusters := fake.NewClusterClient(newTestScheme(t)).WithObjects(clusterA, cm)
+	c := clusters.ForCluster(clusterA)
+	r := &ConfigMapReconciler{ClusterClient: clusters}
+
+	cm = reconcileSource(t, r)
+	if !controllerutil.ContainsFinalizer(cm, secretTargetFinalizer) {
+		t.Errorf("expected the finalizer on a configmap publishing into another namespace, got %v", cm.Finalizers)
+	}
+	secret := expectPublished(t, c, types.NamespacedName{Namespace: "other", Name: "cm"}, "s3cr3t")
+	if len(secret.OwnerReferences) != 0 {
+		t.Errorf("expected no owner reference across namespaces, got %v", secret.OwnerReferences)
+	}
+
+	// Retargeting publishes the secret in the new place and deletes the old one
+	cm.Data[secretTargetNamespaceKey] = "third"
+	cm.Data[secretTargetNameKey] = "renamed"
+	if err := c.Update(context.Background(), cm); err != nil {
+		t.Fatal(err)
+	}
+	reconcileSource(t, r)
+	expectPublished(t, c, types.NamespacedName{Namespace: "third", Name: "renamed"}, "s3cr3t")
+	expectNoSecret(t, c, types.NamespacedName{Namespace: "other", Name: "cm"})
+
+	// Back in its own namespace, the secret is owned by the configmap and the finalizer is no longer needed
+	cm = reconcileSource(t, r)
+	delete(cm.Data, secretTargetNamespaceKey)
+	delete(cm.Data, secretTargetNameKey)
+	if err := c.Update(context.Background(), cm); err != nil {
+		t.Fatal(err)
+	}
+	cm = reconcileSource(t, r)
+	secret = expectPublished(t, c, types.NamespacedName{Namespace: "default", Name: "cm"}, "s3cr3t")
+	if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].UID != cm.UID {
+		t.Errorf("expected the configmap to own the secret, got %v", secret.OwnerReferences)
+	}
+	expectNoSecret(t, c, types.NamespacedName{Namespace: "third", Name: "renamed"})
+	if controllerutil.ContainsFinalizer(cm, secretTargetFinalizer) {
+		t.Errorf("expected the finalizer to be removed, got %v", cm.Finalizers)
+	}
+
+	// Removing secretData deletes the secret
+	delete(cm.Data, "secretData")
+	if err := c.Update(context.Background(), cm); err != nil {
+		t.Fatal(err)
+	}
+	reconcileSource(t, r)
+	expectNoSecret(t, c, types.NamespacedName{Namespace: "default", Name: "cm"})
+}
+
+// secretListCounter counts the secret lists of the clients it returns.
+type secretListCounter struct {
+	ClusterClient
+	lists int
+}
+
+func (c *secretListCounter) ForCluster(cluster logicalcluster.Name) client.Client {
+	return &secretListCountingClient{Client: c.ClusterClient.ForCluster(cluster), counter: c}
+}
+
+type secretListCountingClient struct {
+	client.Client
+	counter *secretListCounter
+}
+
+func (c *secretListCountingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if _, ok := list.(*corev1.SecretList); ok {
+		c.counter.lists++
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestConfigMapSecretListsOnlyOnChange(t *testing.T) {
+	cm := configMap("cm", nil, map[string]string{"secretData": "s3cr3t"})
+	clusters := &secretListCounter{ClusterClient: fake.NewClusterClient(newTestScheme(t)).WithObjects(clusterA, cm)}
+	c := clusters.ForCluster(clusterA)
+	r := &ConfigMapReconciler{ClusterClient: clusters}
+
+	cm = reconcileSource(t, r)
+	if got, want := cm.Annotations[publishedSecretAnnotation], "default/cm"; got != want {
+		t.Errorf("expected the configmap to record the secret %s, got %q", want, got)
+	}
+	if clusters.lists != 1 {
+		t.Errorf("expected the first publication to look for stale secrets once, got %d lists", clusters.lists)
+	}
+
+	// Once published, the secrets are not listed again until the target changes
+	clusters.lists = 0
+	reconcileSource(t, r)
+	if clusters.lists != 0 {
+		t.Errorf("expected no lists while the target is unchanged, got %d", clusters.lists)
+	}
+
+	cm.Data[secretTargetNameKey] = "renamed"
+	if err := c.Update(context.Background(), cm); err != nil {
+		t.Fatal(err)
+	}
+	reconcileSource(t, r)
+	if clusters.lists != 1 {
+		t.Errorf("expected one list for the new target, got %d", clusters.lists)
+	}
+	expectNoSecret(t, c, types.NamespacedName{Namespace: "default", Name: "cm"})
+
+	// A configmap that never published a secret is not concerned
+	other := configMap("cm", nil, nil)
+	other.Name, other.UID = "plain", "plain-uid"
+	if err := c.Create(context.Background(), other); err != nil {
+		t.Fatal(err)
+	}
+	clusters.lists = 0
+	key := types.NamespacedName{Namespace: "default", Name: "plain"}
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key, ClusterName: clusterA.String()}); err != nil {
+		t.Fatal(err)
+	}
+	if clusters.lists != 0 {
+		t.Errorf("expected no lists for a configmap without secretData, got %d", clusters.lists)
+	}
+}
+
+func TestSecretToSourceConfigMap(t *testing.T) {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "other",
+		Name:      "renamed",
+		Annotations: map[string]string{
+			logicalcluster.AnnotationKey: "root:org:ws",
+			sourceNamespaceAnnotation:    "default",
+			sourceNameAnnotation:         "cm",
+		},
+	}}
+	requests := secretToSourceConfigMap(secret)
+	want := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "cm"}, ClusterName: "root:org:ws"}
+	if len(requests) != 1 || requests[0] != want {
+		t.Errorf("expected %v, got %v", want, requests)
+	}
+
+	delete(secret.Annotations, sourceNameAnnotation)
+	if requests := secretToSourceConfigMap(secret); len(requests) != 0 {
+		t.Errorf("expected no requests for a secret without a source, got %v", requests)
+	}
+}
+
+func TestConfigMapSecretDrift(t *testing.T) {
+	key := types.NamespacedName{Namespace: "default", Name: "cm"}
+	tests := []struct {
+		name string
+		mode SecretSyncMode
+		data map[string]string
+		// tamper changes the published secret behind the controller's back.
+		tamper     func(secret *corev1.Secret)
+		wantDrift  bool
+		wantData   map[string]string
+		wantLabels map[string]string
+		wantType   corev1.SecretType
+	}{
+
+		{
+			name: "lenient mode keeps foreign keys and labels",
+			tamper: func(secret *corev1.Secret) {
+				secret.Data["extra"] = []byte("kept")
+				secret.Labels["team"] = "a"
+			},
+			wantData:   map[string]string{"dataFromCM": "s3cr3t", "extra": "kept"},
+			wantLabels: map[string]string{sourceUIDLabel: "cm-uid", "team": "a"},
+		},
+
+		{
+			name: "the configmap overrides the default mode",
+			data: map[string]string{secretSyncModeKey: string(SecretSyncModeStrict)},
+			tamper: func(secret *corev1.Secret) {
+				secret.Data["extra"] = []byte("removed")
+			},
+			wantDrift:  true,
+			wantData:   map[string]string{"dataFromCM": "s3cr3t"},
+			wantLabels: map[string]string{sourceUIDLabel: "cm-uid"},
+		},
+		{
+			name:       "a change of the configmap is not drift",
+			tamper:     func(secret *corev1.Secret) {},
+			data:       map[string]string{"secretData": "rotated"},
+			wantData:   map[string]string{"dataFromCM": "rotated"},
+			wantLabels: map[string]string{sourceUIDLabel: "cm-uid"},
+		},
+		{
+			name: "a secret without the hash of its data is not drift",
+			tamper: func(secret *corev1.Secret) {
+				delete(secret.Annotations, secretDataHashAnnotation)
+				secret.Data["dataFromCM"] = []byte("old")
+			},
+			wantData:   map[string]string{"dataFromCM": "s3cr3t"},
+			wantLabels: map[string]string{sourceUIDLabel: "cm-uid"},
+		},
+
+		{
+			name:       "lenient mode keeps a secret of another type",
+			tamper:     func(secret *corev1.Secret) { secret.Type = corev1.SecretTypeBasicAuth },
+			wantData:   map[string]string{"dataFromCM": "s3cr3t"},
+			wantLabels: map[string]string{sourceUIDLabel: "cm-uid"},
+			wantType:   corev1.SecretTypeBasicAuth,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := configMap("cm", nil, map[string]string{"secretData": "s3cr3t"})
+			clusters := fake.NewClusterClient(newTestScheme(t)).WithObjects(clusterA, cm)
+			c := clusters.ForCluster(clusterA)
+			recorder := record.NewFakeRecorder(10)
+			r := &ConfigMapReconciler{ClusterClient: clusters, Recorder: recorder, SecretSyncMode: tt.mode}
+			cm = reconcileSource(t, r)
+			secret := expectPublished(t, c, key, "s3cr3t")
+			if secret.Annotations[secretDataHashAnnotation] == "" {
+				t.Fatal("expected the hash of the published data")
+			}
+
+			// The type of a secret is immutable, so a secret of another type has to be created in its place
+			tt.tamper(secret)
+			if secret.Type != corev1.SecretTypeOpaque {
+				if err := c.Delete(context.Background(), secret); err != nil {
+					t.Fatal(err)
+				}
+				secret.ResourceVersion = ""
+				if err := c.Create(context.Background(), secret); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := c.Update(context.Background(), secret); err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.data) > 0 {
+				for k, v := range tt.data {
+					cm.Data[k] = v
+				}
+				if err := c.Update(context.Background(), cm); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			mode := tt.mode
+			if override := tt.data[secretSyncModeKey]; override != "" {
+				mode = SecretSyncMode(override)
+			} else if mode == "" {
+				mode = SecretSyncModeLenient
+			}
+			before := testutil.ToFloat64(secretDriftTotal.WithLabelValues(string(mode)))
+			for i := 0; i < 3; i++ {
+				if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: key, ClusterName: clusterA.String()}); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			var got corev1.Secret
+			if err := c.Get(context.Background(), key, &got); err != nil {
+				t.Fatal(err)
+			}
+			data := map[string]string{}
+			for k, v := range got.Data {
+				data[k] = string(v)
+			}
+			if !equalStringMaps(data, tt.wantData) {
+				t.Errorf("expected data %v, got %v", tt.wantData, data)
+			}
+			if !equalStringMaps(got.Labels, tt.wantLabels) {
+				t.Errorf("expected labels %v, got %v", tt.wantLabels, got.Labels)
+			}
+			wantType := tt.wantType
+			if wantType == "" {
+				wantType = corev1.SecretTypeOpaque
+			}
+			if got.Type != wantType {
+				t.Errorf("expected type %s, got %s", wantType, got.Type)
+			}
+
+			drift := testutil.ToFloat64(secretDriftTotal.WithLabelValues(string(mode))) - before
+			var events []string
+			for len(recorder.Events) > 0 {
+				events = append(events, <-recorder.Events)
+			}
+			if tt.wantDrift {
+				if drift != 1 {
+					t.Errorf("expected one drift correction, got %v", drift)
+				}
+				if len(events) != 1 || !strings.Contains(events[0], "SecretDrift") {
+					t.Errorf("expected a SecretDrift event, got %v", events)
+				}
+			} else if drift != 0 || len(events) != 0 {
+				t.Errorf("expected no drift, got %v corrections and events %v", drift, events)
+			}
+		})
+	}
+}
+
+func equalStringMaps(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	// OtherClusters is the cluster label value of the logical clusters beyond ClusterMetricsOptions.MaxClusters.
+	OtherClusters = "other"
+)
+
+var (
+	// secretDriftTotal counts the corrections applied to published secrets that no longer matched their configmap.
+	secretDriftTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "configmap_secret_drift_total",
+		Help: "Number of corrections applied to secrets that drifted from the state published by their configmap.",
+	}, []string{"mode"})
+
+	// configMapAuditFindings holds the findings of the last consistency audit of configmaps.
+	configMapAuditFindings = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "configmap_consistency_audit_findings",
+		Help: "Number of findings, by kind, in the last consistency audit of configmaps across workspaces.",
+	}, []string{"kind"})
+
+	// configMapAuditsTotal counts the consistency audits of configmaps.
+	configMapAuditsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "configmap_consistency_audits_total",
+		Help: "Number of consistency audits of configmaps across workspaces.",
+	})
+
+	// incompleteClaimsWorkspaces holds the number of workspaces whose APIBinding does not accept every permission
+	// claim of the APIExport.
+	incompleteClaimsWorkspaces = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "apibinding_incomplete_permission_claims_workspaces",
+		Help: "Number of workspaces whose APIBinding does not accept every permission claim of the APIExport.",
+	})
+
+	// The metrics below are labelled by logical cluster, see ClusterMetricsOptions for how the label is derived.
+
+	// widgetsPerCluster holds the number of widgets the widget controller last counted in each logical cluster.
+	widgetsPerCluster = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "widget_cluster_widgets",
+		Help: "Number of widgets last counted in the logical cluster.",
+	}, []string{"cluster"})
+
+	// secretsManagedTotal counts the secrets created, updated and deleted for configmaps.
+	secretsManagedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "configmap_cluster_secrets_managed_total",
+		Help: "Number of secrets created, updated or deleted for configmaps in the logical cluster, by operation.",
+	}, []string{"cluster", "operation"})
+
+	// namespacesCreatedTotal counts the namespaces created for configmaps.
+	namespacesCreatedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "configmap_cluster_namespaces_created_total",
+		Help: "Number of namespaces created for configmaps in the logical cluster.",
+	}, []string{"cluster"})
+
+	// reconcileErrorsTotal counts the errors returned by the reconcilers, by the reason of the API error, if any.
+	reconcileErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cluster_reconcile_errors_total",
+		Help: "Number of reconcile errors in the logical cluster, by controller and reason.",
+	}, []string{"controller", "cluster", "reason"})
+
+	// throttledRequestsTotal counts the client requests that waited for a client-side rate limit.
+	throttledRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "client_cluster_throttled_requests_total",
+		Help: "Number of client requests in the logical cluster throttled by the client-side rate limits, by limit.",
+	}, []string{"cluster", "limit"})
+
+	// throttledSecondsTotal counts the time client requests waited for a client-side rate limit.
+	throttledSecondsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "client_cluster_throttled_seconds_total",
+		Help: "Time client requests in the logical cluster waited for the client-side rate limits, by limit.",
+	}, []string{"cluster", "limit"})
+
+	clusterMetrics = newClusterLabeler(ClusterMetricsOptions{})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		secretDriftTotal,
+		configMapAuditFindings,
+		configMapAuditsTotal,
+		incompleteClaimsWorkspaces,
+		widgetsPerCluster,
+		secretsManagedTotal,
+		namespacesCreatedTotal,
+		reconcileErrorsTotal,
+		throttledRequestsTotal,
+		throttledSecondsTotal,
+	)
+}
+
+// ClusterMetricsOptions bounds the cardinality of the cluster label of the per-cluster metrics, for fleets with more
+// logical clusters than a time series each can be afforded for.
+type ClusterMetricsOptions struct {
+	// MaxClusters is the number of logical clusters that are reported under their own name. Logical clusters seen
+	// after that are reported as OtherClusters. Zero means no limit.
+	MaxClusters int
+	// HashBuckets, if set, reports every logical cluster under one of HashBuckets labels derived from a hash of its
+	// name, such as "bucket-7", instead of under its name. MaxClusters is ignored then.
+	HashBuckets int
+}
+
+// ConfigureClusterMetrics sets how the cluster label of the per-cluster metrics is derived. It resets those metrics,
+// so it is meant to be called once, before the controllers start.
+func ConfigureClusterMetrics(opts ClusterMetricsOptions) error {
+	if opts.MaxClusters < 0 {
+		return fmt.Errorf("the maximum number of clusters cannot be negative: %d", opts.MaxClusters)
+	}
+	if opts.HashBuckets < 0 {
+		return fmt.Errorf("the number of hash buckets cannot be negative: %d", opts.HashBuckets)
+	}
+	clusterMetrics = newClusterLabeler(opts)
+	widgetsPerCluster.Reset()
+	secretsManagedTotal.Reset()
+	namespacesCreatedTotal.Reset()
+	reconcileErrorsTotal.Reset()
+	throttledRequestsTotal.Reset()
+	throttledSecondsTotal.Reset()
+	return nil
+}
+
+// clusterLabeler maps logical clusters to the value of the cluster label. Its state is bounded by MaxClusters: it only
+// remembers the logical clusters reported under their own name, and the widget counts last reported per label.
+type clusterLabeler struct {
+	opts ClusterMetricsOptions
+
+	lock sync.Mutex
+	// named holds the logical clusters reported under their own name when MaxClusters is set.
+	named map[logicalcluster.Name]struct{}
+	// widgetCounts holds the widget counts per label last reported by each reporter, see setWidgets.
+	widgetCounts map[string]map[string]int
+}
+
+func newClusterLabeler(opts ClusterMetricsOptions) *clusterLabeler {
+	return &clusterLabeler{
+		opts:         opts,
+		named:        map[logicalcluster.Name]struct{}{},
+		widgetCounts: map[string]map[string]int{},
+	}
+}
+
+// label returns the cluster label value of the logical cluster.
+func (l *clusterLabeler) label(cluster logicalcluster.Name) string {
+	if l.opts.HashBuckets > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(cluster.String()))
+		return fmt.Sprintf("bucket-%d", h.Sum32()%uint32(l.opts.HashBuckets))
+	}
+	if l.opts.MaxClusters == 0 {
+		return cluster.String()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.named[cluster]; ok {
+		return cluster.String()
+	}
+	if len(l.named) < l.opts.MaxClusters {
+		l.named[cluster] = struct{}{}
+		return cluster.String()
+	}
+	return OtherClusters
+}
+
+// setWidgets records the number of widgets in each logical cluster, which must be every logical cluster with widgets
+// that the reporter reconciles. Each manager of the replica is a reporter of its own, so that the logical clusters of
+// the other managers are left alone. Logical clusters sharing a label add up across the reporters, and labels without
+// widgets left report zero.
+func (l *clusterLabeler) setWidgets(reporter string, counts map[logicalcluster.Name]int) {
+	perLabel := map[string]int{}
+	for cluster, count := range counts {
+		perLabel[l.label(cluster)] += count
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	previous := l.widgetCounts[reporter]
+	l.widgetCounts[reporter] = perLabel
+	for label := range previous {
+		if _, ok := perLabel[label]; !ok {
+			l.setWidgetsLocked(label)
+		}
+	}
+	for label := range perLabel {
+		l.setWidgetsLocked(label)
+	}
+}
+
+// setWidgetsLocked sets the widget count of the label to the sum of the counts of all reporters. l.lock must be held.
+func (l *clusterLabeler) setWidgetsLocked(label string) {
+	total := 0
+	for _, perLabel := range l.widgetCounts {
+		total += perLabel[label]
+	}
+	widgetsPerCluster.WithLabelValues(label).Set(float64(total))
+}
+
+// forget drops the series of an offboarded logical cluster reported under its own name, and frees its name for
+// another logical cluster when MaxClusters is set. Series shared with other logical clusters are kept.
+func (l *clusterLabeler) forget(cluster logicalcluster.Name) {
+	if l.opts.HashBuckets > 0 {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.opts.MaxClusters > 0 {
+		if _, ok := l.named[cluster]; !ok {
+			return
+		}
+		delete(l.named, cluster)
+	}
+	label := cluster.String()
+	for _, perLabel := range l.widgetCounts {
+		delete(perLabel, label)
+	}
+	for _, vec := range []*prometheus.MetricVec{
+		widgetsPerCluster.MetricVec,
+		secretsManagedTotal.MetricVec,
+		namespacesCreatedTotal.MetricVec,
+		reconcileErrorsTotal.MetricVec,
+		throttledRequestsTotal.MetricVec,
+		throttledSecondsTotal.MetricVec,
+	} {
+		vec.DeletePartialMatch(prometheus.Labels{"cluster": label})
+	}
+}
+
+// secretManaged records an operation on a secret published for a configmap in the logical cluster.
+func (l *clusterLabeler) secretManaged(cluster logicalcluster.Name, operation string) {
+	secretsManagedTotal.WithLabelValues(l.label(cluster), operation).Inc()
+}
+
+// namespaceCreated records a namespace created for a configmap in the logical cluster.
+func (l *clusterLabeler) namespaceCreated(cluster logicalcluster.Name) {
+	namespacesCreatedTotal.WithLabelValues(l.label(cluster)).Inc()
+}
+
+// reconcileError records the error returned by a reconciler, if any.
+func (l *clusterLabeler) reconcileError(controller string, cluster logicalcluster.Name, err error) {
+	if err == nil {
+		return
+	}
+	reason := string(apierrors.ReasonForError(err))
+	if reason == "" {
+		reason = "Unknown"
+	}
+	reconcileErrorsTotal.WithLabelValues(controller, l.label(cluster), reason).Inc()
+}
+
+// throttled records a client request in the logical cluster that waited for the given client-side rate limit.
+func (l *clusterLabeler) throttled(cluster logicalcluster.Name, limit string, wait time.Duration) {
+	label := l.label(cluster)
+	throttledRequestsTotal.WithLabelValues(label, limit).Inc()
+	throttledSecondsTotal.WithLabelValues(label, limit).Add(wait.Seconds())
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+// configureClusterMetrics resets the per-cluster metrics for the test.
+func configureClusterMetrics(t *testing.T, opts ClusterMetricsOptions) {
+	t.Helper()
+	if err := ConfigureClusterMetrics(opts); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ConfigureClusterMetrics(ClusterMetricsOptions{})
+	})
+}
+
+func TestClusterMetricsRegistered(t *testing.T) {
+	configureClusterMetrics(t, ClusterMetricsOptions{})
+	clusterMetrics.setWidgets("widget", map[logicalcluster.Name]int{clusterA: 1})
+	clusterMetrics.secretManaged(clusterA, "created")
+	clusterMetrics.namespaceCreated(clusterA)
+	clusterMetrics.reconcileError("widget", clusterA, errors.New("boom"))
+
+	count, err := testutil.GatherAndCount(metrics.Registry,
+		"widget_cluster_widgets",
+		"configmap_cluster_secrets_managed_total",
+		"configmap_cluster_namespaces_created_total",
+		"cluster_reconcile_errors_total",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("expected 4 per-cluster series on the controller-runtime registry, got %d", count)
+	}
+}
+
+func TestClusterLabel(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     ClusterMetricsOptions
+		clusters []logicalcluster.Name
+		want     []string
+	}{
+		{
+			name:     "names without a limit",
+			clusters: []logicalcluster.Name{"a", "b", "c"},
+			want:     []string{"a", "b", "c"},
+		},
+		{
+			name:     "clusters beyond the limit are other",
+			opts:     ClusterMetricsOptions{MaxClusters: 2},
+			clusters: []logicalcluster.Name{"a", "b", "c", "a", "d", "b"},
+			want:     []string{"a", "b", OtherClusters, "a", OtherClusters, "b"},
+		},
+		{
+			name:     "hash buckets",
+			opts:     ClusterMetricsOptions{HashBuckets: 4, MaxClusters: 1},
+			clusters: []logicalcluster.Name{"a", "b", "a"},
+			want:     []string{"bucket-0", "bucket-1", "bucket-0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newClusterLabeler(tt.opts)
+			for i, cluster := range tt.clusters {
+				if got := l.label(cluster); got != tt.want[i] {
+					t.Errorf("expected label %q for %s, got %q", tt.want[i], cluster, got)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigureClusterMetricsInvalid(t *testing.T) {
+	for _, opts := range []ClusterMetricsOptions{{MaxClusters: -1}, {HashBuckets: -1}} {
+		if err := ConfigureClusterMetrics(opts); err == nil {
+			t.Errorf("expected an error for %+v", opts)
+		}
+	}
+}
+
+func TestWidgetsPerCluster(t *testing.T) {
+	configureClusterMetrics(t, ClusterMetricsOptions{MaxClusters: 1})
+
+	clusterMetrics.label(clusterA)
+	clusterMetrics.setWidgets("widget", map[logicalcluster.Name]int{clusterA: 3, "cluster-c": 2, "cluster-d": 4})
+	// Logical clusters sharing a label add up, a new count replaces the previous one, and labels without widgets left
+	// report zero
+	clusterMetrics.setWidgets("widget", map[logicalcluster.Name]int{"cluster-c": 1})
+
+	expected := `
+# HELP widget_cluster_widgets Number of widgets last counted in the logical cluster.
+# TYPE widget_cluster_widgets gauge
+widget_cluster_widgets{cluster="cluster-a"} 0
+widget_cluster_widgets{cluster="other"} 1
+`
+	if err := testutil.CollectAndCompare(widgetsPerCluster, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWidgetsPerClusterReporters(t *testing.T) {
+	configureClusterMetrics(t, ClusterMetricsOptions{MaxClusters: 1})
+
+	clusterMetrics.label(clusterA)
+	// The managers of two shards report the logical clusters they own
+	clusterMetrics.setWidgets("widget-shard-1", map[logicalcluster.Name]int{clusterA: 3, "cluster-c": 2})
+	clusterMetrics.setWidgets("widget-shard-2", map[logicalcluster.Name]int{clusterB: 1, "cluster-d": 4})
+	// A new count of one shard leaves the logical clusters of the other one alone
+	clusterMetrics.setWidgets("widget-shard-1", map[logicalcluster.Name]int{clusterA: 2})
+	clusterMetrics.setWidgets("widget-shard-2", map[logicalcluster.Name]int{clusterB: 1, "cluster-d": 4})
+
+	expected := `
+# HELP widget_cluster_widgets Number of widgets last counted in the logical cluster.
+# TYPE widget_cluster_widgets gauge
+widget_cluster_widgets{cluster="cluster-a"} 2
+widget_cluster_widgets{cluster="other"} 5
+`
+	if err := testutil.CollectAndCompare(widgetsPerCluster, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClusterLabelerBounded(t *testing.T) {
+	l := newClusterLabeler(ClusterMetricsOptions{MaxClusters: 2})
+	counts := map[logicalcluster.Name]int{}
+	for i := 0; i < 100; i++ {
+		counts[logicalcluster.Name(fmt.Sprintf("cluster-%d", i))] = 1
+	}
+	l.setWidgets("widget", counts)
+	if len(l.named) != 2 {
+		t.Errorf("expected 2 named clusters, got %d", len(l.named))
+	}
+	if len(l.widgetCounts["widget"]) != 3 {
+		t.Errorf("expected the widget counts of 2 named clusters and other, got %d labels", len(l.widgetCounts["widget"]))
+	}
+}
+
+func TestClusterMetricsForget(t *testing.T) {
+	configureClusterMetrics(t, ClusterMetricsOptions{MaxClusters: 1})
+
+	clusterMetrics.label(clusterA)
+	clusterMetrics.setWidgets("widget", map[logicalcluster.Name]int{clusterA: 2, clusterB: 1})
+	clusterMetrics.secretManaged(clusterA, "created")
+	clusterMetrics.secretManaged(clusterB, "created")
+
+	// The series of other are shared with the logical clusters that are still there
+	clusterMetrics.forget(clusterB)
+	if got := testutil.CollectAndCount(widgetsPerCluster); got != 2 {
+		t.Errorf("expected 2 widget series, got %d", got)
+	}
+
+	clusterMetrics.forget(clusterA)
+	expected := `
+# HELP widget_cluster_widgets Number of widgets last counted in the logical cluster.
+# TYPE widget_cluster_widgets gauge
+widget_cluster_widgets{cluster="other"} 1
+`
+	if err := testutil.CollectAndCompare(widgetsPerCluster, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	if got := testutil.ToFloat64(secretsManagedTotal.WithLabelValues(OtherClusters, "created")); got != 1 {
+		t.Errorf("expected 1 secret created in other clusters, got %v", got)
+	}
+	if got := testutil.CollectAndCount(secretsManagedTotal); got != 1 {
+		t.Errorf("expected only the secrets of other clusters, got %d series", got)
+	}
+
+	// The name of the offboarded logical cluster is free for the next one
+	if got := clusterMetrics.label(clusterB); got != clusterB.String() {
+		t.Errorf("expected %s to take the free name, got %q", clusterB, got)
+	}
+}
+
+func TestReconcileErrorReason(t *testing.T) {
+	configureClusterMetrics(t, ClusterMetricsOptions{})
+
+	clusterMetrics.reconcileError("configmap", clusterA, nil)
+	clusterMetrics.reconcileError("configmap", clusterA, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "cm", errors.New("changed")))
+	clusterMetrics.reconcileError("configmap", clusterA, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, "cm", errors.New("changed")))
+	clusterMetrics.reconcileError("widget", clusterB, errors.New("boom"))
+
+	expected := `
+# HELP cluster_reconcile_errors_total Number of reconcile errors in the logical cluster, by controller and reason.
+# TYPE cluster_reconcile_errors_total counter
+cluster_reconcile_errors_total{cluster="cluster-a",controller="configmap",reason="Conflict"} 2
+cluster_reconcile_errors_total{cluster="cluster-b",controller="widget",reason="Unknown"} 1
+`
+	if err := testutil.CollectAndCompare(reconcileErrorsTotal, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigMapReconcileMetrics(t *testing.T) {
+	configureClusterMetrics(t, ClusterMetricsOptions{})
+
+	cm := configMap("cm", nil, map[string]string{"namespace": "created", "secretData": "hello"})
+	stale := publishedSecret(cm, types.NamespacedName{Namespace: "default", Name: "stale"}, "hello")
+	clusters := fake.NewClusterClient(newTestScheme(t)).WithObjects(clusterA, cm, stale)
+	r := &ConfigMapReconciler{
+		ClusterClient: clusters,
+		Recorder:      record.NewFakeRecorder(10),
+	}
+	request := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(cm), ClusterName: clusterA.String()}
+
+	// The first reconcile creates the namespace, the second one publishes the secret and deletes the stale one
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(context.Background(), request); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := testutil.ToFloat64(namespacesCreatedTotal.WithLabelValues(clusterA.String())); got != 1 {
+		t.Errorf("expected 1 namespace created, got %v", got)
+	}
+	if got := testutil.ToFloat64(secretsManagedTotal.WithLabelValues(clusterA.String(), "created")); got != 1 {
+		t.Errorf("expected 1 secret created, got %v", got)
+	}
+	if got := testutil.ToFloat64(secretsManagedTotal.WithLabelValues(clusterA.String(), "deleted")); got != 1 {
+		t.Errorf("expected 1 secret deleted, got %v", got)
+	}
+	if got := testutil.CollectAndCount(reconcileErrorsTotal); got != 0 {
+		t.Errorf("expected no reconcile errors, got %d series", got)
+	}
+}
+
+func TestWidgetReconcileMetrics(t *testing.T) {
+	configureClusterMetrics(t, ClusterMetricsOptions{})
+
+	clusters := fake.NewClusterClient(newTestScheme(t)).
+		WithObjects(clusterA, widget("w", 0), widget("x", 0)).
+		WithObjects(clusterB, widget("w", 0))
+	r := &WidgetReconciler{ClusterClient: clusters}
+
+	reconcile := func(cluster logicalcluster.Name, name string) {
+		t.Helper()
+		if _, err := r.Reconcile(context.Background(), ctrl.Request{
+			NamespacedName: types.NamespacedName{Namespace: "default", Name: name},
+			ClusterName:    cluster.String(),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reconcile(clusterA, "w")
+	reconcile(clusterB, "w")
+
+	// Once the last widget of a logical cluster is gone, reconciling it records that there are none left
+	if err := clusters.ForCluster(clusterB).Delete(context.Background(), widget("w", 0)); err != nil {
+		t.Fatal(err)
+	}
+	reconcile(clusterB, "w")
+
+	expected := `
+# HELP widget_cluster_widgets Number of widgets last counted in the logical cluster.
+# TYPE widget_cluster_widgets gauge
+widget_cluster_widgets{cluster="cluster-a"} 2
+widget_cluster_widgets{cluster="cluster-b"} 0
+`
+	if err := testutil.CollectAndCompare(widgetsPerCluster, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
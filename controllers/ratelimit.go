@@ -0,0 +1,345 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"golang.org/x/time/rate"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/kontext"
+)
+
+// ClusterRateLimit is a token bucket budget of client requests.
+type ClusterRateLimit struct {
+	// QPS is the rate at which the bucket refills. Zero means no limit.
+	QPS float64
+	// Burst is the size of the bucket. It defaults to the QPS, rounded up.
+	Burst int
+}
+
+// ClusterRateLimitOptions configures the client-side rate limits of the requests of the reconcilers, so that one busy
+// logical cluster cannot use up the budget of the others.
+type ClusterRateLimitOptions struct {
+	// Default is the budget of every logical cluster without an override.
+	Default ClusterRateLimit
+	// Overrides are the budgets of specific logical clusters.
+	Overrides map[logicalcluster.Name]ClusterRateLimit
+	// Global is the ceiling across all logical clusters, on top of their own budget.
+	Global ClusterRateLimit
+}
+
+// ParseClusterRateLimits parses per-cluster budgets written as comma-separated <cluster>=<qps>[/<burst>], such as
+// "root:org:busy=50/100,root:org:quiet=1".
+func ParseClusterRateLimits(s string) (map[logicalcluster.Name]ClusterRateLimit, error) {
+	limits := map[logicalcluster.Name]ClusterRateLimit{}
+	if s == "" {
+		return limits, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		cluster, budget, ok := strings.Cut(entry, "=")
+		if !ok || cluster == "" {
+			return nil, fmt.Errorf("invalid rate limit %q, expected <cluster>=<qps>[/<burst>]", entry)
+		}
+		qps, burst, hasBurst := strings.Cut(budget, "/")
+		var limit ClusterRateLimit
+		var err error
+		if limit.QPS, err = strconv.ParseFloat(qps, 64); err != nil {
+			return nil, fmt.Errorf("invalid QPS in rate limit %q: %w", entry, err)
+		}
+		if hasBurst {
+			if limit.Burst, err = strconv.Atoi(burst); err != nil {
+				return nil, fmt.Errorf("invalid burst in rate limit %q: %w", entry, err)
+			}
+		}
+		name := logicalcluster.Name(cluster)
+		if _, ok := limits[name]; ok {
+			return nil, fmt.Errorf("logical cluster %s has more than one rate limit", cluster)
+		}
+		limits[name] = limit
+	}
+	return limits, nil
+}
+
+// validate returns an error for a negative budget.
+func (l ClusterRateLimit) validate() error {
+	if l.QPS < 0 {
+		return fmt.Errorf("the QPS cannot be negative: %v", l.QPS)
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("the burst cannot be negative: %d", l.Burst)
+	}
+	return nil
+}
+
+// newLimiter returns the token bucket of the budget, or nil for no limit.
+func (l ClusterRateLimit) newLimiter() *rate.Limiter {
+	if l.QPS == 0 {
+		return nil
+	}
+	burst := l.Burst
+	if burst == 0 {
+		burst = int(l.QPS)
+		if float64(burst) < l.QPS {
+			burst++
+		}
+	}
+	return rate.NewLimiter(rate.Limit(l.QPS), burst)
+}
+
+// idleBucketSweepInterval is the time between two evictions of the token buckets of idle logical clusters.
+const idleBucketSweepInterval = time.Minute
+
+// ClusterRateLimiter holds a token bucket per logical cluster and a global one. It is shared by the clients of all
+// managers, see NewRateLimitingClient. A nil ClusterRateLimiter does not limit anything.
+type ClusterRateLimiter struct {
+	opts   ClusterRateLimitOptions
+	global *rate.Limiter
+	clock  clock.PassiveClock
+
+	lock sync.Mutex
+	// clusters holds the token buckets of the limited logical clusters that are not full. A full bucket is the same
+	// as a new one, so the buckets of idle logical clusters are evicted.
+	clusters  map[logicalcluster.Name]*clusterBucket
+	lastSweep time.Time
+}
+
+// clusterBucket is the token bucket of a logical cluster.
+type clusterBucket struct {
+	limiter *rate.Limiter
+	// full is when the bucket is full again, if no more tokens are taken.
+	full time.Time
+}
+
+// NewClusterRateLimiter returns a ClusterRateLimiter with the budgets of opts.
+func NewClusterRateLimiter(opts ClusterRateLimitOptions) (*ClusterRateLimiter, error) {
+	if err := opts.Default.validate(); err != nil {
+		return nil, fmt.Errorf("invalid default rate limit: %w", err)
+	}
+	if err := opts.Global.validate(); err != nil {
+		return nil, fmt.Errorf("invalid global rate limit: %w", err)
+	}
+	for cluster, limit := range opts.Overrides {
+		if err := limit.validate(); err != nil {
+			return nil, fmt.Errorf("invalid rate limit of logical cluster %s: %w", cluster, err)
+		}
+	}
+	return &ClusterRateLimiter{
+		opts:     opts,
+		global:   opts.Global.newLimiter(),
+		clock:    clock.RealClock{},
+		clusters: map[logicalcluster.Name]*clusterBucket{},
+	}, nil
+}
+
+// take takes a token of the bucket of the logical cluster and one of the global bucket if both have one. Otherwise it
+// takes none, and returns how long to wait for the budget that is the furthest from having a token, and which one it is.
+func (l *ClusterRateLimiter) take(cluster logicalcluster.Name) (time.Duration, string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.clock.Now()
+	if now.Sub(l.lastSweep) >= idleBucketSweepInterval {
+		for name, bucket := range l.clusters {
+			if !now.Before(bucket.full) {
+				delete(l.clusters, name)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	var bucket *clusterBucket
+	var reservations []*rate.Reservation
+	var limits []string
+	if !cluster.Empty() {
+		bucket = l.bucket(cluster)
+	}
+	if bucket != nil {
+		reservations, limits = append(reservations, bucket.limiter.ReserveN(now, 1)), append(limits, "cluster")
+	}
+	if l.global != nil {
+		reservations, limits = append(reservations, l.global.ReserveN(now, 1)), append(limits, "global")
+	}
+
+	var delay time.Duration
+	limit := ""
+	for i, reservation := range reservations {
+		if d := reservation.DelayFrom(now); d > delay {
+			delay, limit = d, limits[i]
+		}
+	}
+	if delay > 0 {
+		// Given back at the time they were taken, the tokens are as if they had never been taken
+		for _, reservation := range reservations {
+			reservation.CancelAt(now)
+		}
+		return delay, limit
+	}
+	if bucket != nil {
+		bucket.full = now.Add(bucket.refill())
+	}
+	return 0, ""
+}
+
+// bucket returns the token bucket of the logical cluster, or nil if it is not limited. l.lock must be held.
+func (l *ClusterRateLimiter) bucket(cluster logicalcluster.Name) *clusterBucket {
+	if bucket, ok := l.clusters[cluster]; ok {
+		return bucket
+	}
+	limit, ok := l.opts.Overrides[cluster]
+	if !ok {
+		limit = l.opts.Default
+	}
+	limiter := limit.newLimiter()
+	if limiter == nil {
+		return nil
+	}
+	bucket := &clusterBucket{limiter: limiter}
+	l.clusters[cluster] = bucket
+	return bucket
+}
+
+// refill returns how long the bucket takes to refill from empty.
+func (b *clusterBucket) refill() time.Duration {
+	return time.Duration(float64(b.limiter.Burst()) / float64(b.limiter.Limit()) * float64(time.Second))
+}
+
+// Wait blocks until a request to the logical cluster is within both its budget and the global one, or ctx is done.
+// Requests without a logical cluster, which span all of them, only count against the global budget. The tokens of
+// both budgets are taken together, so a request that gives up does not use up either of them.
+func (l *ClusterRateLimiter) Wait(ctx context.Context, cluster logicalcluster.Name) error {
+	if l == nil {
+		return nil
+	}
+
+	throttled := map[string]time.Duration{}
+	defer func() {
+		for limit, wait := range throttled {
+			clusterMetrics.throttled(cluster, limit, wait)
+		}
+	}()
+	for {
+		delay, limit := l.take(cluster)
+		if delay == 0 {
+			return nil
+		}
+		start := l.clock.Now()
+		err := l.sleep(ctx, delay)
+		throttled[limit] += l.clock.Since(start)
+		if err != nil {
+			if limit == "cluster" {
+				return fmt.Errorf("client-side rate limit of logical cluster %s: %w", cluster, err)
+			}
+			return fmt.Errorf("global client-side rate limit: %w", err)
+		}
+	}
+}
+
+// sleep waits for delay, or returns an error if ctx is done first or would be done by then.
+func (l *ClusterRateLimiter) sleep(ctx context.Context, delay time.Duration) error {
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(l.clock.Now().Add(delay)) {
+		return fmt.Errorf("waiting %v would exceed the context deadline", delay)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// NewRateLimitingClient returns a client whose writes wait for the budget of their logical cluster, in the context of
+// the request, see kontext.WithCluster. Reads are not limited: the reconcilers read from the cache.
+func NewRateLimitingClient(c client.Client, limiter *ClusterRateLimiter) client.Client {
+	return &rateLimitingClient{Client: c, limiter: limiter}
+}
+
+type rateLimitingClient struct {
+	client.Client
+	limiter *ClusterRateLimiter
+}
+
+func (c *rateLimitingClient) wait(ctx context.Context) error {
+	cluster, _ := kontext.ClusterFrom(ctx)
+	return c.limiter.Wait(ctx, cluster)
+}
+
+func (c *rateLimitingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *rateLimitingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func (c *rateLimitingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *rateLimitingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c *rateLimitingClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	if err := c.wait(ctx); err != nil {
+		return err
+	}
+	return c.Client.DeleteAllOf(ctx, obj, opts...)
+}
+
+func (c *rateLimitingClient) Status() client.StatusWriter {
+	return &rateLimitingStatusWriter{StatusWriter: c.Client.Status(), client: c}
+}
+
+type rateLimitingStatusWriter struct {
+	client.StatusWriter
+	client *rateLimitingClient
+}
+
+func (w *rateLimitingStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if err := w.client.wait(ctx); err != nil {
+		return err
+	}
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+func (w *rateLimitingStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if err := w.client.wait(ctx); err != nil {
+		return err
+	}
+	return w.StatusWriter.Patch(ctx, obj, patch, opts...)
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kcp-dev/logicalcluster/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clocktesting "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+func TestParseClusterRateLimits(t *testing.T) {
+	got, err := ParseClusterRateLimits("root:org:busy=50/100,root:org:quiet=0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[logicalcluster.Name]ClusterRateLimit{
+		"root:org:busy":  {QPS: 50, Burst: 100},
+		"root:org:quiet": {QPS: 0.5},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected rate limits (-want +got):\n%s", diff)
+	}
+
+	for _, invalid := range []string{"root:org", "=5", "root:org=fast", "root:org=5/many", "root:org=5,root:org=6"} {
+		if _, err := ParseClusterRateLimits(invalid); err == nil {
+			t.Errorf("expected an error for %q", invalid)
+		}
+	}
+}
+
+func TestNewClusterRateLimiterInvalid(t *testing.T) {
+	for _, opts := range []ClusterRateLimitOptions{
+		{Default: ClusterRateLimit{QPS: -1}},
+		{Global: ClusterRateLimit{Burst: -1}},
+		{Overrides: map[logicalcluster.Name]ClusterRateLimit{clusterA: {QPS: -1}}},
+	} {
+		if _, err := NewClusterRateLimiter(opts); err == nil {
+			t.Errorf("expected an error for %+v", opts)
+		}
+	}
+}
+
+func TestRateLimitingClient(t *testing.T) {
+	configureClusterMetrics(t, ClusterMetricsOptions{})
+	clusterC := logicalcluster.Name("cluster-c")
+	limiter, err := NewClusterRateLimiter(ClusterRateLimitOptions{
+		Default:   ClusterRateLimit{QPS: 0.001, Burst: 1},
+		Overrides: map[logicalcluster.Name]ClusterRateLimit{clusterB: {QPS: 0.001, Burst: 3}, clusterC: {QPS: 0.001, Burst: 10}},
+		Global:    ClusterRateLimit{QPS: 0.001, Burst: 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters := fake.NewClusterClient(newTestScheme(t))
+	c := NewClusterClient(NewRateLimitingClient(clusters, limiter))
+
+	// The buckets do not refill within the test, a throttled request fails right away with the short deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	create := func(cluster logicalcluster.Name, name string) error {
+		return c.ForCluster(cluster).Create(ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}})
+	}
+
+	if err := create(clusterA, "first"); err != nil {
+		t.Fatalf("expected the first write to cluster-a to be within its budget: %v", err)
+	}
+	if err := create(clusterA, "second"); err == nil {
+		t.Error("expected the second write to cluster-a to exceed its budget")
+	}
+	// A busy logical cluster does not use up the budget of the others
+	for i, name := range []string{"first", "second", "third"} {
+		if err := create(clusterB, name); err != nil {
+			t.Fatalf("expected write %d to cluster-b to be within its override: %v", i, err)
+		}
+	}
+	if err := create(clusterB, "fourth"); err == nil {
+		t.Error("expected the fourth write to cluster-b to exceed its override")
+	}
+	// Reads are not limited
+	var cm corev1.ConfigMap
+	if err := c.ForCluster(clusterA).Get(ctx, client.ObjectKey{Namespace: "default", Name: "first"}, &cm); err != nil {
+		t.Errorf("expected reads to be within budget: %v", err)
+	}
+	// The global budget of 5 is used up by the writes to cluster-a and cluster-b
+	if err := create(clusterC, "first"); err != nil {
+		t.Fatalf("expected the first write to cluster-c to be within the global budget: %v", err)
+	}
+	if err := c.ForCluster(clusterC).Status().Update(ctx, &cm); err == nil || !strings.Contains(err.Error(), "global client-side rate limit") {
+		t.Errorf("expected the second write to cluster-c to exceed the global budget, got %v", err)
+	}
+
+	for _, tt := range []struct {
+		cluster logicalcluster.Name
+		limit   string
+		want    float64
+	}{
+		{cluster: clusterA, limit: "cluster", want: 1},
+		{cluster: clusterB, limit: "cluster", want: 1},
+		{cluster: clusterC, limit: "cluster", want: 0},
+		{cluster: clusterC, limit: "global", want: 1},
+	} {
+		if got := testutil.ToFloat64(throttledRequestsTotal.WithLabelValues(tt.cluster.String(), tt.limit)); got != tt.want {
+			t.Errorf("expected %v throttled requests in %s by the %s limit, got %v", tt.want, tt.cluster, tt.limit, got)
+		}
+	}
+}
+
+func TestNilClusterRateLimiter(t *testing.T) {
+	var limiter *ClusterRateLimiter
+	if err := limiter.Wait(context.Background(), clusterA); err != nil {
+		t.Errorf("expected a nil limiter not to limit: %v", err)
+	}
+}
+
+func TestClusterRateLimiterGivesTokensBack(t *testing.T) {
+	configureClusterMetrics(t, ClusterMetricsOptions{})
+	limiter, err := NewClusterRateLimiter(ClusterRateLimitOptions{
+		Default: ClusterRateLimit{QPS: 0.001, Burst: 1},
+		Global:  ClusterRateLimit{QPS: 0.001, Burst: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// A request across all logical clusters uses up the global budget
+	if err := limiter.Wait(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := limiter.Wait(ctx, clusterA); err == nil || !strings.Contains(err.Error(), "global client-side rate limit") {
+		t.Fatalf("expected the global budget to be used up, got %v", err)
+	}
+	// The request that gave up did not use up the budget of its logical cluster
+	if !limiter.clusters[clusterA].limiter.Allow() {
+		t.Error("expected the token of cluster-a to be given back")
+	}
+}
+
+func TestClusterRateLimiterEvictsIdleBuckets(t *testing.T) {
+	configureClusterMetrics(t, ClusterMetricsOptions{})
+	limiter, err := NewClusterRateLimiter(ClusterRateLimitOptions{
+		Default:   ClusterRateLimit{QPS: 1, Burst: 2},
+		Overrides: map[logicalcluster.Name]ClusterRateLimit{clusterB: {QPS: 0.001, Burst: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := clocktesting.NewFakePassiveClock(now)
+	limiter.clock = clock
+
+	for i := 0; i < 10; i++ {
+		if err := limiter.Wait(context.Background(), logicalcluster.Name(fmt.Sprintf("cluster-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := limiter.Wait(context.Background(), clusterB); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(limiter.clusters); got != 11 {
+		t.Fatalf("expected 11 buckets, got %d", got)
+	}
+
+	// The buckets that refilled in the meantime are evicted, the one of cluster-b takes longer than that to refill
+	clock.SetTime(now.Add(idleBucketSweepInterval))
+	if err := limiter.Wait(context.Background(), clusterA); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for cluster := range limiter.clusters {
+		got = append(got, cluster.String())
+	}
+	sort.Strings(got)
+	if want := []string{clusterA.String(), clusterB.String()}; !cmp.Equal(want, got) {
+		t.Errorf("expected the buckets %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/utils/pointer"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// shardGroupLabel is set on the membership lease of every replica to the name of its group.
+	shardGroupLabel = "data.my.domain/shard-group"
+
+	// shardRingReplicas is the number of points of each member on the hash ring. More points spread the logical
+	// clusters more evenly, and move fewer of them when a member joins or leaves.
+	shardRingReplicas = 100
+)
+
+// Sharder splits the logical clusters between the replicas of the controller-manager: each replica renews a Lease
+// for itself, and the logical clusters are assigned to the replicas with a live Lease by consistent hashing of their
+// names. When a replica joins or leaves, the others pick up the logical clusters they gained.
+//
+// A nil *Sharder owns every logical cluster.
+type Sharder struct {
+	// Client reads and writes the membership leases. It is not cluster-aware, the leases live in a single workspace
+	// such as the workspace of the APIExport.
+	Client client.Client
+	// Namespace is the namespace of the membership leases.
+	Namespace string
+	// Group is the name shared by all replicas that split the logical clusters between them.
+	Group string
+	// Identity is the name of this replica, unique within the group.
+	Identity string
+	// LeaseDuration is how long a replica is considered a member after it last renewed its lease.
+	LeaseDuration time.Duration
+	// RenewPeriod is the time between two renewals of the lease of this replica, and two checks of the membership.
+	RenewPeriod time.Duration
+
+	lock        sync.RWMutex
+	members     []string
+	ring        []ringPoint
+	subscribers []chan event.GenericEvent
+}
+
+type ringPoint struct {
+	hash   uint64
+	member string
+}
+
+// Start renews the lease of this replica and tracks the membership of the group until ctx is done. The lease is
+// deleted on return, so that the other replicas take over right away.
+func (s *Sharder) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("sharder").WithValues("group", s.Group, "identity", s.Identity)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := s.renew(ctx); err != nil {
+			logger.Error(err, "unable to renew membership lease")
+		}
+		members, err := s.liveMembers(ctx)
+		if err != nil {
+			logger.Error(err, "unable to list membership leases")
+			return
+		}
+		if s.setMembers(members) {
+			logger.Info("Shard membership changed", "members", members)
+		}
+	}, s.RenewPeriod)
+
+	// ctx is done, so give the lease up with a fresh one. It expires by itself after LeaseDuration anyway.
+	releaseCtx, cancel := context.WithTimeout(context.Background(), s.LeaseDuration)
+	defer cancel()
+	lease := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Namespace: s.Namespace, Name: s.leaseName()}}
+	if err := s.Client.Delete(releaseCtx, lease); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error releasing membership lease: %w", err)
+	}
+	return nil
+}
+
+// NeedLeaderElection makes every replica a member, whether or not it is the leader.
+func (s *Sharder) NeedLeaderElection() bool {
+	return false
+}
+
+// leaseName returns the name of the membership lease of this replica.
+func (s *Sharder) leaseName() string {
+	return s.Group + "-" + s.Identity
+}
+
+// renew creates or renews the membership lease of this replica.
+func (s *Sharder) renew(ctx context.Context) error {
+	now := metav1.NewMicroTime(time.Now())
+	lease := &coordinationv1.Lease{}
+	err := s.Client.Get(ctx, client.ObjectKey{Namespace: s.Namespace, Name: s.leaseName()}, lease)
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: s.Namespace,
+				Name:      s.leaseName(),
+				Labels:    map[string]string{shardGroupLabel: s.Group},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       pointer.String(s.Identity),
+				LeaseDurationSeconds: pointer.Int32(int32(s.LeaseDuration.Seconds())),
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		return s.Client.Create(ctx, lease)
+	}
+	if err != nil {
+		return err
+	}
+	lease.Spec.HolderIdentity = pointer.String(s.Identity)
+	lease.Spec.LeaseDurationSeconds = pointer.Int32(int32(s.LeaseDuration.Seconds()))
+	lease.Spec.RenewTime = &now
+	return s.Client.Update(ctx, lease)
+}
+
+// liveMembers returns the sorted identities of the replicas of the group whose lease has not expired. This replica is
+// always a member, even if it failed to renew its own lease.
+func (s *Sharder) liveMembers(ctx context.Context) ([]string, error) {
+	var leases coordinationv1.LeaseList
+	if err := s.Client.List(ctx, &leases, client.InNamespace(s.Namespace), client.MatchingLabels{shardGroupLabel: s.Group}); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	members := map[string]bool{s.Identity: true}
+	for _, lease := range leases.Items {
+		spec := lease.Spec
+		if spec.HolderIdentity == nil || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		if spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second).Before(now) {
+			continue
+		}
+		members[*spec.HolderIdentity] = true
+	}
+	identities := make([]string, 0, len(members))
+	for identity := range members {
+		identities = append(identities, identity)
+	}
+	sort.Strings(identities)
+	return identities, nil
+}
+
+// setMembers rebuilds the hash ring for the members and notifies the subscribers if they changed.
+func (s *Sharder) setMembers(members []string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if equalStrings(s.members, members) {
+		return false
+	}
+	s.members = members
+	s.ring = newRing(members)
+	for _, subscriber := range s.subscribers {
+		// A resync that is still pending covers this change as well
+		select {
+		case subscriber <- event.GenericEvent{Object: &coordinationv1.Lease{}}:
+		default:
+		}
+	}
+	return true
+}
+
+// Members returns the sorted identities of the current members of the group, or nil if the membership is not known
+// yet.
+func (s *Sharder) Members() []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]string(nil), s.members...)
+}
+
+// Owns returns whether this replica reconciles the logical cluster. Until the membership is known, it owns none.
+func (s *Sharder) Owns(cluster logicalcluster.Name) bool {
+	if s == nil {
+		return true
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return ownerOf(s.ring, cluster) == s.Identity
+}
+
+// Predicate filters out the events of objects in logical clusters owned by other replicas.
+func (s *Sharder) Predicate() predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return s.Owns(logicalcluster.From(obj))
+	})
+}
+
+// Resync returns a source that emits an event whenever the membership changes, so that a controller can enqueue the
+// objects of the logical clusters this replica gained. Each controller needs its own source. It returns nil for a nil
+// *Sharder.
+func (s *Sharder) Resync() source.Source {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	subscriber := make(chan event.GenericEvent, 1)
+	s.subscribers = append(s.subscribers, subscriber)
+	return &source.Channel{Source: subscriber}
+}
+
+// newRing returns the hash ring of the members, sorted by hash.
+func newRing(members []string) []ringPoint {
+	ring := make([]ringPoint, 0, len(members)*shardRingReplicas)
+	for _, member := range members {
+		for i := 0; i < shardRingReplicas; i++ {
+			ring = append(ring, ringPoint{hash: ringHash(fmt.Sprintf("%s#%d", member, i)), member: member})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].member < ring[j].member
+	})
+	return ring
+}
+
+// ownerOf returns the member owning the logical cluster, the first point of the ring at or after its hash, or "" for
+// an empty ring.
+func ownerOf(ring []ringPoint, cluster logicalcluster.Name) string {
+	if len(ring) == 0 {
+		return ""
+	}
+	hash := ringHash(cluster.String())
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].member
+}
+
+// ringHash places a key on the ring. FNV would be cheaper, but spreads similar keys such as the points of a member
+// too unevenly.
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kcp-dev/logicalcluster/v3"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+func testClusters(n int) []logicalcluster.Name {
+	clusters := make([]logicalcluster.Name, 0, n)
+	for i := 0; i < n; i++ {
+		clusters = append(clusters, logicalcluster.Name(fmt.Sprintf("root:tenant-%d", i)))
+	}
+	return clusters
+}
+
+func TestShardRing(t *testing.T) {
+	clusters := testClusters(1000)
+	before := newRing([]string{"a", "b", "c"})
+	after := newRing([]string{"a", "c"})
+
+	shares := map[string]int{}
+	for _, cluster := range clusters {
+		owner := ownerOf(before, cluster)
+		shares[owner]++
+		// Only the logical clusters of the member that left move
+		if owner != "b" && ownerOf(after, cluster) != owner {
+			t.Errorf("expected %s to stay with %s when b leaves, moved to %s", cluster, owner, ownerOf(after, cluster))
+		}
+	}
+	for _, member := range []string{"a", "b", "c"} {
+		if shares[member] < len(clusters)/5 {
+			t.Errorf("expected each member to own a fair share of the logical clusters, got %v", shares)
+		}
+	}
+
+	if owner := ownerOf(nil, "root:tenant-0"); owner != "" {
+		t.Errorf("expected no owner without members, got %q", owner)
+	}
+	var s *Sharder
+	if !s.Owns("root:tenant-0") {
+		t.Error("expected a nil sharder to own every logical cluster")
+	}
+}
+
+// startSharder runs a member of the group "test" until the returned function is called.
+func startSharder(t *testing.T, c client.Client, identity string) (*Sharder, func()) {
+	t.Helper()
+	s := &Sharder{
+		Client:        c,
+		Namespace:     "default",
+		Group:         "test",
+		Identity:      identity,
+		LeaseDuration: 2 * time.Second,
+		RenewPeriod:   100 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := s.Start(ctx); err != nil {
+			t.Errorf("failed to run sharder %s: %v", identity, err)
+		}
+	}()
+	stop := func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return s, stop
+}
+
+// waitForMembers waits until every sharder sees exactly the given members.
+func waitForMembers(t *testing.T, sharders []*Sharder, members ...string) {
+	t.Helper()
+	if err := wait.PollImmediate(50*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		for _, s := range sharders {
+			if !cmp.Equal(members, s.Members()) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}); err != nil {
+		for _, s := range sharders {
+			t.Logf("%s sees members %v", s.Identity, s.Members())
+		}
+		t.Fatalf("sharders never agreed on members %v", members)
+	}
+}
+
+// checkOwners checks that every logical cluster is owned by exactly one of the sharders.
+func checkOwners(t *testing.T, sharders []*Sharder, clusters []logicalcluster.Name) map[string]int {
+	t.Helper()
+	shares := map[string]int{}
+	for _, cluster := range clusters {
+		var owners []string
+		for _, s := range sharders {
+			if s.Owns(cluster) {
+				owners = append(owners, s.Identity)
+			}
+		}
+		if len(owners) != 1 {
+			t.Errorf("expected %s to be owned by exactly one replica, got %v", cluster, owners)
+			continue
+		}
+		shares[owners[0]]++
+	}
+	return shares
+}
+
+func TestSharderMembership(t *testing.T) {
+	server := fake.NewServer("root")
+	// Registered first, so that the server outlives the sharders
+	t.Cleanup(server.Close)
+	cfg := server.Config()
+	// Three replicas renewing every 100ms are well above the default client rate limit
+	cfg.QPS, cfg.Burst = 1000, 1000
+	c, err := client.New(cfg, client.Options{Scheme: newTestScheme(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clusters := testClusters(30)
+
+	a, _ := startSharder(t, c, "a")
+	resync := a.Resync().(*source.Channel).Source
+	b, stopB := startSharder(t, c, "b")
+	cc, _ := startSharder(t, c, "c")
+	waitForMembers(t, []*Sharder{a, b, cc}, "a", "b", "c")
+	if shares := checkOwners(t, []*Sharder{a, b, cc}, clusters); len(shares) != 3 {
+		t.Errorf("expected all replicas to own logical clusters, got %v", shares)
+	}
+
+	drain := func() {
+		for {
+			select {
+			case <-resync:
+			default:
+				return
+			}
+		}
+	}
+	drain()
+
+	// The lease of a replica is gone as soon as it stops, and the others take its logical clusters over
+	stopB()
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "test-b"}, &coordinationv1.Lease{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the lease of b to be deleted, got %v", err)
+	}
+	waitForMembers(t, []*Sharder{a, cc}, "a", "c")
+	checkOwners(t, []*Sharder{a, cc}, clusters)
+	select {
+	case <-resync:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Error("expected a resync when the membership changed")
+	}
+
+	// A replica joining takes its share back
+	b, _ = startSharder(t, c, "b")
+	waitForMembers(t, []*Sharder{a, b, cc}, "a", "b", "c")
+	checkOwners(t, []*Sharder{a, b, cc}, clusters)
+}
+
+func TestSharderPredicate(t *testing.T) {
+	s := &Sharder{Identity: "a"}
+	obj := widget("w", 0)
+	obj.Annotations = map[string]string{logicalcluster.AnnotationKey: "root:tenant-0"}
+	if s.Predicate().Generic(event.GenericEvent{Object: obj}) {
+		t.Error("expected no events before the membership is known")
+	}
+	s.setMembers([]string{"a"})
+	if !s.Predicate().Generic(event.GenericEvent{Object: obj}) {
+		t.Error("expected the only member to own every logical cluster")
+	}
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// drainPollInterval is the time between two checks of whether the workqueues are drained.
+const drainPollInterval = 50 * time.Millisecond
+
+// DrainStats counts the reconciles of a controller during a graceful shutdown.
+type DrainStats struct {
+	// InFlight is the number of reconciles still running when the shutdown period ended.
+	InFlight int
+	// Completed is the number of reconciles that finished successfully during the shutdown period.
+	Completed int
+	// Dropped is the number of requests that were not reconciled: the ones that failed or asked to be requeued during
+	// the shutdown period, since the workqueue no longer takes requests, and the ones still queued when it ended.
+	Dropped int
+}
+
+// Drainer lets the reconcilers of a manager finish their work when the manager is stopped, instead of having the
+// context of every API call canceled right away. The reconcilers wrapped by the Drainer keep a live context for
+// Timeout after the shutdown started, during which the controllers work off the requests already in their
+// workqueues, so that in-flight status updates are written. At the end, a summary is logged for each controller.
+//
+// The Drainer must be added to the manager, and the manager's GracefulShutdownTimeout must leave it enough time. A
+// nil *Drainer leaves the reconcilers as they are.
+type Drainer struct {
+	// Timeout is how long the reconcilers may run after the shutdown started.
+	Timeout time.Duration
+	// Shard tells the managers of several virtual workspace shards apart. The Drainer finds the workqueues of its
+	// controllers by name, so the names of the controllers of each manager must be unique, see ControllerName.
+	Shard string
+
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock     sync.Mutex
+	stopping bool
+	done     bool
+	inFlight map[string]int
+	stats    map[string]DrainStats
+}
+
+func (d *Drainer) init() {
+	d.once.Do(func() {
+		d.ctx, d.cancel = context.WithCancel(context.Background())
+		d.inFlight = map[string]int{}
+		d.stats = map[string]DrainStats{}
+	})
+}
+
+// ControllerName returns the name for the controller of a manager running under the Drainer: the controller with the
+// Shard appended, if any.
+func (d *Drainer) ControllerName(controller string) string {
+	if d == nil || d.Shard == "" {
+		return controller
+	}
+	return controller + "-" + d.Shard
+}
+
+// Wrap returns a reconciler that runs r under the Drainer. controller must be the name of the controller, see
+// ControllerName.
+func (d *Drainer) Wrap(controller string, r reconcile.Reconciler) reconcile.Reconciler {
+	if d == nil {
+		return r
+	}
+	d.init()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.inFlight[controller] = 0
+	return &drainingReconciler{drainer: d, controller: controller, reconciler: r}
+}
+
+// Start waits for ctx to be done, then for the wrapped reconcilers to drain their workqueues or for Timeout to pass,
+// and logs the summary.
+func (d *Drainer) Start(ctx context.Context) error {
+	d.init()
+	<-ctx.Done()
+	logger := log.FromContext(ctx).WithName("drainer")
+
+	d.lock.Lock()
+	d.stopping = true
+	d.lock.Unlock()
+	logger.Info("Draining workqueues", "timeout", d.Timeout)
+
+	deadline := time.NewTimer(d.Timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	// A request taken off the workqueue is briefly neither queued nor in flight, so drained has to hold twice in a row
+	idle := 0
+	for idle < 2 {
+		select {
+		case <-deadline.C:
+			idle = 2
+		case <-ticker.C:
+			if d.drained() {
+				idle++
+			} else {
+				idle = 0
+			}
+		}
+	}
+
+	d.lock.Lock()
+	d.done = true
+	depths := queueDepths()
+	for controller, inFlight := range d.inFlight {
+		stats := d.stats[controller]
+		stats.InFlight = inFlight
+		stats.Dropped += depths[controller]
+		d.stats[controller] = stats
+	}
+	d.lock.Unlock()
+	// Reconciles that are still running have run out of time
+	d.cancel()
+
+	summary := d.Summary()
+	controllers := make([]string, 0, len(summary))
+	for controller := range summary {
+		controllers = append(controllers, controller)
+	}
+	sort.Strings(controllers)
+	for _, controller := range controllers {
+		stats := summary[controller]
+		logger.Info("Shutdown summary", "controller", controller, "inFlight", stats.InFlight, "dropped", stats.Dropped, "completed", stats.Completed)
+	}
+	return nil
+}
+
+// NeedLeaderElection stops the Drainer together with the controllers, which only run while the manager leads.
+func (d *Drainer) NeedLeaderElection() bool {
+	return true
+}
+
+// Summary returns the stats of each controller. They are final once Start returned.
+func (d *Drainer) Summary() map[string]DrainStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	summary := make(map[string]DrainStats, len(d.stats))
+	for controller, stats := range d.stats {
+		summary[controller] = stats
+	}
+	return summary
+}
+
+// drained returns whether no wrapped reconciler is running and their workqueues are empty.
+func (d *Drainer) drained() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	depths := queueDepths()
+	for controller, inFlight := range d.inFlight {
+		if inFlight > 0 || depths[controller] > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// queueDepths returns the depth of the workqueue of each controller, from the workqueue metrics of controller-runtime.
+func queueDepths() map[string]int {
+	depths := map[string]int{}
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		return depths
+	}
+	for _, family := range families {
+		if family.GetName() != "workqueue_depth" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "name" {
+					depths[label.GetValue()] += int(metric.GetGauge().GetValue())
+				}
+			}
+		}
+	}
+	return depths
+}
+
+type drainingReconciler struct {
+	drainer    *Drainer
+	controller string
+	reconciler reconcile.Reconciler
+}
+
+func (r *drainingReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	d := r.drainer
+	d.lock.Lock()
+	if d.done {
+		// The summary counted the request as dropped while it was still queued
+		d.lock.Unlock()
+		return ctrl.Result{}, nil
+	}
+	d.inFlight[r.controller]++
+	d.lock.Unlock()
+
+	result, err := r.reconciler.Reconcile(&drainContext{Context: d.ctx, values: ctx}, req)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.inFlight[r.controller]--
+	if d.stopping && !d.done {
+		stats := d.stats[r.controller]
+		if err != nil || result.Requeue || result.RequeueAfter > 0 {
+			stats.Dropped++
+		} else {
+			stats.Completed++
+		}
+		d.stats[r.controller] = stats
+	}
+	return result, err
+}
+
+// drainContext is canceled with the Drainer rather than with the manager, but carries the values of the context of
+// the reconcile, such as its logger.
+type drainContext struct {
+	context.Context
+	values context.Context
+}
+
+func (c *drainContext) Value(key interface{}) interface{} {
+	return c.values.Value(key)
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/kcp"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+// blockingClient holds every status patch until it is released, or until the context of the patch is done.
+type blockingClient struct {
+	client.Client
+	patching chan<- struct{}
+	release  <-chan struct{}
+}
+
+func (c *blockingClient) Status() client.StatusWriter {
+	return &blockingStatusWriter{StatusWriter: c.Client.Status(), client: c}
+}
+
+type blockingStatusWriter struct {
+	client.StatusWriter
+	client *blockingClient
+}
+
+func (w *blockingStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	w.client.patching <- struct{}{}
+	select {
+	case <-w.client.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return w.StatusWriter.Patch(ctx, obj, patch, opts...)
+}
+
+// startDrainingManager starts a cluster-aware manager running the Widget controller under a Drainer, with status
+// patches going through a blockingClient. The returned function stops the manager and waits for it to return.
+func startDrainingManager(t *testing.T, s *fake.Server, drainer *Drainer, patching chan<- struct{}, release <-chan struct{}) func() {
+	t.Helper()
+	cfg := rest.CopyConfig(s.Config())
+	cfg.Host = s.VirtualWorkspaceURL("data.my.domain")
+	gracefulShutdownTimeout := drainer.Timeout + 5*time.Second
+	mgr, err := kcp.NewClusterAwareManager(cfg, ctrl.Options{
+		Scheme:                  newTestScheme(t),
+		MetricsBindAddress:      "0",
+		HealthProbeBindAddress:  "0",
+		GracefulShutdownTimeout: &gracefulShutdownTimeout,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Add(drainer); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&WidgetReconciler{
+		ClusterClient: NewClusterClient(&blockingClient{Client: mgr.GetClient(), patching: patching, release: release}),
+		Scheme:        mgr.GetScheme(),
+		Drainer:       drainer,
+	}).SetupWithManager(mgr); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := mgr.Start(ctx); err != nil {
+			t.Errorf("failed to run manager: %v", err)
+		}
+	}()
+	return func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatal("manager did not stop")
+		}
+	}
+}
+
+func createWidgets(t *testing.T, s *fake.Server, cluster logicalcluster.Name, names ...string) client.Client {
+	t.Helper()
+	c, err := client.New(s.ClusterConfig(cluster), client.Options{Scheme: newTestScheme(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := c.Create(context.Background(), widget(name, 0)); err != nil {
+			t.Fatalf("failed to create widget %s: %v", name, err)
+		}
+	}
+	return c
+}
+
+func TestDrainerFinishesInFlightReconcile(t *testing.T) {
+	s := fake.NewServer("root")
+	t.Cleanup(s.Close)
+	c := createWidgets(t, s, clusterA, "w")
+
+	patching, release := make(chan struct{}, 10), make(chan struct{})
+	drainer := &Drainer{Timeout: 5 * time.Second}
+	stop := startDrainingManager(t, s, drainer, patching, release)
+
+	select {
+	case <-patching:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("the status of the widget was never patched")
+	}
+	// Cancel the manager while the reconcile is patching the status, and let the patch through once the manager's
+	// context is done
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		stop()
+	}()
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	<-stopped
+
+	var w datav1alpha1.Widget
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "w"}, &w); err != nil {
+		t.Fatal(err)
+	}
+	if w.Status.Total != 1 {
+		t.Errorf("expected the status patch to be written during the shutdown, got total %d", w.Status.Total)
+	}
+	// The widget may have been queued again while it was reconciled, in which case it is reconciled once more
+	if summary := drainer.Summary()["widget"]; summary.InFlight != 0 || summary.Dropped != 0 || summary.Completed < 1 {
+		t.Errorf("expected the in-flight reconcile to complete and nothing to be dropped, got %+v", summary)
+	}
+}
+
+func TestDrainerTimeout(t *testing.T) {
+	s := fake.NewServer("root")
+	t.Cleanup(s.Close)
+	c := createWidgets(t, s, clusterA, "w", "x")
+
+	// The status patch is never released, so the reconcile is still in flight when the shutdown period ends, and the
+	// other widget is still queued behind it
+	patching := make(chan struct{}, 10)
+	drainer := &Drainer{Timeout: 500 * time.Millisecond}
+	stop := startDrainingManager(t, s, drainer, patching, nil)
+
+	select {
+	case <-patching:
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatal("the status of the widget was never patched")
+	}
+	stop()
+
+	summary := drainer.Summary()["widget"]
+	if summary.InFlight != 1 || summary.Completed != 0 || summary.Dropped < 1 {
+		t.Errorf("expected one reconcile in flight and the queued one dropped, got %+v", summary)
+	}
+	var list datav1alpha1.WidgetList
+	if err := c.List(context.Background(), &list); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range list.Items {
+		if w.Status.Total != 0 {
+			t.Errorf("expected no status to be written, got total %d for %s", w.Status.Total, w.Name)
+		}
+	}
+}
+
+func TestDrainerShards(t *testing.T) {
+	if got := (*Drainer)(nil).ControllerName("widget"); got != "widget" {
+		t.Errorf("expected a nil Drainer to keep the name, got %q", got)
+	}
+	if got := (&Drainer{}).ControllerName("widget"); got != "widget" {
+		t.Errorf("expected a Drainer without shard to keep the name, got %q", got)
+	}
+
+	// The managers of two shards run the same controllers, and only the workqueue of the second one has requests
+	first, second := &Drainer{Shard: "0000000a"}, &Drainer{Shard: "0000000b"}
+	noop := reconcile.Func(func(context.Context, reconcile.Request) (reconcile.Result, error) { return reconcile.Result{}, nil })
+	for _, d := range []*Drainer{first, second} {
+		d.Wrap(d.ControllerName("widget"), noop)
+	}
+	if got := second.ControllerName("widget"); got != "widget-0000000b" {
+		t.Errorf("expected the shard in the name of the controller, got %q", got)
+	}
+	queue := workqueue.NewNamed(second.ControllerName("widget"))
+	defer queue.ShutDown()
+	queue.Add("request")
+
+	if !first.drained() {
+		t.Error("expected the first shard to be drained")
+	}
+	if second.drained() {
+		t.Error("expected the second shard to wait for its queued request")
+	}
+}
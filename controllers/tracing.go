@@ -0,0 +1,211 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/kontext"
+)
+
+// tracerName is the name of the tracer of the spans of this package.
+const tracerName = "github.com/kcp-dev/controller-runtime-example/controllers"
+
+// tracePropagator carries the trace context of the client calls to kcp as W3C Trace Context and Baggage headers.
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// TracingOptions configures the export of spans over OTLP/HTTP.
+type TracingOptions struct {
+	// Endpoint is the host and port of the OTLP/HTTP receiver, such as "otel-collector:4318".
+	Endpoint string
+	// Insecure sends spans over plain HTTP instead of HTTPS.
+	Insecure bool
+	// SamplingRatio is the fraction of the traces started by the controllers that are sampled. Traces started by a
+	// caller are sampled according to the caller.
+	SamplingRatio float64
+}
+
+// NewTracerProvider returns a TracerProvider that exports spans to the OTLP receiver at opts.Endpoint. It has to be
+// shut down to flush the last spans.
+func NewTracerProvider(ctx context.Context, opts TracingOptions) (*sdktrace.TracerProvider, error) {
+	if opts.SamplingRatio < 0 || opts.SamplingRatio > 1 {
+		return nil, fmt.Errorf("the sampling ratio must be between 0 and 1: %v", opts.SamplingRatio)
+	}
+	exporterOpts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(opts.Endpoint)}
+	if opts.Insecure {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, exporterOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OTLP exporter: %w", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SamplingRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("controller-runtime-example"))),
+	), nil
+}
+
+// TracingTransport propagates the trace context of each request to the server. It is meant for rest.Config.Wrap.
+func TracingTransport(rt http.RoundTripper) http.RoundTripper {
+	return &tracingTransport{rt: rt}
+}
+
+type tracingTransport struct {
+	rt http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if trace.SpanContextFromContext(req.Context()).IsValid() {
+		// RoundTrippers must not modify the request
+		req = req.Clone(req.Context())
+		tracePropagator.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	}
+	return t.rt.RoundTrip(req)
+}
+
+// startReconcileSpan starts the span of a reconcile of the request. tp defaults to the global TracerProvider.
+func startReconcileSpan(ctx context.Context, tp trace.TracerProvider, controller string, req ctrl.Request) (context.Context, trace.Span) {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName).Start(ctx, "Reconcile "+controller, trace.WithAttributes(
+		attribute.String("controller", controller),
+		attribute.String("cluster", req.ClusterName),
+		attribute.String("namespace", req.Namespace),
+		attribute.String("name", req.Name),
+	))
+}
+
+// endSpan ends the span, recording err if there was one.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// NewTracingClient returns a client that records a span for every request made through c, as a child of the span in
+// the context of the request.
+func NewTracingClient(c client.Client, tp trace.TracerProvider) client.Client {
+	return &tracingClient{Client: c, tracer: tp.Tracer(tracerName)}
+}
+
+type tracingClient struct {
+	client.Client
+	tracer trace.Tracer
+}
+
+// start starts the span of a request for obj.
+func (c *tracingClient) start(ctx context.Context, verb string, obj runtime.Object) (context.Context, trace.Span) {
+	attributes := []attribute.KeyValue{attribute.String("verb", verb)}
+	if gvk, err := apiutil.GVKForObject(obj, c.Scheme()); err == nil {
+		attributes = append(attributes, attribute.String("kind", gvk.Kind))
+	}
+	if o, ok := obj.(client.Object); ok {
+		if o.GetNamespace() != "" {
+			attributes = append(attributes, attribute.String("namespace", o.GetNamespace()))
+		}
+		if o.GetName() != "" {
+			attributes = append(attributes, attribute.String("name", o.GetName()))
+		}
+	}
+	if cluster, ok := kontext.ClusterFrom(ctx); ok {
+		attributes = append(attributes, attribute.String("cluster", cluster.String()))
+	}
+	return c.tracer.Start(ctx, "client "+verb, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+}
+
+func (c *tracingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) (err error) {
+	ctx, span := c.start(ctx, "Get", obj)
+	span.SetAttributes(attribute.String("namespace", key.Namespace), attribute.String("name", key.Name))
+	defer func() { endSpan(span, err) }()
+	return c.Client.Get(ctx, key, obj)
+}
+
+func (c *tracingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) (err error) {
+	ctx, span := c.start(ctx, "List", list)
+	defer func() { endSpan(span, err) }()
+	return c.Client.List(ctx, list, opts...)
+}
+
+func (c *tracingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) (err error) {
+	ctx, span := c.start(ctx, "Create", obj)
+	defer func() { endSpan(span, err) }()
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) (err error) {
+	ctx, span := c.start(ctx, "Delete", obj)
+	defer func() { endSpan(span, err) }()
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) (err error) {
+	ctx, span := c.start(ctx, "Update", obj)
+	defer func() { endSpan(span, err) }()
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) (err error) {
+	ctx, span := c.start(ctx, "Patch", obj)
+	defer func() { endSpan(span, err) }()
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c *tracingClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) (err error) {
+	ctx, span := c.start(ctx, "DeleteAllOf", obj)
+	defer func() { endSpan(span, err) }()
+	return c.Client.DeleteAllOf(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Status() client.StatusWriter {
+	return &tracingStatusWriter{StatusWriter: c.Client.Status(), client: c}
+}
+
+type tracingStatusWriter struct {
+	client.StatusWriter
+	client *tracingClient
+}
+
+func (w *tracingStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) (err error) {
+	ctx, span := w.client.start(ctx, "UpdateStatus", obj)
+	defer func() { endSpan(span, err) }()
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+func (w *tracingStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) (err error) {
+	ctx, span := w.client.start(ctx, "PatchStatus", obj)
+	defer func() { endSpan(span, err) }()
+	return w.StatusWriter.Patch(ctx, obj, patch, opts...)
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+// otlpCollector is an in-process stand-in for an OTLP/HTTP receiver that keeps the spans it receives.
+type otlpCollector struct {
+	*httptest.Server
+
+	lock  sync.Mutex
+	spans []*tracepb.Span
+}
+
+func newOTLPCollector(t *testing.T) *otlpCollector {
+	t.Helper()
+	c := &otlpCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var request coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.lock.Lock()
+		for _, resourceSpans := range request.GetResourceSpans() {
+			for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+				c.spans = append(c.spans, scopeSpans.GetSpans()...)
+			}
+		}
+		c.lock.Unlock()
+
+		response, err := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(response)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *otlpCollector) endpoint() string {
+	return strings.TrimPrefix(c.URL, "http://")
+}
+
+func (c *otlpCollector) received() []*tracepb.Span {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]*tracepb.Span(nil), c.spans...)
+}
+
+func spanAttributes(span *tracepb.Span) map[string]string {
+	attributes := map[string]string{}
+	for _, kv := range span.GetAttributes() {
+		attributes[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	return attributes
+}
+
+func TestWidgetReconcileTracing(t *testing.T) {
+	collector := newOTLPCollector(t)
+	ctx := context.Background()
+	tp, err := NewTracerProvider(ctx, TracingOptions{Endpoint: collector.endpoint(), Insecure: true, SamplingRatio: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusters := fake.NewClusterClient(newTestScheme(t)).
+		WithObjects(clusterA, widget("w", 0), widget("x", 0)).
+		WithObjects(clusterB, widget("w", 0))
+	r := &WidgetReconciler{
+		ClusterClient:  NewClusterClient(NewTracingClient(clusters, tp)),
+		TracerProvider: tp,
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{
+		NamespacedName: types.NamespacedName{Namespace: "default", Name: "w"},
+		ClusterName:    clusterA.String(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Shutting down flushes the spans to the collector
+	if err := tp.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to export spans: %v", err)
+	}
+
+	spans := collector.received()
+	var reconcile *tracepb.Span
+	for _, span := range spans {
+		if span.GetName() == "Reconcile widget" {
+			reconcile = span
+		}
+	}
+	if reconcile == nil {
+		t.Fatalf("expected a reconcile span, got %v", spans)
+	}
+	expected := map[string]string{"controller": "widget", "cluster": clusterA.String(), "namespace": "default", "name": "w"}
+	if diff := cmp.Diff(expected, spanAttributes(reconcile)); diff != "" {
+		t.Errorf("unexpected reconcile span attributes (-want +got):\n%s", diff)
+	}
+
+	var calls []string
+	for _, span := range spans {
+		if span == reconcile {
+			continue
+		}
+		if !bytes.Equal(span.GetTraceId(), reconcile.GetTraceId()) || !bytes.Equal(span.GetParentSpanId(), reconcile.GetSpanId()) {
+			t.Errorf("expected span %q to be a child of the reconcile span", span.GetName())
+		}
+		attributes := spanAttributes(span)
+		calls = append(calls, strings.Join([]string{span.GetName(), attributes["kind"], attributes["cluster"], attributes["name"]}, " "))
+	}
+	sort.Strings(calls)
+	// The first List spans all logical clusters, every other call is scoped to the logical cluster of the request
+	expectedCalls := []string{
+		"client Get Widget cluster-a w",
+		"client Get WidgetQuota cluster-a default",
+		"client List WidgetList  ",
+		"client List WidgetList cluster-a ",
+		"client PatchStatus Widget cluster-a w",
+	}
+	if diff := cmp.Diff(expectedCalls, calls); diff != "" {
+		t.Errorf("unexpected client spans (-want +got):\n%s", diff)
+	}
+}
+
+func TestTracingTransport(t *testing.T) {
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+	httpClient := &http.Client{Transport: TracingTransport(http.DefaultTransport)}
+
+	get := func(ctx context.Context) {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get(context.Background())
+	if traceparent != "" {
+		t.Errorf("expected no trace context without a span, got %q", traceparent)
+	}
+
+	tp := sdktrace.NewTracerProvider()
+	ctx, span := tp.Tracer("test").Start(context.Background(), "request")
+	defer span.End()
+	get(ctx)
+	if traceID := span.SpanContext().TraceID().String(); !strings.Contains(traceparent, traceID) {
+		t.Errorf("expected the trace context of trace %s, got %q", traceID, traceparent)
+	}
+}
+
+func TestNewTracerProviderInvalidSamplingRatio(t *testing.T) {
+	if _, err := NewTracerProvider(context.Background(), TracingOptions{Endpoint: "localhost:4318", SamplingRatio: 2}); err == nil {
+		t.Error("expected an error for a sampling ratio above 1")
+	}
+}
@@ -20,28 +20,53 @@ import (
 	"context"
 
 	"github.com/kcp-dev/logicalcluster/v3"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/kontext"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
 )
 
 // WidgetReconciler reconciles a Widget object
 type WidgetReconciler struct {
-	client.Client
+	ClusterClient
 	Scheme *runtime.Scheme
+	// TracerProvider records the span of each reconcile. It defaults to the global TracerProvider.
+	TracerProvider trace.TracerProvider
+	// Sharder restricts the reconciler to the logical clusters owned by this replica. If nil, it reconciles all of
+	// them.
+	Sharder *Sharder
+	// Drainer lets in-flight reconciles finish when the manager stops. If nil, they are canceled right away.
+	Drainer *Drainer
 }
 
 // +kubebuilder:rbac:groups=data.my.domain,resources=widgets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=data.my.domain,resources=widgets/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=data.my.domain,resources=widgets/finalizers,verbs=update
+// +kubebuilder:rbac:groups=data.my.domain,resources=widgetquotas,verbs=get;list;watch
+// +kubebuilder:rbac:groups=data.my.domain,resources=widgetquotas/status,verbs=get;update;patch
+
+// Reconcile records the number of widgets in the logical cluster of the request: in the total of the requested widget,
+// in the usage of the WidgetQuota of the logical cluster and in the widget metrics. A request without a name is the
+// recount of the logical cluster, see clusterRecount, which corrects the total of all its widgets.
+func (r *WidgetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, err error) {
+	if !r.Sharder.Owns(logicalcluster.Name(req.ClusterName)) {
+		// Another replica took the logical cluster over since the request was queued
+		return ctrl.Result{}, nil
+	}
+
+	ctx, span := startReconcileSpan(ctx, r.TracerProvider, "widget", req)
+	defer func() { endSpan(span, err) }()
 
-// Reconcile TODO
-func (r *WidgetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
 
 	// Include the clusterName from req.ObjectKey in the logger, similar to the namespace and name keys that are already
@@ -56,14 +81,30 @@ func (r *WidgetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 
 	logger.Info("Listed all widgets across all workspaces", "count", len(allWidgets.Items))
 
-	// Add the logical cluster to the context
-	ctx = kontext.WithCluster(ctx, logicalcluster.Name(req.ClusterName))
+	// Scope the client to the logical cluster
+	cluster := logicalcluster.Name(req.ClusterName)
+	defer func() { clusterMetrics.reconcileError("widget", cluster, err) }()
+	c := r.ForCluster(cluster)
+
+	// The count of the logical cluster is recorded even if there are no widgets left to reconcile
+	counts := map[logicalcluster.Name]int{cluster: 0}
+	for i := range allWidgets.Items {
+		if from := logicalcluster.From(&allWidgets.Items[i]); r.Sharder.Owns(from) {
+			counts[from]++
+		}
+	}
+	// The managers of the replica count the widgets of their own logical clusters, see Sharder
+	clusterMetrics.setWidgets(r.Drainer.ControllerName("widget"), counts)
+
+	if req.Name == "" {
+		return ctrl.Result{}, r.recount(ctx, c)
+	}
 
 	logger.Info("Getting widget")
 	var w datav1alpha1.Widget
-	if err := r.Get(ctx, req.NamespacedName, &w); err != nil {
+	if err := c.Get(ctx, req.NamespacedName, &w); err != nil {
 		if errors.IsNotFound(err) {
-			// Normal - was deleted
+			// Normal - was deleted. The recount of the logical cluster queued by the deletion takes care of the others.
 			return ctrl.Result{}, nil
 		}
 
@@ -72,11 +113,14 @@ func (r *WidgetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 
 	logger.Info("Listing all widgets in the current logical cluster")
 	var list datav1alpha1.WidgetList
-	if err := r.List(ctx, &list); err != nil {
+	if err := c.List(ctx, &list); err != nil {
 		return ctrl.Result{}, err
 	}
 
 	numWidgets := len(list.Items)
+	if err := setWidgetQuotaUsage(ctx, c, numWidgets); err != nil {
+		return ctrl.Result{}, err
+	}
 
 	if numWidgets == w.Status.Total {
 		logger.Info("No need to patch because the widget status is already correct")
@@ -89,16 +133,103 @@ func (r *WidgetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctr
 
 	w.Status.Total = numWidgets
 
-	if err := r.Status().Patch(ctx, &w, patch); err != nil {
+	if err := c.Status().Patch(ctx, &w, patch); err != nil {
 		return ctrl.Result{}, err
 	}
 
 	return ctrl.Result{}, nil
 }
 
+// recount corrects the total of every widget in the logical cluster of c, and the usage of its WidgetQuota.
+func (r *WidgetReconciler) recount(ctx context.Context, c client.Client) error {
+	logger := log.FromContext(ctx)
+
+	logger.Info("Recounting all widgets in the current logical cluster")
+	var list datav1alpha1.WidgetList
+	if err := c.List(ctx, &list); err != nil {
+		return err
+	}
+
+	numWidgets := len(list.Items)
+	if err := setWidgetQuotaUsage(ctx, c, numWidgets); err != nil {
+		return err
+	}
+
+	for i := range list.Items {
+		w := &list.Items[i]
+		if w.Status.Total == numWidgets {
+			continue
+		}
+		logger.Info("Patching widget status to store total widget count in the current logical cluster", "name", w.Name, "namespace", w.Namespace)
+		patch := client.MergeFrom(w.DeepCopy())
+		w.Status.Total = numWidgets
+		// A widget deleted since it was listed has queued another recount
+		if err := c.Status().Patch(ctx, w, patch); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *WidgetReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&datav1alpha1.Widget{}).
-		Complete(r)
+	name := r.Drainer.ControllerName("widget")
+	b := ctrl.NewControllerManagedBy(mgr).
+		Named(name).
+		For(&datav1alpha1.Widget{}, builder.WithPredicates(r.Sharder.Predicate())).
+		// Creating or deleting a widget changes the total of every other widget in the same logical cluster
+		Watches(
+			&source.Kind{Type: &datav1alpha1.Widget{}},
+			handler.EnqueueRequestsFromMapFunc(clusterRecount),
+			builder.WithPredicates(predicate.Funcs{
+				UpdateFunc:  func(event.UpdateEvent) bool { return false },
+				GenericFunc: func(event.GenericEvent) bool { return false },
+			}, r.Sharder.Predicate()),
+		).
+		// A new WidgetQuota gets the usage of its logical cluster from its recount
+		Watches(
+			&source.Kind{Type: &datav1alpha1.WidgetQuota{}},
+			handler.EnqueueRequestsFromMapFunc(clusterRecount),
+			builder.WithPredicates(predicate.Funcs{
+				CreateFunc:  func(e event.CreateEvent) bool { return e.Object.GetName() == datav1alpha1.WidgetQuotaName },
+				UpdateFunc:  func(event.UpdateEvent) bool { return false },
+				DeleteFunc:  func(event.DeleteEvent) bool { return false },
+				GenericFunc: func(event.GenericEvent) bool { return false },
+			}, r.Sharder.Predicate()),
+		)
+	if resync := r.Sharder.Resync(); resync != nil {
+		// The logical clusters this replica gained from a change of membership have to be caught up with
+		b = b.Watches(resync, handler.EnqueueRequestsFromMapFunc(r.ownedClusters))
+	}
+	return b.Complete(r.Drainer.Wrap(name, r))
+}
+
+// clusterRecount maps an object to the recount of its logical cluster, a request without a name: the workqueue
+// coalesces the recounts of a logical cluster, however many of its widgets change at once.
+func clusterRecount(obj client.Object) []reconcile.Request {
+	return []reconcile.Request{{ClusterName: logicalcluster.From(obj).String()}}
+}
+
+// ownedClusters maps a change of the shard membership to the recount of all logical clusters with widgets owned by
+// this replica.
+func (r *WidgetReconciler) ownedClusters(client.Object) []reconcile.Request {
+	ctx := context.Background()
+
+	var list datav1alpha1.WidgetList
+	if err := r.List(ctx, &list); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list widgets across all workspaces")
+		return nil
+	}
+
+	var requests []reconcile.Request
+	seen := map[logicalcluster.Name]struct{}{}
+	for i := range list.Items {
+		cluster := logicalcluster.From(&list.Items[i])
+		if _, ok := seen[cluster]; ok || !r.Sharder.Owns(cluster) {
+			continue
+		}
+		seen[cluster] = struct{}{}
+		requests = append(requests, reconcile.Request{ClusterName: cluster.String()})
+	}
+	return requests
 }
@@ -0,0 +1,89 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+)
+
+var _ = Describe("Widget controller", func() {
+	var (
+		ctx       context.Context
+		namespace string
+	)
+
+	// totals returns the status total of every widget. Without kcp, all widgets are in the same logical cluster.
+	totals := func() []int {
+		var list datav1alpha1.WidgetList
+		if err := k8sClient.List(ctx, &list); err != nil {
+			return nil
+		}
+		var totals []int
+		for _, widget := range list.Items {
+			totals = append(totals, widget.Status.Total)
+		}
+		return totals
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		namespace = createNamespace(ctx)
+	})
+
+	AfterEach(func() {
+		Expect(k8sClient.DeleteAllOf(ctx, &datav1alpha1.Widget{}, client.InNamespace(namespace))).To(Succeed())
+		Eventually(totals, timeout, interval).Should(BeEmpty())
+	})
+
+	It("counts the widgets in the logical cluster", func() {
+		for i := 0; i < 3; i++ {
+			Expect(k8sClient.Create(ctx, &datav1alpha1.Widget{
+				ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: fmt.Sprintf("widget-%d", i)},
+				Spec:       datav1alpha1.WidgetSpec{Foo: fmt.Sprintf("intended-%d", i)},
+			})).To(Succeed())
+		}
+		Eventually(totals, timeout, interval).Should(Equal([]int{3, 3, 3}))
+
+		By("updating a widget")
+		widget := &datav1alpha1.Widget{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: "widget-0"}, widget)).To(Succeed())
+		widget.Spec.Foo = "updated"
+		Expect(k8sClient.Update(ctx, widget)).To(Succeed())
+		Consistently(totals, time.Second, interval).Should(Equal([]int{3, 3, 3}))
+
+		By("deleting a widget")
+		Expect(k8sClient.Delete(ctx, widget)).To(Succeed())
+		Eventually(totals, timeout, interval).Should(Equal([]int{2, 2}))
+
+		By("creating a widget in another namespace")
+		otherNamespace := createNamespace(ctx)
+		Expect(k8sClient.Create(ctx, &datav1alpha1.Widget{
+			ObjectMeta: metav1.ObjectMeta{Namespace: otherNamespace, Name: "widget"},
+		})).To(Succeed())
+		Eventually(totals, timeout, interval).Should(Equal([]int{3, 3, 3}))
+		Expect(k8sClient.DeleteAllOf(ctx, &datav1alpha1.Widget{}, client.InNamespace(otherNamespace))).To(Succeed())
+	})
+})
@@ -0,0 +1,122 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+)
+
+// WidgetQuotaWebhookPath is the path of WidgetQuotaValidator on the webhook server of the manager.
+const WidgetQuotaWebhookPath = "/validate-data-my-domain-v1alpha1-widget"
+
+// WidgetQuotaValidator is a validating admission webhook that rejects the creation of a widget once its logical cluster
+// has as many widgets as its quota allows. The quota is the WidgetQuota named datav1alpha1.WidgetQuotaName in the
+// logical cluster, or DefaultMaxWidgets without one. The widgets are counted from the cache, so widgets created at the
+// same time can exceed the quota by a few.
+type WidgetQuotaValidator struct {
+	ClusterClient
+	// DefaultMaxWidgets is the quota of the logical clusters without a WidgetQuota. Zero means no limit.
+	DefaultMaxWidgets int
+
+	decoder *admission.Decoder
+}
+
+// +kubebuilder:webhook:path=/validate-data-my-domain-v1alpha1-widget,mutating=false,failurePolicy=fail,sideEffects=None,groups=data.my.domain,resources=widgets,verbs=create,versions=v1alpha1,name=vwidgetquota.data.my.domain,admissionReviewVersions=v1
+// +kubebuilder:rbac:groups=data.my.domain,resources=widgetquotas,verbs=get;list;watch
+
+// Handle admits the creation of a widget if its logical cluster is below its quota.
+func (v *WidgetQuotaValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1.Create {
+		return admission.Allowed("")
+	}
+	var widget datav1alpha1.Widget
+	if err := v.decoder.Decode(req, &widget); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	// kcp sets the logical cluster of the request on the object
+	cluster := logicalcluster.From(&widget)
+	c := v.ForCluster(cluster)
+	maxWidgets, limited, err := widgetQuota(ctx, c, v.DefaultMaxWidgets)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to get the widget quota", "clusterName", cluster)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if !limited {
+		return admission.Allowed("")
+	}
+	var list datav1alpha1.WidgetList
+	if err := c.List(ctx, &list); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list widgets", "clusterName", cluster)
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if len(list.Items) >= maxWidgets {
+		return admission.Denied(fmt.Sprintf("the workspace already has %d widgets, its quota is %d", len(list.Items), maxWidgets))
+	}
+	return admission.Allowed("")
+}
+
+// SetupWebhookWithManager registers the webhook on the webhook server of the manager.
+func (v *WidgetQuotaValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	v.decoder = decoder
+	mgr.GetWebhookServer().Register(WidgetQuotaWebhookPath, &webhook.Admission{Handler: v})
+	return nil
+}
+
+// widgetQuota returns the maximum number of widgets in the logical cluster of c, and false if it is not limited.
+func widgetQuota(ctx context.Context, c client.Client, defaultMaxWidgets int) (int, bool, error) {
+	var quota datav1alpha1.WidgetQuota
+	if err := c.Get(ctx, client.ObjectKey{Name: datav1alpha1.WidgetQuotaName}, &quota); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return 0, false, err
+		}
+		return defaultMaxWidgets, defaultMaxWidgets > 0, nil
+	}
+	return quota.Spec.MaxWidgets, true, nil
+}
+
+// setWidgetQuotaUsage records the number of widgets in the status of the WidgetQuota of the logical cluster of c, if
+// there is one.
+func setWidgetQuotaUsage(ctx context.Context, c client.Client, used int) error {
+	var quota datav1alpha1.WidgetQuota
+	if err := c.Get(ctx, client.ObjectKey{Name: datav1alpha1.WidgetQuotaName}, &quota); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if quota.Status.Used == used {
+		return nil
+	}
+	patch := client.MergeFrom(quota.DeepCopy())
+	quota.Status.Used = used
+	return c.Status().Patch(ctx, &quota, patch)
+}
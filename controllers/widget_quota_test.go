@@ -0,0 +1,102 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+func TestWidgetQuotaValidator(t *testing.T) {
+	clusterC := logicalcluster.Name("cluster-c")
+	quota := &datav1alpha1.WidgetQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: datav1alpha1.WidgetQuotaName},
+		Spec:       datav1alpha1.WidgetQuotaSpec{MaxWidgets: 3},
+	}
+	clusters := fake.NewClusterClient(newTestScheme(t)).
+		WithObjects(clusterA, widget("w", 0), widget("x", 0)).
+		WithObjects(clusterB, widget("w", 0), widget("x", 0), quota).
+		WithObjects(clusterC, widget("w", 0), &datav1alpha1.WidgetQuota{ObjectMeta: metav1.ObjectMeta{Name: datav1alpha1.WidgetQuotaName}})
+	decoder, err := admission.NewDecoder(clusters.Scheme())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(t *testing.T, cluster logicalcluster.Name, operation admissionv1.Operation) admission.Request {
+		t.Helper()
+		w := widget("new", 0)
+		w.Annotations = map[string]string{logicalcluster.AnnotationKey: cluster.String()}
+		raw, err := json.Marshal(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: operation,
+			Object:    runtime.RawExtension{Raw: raw},
+		}}
+	}
+
+	tests := []struct {
+		name              string
+		cluster           logicalcluster.Name
+		operation         admissionv1.Operation
+		defaultMaxWidgets int
+		wantAllowed       bool
+		wantReason        string
+	}{
+		{name: "no limit", cluster: clusterA, operation: admissionv1.Create, wantAllowed: true},
+		{name: "below the default", cluster: clusterA, operation: admissionv1.Create, defaultMaxWidgets: 3, wantAllowed: true},
+		{name: "at the default", cluster: clusterA, operation: admissionv1.Create, defaultMaxWidgets: 2, wantReason: "its quota is 2"},
+		{name: "quota overrides the default", cluster: clusterB, operation: admissionv1.Create, defaultMaxWidgets: 2, wantAllowed: true},
+		{name: "quota of zero", cluster: clusterC, operation: admissionv1.Create, wantReason: "already has 1 widgets, its quota is 0"},
+		{name: "updates are not limited", cluster: clusterA, operation: admissionv1.Update, defaultMaxWidgets: 1, wantAllowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &WidgetQuotaValidator{ClusterClient: clusters, DefaultMaxWidgets: tt.defaultMaxWidgets, decoder: decoder}
+			resp := v.Handle(context.Background(), request(t, tt.cluster, tt.operation))
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("expected allowed to be %v, got %v: %s", tt.wantAllowed, resp.Allowed, resp.Result.Reason)
+			}
+			if tt.wantReason != "" && !strings.Contains(string(resp.Result.Reason), tt.wantReason) {
+				t.Errorf("expected the denial to contain %q, got %q", tt.wantReason, resp.Result.Reason)
+			}
+		})
+	}
+
+	// Widgets of other logical clusters do not count
+	v := &WidgetQuotaValidator{ClusterClient: clusters, decoder: decoder}
+	for _, name := range []string{"y", "z"} {
+		if err := clusters.ForCluster(clusterA).Create(context.Background(), widget(name, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resp := v.Handle(context.Background(), request(t, clusterB, admissionv1.Create)); !resp.Allowed {
+		t.Errorf("expected %s to be below its quota: %s", clusterB, resp.Result.Reason)
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+func widget(name string, total int) *datav1alpha1.Widget {
+	return &datav1alpha1.Widget{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Status:     datav1alpha1.WidgetStatus{Total: total},
+	}
+}
+
+func TestWidgetReconcile(t *testing.T) {
+	tests := []struct {
+		name    string
+		objects []client.Object
+		// others are the widgets of another logical cluster, which must neither be counted nor touched.
+		others      []client.Object
+		request     string
+		wantTotal   int
+		wantPatched bool
+	}{
+		{
+			name:    "widget not found",
+			objects: []client.Object{widget("other", 0)},
+			others:  []client.Object{widget("missing", 0)},
+			request: "missing",
+		},
+		{
+			name:        "counts the widgets in the logical cluster",
+			objects:     []client.Object{widget("w", 0), widget("x", 0)},
+			others:      []client.Object{widget("w", 0), widget("y", 0), widget("z", 0)},
+			wantTotal:   2,
+			wantPatched: true,
+		},
+		{
+			name:        "corrects a stale total",
+			objects:     []client.Object{widget("w", 3)},
+			others:      []client.Object{widget("w", 3), widget("x", 3), widget("y", 3)},
+			wantTotal:   1,
+			wantPatched: true,
+		},
+		{
+			name:      "total already correct",
+			objects:   []client.Object{widget("w", 2), widget("x", 2)},
+			wantTotal: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clusters := fake.NewClusterClient(newTestScheme(t)).
+				WithObjects(clusterA, tt.objects...).
+				WithObjects(clusterB, tt.others...)
+			before := widgetVersions(t, clusters.ForCluster(clusterB))
+			beforeA := widgetVersions(t, clusters.ForCluster(clusterA))
+
+			r := &WidgetReconciler{ClusterClient: clusters, Scheme: clusters.Scheme()}
+
+			request := tt.request
+			if request == "" {
+				request = "w"
+			}
+			result, err := r.Reconcile(context.Background(), ctrl.Request{
+				NamespacedName: types.NamespacedName{Namespace: "default", Name: request},
+				ClusterName:    clusterA.String(),
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !result.IsZero() {
+				t.Errorf("expected empty result, got %+v", result)
+			}
+
+			if tt.request == "" {
+				var w datav1alpha1.Widget
+				if err := clusters.ForCluster(clusterA).Get(context.Background(), client.ObjectKey{Namespace: "default", Name: request}, &w); err != nil {
+					t.Fatal(err)
+				}
+				if w.Status.Total != tt.wantTotal {
+					t.Errorf("expected total %d, got %d", tt.wantTotal, w.Status.Total)
+				}
+			}
+			if patched := widgetVersions(t, clusters.ForCluster(clusterA)) != beforeA; patched != tt.wantPatched {
+				t.Errorf("expected patched to be %v, got %v", tt.wantPatched, patched)
+			}
+			if after := widgetVersions(t, clusters.ForCluster(clusterB)); after != before {
+				t.Errorf("expected %s to be untouched, got %v, want %v", clusterB, after, before)
+			}
+		})
+	}
+}
+
+func TestWidgetReconcileQuotaUsage(t *testing.T) {
+	quota := func(name string, used int) *datav1alpha1.WidgetQuota {
+		return &datav1alpha1.WidgetQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       datav1alpha1.WidgetQuotaSpec{MaxWidgets: 5},
+			Status:     datav1alpha1.WidgetQuotaStatus{Used: used},
+		}
+	}
+	clusters := fake.NewClusterClient(newTestScheme(t)).
+		WithObjects(clusterA, widget("w", 0), widget("x", 0), quota(datav1alpha1.WidgetQuotaName, 0), quota("ignored", 0)).
+		WithObjects(clusterB, widget("y", 0), quota(datav1alpha1.WidgetQuotaName, 7))
+	r := &WidgetReconciler{ClusterClient: clusters, Scheme: clusters.Scheme()}
+
+	used := func(cluster logicalcluster.Name, name string) int {
+		t.Helper()
+		var q datav1alpha1.WidgetQuota
+		if err := clusters.ForCluster(cluster).Get(context.Background(), client.ObjectKey{Name: name}, &q); err != nil {
+			t.Fatal(err)
+		}
+		return q.Status.Used
+	}
+	reconcile := func(cluster logicalcluster.Name, name string) {
+		t.Helper()
+		if _, err := r.Reconcile(context.Background(), ctrl.Request{
+			NamespacedName: types.NamespacedName{Namespace: "default", Name: name},
+			ClusterName:    cluster.String(),
+		}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	reconcile(clusterA, "w")
+	if got := used(clusterA, datav1alpha1.WidgetQuotaName); got != 2 {
+		t.Errorf("expected 2 widgets used in %s, got %d", clusterA, got)
+	}
+	if got := used(clusterA, "ignored"); got != 0 {
+		t.Errorf("expected the other quota to be ignored, got %d used", got)
+	}
+
+	// The usage drops with the recount that follows the deletion of a widget, even with none left
+	if err := clusters.ForCluster(clusterB).Delete(context.Background(), widget("y", 0)); err != nil {
+		t.Fatal(err)
+	}
+	reconcile(clusterB, "")
+	if got := used(clusterB, datav1alpha1.WidgetQuotaName); got != 0 {
+		t.Errorf("expected no widgets used in %s, got %d", clusterB, got)
+	}
+}
+
+func TestWidgetReconcileRecount(t *testing.T) {
+	clusters := fake.NewClusterClient(newTestScheme(t)).
+		WithObjects(clusterA, widget("w", 0), widget("x", 2), widget("y", 3)).
+		WithObjects(clusterB, widget("w", 0))
+	r := &WidgetReconciler{ClusterClient: clusters, Scheme: clusters.Scheme()}
+	c := clusters.ForCluster(clusterA)
+
+	var correct datav1alpha1.Widget
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: "default", Name: "y"}, &correct); err != nil {
+		t.Fatal(err)
+	}
+	before := widgetVersions(t, clusters.ForCluster(clusterB))
+
+	requests := clusterRecount(&correct)
+	if len(requests) != 1 || requests[0].ClusterName != clusterA.String() || requests[0].Name != "" {
+		t.Fatalf("expected a single recount of %s, got %v", clusterA, requests)
+	}
+	if _, err := r.Reconcile(context.Background(), requests[0]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var list datav1alpha1.WidgetList
+	if err := c.List(context.Background(), &list); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range list.Items {
+		if w.Status.Total != 3 {
+			t.Errorf("expected widget %s to have total 3, got %d", w.Name, w.Status.Total)
+		}
+		if w.Name == "y" && w.ResourceVersion != correct.ResourceVersion {
+			t.Errorf("expected the widget with a correct total not to be patched")
+		}
+	}
+	if after := widgetVersions(t, clusters.ForCluster(clusterB)); after != before {
+		t.Errorf("expected %s to be untouched, got %v, want %v", clusterB, after, before)
+	}
+}
+
+// widgetVersions returns the names and resource versions of the widgets in the logical cluster.
+func widgetVersions(t *testing.T, c client.Client) string {
+	t.Helper()
+	var list datav1alpha1.WidgetList
+	if err := c.List(context.Background(), &list); err != nil {
+		t.Fatal(err)
+	}
+	var versions string
+	for _, item := range list.Items {
+		versions += item.Name + "@" + item.ResourceVersion + ","
+	}
+	return versions
+}
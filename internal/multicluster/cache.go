@@ -0,0 +1,323 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// errNoCluster is returned for requests that need a cluster but have none.
+var errNoCluster = errors.New("the request has no cluster, see kontext.WithCluster")
+
+// clusterCache is a cache.Cache with one cache per cluster.
+type clusterCache struct {
+	// names are the names of the clusters in the order they were given.
+	names   []logicalcluster.Name
+	configs map[logicalcluster.Name]*rest.Config
+	mappers map[logicalcluster.Name]meta.RESTMapper
+	caches  map[logicalcluster.Name]cache.Cache
+}
+
+var _ cache.Cache = &clusterCache{}
+
+// NewCacheFunc returns a cache.NewCacheFunc for a cache that spans the clusters. The config it is called with is
+// ignored, each cluster is cached through its own config and REST mapper.
+func NewCacheFunc(clusters []Cluster) cache.NewCacheFunc {
+	return func(_ *rest.Config, opts cache.Options) (cache.Cache, error) {
+		c := &clusterCache{
+			configs: map[logicalcluster.Name]*rest.Config{},
+			mappers: map[logicalcluster.Name]meta.RESTMapper{},
+			caches:  map[logicalcluster.Name]cache.Cache{},
+		}
+		opts = withoutClusterAnnotation(opts)
+		for _, cluster := range clusters {
+			mapper, err := apiutil.NewDynamicRESTMapper(cluster.Config)
+			if err != nil {
+				return nil, fmt.Errorf("error creating the REST mapper of cluster %s: %w", cluster.Name, err)
+			}
+			clusterOpts := opts
+			clusterOpts.Mapper = mapper
+			clusterCache, err := cache.New(cluster.Config, clusterOpts)
+			if err != nil {
+				return nil, fmt.Errorf("error creating the cache of cluster %s: %w", cluster.Name, err)
+			}
+			c.names = append(c.names, cluster.Name)
+			c.configs[cluster.Name] = cluster.Config
+			c.mappers[cluster.Name] = mapper
+			c.caches[cluster.Name] = clusterCache
+		}
+		return c, nil
+	}
+}
+
+// withoutClusterAnnotation makes the transforms of opts drop the cluster annotation, which is only ever set on the
+// way out of the cache: a stale one stored in a cluster must not misroute its object.
+func withoutClusterAnnotation(opts cache.Options) cache.Options {
+	strip := func(transform toolscache.TransformFunc) toolscache.TransformFunc {
+		return func(obj interface{}) (interface{}, error) {
+			if o, ok := obj.(runtime.Object); ok {
+				unannotate(o)
+			}
+			if transform == nil {
+				return obj, nil
+			}
+			return transform(obj)
+		}
+	}
+	opts.DefaultTransform = strip(opts.DefaultTransform)
+	if opts.TransformByObject != nil {
+		transforms := make(cache.TransformByObject, len(opts.TransformByObject))
+		for obj, transform := range opts.TransformByObject {
+			transforms[obj] = strip(transform)
+		}
+		opts.TransformByObject = transforms
+	}
+	return opts
+}
+
+// cacheFor returns the cache of the cluster of the request.
+func (c *clusterCache) cacheFor(ctx context.Context, obj runtime.Object) (logicalcluster.Name, cache.Cache, error) {
+	cluster := clusterFor(ctx, obj)
+	if cluster.Empty() {
+		return "", nil, errNoCluster
+	}
+	clusterCache, ok := c.caches[cluster]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown cluster %s", cluster)
+	}
+	return cluster, clusterCache, nil
+}
+
+// Get implements client.Reader.
+func (c *clusterCache) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	cluster, clusterCache, err := c.cacheFor(ctx, obj)
+	if err != nil {
+		return err
+	}
+	if err := clusterCache.Get(ctx, key, obj); err != nil {
+		return err
+	}
+	annotate(obj, cluster)
+	return nil
+}
+
+// List implements client.Reader. Without a cluster, it lists across all clusters.
+func (c *clusterCache) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return listClusters(ctx, c.names, list, func(ctx context.Context, cluster logicalcluster.Name, list client.ObjectList) error {
+		clusterCache, ok := c.caches[cluster]
+		if !ok {
+			return fmt.Errorf("unknown cluster %s", cluster)
+		}
+		return clusterCache.List(ctx, list, opts...)
+	})
+}
+
+// listClusters lists in the cluster of the request with list, or else in each of the clusters, and annotates the
+// items with their cluster.
+func listClusters(ctx context.Context, clusters []logicalcluster.Name, list client.ObjectList, listCluster func(context.Context, logicalcluster.Name, client.ObjectList) error) error {
+	if cluster := clusterFor(ctx, nil); !cluster.Empty() {
+		if err := listCluster(ctx, cluster, list); err != nil {
+			return err
+		}
+		return annotateItems(list, cluster)
+	}
+
+	var items []runtime.Object
+	for _, cluster := range clusters {
+		clusterList := list.DeepCopyObject().(client.ObjectList)
+		if err := listCluster(ctx, cluster, clusterList); err != nil {
+			return fmt.Errorf("failed to list in cluster %s: %w", cluster, err)
+		}
+		if err := annotateItems(clusterList, cluster); err != nil {
+			return err
+		}
+		clusterItems, err := meta.ExtractList(clusterList)
+		if err != nil {
+			return err
+		}
+		items = append(items, clusterItems...)
+	}
+	return meta.SetList(list, items)
+}
+
+func annotateItems(list client.ObjectList, cluster logicalcluster.Name) error {
+	return meta.EachListItem(list, func(obj runtime.Object) error {
+		annotate(obj, cluster)
+		return nil
+	})
+}
+
+// GetInformer implements cache.Informers. The informer spans all clusters.
+func (c *clusterCache) GetInformer(ctx context.Context, obj client.Object) (cache.Informer, error) {
+	return c.informer(func(clusterCache cache.Cache) (cache.Informer, error) {
+		return clusterCache.GetInformer(ctx, obj)
+	})
+}
+
+// GetInformerForKind implements cache.Informers. The informer spans all clusters.
+func (c *clusterCache) GetInformerForKind(ctx context.Context, gvk schema.GroupVersionKind) (cache.Informer, error) {
+	return c.informer(func(clusterCache cache.Cache) (cache.Informer, error) {
+		return clusterCache.GetInformerForKind(ctx, gvk)
+	})
+}
+
+func (c *clusterCache) informer(get func(cache.Cache) (cache.Informer, error)) (cache.Informer, error) {
+	informer := &clusterInformer{informers: map[logicalcluster.Name]cache.Informer{}}
+	for _, cluster := range c.names {
+		clusterInformer, err := get(c.caches[cluster])
+		if err != nil {
+			return nil, fmt.Errorf("error getting the informer of cluster %s: %w", cluster, err)
+		}
+		informer.names = append(informer.names, cluster)
+		informer.informers[cluster] = clusterInformer
+	}
+	return informer, nil
+}
+
+// Start implements cache.Informers. It runs the caches of all clusters until ctx is done or one of them fails.
+func (c *clusterCache) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(c.names))
+	for _, cluster := range c.names {
+		go func(cluster logicalcluster.Name) {
+			if err := c.caches[cluster].Start(ctx); err != nil {
+				errs <- fmt.Errorf("cache of cluster %s: %w", cluster, err)
+				return
+			}
+			errs <- nil
+		}(cluster)
+	}
+	var result error
+	for range c.names {
+		if err := <-errs; err != nil && result == nil {
+			result = err
+			cancel()
+		}
+	}
+	return result
+}
+
+// WaitForCacheSync implements cache.Informers.
+func (c *clusterCache) WaitForCacheSync(ctx context.Context) bool {
+	for _, cluster := range c.names {
+		if !c.caches[cluster].WaitForCacheSync(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+// IndexField implements client.FieldIndexer. The index is added in every cluster.
+func (c *clusterCache) IndexField(ctx context.Context, obj client.Object, field string, extractValue client.IndexerFunc) error {
+	for _, cluster := range c.names {
+		if err := c.caches[cluster].IndexField(ctx, obj, field, extractValue); err != nil {
+			return fmt.Errorf("error indexing %s in cluster %s: %w", field, cluster, err)
+		}
+	}
+	return nil
+}
+
+// clusterInformer is a cache.Informer with one informer per cluster. Its event handlers get copies of the objects
+// annotated with their cluster.
+type clusterInformer struct {
+	names     []logicalcluster.Name
+	informers map[logicalcluster.Name]cache.Informer
+}
+
+// AddEventHandler implements cache.Informer.
+func (i *clusterInformer) AddEventHandler(handler toolscache.ResourceEventHandler) {
+	for _, cluster := range i.names {
+		i.informers[cluster].AddEventHandler(&clusterHandler{cluster: cluster, handler: handler})
+	}
+}
+
+// AddEventHandlerWithResyncPeriod implements cache.Informer.
+func (i *clusterInformer) AddEventHandlerWithResyncPeriod(handler toolscache.ResourceEventHandler, resyncPeriod time.Duration) {
+	for _, cluster := range i.names {
+		i.informers[cluster].AddEventHandlerWithResyncPeriod(&clusterHandler{cluster: cluster, handler: handler}, resyncPeriod)
+	}
+}
+
+// AddIndexers implements cache.Informer.
+func (i *clusterInformer) AddIndexers(indexers toolscache.Indexers) error {
+	for _, cluster := range i.names {
+		if err := i.informers[cluster].AddIndexers(indexers); err != nil {
+			return fmt.Errorf("error adding indexers in cluster %s: %w", cluster, err)
+		}
+	}
+	return nil
+}
+
+// HasSynced implements cache.Informer.
+func (i *clusterInformer) HasSynced() bool {
+	for _, cluster := range i.names {
+		if !i.informers[cluster].HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// clusterHandler passes the events of the informer of a cluster to handler.
+type clusterHandler struct {
+	cluster logicalcluster.Name
+	handler toolscache.ResourceEventHandler
+}
+
+func (h *clusterHandler) OnAdd(obj interface{}) {
+	h.handler.OnAdd(h.annotated(obj))
+}
+
+func (h *clusterHandler) OnUpdate(oldObj, newObj interface{}) {
+	h.handler.OnUpdate(h.annotated(oldObj), h.annotated(newObj))
+}
+
+func (h *clusterHandler) OnDelete(obj interface{}) {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		tombstone.Obj = h.annotated(tombstone.Obj)
+		h.handler.OnDelete(tombstone)
+		return
+	}
+	h.handler.OnDelete(h.annotated(obj))
+}
+
+// annotated returns a copy of obj annotated with the cluster. The objects of the informer are shared and must not
+// be modified.
+func (h *clusterHandler) annotated(obj interface{}) interface{} {
+	o, ok := obj.(runtime.Object)
+	if !ok {
+		return obj
+	}
+	o = o.DeepCopyObject()
+	annotate(o, h.cluster)
+	return o
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicluster
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/cluster"
+)
+
+// clusterClient is a client.Client with one client per cluster, each reading from the cache of its cluster.
+type clusterClient struct {
+	names   []logicalcluster.Name
+	clients map[logicalcluster.Name]client.Client
+}
+
+var _ client.Client = &clusterClient{}
+
+// NewClient is a cluster.NewClientFunc for a client that spans the clusters of a cache created by NewCacheFunc. The
+// config it is called with is ignored, each cluster is reached through its own config and REST mapper.
+func NewClient(c cache.Cache, _ *rest.Config, options client.Options, uncachedObjects ...client.Object) (client.Client, error) {
+	clusters, ok := c.(*clusterCache)
+	if !ok {
+		return nil, fmt.Errorf("the cache %T was not created by multicluster.NewCacheFunc", c)
+	}
+	cc := &clusterClient{clients: map[logicalcluster.Name]client.Client{}}
+	for _, name := range clusters.names {
+		clusterOptions := options
+		clusterOptions.Mapper = clusters.mappers[name]
+		clusterClient, err := cluster.DefaultNewClient(clusters.caches[name], clusters.configs[name], clusterOptions, uncachedObjects...)
+		if err != nil {
+			return nil, fmt.Errorf("error creating the client of cluster %s: %w", name, err)
+		}
+		cc.names = append(cc.names, name)
+		cc.clients[name] = clusterClient
+	}
+	return cc, nil
+}
+
+// clientFor returns the client of the cluster of the request.
+func (c *clusterClient) clientFor(ctx context.Context, obj runtime.Object) (logicalcluster.Name, client.Client, error) {
+	cluster := clusterFor(ctx, obj)
+	if cluster.Empty() {
+		return "", nil, errNoCluster
+	}
+	clusterClient, ok := c.clients[cluster]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown cluster %s", cluster)
+	}
+	return cluster, clusterClient, nil
+}
+
+// write calls f with the client of the cluster of the request, with the cluster annotation removed from obj for the
+// duration of the call.
+func (c *clusterClient) write(ctx context.Context, obj client.Object, f func(client.Client) error) error {
+	cluster, clusterClient, err := c.clientFor(ctx, obj)
+	if err != nil {
+		return err
+	}
+	unannotate(obj)
+	defer annotate(obj, cluster)
+	return f(clusterClient)
+}
+
+// Get implements client.Client.
+func (c *clusterClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	cluster, clusterClient, err := c.clientFor(ctx, obj)
+	if err != nil {
+		return err
+	}
+	if err := clusterClient.Get(ctx, key, obj); err != nil {
+		return err
+	}
+	annotate(obj, cluster)
+	return nil
+}
+
+// List implements client.Client. Without a cluster, it lists across all clusters.
+func (c *clusterClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return listClusters(ctx, c.names, list, func(ctx context.Context, cluster logicalcluster.Name, list client.ObjectList) error {
+		clusterClient, ok := c.clients[cluster]
+		if !ok {
+			return fmt.Errorf("unknown cluster %s", cluster)
+		}
+		return clusterClient.List(ctx, list, opts...)
+	})
+}
+
+// Create implements client.Client.
+func (c *clusterClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	return c.write(ctx, obj, func(clusterClient client.Client) error {
+		return clusterClient.Create(ctx, obj, opts...)
+	})
+}
+
+// Delete implements client.Client.
+func (c *clusterClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	return c.write(ctx, obj, func(clusterClient client.Client) error {
+		return clusterClient.Delete(ctx, obj, opts...)
+	})
+}
+
+// Update implements client.Client.
+func (c *clusterClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return c.write(ctx, obj, func(clusterClient client.Client) error {
+		return clusterClient.Update(ctx, obj, opts...)
+	})
+}
+
+// Patch implements client.Client.
+func (c *clusterClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return c.write(ctx, obj, func(clusterClient client.Client) error {
+		return clusterClient.Patch(ctx, obj, patch, opts...)
+	})
+}
+
+// DeleteAllOf implements client.Client.
+func (c *clusterClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	return c.write(ctx, obj, func(clusterClient client.Client) error {
+		return clusterClient.DeleteAllOf(ctx, obj, opts...)
+	})
+}
+
+// Status implements client.Client.
+func (c *clusterClient) Status() client.StatusWriter {
+	return &clusterStatusWriter{c: c}
+}
+
+// Scheme implements client.Client.
+func (c *clusterClient) Scheme() *runtime.Scheme {
+	return c.clients[c.names[0]].Scheme()
+}
+
+// RESTMapper implements client.Client. It is the REST mapper of the first cluster.
+func (c *clusterClient) RESTMapper() meta.RESTMapper {
+	return c.clients[c.names[0]].RESTMapper()
+}
+
+type clusterStatusWriter struct {
+	c *clusterClient
+}
+
+func (w *clusterStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return w.c.write(ctx, obj, func(clusterClient client.Client) error {
+		return clusterClient.Status().Update(ctx, obj, opts...)
+	})
+}
+
+func (w *clusterStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return w.c.write(ctx, obj, func(clusterClient client.Client) error {
+		return clusterClient.Status().Patch(ctx, obj, patch, opts...)
+	})
+}
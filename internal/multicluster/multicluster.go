@@ -0,0 +1,191 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package multicluster runs the controllers against a set of plain Kubernetes clusters as if they were the logical
+// clusters of kcp. The manager it builds has a cache and a client that span all the clusters, like the ones of a kcp
+// cluster-aware manager:
+//
+//   - every object read from them, or passed to event handlers, carries the name of its cluster in the
+//     logicalcluster.AnnotationKey annotation, so that requests are enqueued with their ClusterName;
+//   - requests are routed to the cluster in their context, see kontext.WithCluster, or else to the cluster in the
+//     annotation of their object. Lists without a cluster span all clusters;
+//   - events are recorded in the cluster of their object.
+//
+// Each cluster has its own cache and REST mapper. The annotation is never written to the clusters.
+package multicluster
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/kontext"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// Cluster is a Kubernetes cluster treated as a logical cluster.
+type Cluster struct {
+	Name   logicalcluster.Name
+	Config *rest.Config
+}
+
+// FromContexts returns a Cluster for each of the contexts of the kubeconfig, named after the context. An empty
+// kubeconfig path loads the default kubeconfig, e.g. from $KUBECONFIG.
+func FromContexts(kubeconfig string, contexts []string) ([]Cluster, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+
+	clusters := make([]Cluster, 0, len(contexts))
+	for _, context := range contexts {
+		cfg, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: context}).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("error loading context %s: %w", context, err)
+		}
+		clusters = append(clusters, Cluster{Name: logicalcluster.Name(context), Config: cfg})
+	}
+	return clusters, validate(clusters)
+}
+
+// FromDir returns a Cluster for the current context of each kubeconfig file in dir, named after the file without its
+// extension. Hidden files and subdirectories are skipped.
+func FromDir(dir string) ([]Cluster, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var clusters []Cluster
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		cfg, err := clientcmd.BuildConfigFromFlags("", path)
+		if err != nil {
+			return nil, fmt.Errorf("error loading %s: %w", path, err)
+		}
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		clusters = append(clusters, Cluster{Name: logicalcluster.Name(name), Config: cfg})
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Name < clusters[j].Name })
+	return clusters, validate(clusters)
+}
+
+// validate returns an error if there are no clusters or if two of them have the same name.
+func validate(clusters []Cluster) error {
+	if len(clusters) == 0 {
+		return fmt.Errorf("no clusters")
+	}
+	seen := map[logicalcluster.Name]bool{}
+	for _, cluster := range clusters {
+		if cluster.Name.Empty() {
+			return fmt.Errorf("a cluster has no name")
+		}
+		if seen[cluster.Name] {
+			return fmt.Errorf("cluster %s is given twice", cluster.Name)
+		}
+		seen[cluster.Name] = true
+	}
+	return nil
+}
+
+// NewManager returns a manager whose cache, client and event recorders span the clusters. Leader election, if
+// enabled, and the manager's own API calls use the first cluster.
+func NewManager(clusters []Cluster, options manager.Options) (manager.Manager, error) {
+	if err := validate(clusters); err != nil {
+		return nil, err
+	}
+	options.NewCache = NewCacheFunc(clusters)
+	options.NewClient = NewClient
+	mgr, err := manager.New(clusters[0].Config, options)
+	if err != nil {
+		return nil, err
+	}
+	recorders, err := newRecorderProvider(clusters, mgr.GetScheme(), mgr.GetLogger())
+	if err != nil {
+		return nil, err
+	}
+	if err := mgr.Add(recorders); err != nil {
+		return nil, err
+	}
+	return &clusterManager{Manager: mgr, recorders: recorders}, nil
+}
+
+// clusterManager records events in the cluster of their object.
+type clusterManager struct {
+	manager.Manager
+	recorders *recorderProvider
+}
+
+func (m *clusterManager) GetEventRecorderFor(name string) record.EventRecorder {
+	return m.recorders.GetEventRecorderFor(name)
+}
+
+// clusterFor returns the cluster in the context, or else the one in the annotation of obj, if any.
+func clusterFor(ctx context.Context, obj runtime.Object) logicalcluster.Name {
+	if cluster, ok := kontext.ClusterFrom(ctx); ok && !cluster.Empty() {
+		return cluster
+	}
+	if obj == nil {
+		return ""
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return ""
+	}
+	return logicalcluster.From(accessor)
+}
+
+// annotate sets the cluster annotation of obj, if it has metadata.
+func annotate(obj runtime.Object, cluster logicalcluster.Name) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+	annotations := accessor.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[logicalcluster.AnnotationKey] = cluster.String()
+	accessor.SetAnnotations(annotations)
+}
+
+// unannotate removes the cluster annotation of obj, and returns a function that restores it.
+func unannotate(obj runtime.Object) (restore func()) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return func() {}
+	}
+	annotations := accessor.GetAnnotations()
+	cluster, ok := annotations[logicalcluster.AnnotationKey]
+	if !ok {
+		return func() {}
+	}
+	delete(annotations, logicalcluster.AnnotationKey)
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	accessor.SetAnnotations(annotations)
+	return func() { annotate(obj, logicalcluster.Name(cluster)) }
+}
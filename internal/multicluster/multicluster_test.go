@@ -0,0 +1,299 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicluster
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/kontext"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+func writeKubeconfig(t *testing.T, path string, contexts map[string]string, current string) {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("apiVersion: v1\nkind: Config\nclusters:\n")
+	for name, host := range contexts {
+		fmt.Fprintf(&b, "- name: %s\n  cluster:\n    server: %s\n", name, host)
+	}
+	b.WriteString("users:\n- name: user\n  user:\n    token: token\ncontexts:\n")
+	for name := range contexts {
+		fmt.Fprintf(&b, "- name: %s\n  context:\n    cluster: %s\n    user: user\n", name, name)
+	}
+	fmt.Fprintf(&b, "current-context: %s\n", current)
+	if err := os.WriteFile(path, []byte(b.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func hosts(clusters []Cluster) map[logicalcluster.Name]string {
+	hosts := map[logicalcluster.Name]string{}
+	for _, cluster := range clusters {
+		hosts[cluster.Name] = cluster.Config.Host
+	}
+	return hosts
+}
+
+func TestFromContexts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	writeKubeconfig(t, path, map[string]string{"kind-a": "https://a:6443", "kind-b": "https://b:6443", "kind-c": "https://c:6443"}, "kind-c")
+
+	clusters, err := FromContexts(path, []string{"kind-b", "kind-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 || clusters[0].Name != "kind-b" || clusters[1].Name != "kind-a" {
+		t.Fatalf("expected the clusters in the order of the contexts, got %v", clusters)
+	}
+	if got := hosts(clusters); got["kind-a"] != "https://a:6443" || got["kind-b"] != "https://b:6443" {
+		t.Errorf("unexpected hosts %v", got)
+	}
+
+	if _, err := FromContexts(path, []string{"kind-a", "kind-d"}); err == nil {
+		t.Error("expected an error for an unknown context")
+	}
+	if _, err := FromContexts(path, []string{"kind-a", "kind-a"}); err == nil {
+		t.Error("expected an error for a context given twice")
+	}
+	if _, err := FromContexts(path, nil); err == nil {
+		t.Error("expected an error without contexts")
+	}
+}
+
+func TestFromDir(t *testing.T) {
+	dir := t.TempDir()
+	writeKubeconfig(t, filepath.Join(dir, "west.yaml"), map[string]string{"kind-a": "https://a:6443", "kind-b": "https://b:6443"}, "kind-b")
+	writeKubeconfig(t, filepath.Join(dir, "east"), map[string]string{"kind-c": "https://c:6443"}, "kind-c")
+	if err := os.WriteFile(filepath.Join(dir, ".hidden"), []byte("not a kubeconfig"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	clusters, err := FromDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) != 2 || clusters[0].Name != "east" || clusters[1].Name != "west" {
+		t.Fatalf("expected the clusters named after the files in order, got %v", clusters)
+	}
+	if got := hosts(clusters); got["east"] != "https://c:6443" || got["west"] != "https://b:6443" {
+		t.Errorf("expected the current context of each kubeconfig, got %v", got)
+	}
+
+	writeKubeconfig(t, filepath.Join(dir, "west.yml"), map[string]string{"kind-a": "https://a:6443"}, "kind-a")
+	if _, err := FromDir(dir); err == nil || !strings.Contains(err.Error(), "given twice") {
+		t.Errorf("expected an error for two kubeconfigs with the same name, got %v", err)
+	}
+	if _, err := FromDir(t.TempDir()); err == nil {
+		t.Error("expected an error for an empty directory")
+	}
+}
+
+// events records the clusters of the objects passed to an event handler.
+type events struct {
+	lock     sync.Mutex
+	clusters map[string]logicalcluster.Name
+}
+
+func (e *events) OnAdd(obj interface{}) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	cm := obj.(*corev1.ConfigMap)
+	e.clusters[cm.Name] = logicalcluster.From(cm)
+}
+
+func (e *events) OnUpdate(_, newObj interface{}) { e.OnAdd(newObj) }
+func (e *events) OnDelete(interface{})           {}
+
+func (e *events) get() map[string]logicalcluster.Name {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	clusters := map[string]logicalcluster.Name{}
+	for name, cluster := range e.clusters {
+		clusters[name] = cluster
+	}
+	return clusters
+}
+
+func TestManager(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var clusters []Cluster
+	servers := map[logicalcluster.Name]client.Client{}
+	for _, name := range []logicalcluster.Name{"kind-a", "kind-b"} {
+		// The fake server annotates its objects with its home, which must not leak into the manager
+		s := fake.NewServer("stale")
+		defer s.Close()
+		clusters = append(clusters, Cluster{Name: name, Config: s.Config()})
+		c, err := client.New(s.Config(), client.Options{Scheme: clientgoscheme.Scheme})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Create(ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "config"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Create(ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "only-" + name.String()}}); err != nil {
+			t.Fatal(err)
+		}
+		servers[name] = c
+	}
+
+	mgr, err := NewManager(clusters, manager.Options{
+		Scheme:                 clientgoscheme.Scheme,
+		MetricsBindAddress:     "0",
+		HealthProbeBindAddress: "0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	informer, err := mgr.GetCache().GetInformer(ctx, &corev1.ConfigMap{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &events{clusters: map[string]logicalcluster.Name{}}
+	informer.AddEventHandler(handler)
+	go func() {
+		if err := mgr.Start(ctx); err != nil {
+			t.Errorf("failed to run manager: %v", err)
+		}
+	}()
+	if !mgr.GetCache().WaitForCacheSync(ctx) {
+		t.Fatal("the caches never synced")
+	}
+
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return len(handler.get()) == 3, nil
+	}); err != nil {
+		t.Fatalf("expected events for 3 configmaps, got %v", handler.get())
+	}
+	if got := handler.get(); got["only-kind-a"] != "kind-a" || got["only-kind-b"] != "kind-b" {
+		t.Errorf("expected the event handler to get objects annotated with their cluster, got %v", got)
+	}
+
+	c := mgr.GetClient()
+	var list corev1.ConfigMapList
+	if err := c.List(ctx, &list); err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, cm := range list.Items {
+		listed = append(listed, logicalcluster.From(&cm).String()+"|"+cm.Name)
+	}
+	sort.Strings(listed)
+	if want := "kind-a|config,kind-a|only-kind-a,kind-b|config,kind-b|only-kind-b"; strings.Join(listed, ",") != want {
+		t.Errorf("expected a list across clusters of %s, got %v", want, listed)
+	}
+	if err := c.List(kontext.WithCluster(ctx, "kind-b"), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 2 {
+		t.Errorf("expected 2 configmaps in kind-b, got %d", len(list.Items))
+	}
+
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "config"}, &corev1.ConfigMap{}); err == nil {
+		t.Error("expected an error for a get without a cluster")
+	}
+	if err := c.Get(kontext.WithCluster(ctx, "kind-c"), client.ObjectKey{Namespace: "default", Name: "config"}, &corev1.ConfigMap{}); err == nil {
+		t.Error("expected an error for a get in an unknown cluster")
+	}
+
+	// Writes go to the cluster of the object, without its annotation
+	var cm corev1.ConfigMap
+	if err := c.Get(kontext.WithCluster(ctx, "kind-b"), client.ObjectKey{Namespace: "default", Name: "config"}, &cm); err != nil {
+		t.Fatal(err)
+	}
+	if cluster := logicalcluster.From(&cm); cluster != "kind-b" {
+		t.Fatalf("expected the configmap to be annotated with kind-b, got %q", cluster)
+	}
+	cm.Data = map[string]string{"updated": "true"}
+	if err := c.Update(ctx, &cm); err != nil {
+		t.Fatal(err)
+	}
+	if cluster := logicalcluster.From(&cm); cluster != "kind-b" {
+		t.Errorf("expected the updated configmap to keep its annotation, got %q", cluster)
+	}
+	for name, server := range servers {
+		var got corev1.ConfigMap
+		if err := server.Get(ctx, client.ObjectKey{Namespace: "default", Name: "config"}, &got); err != nil {
+			t.Fatal(err)
+		}
+		if updated := got.Data["updated"] == "true"; updated != (name == "kind-b") {
+			t.Errorf("expected only the configmap of kind-b to be updated, %s has %v", name, got.Data)
+		}
+	}
+
+	// Events are recorded in the cluster of their object
+	mgr.GetEventRecorderFor("test").Event(&cm, corev1.EventTypeNormal, "Tested", "recorded in kind-b")
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		var events corev1.EventList
+		if err := servers["kind-b"].List(ctx, &events); err != nil {
+			return false, err
+		}
+		return len(events.Items) == 1 && events.Items[0].Reason == "Tested", nil
+	}); err != nil {
+		t.Fatalf("the event was never recorded in kind-b: %v", err)
+	}
+	var events corev1.EventList
+	if err := servers["kind-a"].List(ctx, &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events.Items) != 0 {
+		t.Errorf("expected no events in kind-a, got %v", events.Items)
+	}
+}
+
+func TestClusterHandlerCopiesObjects(t *testing.T) {
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "config"}}
+	var got []interface{}
+	h := &clusterHandler{cluster: "kind-a", handler: toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { got = append(got, obj) },
+		DeleteFunc: func(obj interface{}) { got = append(got, obj) },
+	}}
+	h.OnAdd(cm)
+	h.OnDelete(toolscache.DeletedFinalStateUnknown{Key: "config", Obj: cm})
+
+	if len(cm.Annotations) != 0 {
+		t.Errorf("expected the object of the informer to be left alone, got %v", cm.Annotations)
+	}
+	if cluster := logicalcluster.From(got[0].(*corev1.ConfigMap)); cluster != "kind-a" {
+		t.Errorf("expected the added object to be annotated with kind-a, got %q", cluster)
+	}
+	tombstone := got[1].(toolscache.DeletedFinalStateUnknown)
+	if cluster := logicalcluster.From(tombstone.Obj.(*corev1.ConfigMap)); cluster != "kind-a" {
+		t.Errorf("expected the deleted object to be annotated with kind-a, got %q", cluster)
+	}
+}
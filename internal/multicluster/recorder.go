@@ -0,0 +1,116 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package multicluster
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/kcp-dev/logicalcluster/v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// recorderProvider records events in the cluster of their object, through one broadcaster per cluster. It is a
+// manager.Runnable that shuts the broadcasters down when the manager stops.
+type recorderProvider struct {
+	scheme       *runtime.Scheme
+	logger       logr.Logger
+	broadcasters map[logicalcluster.Name]record.EventBroadcaster
+}
+
+func newRecorderProvider(clusters []Cluster, scheme *runtime.Scheme, logger logr.Logger) (*recorderProvider, error) {
+	p := &recorderProvider{
+		scheme:       scheme,
+		logger:       logger.WithName("events"),
+		broadcasters: map[logicalcluster.Name]record.EventBroadcaster{},
+	}
+	for _, cluster := range clusters {
+		events, err := corev1client.NewForConfig(cluster.Config)
+		if err != nil {
+			return nil, fmt.Errorf("error creating the event client of cluster %s: %w", cluster.Name, err)
+		}
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: events.Events("")})
+		logger := p.logger.WithValues("cluster", cluster.Name)
+		broadcaster.StartEventWatcher(func(e *corev1.Event) {
+			logger.V(1).Info(e.Message, "type", e.Type, "object", e.InvolvedObject, "reason", e.Reason)
+		})
+		p.broadcasters[cluster.Name] = broadcaster
+	}
+	return p, nil
+}
+
+// GetEventRecorderFor returns a recorder for the component name.
+func (p *recorderProvider) GetEventRecorderFor(name string) record.EventRecorder {
+	r := &clusterRecorder{logger: p.logger, recorders: map[logicalcluster.Name]record.EventRecorder{}}
+	for cluster, broadcaster := range p.broadcasters {
+		r.recorders[cluster] = broadcaster.NewRecorder(p.scheme, corev1.EventSource{Component: name})
+	}
+	return r
+}
+
+// Start waits for the manager to stop and shuts the broadcasters down.
+func (p *recorderProvider) Start(ctx context.Context) error {
+	<-ctx.Done()
+	for _, broadcaster := range p.broadcasters {
+		broadcaster.Shutdown()
+	}
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, events are recorded by every replica.
+func (p *recorderProvider) NeedLeaderElection() bool {
+	return false
+}
+
+// clusterRecorder passes events to the recorder of the cluster of their object. Events of objects without a known
+// cluster are dropped.
+type clusterRecorder struct {
+	logger    logr.Logger
+	recorders map[logicalcluster.Name]record.EventRecorder
+}
+
+func (r *clusterRecorder) recorderFor(object runtime.Object, reason string) (record.EventRecorder, bool) {
+	cluster := clusterFor(context.Background(), object)
+	recorder, ok := r.recorders[cluster]
+	if !ok {
+		r.logger.Info("Dropping an event of an object without a known cluster", "cluster", cluster, "reason", reason)
+	}
+	return recorder, ok
+}
+
+func (r *clusterRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	if recorder, ok := r.recorderFor(object, reason); ok {
+		recorder.Event(object, eventtype, reason, message)
+	}
+}
+
+func (r *clusterRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	if recorder, ok := r.recorderFor(object, reason); ok {
+		recorder.Eventf(object, eventtype, reason, messageFmt, args...)
+	}
+}
+
+func (r *clusterRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	if recorder, ok := r.recorderFor(object, reason); ok {
+		recorder.AnnotatedEventf(object, annotations, eventtype, reason, messageFmt, args...)
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package schemacompat classifies the changes between two revisions of an APIResourceSchema as safe or breaking for
+// the workspaces bound to the old revision.
+package schemacompat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+// Severity is how a change affects the workspaces bound to the old revision.
+type Severity string
+
+const (
+	// Safe is a change that objects stored and clients written against the old schema keep working with.
+	Safe Severity = "safe"
+	// Breaking is a change that may reject or prune existing objects, or break existing clients.
+	Breaking Severity = "breaking"
+)
+
+// Change is a difference between two revisions of an APIResourceSchema.
+type Change struct {
+	Severity Severity
+	// Resource is <resource>.<group>.
+	Resource string
+	// Version is empty for changes to the resource as a whole.
+	Version string
+	// Path is the path of the field in the objects, empty for changes outside of the OpenAPI schema.
+	Path    string
+	Message string
+}
+
+func (c Change) String() string {
+	location := c.Resource
+	if c.Version != "" {
+		location += " " + c.Version
+	}
+	if c.Path != "" {
+		location += " " + c.Path
+	}
+	return fmt.Sprintf("%s: %s: %s", c.Severity, location, c.Message)
+}
+
+// Resource returns the <resource>.<group> that the APIResourceSchema defines, which does not depend on its prefix.
+func Resource(schema *apisv1alpha1.APIResourceSchema) string {
+	return schema.Spec.Names.Plural + "." + schema.Spec.Group
+}
+
+// Compare returns the changes from the old to the new revision of an APIResourceSchema.
+func Compare(old, new *apisv1alpha1.APIResourceSchema) ([]Change, error) {
+	d := &differ{resource: Resource(new)}
+	if Resource(old) != d.resource {
+		return nil, fmt.Errorf("%s and %s define different resources", old.Name, new.Name)
+	}
+
+	if old.Spec.Scope != new.Spec.Scope {
+		d.add(Breaking, "", "", "scope changed from %s to %s", old.Spec.Scope, new.Spec.Scope)
+	}
+	if old.Spec.Names.Kind != new.Spec.Names.Kind {
+		d.add(Breaking, "", "", "kind changed from %s to %s", old.Spec.Names.Kind, new.Spec.Names.Kind)
+	}
+	if old.Spec.Names.ListKind != new.Spec.Names.ListKind {
+		d.add(Breaking, "", "", "list kind changed from %s to %s", old.Spec.Names.ListKind, new.Spec.Names.ListKind)
+	}
+	for _, name := range sets.NewString(old.Spec.Names.ShortNames...).Difference(sets.NewString(new.Spec.Names.ShortNames...)).List() {
+		d.add(Breaking, "", "", "short name %s removed", name)
+	}
+
+	newVersions := map[string]*apisv1alpha1.APIResourceVersion{}
+	for i := range new.Spec.Versions {
+		newVersions[new.Spec.Versions[i].Name] = &new.Spec.Versions[i]
+	}
+	for i := range old.Spec.Versions {
+		oldVersion := &old.Spec.Versions[i]
+		newVersion, ok := newVersions[oldVersion.Name]
+		delete(newVersions, oldVersion.Name)
+		switch {
+		case !oldVersion.Served:
+			// Nobody can depend on a version that was not served
+			continue
+		case !ok:
+			d.add(Breaking, oldVersion.Name, "", "version removed")
+			continue
+		case !newVersion.Served:
+			d.add(Breaking, oldVersion.Name, "", "version no longer served")
+			continue
+		}
+		if err := d.compareVersion(oldVersion, newVersion); err != nil {
+			return nil, err
+		}
+	}
+	for name, version := range newVersions {
+		if version.Served {
+			d.add(Safe, name, "", "version added")
+		}
+	}
+
+	sort.SliceStable(d.changes, func(i, j int) bool {
+		if d.changes[i].Version != d.changes[j].Version {
+			return d.changes[i].Version < d.changes[j].Version
+		}
+		return d.changes[i].Path < d.changes[j].Path
+	})
+	return d.changes, nil
+}
+
+// BreakingChanges returns the breaking changes among changes.
+func BreakingChanges(changes []Change) []Change {
+	var breaking []Change
+	for _, c := range changes {
+		if c.Severity == Breaking {
+			breaking = append(breaking, c)
+		}
+	}
+	return breaking
+}
+
+// differ collects the changes to a resource.
+type differ struct {
+	resource string
+	version  string
+	changes  []Change
+}
+
+func (d *differ) add(severity Severity, version, path, format string, args ...interface{}) {
+	d.changes = append(d.changes, Change{
+		Severity: severity,
+		Resource: d.resource,
+		Version:  version,
+		Path:     path,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// compareVersion compares the subresources and schemas of a version.
+func (d *differ) compareVersion(old, new *apisv1alpha1.APIResourceVersion) error {
+	d.version = old.Name
+	if old.Subresources.Status != nil && new.Subresources.Status == nil {
+		d.add(Breaking, d.version, "", "status subresource removed")
+	}
+	if old.Subresources.Status == nil && new.Subresources.Status != nil {
+		// Updates of the main resource stop writing the status
+		d.add(Breaking, d.version, "", "status subresource added")
+	}
+	if old.Subresources.Scale != nil && new.Subresources.Scale == nil {
+		d.add(Breaking, d.version, "", "scale subresource removed")
+	}
+
+	oldSchema, err := old.GetSchema()
+	if err != nil {
+		return fmt.Errorf("error decoding the schema of version %s: %w", old.Name, err)
+	}
+	newSchema, err := new.GetSchema()
+	if err != nil {
+		return fmt.Errorf("error decoding the schema of version %s: %w", new.Name, err)
+	}
+	d.compareSchema("", oldSchema, newSchema)
+	return nil
+}
+
+// compareSchema compares the OpenAPI schemas of the field at path, and of the fields below it.
+func (d *differ) compareSchema(path string, old, new *apiextensionsv1.JSONSchemaProps) {
+	field := path
+	if field == "" {
+		field = "."
+	}
+	switch {
+	case old == nil && new == nil:
+		return
+	case old == nil:
+		d.add(Breaking, d.version, field, "schema added")
+		return
+	case new == nil:
+		// Anything is allowed without a schema
+		d.add(Safe, d.version, field, "schema removed")
+		return
+	}
+
+	if old.Type != new.Type {
+		d.add(Breaking, d.version, field, "type changed from %s to %s", typeOf(old), typeOf(new))
+		return
+	}
+	d.compareEnum(field, old.Enum, new.Enum)
+	if old.XPreserveUnknownFields != nil && *old.XPreserveUnknownFields &&
+		(new.XPreserveUnknownFields == nil || !*new.XPreserveUnknownFields) {
+		d.add(Breaking, d.version, field, "unknown fields are no longer preserved")
+	}
+	if old.Nullable && !new.Nullable {
+		d.add(Breaking, d.version, field, "no longer nullable")
+	}
+
+	oldRequired, newRequired := sets.NewString(old.Required...), sets.NewString(new.Required...)
+	for _, name := range sets.StringKeySet(old.Properties).Difference(sets.StringKeySet(new.Properties)).List() {
+		d.add(Breaking, d.version, path+"."+name, "field removed")
+	}
+	for _, name := range sets.StringKeySet(new.Properties).Difference(sets.StringKeySet(old.Properties)).List() {
+		if newRequired.Has(name) {
+			d.add(Breaking, d.version, path+"."+name, "required field added")
+		} else {
+			d.add(Safe, d.version, path+"."+name, "optional field added")
+		}
+	}
+	for _, name := range newRequired.Difference(oldRequired).List() {
+		if _, ok := old.Properties[name]; ok {
+			d.add(Breaking, d.version, path+"."+name, "field is now required")
+		}
+	}
+	for _, name := range oldRequired.Difference(newRequired).List() {
+		if _, ok := new.Properties[name]; ok {
+			d.add(Safe, d.version, path+"."+name, "field is no longer required")
+		}
+	}
+	for _, name := range sets.StringKeySet(old.Properties).Intersection(sets.StringKeySet(new.Properties)).List() {
+		oldProperty, newProperty := old.Properties[name], new.Properties[name]
+		d.compareSchema(path+"."+name, &oldProperty, &newProperty)
+	}
+
+	if old.Items != nil || new.Items != nil {
+		d.compareSchema(path+"[*]", itemsSchema(old.Items), itemsSchema(new.Items))
+	}
+	oldValues, newValues := additionalPropertiesSchema(old.AdditionalProperties), additionalPropertiesSchema(new.AdditionalProperties)
+	switch {
+	case oldValues != nil && newValues == nil:
+		d.add(Breaking, d.version, field, "additional properties no longer allowed")
+	case oldValues != nil:
+		d.compareSchema(path+".*", oldValues, newValues)
+	}
+}
+
+// compareEnum compares the values allowed for the field.
+func (d *differ) compareEnum(field string, old, new []apiextensionsv1.JSON) {
+	oldValues, newValues := sets.NewString(), sets.NewString()
+	for _, value := range old {
+		oldValues.Insert(string(value.Raw))
+	}
+	for _, value := range new {
+		newValues.Insert(string(value.Raw))
+	}
+	switch {
+	case oldValues.Len() == 0 && newValues.Len() == 0:
+	case oldValues.Len() == 0:
+		d.add(Breaking, d.version, field, "enum added, only %s allowed", strings.Join(newValues.List(), ", "))
+	case newValues.Len() == 0:
+		d.add(Safe, d.version, field, "enum removed")
+	default:
+		if removed := oldValues.Difference(newValues); removed.Len() > 0 {
+			d.add(Breaking, d.version, field, "enum narrowed, %s no longer allowed", strings.Join(removed.List(), ", "))
+		}
+		if added := newValues.Difference(oldValues); added.Len() > 0 {
+			d.add(Safe, d.version, field, "enum widened, %s allowed", strings.Join(added.List(), ", "))
+		}
+	}
+}
+
+func typeOf(schema *apiextensionsv1.JSONSchemaProps) string {
+	if schema.Type == "" {
+		return "any"
+	}
+	return schema.Type
+}
+
+func itemsSchema(items *apiextensionsv1.JSONSchemaPropsOrArray) *apiextensionsv1.JSONSchemaProps {
+	if items == nil {
+		return nil
+	}
+	return items.Schema
+}
+
+// additionalPropertiesSchema returns the schema of the values of a map, or nil if the object is not a map.
+func additionalPropertiesSchema(properties *apiextensionsv1.JSONSchemaPropsOrBool) *apiextensionsv1.JSONSchemaProps {
+	if properties == nil || !properties.Allows {
+		return nil
+	}
+	if properties.Schema == nil {
+		// Any value is allowed
+		return &apiextensionsv1.JSONSchemaProps{}
+	}
+	return properties.Schema
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schemacompat
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+const widgetsSchemas = "../../config/kcp/today.apiresourceschemas.yaml"
+
+// widgets returns the APIResourceSchema of the widgets in config/kcp.
+func widgets(t *testing.T) *apisv1alpha1.APIResourceSchema {
+	t.Helper()
+	f, err := os.Open(widgetsSchemas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	decoder := utilyaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		schema := &apisv1alpha1.APIResourceSchema{}
+		if err := decoder.Decode(schema); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if Resource(schema) == "widgets.data.my.domain" {
+			return schema
+		}
+	}
+	t.Fatalf("no widgets in %s", widgetsSchemas)
+	return nil
+}
+
+// withSchema returns a function that modifies the OpenAPI schema of v1alpha1 of the widgets with mutate.
+func withSchema(mutate func(schema *apiextensionsv1.JSONSchemaProps)) func(*testing.T, *apisv1alpha1.APIResourceSchema) {
+	return func(t *testing.T, widgets *apisv1alpha1.APIResourceSchema) {
+		t.Helper()
+		schema, err := widgets.Spec.Versions[0].GetSchema()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mutate(schema)
+		if err := widgets.Spec.Versions[0].SetSchema(schema); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func enum(values ...string) []apiextensionsv1.JSON {
+	var enum []apiextensionsv1.JSON
+	for _, value := range values {
+		enum = append(enum, apiextensionsv1.JSON{Raw: []byte(`"` + value + `"`)})
+	}
+	return enum
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name string
+		// old modifies the old revision of the widgets, if set
+		old func(*testing.T, *apisv1alpha1.APIResourceSchema)
+		// new modifies the new revision of the widgets
+		new      func(*testing.T, *apisv1alpha1.APIResourceSchema)
+		expected []string
+	}{{
+		name: "new prefix only",
+		new: func(_ *testing.T, widgets *apisv1alpha1.APIResourceSchema) {
+			widgets.Name = "v221018.widgets.data.my.domain"
+		},
+		expected: nil,
+	}, {
+		name: "optional field added",
+		new: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			schema.Properties["spec"].Properties["bar"] = apiextensionsv1.JSONSchemaProps{Type: "string"}
+		}),
+		expected: []string{"safe: widgets.data.my.domain v1alpha1 .spec.bar: optional field added"},
+	}, {
+		name: "required field added",
+		new: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			spec := schema.Properties["spec"]
+			spec.Properties["bar"] = apiextensionsv1.JSONSchemaProps{Type: "string"}
+			spec.Required = []string{"bar"}
+			schema.Properties["spec"] = spec
+		}),
+		expected: []string{"breaking: widgets.data.my.domain v1alpha1 .spec.bar: required field added"},
+	}, {
+		name: "existing field required",
+		new: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			spec := schema.Properties["spec"]
+			spec.Required = []string{"foo"}
+			schema.Properties["spec"] = spec
+		}),
+		expected: []string{"breaking: widgets.data.my.domain v1alpha1 .spec.foo: field is now required"},
+	}, {
+		name: "field no longer required",
+		old: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			spec := schema.Properties["spec"]
+			spec.Required = []string{"foo"}
+			schema.Properties["spec"] = spec
+		}),
+		new:      func(*testing.T, *apisv1alpha1.APIResourceSchema) {},
+		expected: []string{"safe: widgets.data.my.domain v1alpha1 .spec.foo: field is no longer required"},
+	}, {
+		name: "field removed",
+		new: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			delete(schema.Properties["spec"].Properties, "foo")
+		}),
+		expected: []string{"breaking: widgets.data.my.domain v1alpha1 .spec.foo: field removed"},
+	}, {
+		name: "type changed",
+		new: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			schema.Properties["status"].Properties["total"] = apiextensionsv1.JSONSchemaProps{Type: "string"}
+		}),
+		expected: []string{"breaking: widgets.data.my.domain v1alpha1 .status.total: type changed from integer to string"},
+	}, {
+		name: "enum added",
+		new: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			schema.Properties["spec"].Properties["foo"] = apiextensionsv1.JSONSchemaProps{Type: "string", Enum: enum("a", "b")}
+		}),
+		expected: []string{`breaking: widgets.data.my.domain v1alpha1 .spec.foo: enum added, only "a", "b" allowed`},
+	}, {
+		name: "enum narrowed and widened",
+		old: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			schema.Properties["spec"].Properties["foo"] = apiextensionsv1.JSONSchemaProps{Type: "string", Enum: enum("a", "b")}
+		}),
+		new: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			schema.Properties["spec"].Properties["foo"] = apiextensionsv1.JSONSchemaProps{Type: "string", Enum: enum("b", "c")}
+		}),
+		expected: []string{
+			`breaking: widgets.data.my.domain v1alpha1 .spec.foo: enum narrowed, "a" no longer allowed`,
+			`safe: widgets.data.my.domain v1alpha1 .spec.foo: enum widened, "c" allowed`,
+		},
+	}, {
+		name: "enum removed",
+		old: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			schema.Properties["spec"].Properties["foo"] = apiextensionsv1.JSONSchemaProps{Type: "string", Enum: enum("a")}
+		}),
+		new:      func(*testing.T, *apisv1alpha1.APIResourceSchema) {},
+		expected: []string{"safe: widgets.data.my.domain v1alpha1 .spec.foo: enum removed"},
+	}, {
+		name: "array items",
+		old: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			schema.Properties["spec"].Properties["tags"] = apiextensionsv1.JSONSchemaProps{
+				Type:  "array",
+				Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &apiextensionsv1.JSONSchemaProps{Type: "string"}},
+			}
+		}),
+		new: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			schema.Properties["spec"].Properties["tags"] = apiextensionsv1.JSONSchemaProps{
+				Type:  "array",
+				Items: &apiextensionsv1.JSONSchemaPropsOrArray{Schema: &apiextensionsv1.JSONSchemaProps{Type: "object"}},
+			}
+		}),
+		expected: []string{"breaking: widgets.data.my.domain v1alpha1 .spec.tags[*]: type changed from string to object"},
+	}, {
+		name: "map values",
+		old: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			schema.Properties["spec"].Properties["labels"] = apiextensionsv1.JSONSchemaProps{
+				Type:                 "object",
+				AdditionalProperties: &apiextensionsv1.JSONSchemaPropsOrBool{Allows: true, Schema: &apiextensionsv1.JSONSchemaProps{Type: "string"}},
+			}
+		}),
+		new: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			schema.Properties["spec"].Properties["labels"] = apiextensionsv1.JSONSchemaProps{Type: "object"}
+		}),
+		expected: []string{"breaking: widgets.data.my.domain v1alpha1 .spec.labels: additional properties no longer allowed"},
+	}, {
+		name: "unknown fields pruned",
+		old: withSchema(func(schema *apiextensionsv1.JSONSchemaProps) {
+			preserve := true
+			spec := schema.Properties["spec"]
+			spec.XPreserveUnknownFields = &preserve
+			schema.Properties["spec"] = spec
+		}),
+		new:      func(*testing.T, *apisv1alpha1.APIResourceSchema) {},
+		expected: []string{"breaking: widgets.data.my.domain v1alpha1 .spec: unknown fields are no longer preserved"},
+	}, {
+		name: "version added",
+		new: func(_ *testing.T, widgets *apisv1alpha1.APIResourceSchema) {
+			v1beta1 := widgets.Spec.Versions[0]
+			v1beta1.Name = "v1beta1"
+			widgets.Spec.Versions = append(widgets.Spec.Versions, v1beta1)
+		},
+		expected: []string{"safe: widgets.data.my.domain v1beta1: version added"},
+	}, {
+		name: "version removed",
+		old: func(_ *testing.T, widgets *apisv1alpha1.APIResourceSchema) {
+			v1beta1 := widgets.Spec.Versions[0]
+			v1beta1.Name = "v1beta1"
+			widgets.Spec.Versions = append(widgets.Spec.Versions, v1beta1)
+		},
+		new:      func(*testing.T, *apisv1alpha1.APIResourceSchema) {},
+		expected: []string{"breaking: widgets.data.my.domain v1beta1: version removed"},
+	}, {
+		name:     "version no longer served",
+		new:      func(_ *testing.T, widgets *apisv1alpha1.APIResourceSchema) { widgets.Spec.Versions[0].Served = false },
+		expected: []string{"breaking: widgets.data.my.domain v1alpha1: version no longer served"},
+	}, {
+		name: "status subresource removed",
+		new: func(_ *testing.T, widgets *apisv1alpha1.APIResourceSchema) {
+			widgets.Spec.Versions[0].Subresources.Status = nil
+		},
+		expected: []string{"breaking: widgets.data.my.domain v1alpha1: status subresource removed"},
+	}, {
+		name: "scope changed",
+		new: func(_ *testing.T, widgets *apisv1alpha1.APIResourceSchema) {
+			widgets.Spec.Scope = apiextensionsv1.ClusterScoped
+		},
+		expected: []string{"breaking: widgets.data.my.domain: scope changed from Namespaced to Cluster"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old, new := widgets(t), widgets(t)
+			if tt.old != nil {
+				tt.old(t, old)
+			}
+			tt.new(t, new)
+			changes, err := Compare(old, new)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var actual []string
+			for _, c := range changes {
+				actual = append(actual, c.String())
+			}
+			if diff := cmp.Diff(tt.expected, actual); diff != "" {
+				t.Errorf("unexpected changes (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCompareDifferentResources(t *testing.T) {
+	old, new := widgets(t), widgets(t)
+	new.Spec.Names.Plural = "gadgets"
+	if _, err := Compare(old, new); err == nil {
+		t.Error("expected an error")
+	}
+}
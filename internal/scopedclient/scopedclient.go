@@ -0,0 +1,84 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package scopedclient scopes a client that routes requests to the logical cluster in their context to a single
+// logical cluster.
+package scopedclient
+
+import (
+	"context"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/kontext"
+)
+
+// New returns a client whose requests only ever touch the given logical cluster of c, whatever the logical cluster
+// in their context. c must route requests to the logical cluster in their context, see kontext.WithCluster.
+func New(c client.Client, cluster logicalcluster.Name) client.Client {
+	return &scopedClient{Client: c, cluster: cluster}
+}
+
+// scopedClient adds its logical cluster to the context of every request.
+type scopedClient struct {
+	client.Client
+	cluster logicalcluster.Name
+}
+
+func (c *scopedClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return c.Client.Get(kontext.WithCluster(ctx, c.cluster), key, obj)
+}
+
+func (c *scopedClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return c.Client.List(kontext.WithCluster(ctx, c.cluster), list, opts...)
+}
+
+func (c *scopedClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	return c.Client.Create(kontext.WithCluster(ctx, c.cluster), obj, opts...)
+}
+
+func (c *scopedClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	return c.Client.Delete(kontext.WithCluster(ctx, c.cluster), obj, opts...)
+}
+
+func (c *scopedClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return c.Client.Update(kontext.WithCluster(ctx, c.cluster), obj, opts...)
+}
+
+func (c *scopedClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return c.Client.Patch(kontext.WithCluster(ctx, c.cluster), obj, patch, opts...)
+}
+
+func (c *scopedClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	return c.Client.DeleteAllOf(kontext.WithCluster(ctx, c.cluster), obj, opts...)
+}
+
+func (c *scopedClient) Status() client.StatusWriter {
+	return &scopedStatusWriter{StatusWriter: c.Client.Status(), cluster: c.cluster}
+}
+
+type scopedStatusWriter struct {
+	client.StatusWriter
+	cluster logicalcluster.Name
+}
+
+func (w *scopedStatusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return w.StatusWriter.Update(kontext.WithCluster(ctx, w.cluster), obj, opts...)
+}
+
+func (w *scopedStatusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return w.StatusWriter.Patch(kontext.WithCluster(ctx, w.cluster), obj, patch, opts...)
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// leaderElectionOptions configures how the replicas of the controller-manager elect a leader. The leases live in the
+// workspace of the APIExport, or the one of --leader-election-kubeconfig, rather than behind the virtual workspace,
+// which does not serve leases.
+type leaderElectionOptions struct {
+	Enabled bool
+	// Namespace is the namespace of the leases. It is created if it does not exist.
+	Namespace string
+	// ID is the name of the lease, or the prefix of the names of the per-shard leases.
+	ID string
+	// PerShard elects a leader for each virtual workspace shard of the APIExport instead of one for all shards, so that
+	// replicas can split the shards between them.
+	PerShard bool
+}
+
+// managerOptions returns the options of the manager for the given shard, or for all shards if shard is empty, with
+// leader election configured against the workspace of leaseConfig.
+func (o leaderElectionOptions) managerOptions(options ctrl.Options, leaseConfig *rest.Config, shard string) ctrl.Options {
+	options.LeaderElection = o.Enabled
+	options.LeaderElectionConfig = leaseConfig
+	options.LeaderElectionNamespace = o.Namespace
+	options.LeaderElectionID = o.leaseName(shard)
+	options.LeaderElectionResourceLock = resourcelock.LeasesResourceLock
+	// Hand over to the next replica right away on shutdown rather than after the lease expires
+	options.LeaderElectionReleaseOnCancel = true
+	return options
+}
+
+// leaseName returns the name of the lease of the shard, or of all shards if shard is empty.
+func (o leaderElectionOptions) leaseName(shard string) string {
+	if shard == "" {
+		return o.ID
+	}
+	return o.ID + "-" + shard
+}
+
+// shardName returns a short name for the virtual workspace shard at url that is the same in every replica.
+func shardName(url string) string {
+	h := fnv.New32a()
+	h.Write([]byte(url))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;create
+// +kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;patch;delete
+
+// ensureNamespace creates the namespace if it does not exist, such as the namespace of the leases in a fresh workspace.
+func ensureNamespace(ctx context.Context, cfg *rest.Config, name string) error {
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return fmt.Errorf("error creating client: %w", err)
+	}
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(namespace), namespace); err == nil {
+		return nil
+	} else if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error getting namespace %s: %w", name, err)
+	}
+	if err := c.Create(ctx, namespace); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("error creating namespace %s: %w", name, err)
+	}
+	return nil
+}
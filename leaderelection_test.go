@@ -0,0 +1,268 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+// leaders records which replicas are active for each shard, and whether two replicas ever were at the same time.
+type leaders struct {
+	lock      sync.Mutex
+	active    map[string]map[string]bool
+	conflicts []string
+}
+
+func (l *leaders) set(shard, replica string, active bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.active == nil {
+		l.active = map[string]map[string]bool{}
+	}
+	if l.active[shard] == nil {
+		l.active[shard] = map[string]bool{}
+	}
+	if !active {
+		delete(l.active[shard], replica)
+		return
+	}
+	l.active[shard][replica] = true
+	if len(l.active[shard]) > 1 {
+		l.conflicts = append(l.conflicts, fmt.Sprintf("shard %q led by %v", shard, l.of(shard)))
+	}
+}
+
+// of returns the replicas active for the shard. It must be called with the lock held.
+func (l *leaders) of(shard string) []string {
+	var replicas []string
+	for replica := range l.active[shard] {
+		replicas = append(replicas, replica)
+	}
+	sort.Strings(replicas)
+	return replicas
+}
+
+func (l *leaders) get(shard string) []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.of(shard)
+}
+
+func (l *leaders) check(t *testing.T) {
+	t.Helper()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, conflict := range l.conflicts {
+		t.Errorf("more than one replica was active: %s", conflict)
+	}
+}
+
+// startReplica starts a manager for the shard that marks the replica as active while it leads. The returned function
+// stops the manager and waits for it to release its lease.
+func startReplica(t *testing.T, cfg *rest.Config, opts leaderElectionOptions, shard, replica string, l *leaders) func() {
+	t.Helper()
+	leaseDuration, renewDeadline, retryPeriod := 2*time.Second, time.Second, 200*time.Millisecond
+	options := opts.managerOptions(ctrl.Options{
+		Scheme:                 scheme,
+		MetricsBindAddress:     "0",
+		HealthProbeBindAddress: "0",
+		LeaseDuration:          &leaseDuration,
+		RenewDeadline:          &renewDeadline,
+		RetryPeriod:            &retryPeriod,
+	}, cfg, shard)
+	mgr, err := ctrl.NewManager(cfg, options)
+	if err != nil {
+		t.Fatalf("failed to create manager for replica %s: %v", replica, err)
+	}
+	// Runnables that need leader election only run while the manager leads
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		l.set(shard, replica, true)
+		<-ctx.Done()
+		l.set(shard, replica, false)
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := mgr.Start(ctx); err != nil {
+			t.Errorf("failed to run manager for replica %s: %v", replica, err)
+		}
+	}()
+	stopped := false
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// waitForLeader waits until exactly one replica leads the shard and returns it.
+func waitForLeader(t *testing.T, l *leaders, shard string) string {
+	t.Helper()
+	var leader string
+	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		replicas := l.get(shard)
+		if len(replicas) != 1 {
+			return false, nil
+		}
+		leader = replicas[0]
+		return true, nil
+	}); err != nil {
+		t.Fatalf("no replica became the leader of shard %q", shard)
+	}
+	return leader
+}
+
+// testLeaderElection runs two replicas against cfg and checks that only one is active at a time, and that the other
+// one takes over when the leader stops.
+func testLeaderElection(t *testing.T, cfg *rest.Config, opts leaderElectionOptions) {
+	l := &leaders{}
+	stop := map[string]func(){
+		"a": startReplica(t, cfg, opts, "", "a", l),
+		"b": startReplica(t, cfg, opts, "", "b", l),
+	}
+
+	leader := waitForLeader(t, l, "")
+	// The other replica must stay passive while the leader renews its lease
+	time.Sleep(3 * time.Second)
+	if replicas := l.get(""); len(replicas) != 1 || replicas[0] != leader {
+		t.Fatalf("expected replica %s to stay the leader, got %v", leader, replicas)
+	}
+
+	c, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lease coordinationv1.Lease
+	if err := c.Get(context.Background(), client.ObjectKey{Namespace: opts.Namespace, Name: opts.ID}, &lease); err != nil {
+		t.Fatalf("expected lease %s/%s: %v", opts.Namespace, opts.ID, err)
+	}
+
+	stop[leader]()
+	next := waitForLeader(t, l, "")
+	if next == leader {
+		t.Errorf("expected the other replica to take over from %s", leader)
+	}
+	l.check(t)
+}
+
+func TestLeaderElection(t *testing.T) {
+	t.Run("lease in the APIExport workspace", func(t *testing.T) {
+		s := fake.NewServer("root")
+		// Registered first, so that the server outlives the replicas
+		t.Cleanup(s.Close)
+		opts := leaderElectionOptions{Enabled: true, Namespace: "controller-leases", ID: "test.my.domain"}
+		if err := ensureNamespace(context.Background(), s.Config(), opts.Namespace); err != nil {
+			t.Fatalf("failed to create the lease namespace: %v", err)
+		}
+		// Creating the namespace again is a no-op
+		if err := ensureNamespace(context.Background(), s.Config(), opts.Namespace); err != nil {
+			t.Fatalf("failed to ensure the existing lease namespace: %v", err)
+		}
+		testLeaderElection(t, s.Config(), opts)
+	})
+
+	t.Run("envtest", func(t *testing.T) {
+		if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+			t.Skip("KUBEBUILDER_ASSETS is not set, run the tests with make test")
+		}
+		testEnv := &envtest.Environment{}
+		cfg, err := testEnv.Start()
+		if err != nil {
+			t.Fatalf("failed to start envtest: %v", err)
+		}
+		t.Cleanup(func() {
+			if err := testEnv.Stop(); err != nil {
+				t.Errorf("failed to stop envtest: %v", err)
+			}
+		})
+		testLeaderElection(t, cfg, leaderElectionOptions{Enabled: true, Namespace: "default", ID: "test.my.domain"})
+	})
+}
+
+func TestLeaderElectionPerShard(t *testing.T) {
+	s := fake.NewServer("root")
+	t.Cleanup(s.Close)
+	opts := leaderElectionOptions{Enabled: true, Namespace: "default", ID: "test.my.domain", PerShard: true}
+
+	shards := []string{shardName("https://shard-1/services/apiexport/root/data.my.domain"), shardName("https://shard-2/services/apiexport/root/data.my.domain")}
+	if shards[0] == shards[1] {
+		t.Fatalf("expected distinct shard names, got %v", shards)
+	}
+	l := &leaders{}
+	for _, shard := range shards {
+		for _, replica := range []string{"a", "b"} {
+			startReplica(t, s.Config(), opts, shard, replica, l)
+		}
+	}
+
+	c, err := client.New(s.Config(), client.Options{Scheme: scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, shard := range shards {
+		waitForLeader(t, l, shard)
+		var lease coordinationv1.Lease
+		if err := c.Get(context.Background(), client.ObjectKey{Namespace: opts.Namespace, Name: opts.leaseName(shard)}, &lease); err != nil {
+			t.Errorf("expected a lease for shard %s: %v", shard, err)
+		}
+	}
+	l.check(t)
+}
+
+func TestVirtualWorkspaceConfigs(t *testing.T) {
+	s := fake.NewServer("root")
+	defer s.Close()
+	if err := s.PublishAPIExport(testAPIExportName); err != nil {
+		t.Fatalf("failed to publish APIExport: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wait.ForeverTestTimeout)
+	defer cancel()
+
+	cfgs, err := restConfigsForAPIExport(ctx, s.Config(), testAPIExportName)
+	if err != nil {
+		t.Fatalf("failed to look up virtual workspace URLs: %v", err)
+	}
+	if len(cfgs) != 1 || cfgs[0].Host != s.VirtualWorkspaceURL(testAPIExportName) {
+		t.Errorf("expected the virtual workspace of the only shard, got %v", cfgs)
+	}
+}
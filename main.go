@@ -21,6 +21,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -46,17 +48,19 @@ import (
 
 	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
 	"github.com/kcp-dev/kcp/pkg/apis/third_party/conditions/util/conditions"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 
 	// +kubebuilder:scaffold:imports
 
 	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
 	"github.com/kcp-dev/controller-runtime-example/controllers"
+	"github.com/kcp-dev/controller-runtime-example/internal/multicluster"
 )
 
 var (
-	scheme            = runtime.NewScheme()
-	setupLog          = ctrl.Log.WithName("setup")
-	kubeconfigContext string
+	scheme   = runtime.NewScheme()
+	setupLog = ctrl.Log.WithName("setup")
 )
 
 func init() {
@@ -64,21 +68,114 @@ func init() {
 	utilruntime.Must(apisv1alpha1.AddToScheme(scheme))
 	utilruntime.Must(datav1alpha1.AddToScheme(scheme))
 	// +kubebuilder:scaffold:scheme
-
-	flag.StringVar(&kubeconfigContext, "context", "", "kubeconfig context")
 }
 
 func main() {
 	var metricsAddr string
-	var enableLeaderElection bool
+	var leaderElection leaderElectionOptions
 	var probeAddr string
 	var apiExportName string
+	var secretSyncMode string
+	var configMapAudit bool
+	var configMapAuditInterval time.Duration
+	var clusterMetricsOptions controllers.ClusterMetricsOptions
+	var tracingOptions controllers.TracingOptions
+	var shardClusters bool
+	var shardIdentity string
+	var shutdownTimeout time.Duration
+	var bootstrap bool
+	var bootstrapAllowDowngrade bool
+	var tenantStateNamespace string
+	var claimedResourcesPath string
+	var clusterContexts string
+	var clusterKubeconfigDir string
+	var connection connectionOptions
+	var rateLimits controllers.ClusterRateLimitOptions
+	var clusterRateLimits string
+	var widgetQuotaWebhook bool
+	var maxWidgetsPerWorkspace int
+	var webhookCertDir string
+	flag.StringVar(&connection.Context, "context", "",
+		"The context of the kubeconfig. If unset, the current context is used.")
+	flag.StringVar(&connection.LeaderElectionKubeconfig, "leader-election-kubeconfig", "",
+		"The kubeconfig of the workspace or cluster of the leases of --leader-elect and --shard-clusters. "+
+			"If neither it nor --leader-election-context is set, the leases live in the workspace of the APIExport.")
+	flag.StringVar(&connection.LeaderElectionContext, "leader-election-context", "",
+		"The context of the kubeconfig of the leases, or of --kubeconfig if --leader-election-kubeconfig is not set.")
+	flag.Float64Var(&connection.QPS, "kube-api-qps", 20, "The maximum queries per second of each client to the API server.")
+	flag.IntVar(&connection.Burst, "kube-api-burst", 30, "The maximum burst of queries of each client to the API server.")
+	flag.Float64Var(&rateLimits.Default.QPS, "cluster-qps", 0,
+		"The maximum writes per second of the reconcilers to each workspace. Zero means no limit.")
+	flag.IntVar(&rateLimits.Default.Burst, "cluster-burst", 0,
+		"The maximum burst of writes of the reconcilers to each workspace. Defaults to --cluster-qps.")
+	flag.StringVar(&clusterRateLimits, "cluster-rate-limits", "",
+		"Comma-separated <workspace>=<qps>[/<burst>] overrides of --cluster-qps and --cluster-burst for specific workspaces.")
+	flag.Float64Var(&rateLimits.Global.QPS, "global-qps", 0,
+		"The maximum writes per second of the reconcilers across all workspaces. Zero means no limit.")
+	flag.IntVar(&rateLimits.Global.Burst, "global-burst", 0,
+		"The maximum burst of writes of the reconcilers across all workspaces. Defaults to --global-qps.")
 	flag.StringVar(&apiExportName, "api-export-name", "data.my.domain", "The name of the APIExport.")
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
-	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
+	flag.BoolVar(&leaderElection.Enabled, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&leaderElection.Namespace, "leader-election-namespace", "default",
+		"The namespace of the leader election leases, in the workspace of the APIExport. It is created if it does not exist.")
+	flag.StringVar(&leaderElection.ID, "leader-election-id", "68a0532d.my.domain",
+		"The name of the leader election lease, or the prefix of the per-shard leases.")
+	flag.BoolVar(&leaderElection.PerShard, "leader-elect-per-shard", false,
+		"Elect a leader for each virtual workspace shard of the APIExport, so that replicas can split the shards. "+
+			"Requires --leader-elect.")
+	flag.StringVar(&secretSyncMode, "secret-sync-mode", string(controllers.SecretSyncModeLenient),
+		"How secrets published by ConfigMaps are kept in sync. "+
+			"Strict removes extra keys and labels, Lenient only manages the keys owned by the controller.")
+	flag.BoolVar(&configMapAudit, "configmap-consistency-audit", false,
+		"Periodically check that ConfigMaps listed in each workspace are unique and belong to that workspace.")
+	flag.DurationVar(&configMapAuditInterval, "configmap-consistency-audit-interval", 10*time.Minute,
+		"The interval between two ConfigMap consistency audits.")
+	flag.IntVar(&clusterMetricsOptions.MaxClusters, "metrics-max-clusters", 0,
+		"The number of workspaces that per-workspace metrics are reported for under their own name. "+
+			"Further workspaces are reported as \"other\". Zero means no limit.")
+	flag.IntVar(&clusterMetricsOptions.HashBuckets, "metrics-cluster-hash-buckets", 0,
+		"If set, report per-workspace metrics under this many buckets of hashed workspace names instead of the names. "+
+			"Overrides --metrics-max-clusters.")
+	flag.StringVar(&tracingOptions.Endpoint, "tracing-endpoint", "",
+		"The host:port of an OTLP/HTTP receiver to export traces of reconciles and API calls to. Tracing is disabled if empty.")
+	flag.BoolVar(&tracingOptions.Insecure, "tracing-insecure", false, "Export traces over plain HTTP instead of HTTPS.")
+	flag.Float64Var(&tracingOptions.SamplingRatio, "tracing-sampling-ratio", 1,
+		"The fraction of reconciles that are traced.")
+	flag.BoolVar(&shardClusters, "shard-clusters", false,
+		"Split the workspaces between all replicas by consistent hashing, instead of having one active replica. "+
+			"The replicas find each other through leases in --leader-election-namespace. Cannot be used with --leader-elect.")
+	flag.StringVar(&shardIdentity, "shard-identity", "",
+		"The name of this replica among the replicas splitting the workspaces. Defaults to the hostname.")
+	flag.DurationVar(&shutdownTimeout, "graceful-shutdown-timeout", 30*time.Second,
+		"How long in-flight reconciles and the requests already queued are given to finish on shutdown.")
+	flag.StringVar(&tenantStateNamespace, "tenant-state-namespace", "default",
+		"The namespace of the workspace of the APIExport where the state of each tenant is kept. It is created if it does not exist.")
+	flag.StringVar(&claimedResourcesPath, "claimed-resources", "",
+		"A file listing resources of other APIExports to claim, with their APIExports, under claimedResources. "+
+			"Their objects are passed to the hooks registered for them.")
+	flag.StringVar(&clusterContexts, "cluster-contexts", "",
+		"Comma-separated contexts of the kubeconfig whose clusters the controllers run across without kcp, each as a "+
+			"logical cluster named after its context.")
+	flag.StringVar(&clusterKubeconfigDir, "cluster-kubeconfig-dir", "",
+		"A directory of kubeconfig files whose clusters the controllers run across without kcp, each as a logical "+
+			"cluster named after its file.")
+	flag.BoolVar(&widgetQuotaWebhook, "widget-quota-webhook", false,
+		"Serve the validating webhook that rejects the creation of widgets beyond the quota of their workspace.")
+	flag.IntVar(&maxWidgetsPerWorkspace, "max-widgets-per-workspace", 0,
+		"The quota of widgets of the workspaces without a WidgetQuota named default. 0 means no limit. Requires --widget-quota-webhook.")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", "",
+		"The directory of the serving certificate and key of the webhook server, tls.crt and tls.key. "+
+			"If unset, the controller-runtime default is used.")
+	flag.BoolVar(&bootstrap, "bootstrap", false,
+		"Create or update the APIExport and its APIResourceSchemas in the workspace of the kubeconfig on startup, "+
+			"from the manifests of config/kcp built into the binary. Refuses to replace a schema with one that is not compatible with it.")
+	flag.BoolVar(&bootstrapAllowDowngrade, "bootstrap-allow-downgrade", false,
+		"With --bootstrap, replace the schemas of the APIExport even with ones that are not compatible with them, "+
+			"and stop exporting the resources that are not in the built-in manifests.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -91,85 +188,458 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	// --kubeconfig is registered by controller-runtime
+	connection.Kubeconfig = flag.Lookup("kubeconfig").Value.String()
+	if err := connection.validate(); err != nil {
+		setupLog.Error(err, "invalid flags")
+		os.Exit(1)
+	}
+
+	switch controllers.SecretSyncMode(secretSyncMode) {
+	case controllers.SecretSyncModeStrict, controllers.SecretSyncModeLenient:
+	default:
+		setupLog.Error(fmt.Errorf("unknown secret sync mode %q", secretSyncMode), "invalid flags")
+		os.Exit(1)
+	}
+
+	if leaderElection.PerShard && !leaderElection.Enabled {
+		setupLog.Error(fmt.Errorf("--leader-elect-per-shard requires --leader-elect"), "invalid flags")
+		os.Exit(1)
+	}
+
+	if shardClusters && leaderElection.Enabled {
+		setupLog.Error(fmt.Errorf("--shard-clusters cannot be used with --leader-elect"), "invalid flags")
+		os.Exit(1)
+	}
+	if shardClusters && shardIdentity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			setupLog.Error(err, "unable to get the hostname for --shard-identity")
+			os.Exit(1)
+		}
+		shardIdentity = hostname
+	}
+
+	if clusterContexts != "" && clusterKubeconfigDir != "" {
+		setupLog.Error(fmt.Errorf("--cluster-contexts and --cluster-kubeconfig-dir are mutually exclusive"), "invalid flags")
+		os.Exit(1)
+	}
+	if clusterContexts != "" && connection.Context != "" {
+		setupLog.Error(fmt.Errorf("--context cannot be used with --cluster-contexts"), "invalid flags")
+		os.Exit(1)
+	}
+	if clusterKubeconfigDir != "" && (connection.Kubeconfig != "" || connection.Context != "") {
+		setupLog.Error(fmt.Errorf("--kubeconfig and --context cannot be used with --cluster-kubeconfig-dir"), "invalid flags")
+		os.Exit(1)
+	}
+
+	if maxWidgetsPerWorkspace < 0 {
+		setupLog.Error(fmt.Errorf("--max-widgets-per-workspace must not be negative"), "invalid flags")
+		os.Exit(1)
+	}
+	if maxWidgetsPerWorkspace > 0 && !widgetQuotaWebhook {
+		setupLog.Error(fmt.Errorf("--max-widgets-per-workspace requires --widget-quota-webhook"), "invalid flags")
+		os.Exit(1)
+	}
+	if bootstrapAllowDowngrade && !bootstrap {
+		setupLog.Error(fmt.Errorf("--bootstrap-allow-downgrade requires --bootstrap"), "invalid flags")
+		os.Exit(1)
+	}
+	if widgetQuotaWebhook && leaderElection.PerShard {
+		// Each manager would have to serve the webhook for the logical clusters of its shard on its own port
+		setupLog.Error(fmt.Errorf("--widget-quota-webhook cannot be used with --leader-elect-per-shard"), "invalid flags")
+		os.Exit(1)
+	}
+	if widgetQuotaWebhook && (clusterContexts != "" || clusterKubeconfigDir != "") {
+		// The requests of the clusters do not say which cluster they come from
+		setupLog.Error(fmt.Errorf("--widget-quota-webhook cannot be used with --cluster-contexts or --cluster-kubeconfig-dir"), "invalid flags")
+		os.Exit(1)
+	}
+
+	if err := controllers.ConfigureClusterMetrics(clusterMetricsOptions); err != nil {
+		setupLog.Error(err, "invalid flags")
+		os.Exit(1)
+	}
+
+	var rateLimiter *controllers.ClusterRateLimiter
+	if rateLimits.Default.QPS > 0 || rateLimits.Global.QPS > 0 || clusterRateLimits != "" {
+		var err error
+		if rateLimits.Overrides, err = controllers.ParseClusterRateLimits(clusterRateLimits); err != nil {
+			setupLog.Error(err, "invalid flags")
+			os.Exit(1)
+		}
+		if rateLimiter, err = controllers.NewClusterRateLimiter(rateLimits); err != nil {
+			setupLog.Error(err, "invalid flags")
+			os.Exit(1)
+		}
+	}
+
 	ctx := ctrl.SetupSignalHandler()
 
-	restConfig := ctrl.GetConfigOrDie()
+	clusters, err := loadClusters(connection.Kubeconfig, clusterContexts, clusterKubeconfigDir)
+	if err != nil {
+		setupLog.Error(err, "unable to load the clusters")
+		os.Exit(1)
+	}
+	for _, cluster := range clusters {
+		connection.throttle(cluster.Config)
+	}
+
+	var restConfig *rest.Config
+	if len(clusters) > 0 {
+		// The first cluster holds the leases unless told otherwise
+		restConfig = clusters[0].Config
+	} else {
+		var source string
+		if restConfig, source, err = connection.restConfig(defaultConfigLoader); err != nil {
+			setupLog.Error(err, "unable to load the kubeconfig")
+			os.Exit(1)
+		}
+		setupLog.Info("Loaded the kubeconfig", "source", source, "host", restConfig.Host)
+	}
+	leaseConfig, source, err := connection.leaderElectionConfig(defaultConfigLoader, restConfig)
+	if err != nil {
+		setupLog.Error(err, "unable to load the kubeconfig of the leases")
+		os.Exit(1)
+	}
+	if leaseConfig != restConfig {
+		setupLog.Info("Loaded the kubeconfig of the leases", "source", source, "host", leaseConfig.Host)
+	}
+
+	tracerProvider := trace.NewNoopTracerProvider()
+	if tracingOptions.Endpoint != "" {
+		tp, err := controllers.NewTracerProvider(ctx, tracingOptions)
+		if err != nil {
+			setupLog.Error(err, "unable to set up tracing")
+			os.Exit(1)
+		}
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tp.Shutdown(shutdownCtx); err != nil {
+				setupLog.Error(err, "unable to flush traces")
+			}
+		}()
+		otel.SetTracerProvider(tp)
+		tracerProvider = tp
+		// Propagate the trace context of API calls to kcp, or to each of the clusters
+		if len(clusters) == 0 {
+			restConfig.Wrap(controllers.TracingTransport)
+		}
+		for _, cluster := range clusters {
+			cluster.Config.Wrap(controllers.TracingTransport)
+		}
+		setupLog.Info("Exporting traces", "endpoint", tracingOptions.Endpoint)
+	}
 
 	setupLog = setupLog.WithValues("api-export-name", apiExportName)
 
-	var mgr ctrl.Manager
-	var err error
 	options := ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
+		CertDir:                webhookCertDir,
 		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "68a0532d.my.domain",
-		LeaderElectionConfig:   restConfig,
 	}
-	if kcpAPIsGroupPresent(restConfig) {
-		setupLog.Info("Looking up virtual workspace URL")
-		cfg, err := restConfigForAPIExport(ctx, restConfig, apiExportName)
+	// The manager waits for the drain, and then for the leader election lease to be released
+	gracefulShutdownTimeout := shutdownTimeout + 5*time.Second
+	options.GracefulShutdownTimeout = &gracefulShutdownTimeout
+	if leaderElection.Enabled || shardClusters {
+		// The leases are created in the workspace of the APIExport, or the one of --leader-election-kubeconfig, which
+		// may not have the namespace yet
+		if err := ensureNamespace(ctx, leaseConfig, leaderElection.Namespace); err != nil {
+			setupLog.Error(err, "unable to create the namespace of the leases")
+			os.Exit(1)
+		}
+	}
+
+	var sharder *controllers.Sharder
+	if shardClusters {
+		leaseClient, err := client.New(leaseConfig, client.Options{Scheme: scheme})
 		if err != nil {
-			setupLog.Error(err, "error looking up virtual workspace URL")
+			setupLog.Error(err, "unable to create the client of the membership leases")
+			os.Exit(1)
 		}
+		sharder = &controllers.Sharder{
+			Client:        leaseClient,
+			Namespace:     leaderElection.Namespace,
+			Group:         leaderElection.ID,
+			Identity:      shardIdentity,
+			LeaseDuration: 15 * time.Second,
+			RenewPeriod:   5 * time.Second,
+		}
+		setupLog.Info("Splitting workspaces between replicas", "identity", shardIdentity)
+	}
 
-		setupLog.Info("Using virtual workspace URL", "url", cfg.Host)
+	var mgrs []ctrl.Manager
+	// The virtual workspace shard of each manager with --leader-elect-per-shard
+	var shards []string
+	var stateClient client.Client
+	var claims *controllers.ClaimTracker
+	var claimedResources []controllers.ClaimedResource
+	kcpPresent := len(clusters) == 0 && kcpAPIsGroupPresent(restConfig)
+	if kcpPresent {
+		claims = controllers.NewClaimTracker()
+		if claimedResourcesPath != "" {
+			var err error
+			if claimedResources, err = readClaimedResources(claimedResourcesPath); err != nil {
+				setupLog.Error(err, "unable to read the claimed resources")
+				os.Exit(1)
+			}
+			if err := resolveIdentityHashes(ctx, restConfig, claimedResources); err != nil {
+				setupLog.Error(err, "unable to look up the identity hashes of the claimed resources")
+				os.Exit(1)
+			}
+		}
+		if bootstrap {
+			if err := bootstrapAPIExport(ctx, restConfig, kcpManifests, apiExportName, claimedResourceClaims(claimedResources), bootstrapAllowDowngrade); err != nil {
+				setupLog.Error(err, "unable to bootstrap the APIExport")
+				os.Exit(1)
+			}
+		} else if len(claimedResources) > 0 {
+			if err := checkAPIExportClaims(ctx, restConfig, apiExportName, claimedResourceClaims(claimedResources)); err != nil {
+				setupLog.Error(err, "unable to claim the claimed resources")
+				os.Exit(1)
+			}
+		}
+
+		// The state of the tenants is kept in the workspace of the APIExport
+		if err := ensureNamespace(ctx, restConfig, tenantStateNamespace); err != nil {
+			setupLog.Error(err, "unable to create the namespace of the state of the tenants")
+			os.Exit(1)
+		}
+		var err error
+		if stateClient, err = client.New(restConfig, client.Options{Scheme: scheme}); err != nil {
+			setupLog.Error(err, "unable to create the client of the state of the tenants")
+			os.Exit(1)
+		}
 
-		options.LeaderElectionConfig = restConfig
-		mgr, err = kcp.NewClusterAwareManager(cfg, options)
+		setupLog.Info("Looking up virtual workspace URL")
+		cfgs, err := restConfigsForAPIExport(ctx, restConfig, apiExportName)
 		if err != nil {
-			setupLog.Error(err, "unable to start cluster aware manager")
+			setupLog.Error(err, "error looking up virtual workspace URL")
 			os.Exit(1)
 		}
+		if !leaderElection.PerShard {
+			// TODO: sharding support without per-shard leader election
+			cfgs = cfgs[:1]
+		}
+
+		for _, cfg := range cfgs {
+			shard := ""
+			if leaderElection.PerShard {
+				shard = shardName(cfg.Host)
+			}
+			setupLog.Info("Using virtual workspace URL", "url", cfg.Host, "lease", leaderElection.leaseName(shard))
+
+			mgr, err := kcp.NewClusterAwareManager(cfg, leaderElection.managerOptions(options, leaseConfig, shard))
+			if err != nil {
+				setupLog.Error(err, "unable to start cluster aware manager")
+				os.Exit(1)
+			}
+			mgrs = append(mgrs, mgr)
+			shards = append(shards, shard)
+			// Only the first manager serves metrics and probes, the metrics of all of them are in the same registry
+			options.MetricsBindAddress = "0"
+			options.HealthProbeBindAddress = "0"
+		}
 	} else {
-		setupLog.Info("The KCP API group is not present - creating standard manager", "group", apisv1alpha1.SchemeGroupVersion.Group)
-		mgr, err = ctrl.NewManager(restConfig, options)
+		if bootstrap {
+			setupLog.Error(fmt.Errorf("--bootstrap requires kcp"), "invalid flags")
+			os.Exit(1)
+		}
+		if claimedResourcesPath != "" {
+			setupLog.Error(fmt.Errorf("--claimed-resources requires kcp"), "invalid flags")
+			os.Exit(1)
+		}
+		var mgr ctrl.Manager
+		if len(clusters) > 0 {
+			names := make([]string, 0, len(clusters))
+			for _, cluster := range clusters {
+				names = append(names, cluster.Name.String())
+			}
+			setupLog.Info("Running across clusters as logical clusters", "clusters", names)
+			mgr, err = multicluster.NewManager(clusters, leaderElection.managerOptions(options, leaseConfig, ""))
+		} else {
+			setupLog.Info("The KCP API group is not present - creating standard manager", "group", apisv1alpha1.SchemeGroupVersion.Group)
+			mgr, err = ctrl.NewManager(restConfig, leaderElection.managerOptions(options, leaseConfig, ""))
+		}
 		if err != nil {
 			setupLog.Error(err, "unable to start manager")
 			os.Exit(1)
 		}
+		mgrs = append(mgrs, mgr)
+		shards = append(shards, "")
 	}
 
-	if err = (&controllers.ConfigMapReconciler{
-		Client: mgr.GetClient(),
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "ConfigMap")
+	for i, mgr := range mgrs {
+		drainer := &controllers.Drainer{Timeout: shutdownTimeout, Shard: shards[i]}
+		if err := mgr.Add(drainer); err != nil {
+			setupLog.Error(err, "unable to add the drainer")
+			os.Exit(1)
+		}
+
+		mgrClient := mgr.GetClient()
+		if rateLimiter != nil {
+			mgrClient = controllers.NewRateLimitingClient(mgrClient, rateLimiter)
+		}
+		if tracingOptions.Endpoint != "" {
+			// The spans of the requests include the time they were throttled
+			mgrClient = controllers.NewTracingClient(mgrClient, tracerProvider)
+		}
+
+		if err := (&controllers.ConfigMapReconciler{
+			ClusterClient:  controllers.NewClusterClient(mgrClient),
+			Recorder:       mgr.GetEventRecorderFor("configmap-controller"),
+			SecretSyncMode: controllers.SecretSyncMode(secretSyncMode),
+			TracerProvider: tracerProvider,
+			Sharder:        sharder,
+			Drainer:        drainer,
+			Claims:         claims,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ConfigMap")
+		}
+
+		if err := (&controllers.WidgetReconciler{
+			ClusterClient:  controllers.NewClusterClient(mgrClient),
+			Scheme:         mgr.GetScheme(),
+			TracerProvider: tracerProvider,
+			Sharder:        sharder,
+			Drainer:        drainer,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Widget")
+			os.Exit(1)
+		}
+		if widgetQuotaWebhook {
+			if err := (&controllers.WidgetQuotaValidator{
+				ClusterClient:     controllers.NewClusterClient(mgrClient),
+				DefaultMaxWidgets: maxWidgetsPerWorkspace,
+			}).SetupWebhookWithManager(mgr); err != nil {
+				setupLog.Error(err, "unable to create webhook", "webhook", "WidgetQuota")
+				os.Exit(1)
+			}
+		}
+		if kcpPresent {
+			if err := (&controllers.APIBindingReconciler{
+				ClusterClient:  controllers.NewClusterClient(mgrClient),
+				StateClient:    stateClient,
+				StateNamespace: tenantStateNamespace,
+				APIExportName:  apiExportName,
+				Recorder:       mgr.GetEventRecorderFor("apibinding-controller"),
+				Claims:         claims,
+				Sharder:        sharder,
+				Drainer:        drainer,
+			}).SetupWithManager(mgr); err != nil {
+				setupLog.Error(err, "unable to create controller", "controller", "APIBinding")
+				os.Exit(1)
+			}
+		}
+		for _, resource := range claimedResources {
+			gr := resource.GroupVersionResource().GroupResource()
+			hooks := controllers.ClaimedResourceHooks(gr)
+			if len(hooks) == 0 {
+				setupLog.Info("No hooks are registered for the claimed resource, not watching it", "resource", gr.String())
+				continue
+			}
+			if err := (&controllers.ClaimedResourceReconciler{
+				ClusterClient:  controllers.NewClusterClient(mgrClient),
+				Resource:       resource,
+				Hooks:          hooks,
+				TracerProvider: tracerProvider,
+				Claims:         claims,
+				Sharder:        sharder,
+				Drainer:        drainer,
+			}).SetupWithManager(mgr); err != nil {
+				setupLog.Error(err, "unable to create controller", "controller", "ClaimedResource", "resource", gr.String())
+				os.Exit(1)
+			}
+		}
+		// +kubebuilder:scaffold:builder
+
+		if configMapAudit {
+			if err := mgr.Add(&controllers.ConfigMapAuditor{
+				Client:   mgr.GetClient(),
+				Recorder: mgr.GetEventRecorderFor("configmap-audit"),
+				Interval: configMapAuditInterval,
+			}); err != nil {
+				setupLog.Error(err, "unable to add ConfigMap consistency audit")
+				os.Exit(1)
+			}
+		}
 	}
 
-	if err = (&controllers.WidgetReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Widget")
-		os.Exit(1)
+	if sharder != nil {
+		if err := mgrs[0].Add(sharder); err != nil {
+			setupLog.Error(err, "unable to add the sharder")
+			os.Exit(1)
+		}
 	}
-	// +kubebuilder:scaffold:builder
 
-	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
+	if err := mgrs[0].AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+	if err := mgrs[0].AddReadyzCheck("readyz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
 
-	setupLog.Info("starting manager")
+	setupLog.Info("starting manager", "managers", len(mgrs))
 
-	if err := mgr.Start(ctx); err != nil {
+	if err := startManagers(ctx, mgrs); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
 
+// loadClusters returns the clusters given by --cluster-contexts or --cluster-kubeconfig-dir, if any.
+func loadClusters(kubeconfig, contexts, kubeconfigDir string) ([]multicluster.Cluster, error) {
+	switch {
+	case contexts != "":
+		return multicluster.FromContexts(kubeconfig, strings.Split(contexts, ","))
+	case kubeconfigDir != "":
+		return multicluster.FromDir(kubeconfigDir)
+	}
+	return nil, nil
+}
+
+// startManagers runs the managers until ctx is done or one of them fails, which stops the others.
+func startManagers(ctx context.Context, mgrs []ctrl.Manager) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(mgrs))
+	for _, mgr := range mgrs {
+		go func(mgr ctrl.Manager) {
+			errs <- mgr.Start(ctx)
+		}(mgr)
+	}
+	var result error
+	for range mgrs {
+		if err := <-errs; err != nil && result == nil {
+			result = err
+			cancel()
+		}
+	}
+	return result
+}
+
 // +kubebuilder:rbac:groups="apis.kcp.io",resources=apiexports,verbs=get;list;watch
 
 // restConfigForAPIExport returns a *rest.Config properly configured to communicate with the endpoint for the
 // APIExport's virtual workspace. It blocks until the controller APIExport VirtualWorkspaceURLsReady condition
 // becomes truthy, which happens when the APIExport is bound for the first time.
 func restConfigForAPIExport(ctx context.Context, cfg *rest.Config, apiExportName string) (*rest.Config, error) {
+	cfgs, err := restConfigsForAPIExport(ctx, cfg, apiExportName)
+	if err != nil {
+		return nil, err
+	}
+	return cfgs[0], nil
+}
+
+// restConfigsForAPIExport is like restConfigForAPIExport, but returns a *rest.Config for the virtual workspace of the
+// APIExport on each shard.
+func restConfigsForAPIExport(ctx context.Context, cfg *rest.Config, apiExportName string) ([]*rest.Config, error) {
 	apiExportClient, err := client.NewWithWatch(cfg, client.Options{Scheme: scheme})
 	if err != nil {
 		return nil, fmt.Errorf("error creating APIExport client: %w", err)
@@ -182,10 +652,7 @@ func restConfigForAPIExport(ctx context.Context, cfg *rest.Config, apiExportName
 		return nil, fmt.Errorf("error watching for APIExport: %w", err)
 	}
 	if len(list.Items) > 0 && isAPIExportReady(&list.Items[0]) {
-		cfg = rest.CopyConfig(cfg)
-		// TODO: sharding support
-		cfg.Host = list.Items[0].Status.VirtualWorkspaces[0].URL
-		return cfg, nil
+		return virtualWorkspaceConfigs(cfg, &list.Items[0]), nil
 	}
 
 	setupLog.Info("Watching for APIExport to become ready", "name", apiExportName)
@@ -213,15 +680,23 @@ func restConfigForAPIExport(ctx context.Context, cfg *rest.Config, apiExportName
 				if !isAPIExportReady(apiExport) {
 					continue
 				}
-				cfg = rest.CopyConfig(cfg)
-				// TODO: sharding support
-				cfg.Host = apiExport.Status.VirtualWorkspaces[0].URL
-				return cfg, nil
+				return virtualWorkspaceConfigs(cfg, apiExport), nil
 			}
 		}
 	}
 }
 
+// virtualWorkspaceConfigs returns a copy of cfg for each virtual workspace URL of the ready APIExport.
+func virtualWorkspaceConfigs(cfg *rest.Config, apiExport *apisv1alpha1.APIExport) []*rest.Config {
+	cfgs := make([]*rest.Config, 0, len(apiExport.Status.VirtualWorkspaces))
+	for _, virtualWorkspace := range apiExport.Status.VirtualWorkspaces {
+		shardConfig := rest.CopyConfig(cfg)
+		shardConfig.Host = virtualWorkspace.URL
+		cfgs = append(cfgs, shardConfig)
+	}
+	return cfgs
+}
+
 func kcpAPIsGroupPresent(restConfig *rest.Config) bool {
 	discoveryClient, err := discovery.NewDiscoveryClientForConfig(restConfig)
 	if err != nil {
@@ -0,0 +1,608 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kcp-dev/logicalcluster/v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/kcp"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+	"github.com/kcp-dev/controller-runtime-example/controllers"
+	"github.com/kcp-dev/controller-runtime-example/internal/multicluster"
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+const testAPIExportName = "data.my.domain"
+
+func TestKCPAPIsGroupPresent(t *testing.T) {
+	kcpServer := fake.NewServer("root")
+	defer kcpServer.Close()
+	if !kcpAPIsGroupPresent(kcpServer.Config()) {
+		t.Errorf("expected the kcp API group to be present")
+	}
+
+	var resources []fake.Resource
+	for _, r := range fake.DefaultResources {
+		if r.Group != apisv1alpha1.SchemeGroupVersion.Group {
+			resources = append(resources, r)
+		}
+	}
+	kubeServer := fake.NewServer("root", resources...)
+	defer kubeServer.Close()
+	if kcpAPIsGroupPresent(kubeServer.Config()) {
+		t.Errorf("expected the kcp API group not to be present")
+	}
+}
+
+func TestRestConfigForAPIExport(t *testing.T) {
+	s := fake.NewServer("root")
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), wait.ForeverTestTimeout)
+	defer cancel()
+
+	type result struct {
+		host string
+		err  error
+	}
+	results := make(chan result)
+	go func() {
+		cfg, err := restConfigForAPIExport(ctx, s.Config(), testAPIExportName)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		results <- result{host: cfg.Host}
+	}()
+
+	// The lookup has to wait for the APIExport to become ready
+	select {
+	case r := <-results:
+		t.Fatalf("expected lookup to block until the APIExport is ready, got %v", r)
+	case <-time.After(time.Second):
+	}
+
+	if err := s.PublishAPIExport(testAPIExportName); err != nil {
+		t.Fatalf("failed to publish APIExport: %v", err)
+	}
+	r := <-results
+	if r.err != nil {
+		t.Fatalf("failed to look up virtual workspace URL: %v", r.err)
+	}
+	if diff := cmp.Diff(s.VirtualWorkspaceURL(testAPIExportName), r.host); diff != "" {
+		t.Errorf("unexpected virtual workspace URL: %s", diff)
+	}
+
+	// Once ready, the lookup returns immediately
+	cfg, err := restConfigForAPIExport(ctx, s.Config(), testAPIExportName)
+	if err != nil {
+		t.Fatalf("failed to look up virtual workspace URL: %v", err)
+	}
+	if diff := cmp.Diff(s.VirtualWorkspaceURL(testAPIExportName), cfg.Host); diff != "" {
+		t.Errorf("unexpected virtual workspace URL: %s", diff)
+	}
+}
+
+// TestReconcilers runs both reconcilers in a cluster-aware manager against the virtual workspace of the fake kcp.
+func TestReconcilers(t *testing.T) {
+	s := fake.NewServer("root")
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := s.PublishAPIExport(testAPIExportName); err != nil {
+		t.Fatalf("failed to publish APIExport: %v", err)
+	}
+	cfg, err := restConfigForAPIExport(ctx, s.Config(), testAPIExportName)
+	if err != nil {
+		t.Fatalf("failed to look up virtual workspace URL: %v", err)
+	}
+	mgr, err := kcp.NewClusterAwareManager(cfg, ctrl.Options{
+		Scheme:                 scheme,
+		MetricsBindAddress:     "0",
+		HealthProbeBindAddress: "0",
+	})
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	if err := (&controllers.ConfigMapReconciler{
+		ClusterClient: controllers.NewClusterClient(mgr.GetClient()),
+		Recorder:      mgr.GetEventRecorderFor("configmap-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		t.Fatalf("failed to set up ConfigMap controller: %v", err)
+	}
+	if err := (&controllers.WidgetReconciler{
+		ClusterClient: controllers.NewClusterClient(mgr.GetClient()),
+		Scheme:        mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		t.Fatalf("failed to set up Widget controller: %v", err)
+	}
+	go func() {
+		if err := mgr.Start(ctx); err != nil {
+			t.Errorf("failed to run manager: %v", err)
+		}
+	}()
+
+	widgets := map[logicalcluster.Name]int{"tenant-a": 2, "tenant-b": 3}
+	for cluster, count := range widgets {
+		c, err := client.New(s.ClusterConfig(cluster), client.Options{Scheme: scheme})
+		if err != nil {
+			t.Fatalf("failed to create client for %s: %v", cluster, err)
+		}
+
+		if err := c.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "config", Labels: map[string]string{"name": cluster.String()}},
+			Data:       map[string]string{"namespace": "created", "secretData": cluster.String()},
+		}); err != nil {
+			t.Fatalf("failed to create configmap in %s: %v", cluster, err)
+		}
+		for i := 0; i < count; i++ {
+			if err := c.Create(ctx, &datav1alpha1.Widget{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: fmt.Sprintf("widget-%d", i)},
+			}); err != nil {
+				t.Fatalf("failed to create widget in %s: %v", cluster, err)
+			}
+		}
+	}
+
+	for cluster, count := range widgets {
+		c, err := client.New(s.ClusterConfig(cluster), client.Options{Scheme: scheme})
+		if err != nil {
+			t.Fatalf("failed to create client for %s: %v", cluster, err)
+		}
+
+		t.Logf("waiting for the controllers to act on %s", cluster)
+		if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			var cm corev1.ConfigMap
+			if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "config"}, &cm); err != nil {
+				return false, err
+			}
+			if actual, expected := cm.Labels["response"], "hello-"+cluster.String(); actual != expected {
+				t.Logf("configmap in %s has response %q, expected %q", cluster, actual, expected)
+				return false, nil
+			}
+
+			if err := c.Get(ctx, client.ObjectKey{Name: "created"}, &corev1.Namespace{}); err != nil {
+				t.Logf("namespace in %s not created yet: %v", cluster, err)
+				return false, client.IgnoreNotFound(err)
+			}
+
+			var secret corev1.Secret
+			if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "config"}, &secret); err != nil {
+				t.Logf("secret in %s not created yet: %v", cluster, err)
+				return false, client.IgnoreNotFound(err)
+			}
+			if actual, expected := string(secret.Data["dataFromCM"]), cluster.String(); actual != expected {
+				t.Logf("secret in %s has data %q, expected %q", cluster, actual, expected)
+				return false, nil
+			}
+
+			var list datav1alpha1.WidgetList
+			if err := c.List(ctx, &list); err != nil {
+				return false, err
+			}
+			for _, widget := range list.Items {
+				if widget.Status.Total != count {
+					t.Logf("widget %s in %s has total %d, expected %d", widget.Name, cluster, widget.Status.Total, count)
+					return false, nil
+				}
+			}
+			return true, nil
+		}); err != nil {
+			t.Fatalf("controllers never acted on %s: %v", cluster, err)
+		}
+	}
+}
+
+func TestMultiClusterReconcilers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Plain Kubernetes clusters, such as kind clusters, with the Widget CRD installed
+	widgets := map[logicalcluster.Name]int{"kind-a": 2, "kind-b": 3}
+	var clusters []multicluster.Cluster
+	clients := map[logicalcluster.Name]client.Client{}
+	for _, name := range []logicalcluster.Name{"kind-a", "kind-b"} {
+		s := fake.NewServer("default")
+		defer s.Close()
+		clusters = append(clusters, multicluster.Cluster{Name: name, Config: s.Config()})
+		c, err := client.New(s.Config(), client.Options{Scheme: scheme})
+		if err != nil {
+			t.Fatalf("failed to create client for %s: %v", name, err)
+		}
+		clients[name] = c
+	}
+
+	mgr, err := multicluster.NewManager(clusters, ctrl.Options{
+		Scheme:                 scheme,
+		MetricsBindAddress:     "0",
+		HealthProbeBindAddress: "0",
+	})
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	if err := (&controllers.ConfigMapReconciler{
+		ClusterClient: controllers.NewClusterClient(mgr.GetClient()),
+		Recorder:      mgr.GetEventRecorderFor("configmap-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		t.Fatalf("failed to set up ConfigMap controller: %v", err)
+	}
+	if err := (&controllers.WidgetReconciler{
+		ClusterClient: controllers.NewClusterClient(mgr.GetClient()),
+		Scheme:        mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		t.Fatalf("failed to set up Widget controller: %v", err)
+	}
+	go func() {
+		if err := mgr.Start(ctx); err != nil {
+			t.Errorf("failed to run manager: %v", err)
+		}
+	}()
+
+	for cluster, count := range widgets {
+		c := clients[cluster]
+		if err := c.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "config", Labels: map[string]string{"name": cluster.String()}},
+			Data:       map[string]string{"secretData": cluster.String()},
+		}); err != nil {
+			t.Fatalf("failed to create configmap in %s: %v", cluster, err)
+		}
+		for i := 0; i < count; i++ {
+			if err := c.Create(ctx, &datav1alpha1.Widget{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: fmt.Sprintf("widget-%d", i)},
+			}); err != nil {
+				t.Fatalf("failed to create widget in %s: %v", cluster, err)
+			}
+		}
+	}
+
+	for cluster, count := range widgets {
+		c := clients[cluster]
+		t.Logf("waiting for the controllers to act on %s", cluster)
+		if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			var cm corev1.ConfigMap
+			if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "config"}, &cm); err != nil {
+				return false, err
+			}
+			if actual, expected := cm.Labels["response"], "hello-"+cluster.String(); actual != expected {
+				t.Logf("configmap in %s has response %q, expected %q", cluster, actual, expected)
+				return false, nil
+			}
+			if logicalcluster.From(&cm) == cluster {
+				return false, fmt.Errorf("the cluster annotation was written to the configmap in %s", cluster)
+			}
+
+			var secret corev1.Secret
+			if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "config"}, &secret); err != nil {
+				t.Logf("secret in %s not created yet: %v", cluster, err)
+				return false, client.IgnoreNotFound(err)
+			}
+			if actual, expected := string(secret.Data["dataFromCM"]), cluster.String(); actual != expected {
+				t.Logf("secret in %s has data %q, expected %q", cluster, actual, expected)
+				return false, nil
+			}
+
+			// The widgets of each cluster are counted apart from the ones of the other cluster
+			var list datav1alpha1.WidgetList
+			if err := c.List(ctx, &list); err != nil {
+				return false, err
+			}
+			for _, widget := range list.Items {
+				if widget.Status.Total != count {
+					t.Logf("widget %s in %s has total %d, expected %d", widget.Name, cluster, widget.Status.Total, count)
+					return false, nil
+				}
+			}
+			return true, nil
+		}); err != nil {
+			t.Fatalf("controllers never acted on %s: %v", cluster, err)
+		}
+	}
+}
+
+// clusterRecorder records which replicas made requests to each logical cluster.
+type clusterRecorder struct {
+	lock     sync.Mutex
+	replicas map[logicalcluster.Name]map[string]bool
+}
+
+// clusterPath matches the logical cluster of requests scoped to one.
+var clusterPath = regexp.MustCompile(`/clusters/([^/*]+)/`)
+
+// wrap returns a copy of cfg whose requests to a logical cluster are recorded for the replica.
+func (r *clusterRecorder) wrap(cfg *rest.Config, replica string) *rest.Config {
+	cfg = rest.CopyConfig(cfg)
+	cfg.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if match := clusterPath.FindStringSubmatch(req.URL.Path); match != nil {
+				r.lock.Lock()
+				if r.replicas == nil {
+					r.replicas = map[logicalcluster.Name]map[string]bool{}
+				}
+				cluster := logicalcluster.Name(match[1])
+				if r.replicas[cluster] == nil {
+					r.replicas[cluster] = map[string]bool{}
+				}
+				r.replicas[cluster][replica] = true
+				r.lock.Unlock()
+			}
+			return rt.RoundTrip(req)
+		})
+	})
+	return cfg
+}
+
+func (r *clusterRecorder) get(cluster logicalcluster.Name) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var replicas []string
+	for replica := range r.replicas[cluster] {
+		replicas = append(replicas, replica)
+	}
+	sort.Strings(replicas)
+	return replicas
+}
+
+func (r *clusterRecorder) reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.replicas = nil
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// startShardedReplica starts a cluster-aware manager running both reconcilers for the logical clusters its sharder
+// owns. The returned function stops it.
+func startShardedReplica(t *testing.T, cfg, leaseConfig *rest.Config, replica string, recorder *clusterRecorder) (*controllers.Sharder, func()) {
+	t.Helper()
+	mgr, err := kcp.NewClusterAwareManager(recorder.wrap(cfg, replica), ctrl.Options{
+		Scheme:                 scheme,
+		MetricsBindAddress:     "0",
+		HealthProbeBindAddress: "0",
+	})
+	if err != nil {
+		t.Fatalf("failed to create manager for replica %s: %v", replica, err)
+	}
+	leaseClient, err := client.New(leaseConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharder := &controllers.Sharder{
+		Client:        leaseClient,
+		Namespace:     "default",
+		Group:         "test",
+		Identity:      replica,
+		LeaseDuration: 2 * time.Second,
+		RenewPeriod:   100 * time.Millisecond,
+	}
+	if err := mgr.Add(sharder); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&controllers.ConfigMapReconciler{
+		ClusterClient: controllers.NewClusterClient(mgr.GetClient()),
+		Recorder:      mgr.GetEventRecorderFor("configmap-controller"),
+		Sharder:       sharder,
+	}).SetupWithManager(mgr); err != nil {
+		t.Fatalf("failed to set up ConfigMap controller: %v", err)
+	}
+	if err := (&controllers.WidgetReconciler{
+		ClusterClient: controllers.NewClusterClient(mgr.GetClient()),
+		Scheme:        mgr.GetScheme(),
+		Sharder:       sharder,
+	}).SetupWithManager(mgr); err != nil {
+		t.Fatalf("failed to set up Widget controller: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := mgr.Start(ctx); err != nil {
+			t.Errorf("failed to run manager for replica %s: %v", replica, err)
+		}
+	}()
+	stopped := false
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return sharder, stop
+}
+
+// TestShardedReconcilers runs three replicas splitting the logical clusters between them, and checks that each logical
+// cluster is handled by exactly one of them, before and after a replica leaves.
+func TestShardedReconcilers(t *testing.T) {
+	s := fake.NewServer("root")
+	// Registered first, so that the server outlives the replicas
+	t.Cleanup(s.Close)
+	ctx := context.Background()
+
+	if err := s.PublishAPIExport(testAPIExportName); err != nil {
+		t.Fatalf("failed to publish APIExport: %v", err)
+	}
+	cfg, err := restConfigForAPIExport(ctx, s.Config(), testAPIExportName)
+	if err != nil {
+		t.Fatalf("failed to look up virtual workspace URL: %v", err)
+	}
+	leaseConfig := s.Config()
+	// Three replicas renewing every 100ms are well above the default client rate limit
+	leaseConfig.QPS, leaseConfig.Burst = 1000, 1000
+
+	recorder := &clusterRecorder{}
+	replicas := []string{"a", "b", "c"}
+	sharders := map[string]*controllers.Sharder{}
+	stop := map[string]func(){}
+	for _, replica := range replicas {
+		sharders[replica], stop[replica] = startShardedReplica(t, cfg, leaseConfig, replica, recorder)
+	}
+
+	waitForMembers := func(members ...string) {
+		t.Helper()
+		if err := wait.PollImmediate(50*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			for _, member := range members {
+				if !cmp.Equal(members, sharders[member].Members()) {
+					return false, nil
+				}
+			}
+			return true, nil
+		}); err != nil {
+			t.Fatalf("replicas never agreed on members %v", members)
+		}
+	}
+	// ownerOf returns the only member that owns the logical cluster.
+	ownerOf := func(cluster logicalcluster.Name, members ...string) string {
+		t.Helper()
+		var owners []string
+		for _, member := range members {
+			if sharders[member].Owns(cluster) {
+				owners = append(owners, member)
+			}
+		}
+		if len(owners) != 1 {
+			t.Fatalf("expected %s to be owned by exactly one replica, got %v", cluster, owners)
+		}
+		return owners[0]
+	}
+	// waitForSecrets waits until the secret of every logical cluster has the data.
+	waitForSecrets := func(clusters []logicalcluster.Name, data func(logicalcluster.Name) string) {
+		t.Helper()
+		for _, cluster := range clusters {
+			c, err := client.New(s.ClusterConfig(cluster), client.Options{Scheme: scheme})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := wait.PollImmediate(50*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+				var secret corev1.Secret
+				if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "config"}, &secret); err != nil {
+					return false, client.IgnoreNotFound(err)
+				}
+				return string(secret.Data["dataFromCM"]) == data(cluster), nil
+			}); err != nil {
+				t.Fatalf("controllers never acted on %s: %v", cluster, err)
+			}
+		}
+	}
+	// checkHandled checks that only the owner of each logical cluster made requests to it.
+	checkHandled := func(clusters []logicalcluster.Name, members ...string) {
+		t.Helper()
+		for _, cluster := range clusters {
+			if handled, owner := recorder.get(cluster), ownerOf(cluster, members...); !cmp.Equal([]string{owner}, handled) {
+				t.Errorf("expected %s to be handled by %s only, got %v", cluster, owner, handled)
+			}
+		}
+	}
+
+	waitForMembers(replicas...)
+	var clusters []logicalcluster.Name
+	shares := map[string]int{}
+	for i := 0; i < 12; i++ {
+		cluster := logicalcluster.Name(fmt.Sprintf("tenant-%d", i))
+		clusters = append(clusters, cluster)
+		shares[ownerOf(cluster, replicas...)]++
+	}
+	if len(shares) != len(replicas) {
+		t.Fatalf("expected every replica to own logical clusters, got %v", shares)
+	}
+
+	for _, cluster := range clusters {
+		c, err := client.New(s.ClusterConfig(cluster), client.Options{Scheme: scheme})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "config"},
+			Data:       map[string]string{"secretData": cluster.String()},
+		}); err != nil {
+			t.Fatalf("failed to create configmap in %s: %v", cluster, err)
+		}
+		if err := c.Create(ctx, &datav1alpha1.Widget{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "widget"}}); err != nil {
+			t.Fatalf("failed to create widget in %s: %v", cluster, err)
+		}
+	}
+	waitForSecrets(clusters, logicalcluster.Name.String)
+	checkHandled(clusters, replicas...)
+
+	// When a replica leaves, the others catch up with the logical clusters they gained without any change to them
+	var gained []logicalcluster.Name
+	for _, cluster := range clusters {
+		if ownerOf(cluster, replicas...) == "b" {
+			gained = append(gained, cluster)
+		}
+	}
+	// The remaining replicas may catch up as soon as they agree on the members, before waitForMembers returns
+	recorder.reset()
+	stop["b"]()
+	waitForMembers("a", "c")
+	for _, cluster := range gained {
+		owner := ownerOf(cluster, "a", "c")
+		if err := wait.PollImmediate(50*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+			for _, replica := range recorder.get(cluster) {
+				if replica == owner {
+					return true, nil
+				}
+			}
+			return false, nil
+		}); err != nil {
+			t.Fatalf("%s never took %s over", owner, cluster)
+		}
+	}
+
+	// From then on, each logical cluster is still handled by exactly one of the remaining replicas
+	recorder.reset()
+	for _, cluster := range clusters {
+		c, err := client.New(s.ClusterConfig(cluster), client.Options{Scheme: scheme})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cm corev1.ConfigMap
+		if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "config"}, &cm); err != nil {
+			t.Fatal(err)
+		}
+		cm.Data["secretData"] = cluster.String() + "-updated"
+		if err := c.Update(ctx, &cm); err != nil {
+			t.Fatalf("failed to update configmap in %s: %v", cluster, err)
+		}
+	}
+	waitForSecrets(clusters, func(cluster logicalcluster.Name) string { return cluster.String() + "-updated" })
+	checkHandled(clusters, "a", "c")
+}
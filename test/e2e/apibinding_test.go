@@ -0,0 +1,111 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+	"github.com/kcp-dev/controller-runtime-example/test/framework"
+)
+
+// tenantFinalizer is the finalizer the controller-manager sets on the APIBindings of the workspaces it onboarded.
+const tenantFinalizer = "data.my.domain/tenant"
+
+// TestAPIBindingOnboarding verifies that a workspace binding the APIExport is onboarded, and that offboarding it when
+// its APIBinding is deleted only removes what the controllers created.
+func TestAPIBindingOnboarding(t *testing.T) {
+	t.Parallel()
+	workspace := framework.NewWorkspace(t)
+	c := workspace.Client
+
+	bindingKey := client.ObjectKey{Name: framework.APIExportName}
+	framework.EventuallyObject(t, c, bindingKey, &apisv1alpha1.APIBinding{}, func(binding *apisv1alpha1.APIBinding) (bool, string) {
+		for _, finalizer := range binding.Finalizers {
+			if finalizer == tenantFinalizer {
+				return true, ""
+			}
+		}
+		return false, fmt.Sprintf("finalizers are %v", binding.Finalizers)
+	}, fmt.Sprintf("APIBinding %s|%s to have the tenant finalizer", workspace.Path, framework.APIExportName))
+
+	framework.EventuallyExists(t, c, client.ObjectKey{Namespace: "default", Name: "default"}, &datav1alpha1.Widget{})
+	framework.Eventually(t, func() (bool, string) {
+		var events corev1.EventList
+		if err := c.List(context.TODO(), &events, client.InNamespace("default")); err != nil {
+			return false, fmt.Sprintf("failed to list events: %v", err)
+		}
+		for _, event := range events.Items {
+			if event.Reason == "Welcome" && event.InvolvedObject.Name == framework.APIExportName {
+				return true, ""
+			}
+		}
+		return false, "no Welcome event"
+	}, fmt.Sprintf("a Welcome event on APIBinding %s|%s", workspace.Path, framework.APIExportName))
+
+	// The configmap publishes its secret into a namespace the controller creates for it
+	existingNamespaceName := workspace.CreateNamespace(t)
+	createdNamespaceName := framework.RandomName()
+	configmapName := framework.RandomName()
+	t.Logf("creating configmap %s|%s/%s", workspace.Path, existingNamespaceName, configmapName)
+	if err := c.Create(context.TODO(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      configmapName,
+			Namespace: existingNamespaceName,
+		},
+		Data: map[string]string{
+			"namespace":             createdNamespaceName,
+			"secretData":            framework.RandomName(),
+			"secretTargetNamespace": createdNamespaceName,
+		},
+	}); err != nil {
+		t.Fatalf("failed to create a configmap: %v", err)
+	}
+	secretKey := client.ObjectKey{Namespace: createdNamespaceName, Name: configmapName}
+	framework.EventuallyExists(t, c, secretKey, &corev1.Secret{})
+
+	t.Logf("deleting APIBinding %s|%s", workspace.Path, framework.APIExportName)
+	if err := c.Delete(context.TODO(), &apisv1alpha1.APIBinding{ObjectMeta: metav1.ObjectMeta{Name: framework.APIExportName}}); err != nil {
+		t.Fatalf("failed to delete APIBinding: %v", err)
+	}
+	framework.EventuallyDeleted(t, c, bindingKey, &apisv1alpha1.APIBinding{})
+
+	framework.EventuallyDeleted(t, c, secretKey, &corev1.Secret{})
+	framework.EventuallyDeleted(t, c, client.ObjectKey{Name: createdNamespaceName}, &corev1.Namespace{})
+	var existing corev1.Namespace
+	if err := c.Get(context.TODO(), client.ObjectKey{Name: existingNamespaceName}, &existing); err != nil {
+		t.Fatalf("expected namespace %s|%s to survive offboarding: %v", workspace.Path, existingNamespaceName, err)
+	}
+	if !existing.DeletionTimestamp.IsZero() {
+		t.Errorf("expected namespace %s|%s to survive offboarding, it is being deleted", workspace.Path, existingNamespaceName)
+	}
+	var configmap corev1.ConfigMap
+	if err := c.Get(context.TODO(), client.ObjectKey{Namespace: existingNamespaceName, Name: configmapName}, &configmap); err != nil {
+		t.Fatalf("expected configmap %s|%s/%s to survive offboarding: %v", workspace.Path, existingNamespaceName, configmapName, err)
+	}
+	if len(configmap.Finalizers) != 0 {
+		t.Errorf("expected the finalizers of configmap %s|%s/%s to be released, got %v", workspace.Path, existingNamespaceName, configmapName, configmap.Finalizers)
+	}
+}
@@ -2,31 +2,18 @@ package e2e
 
 import (
 	"context"
-	"flag"
 	"fmt"
 	"math/rand"
 	"testing"
-	"time"
 
 	"github.com/google/go-cmp/cmp"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
-
-	kcpclienthelper "github.com/kcp-dev/apimachinery/v2/pkg/client"
-	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
-	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
-	corev1alpha1 "github.com/kcp-dev/kcp/pkg/apis/core/v1alpha1"
-	tenancyv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/tenancy/v1alpha1"
-	"github.com/kcp-dev/kcp/pkg/apis/third_party/conditions/util/conditions"
-	"github.com/kcp-dev/logicalcluster/v3"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/errors"
-	"k8s.io/apimachinery/pkg/util/wait"
-	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
-	"k8s.io/client-go/rest"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+	"github.com/kcp-dev/controller-runtime-example/test/framework"
 )
 
 // The tests in this package expect to be called when:
@@ -37,176 +24,8 @@ import (
 // - that deployment is synced to the kind cluster
 // - the deployment is rolled out & ready
 //
-// We can then check that the controllers defined here are working as expected.
-
-var workspaceName string
-
-func init() {
-	rand.Seed(time.Now().Unix())
-	flag.StringVar(&workspaceName, "workspace", "", "Workspace in which to run these tests.")
-}
-
-func parentWorkspace(t *testing.T) logicalcluster.Path {
-	flag.Parse()
-	if workspaceName == "" {
-		t.Fatal("--workspace cannot be empty")
-	}
-
-	return logicalcluster.NewPath(workspaceName)
-}
-
-func loadClusterConfig(t *testing.T, clusterName logicalcluster.Path) *rest.Config {
-	t.Helper()
-	restConfig, err := config.GetConfigWithContext("base")
-	if err != nil {
-		t.Fatalf("failed to load *rest.Config: %v", err)
-	}
-	return rest.AddUserAgent(kcpclienthelper.SetCluster(rest.CopyConfig(restConfig), clusterName), t.Name())
-}
-
-func loadClient(t *testing.T, clusterName logicalcluster.Path) client.Client {
-	t.Helper()
-	scheme := runtime.NewScheme()
-	if err := clientgoscheme.AddToScheme(scheme); err != nil {
-		t.Fatalf("failed to add client go to scheme: %v", err)
-	}
-	if err := tenancyv1alpha1.AddToScheme(scheme); err != nil {
-		t.Fatalf("failed to add %s to scheme: %v", tenancyv1alpha1.SchemeGroupVersion, err)
-	}
-	if err := datav1alpha1.AddToScheme(scheme); err != nil {
-		t.Fatalf("failed to add %s to scheme: %v", datav1alpha1.GroupVersion, err)
-	}
-	if err := apisv1alpha1.AddToScheme(scheme); err != nil {
-		t.Fatalf("failed to add %s to scheme: %v", apisv1alpha1.SchemeGroupVersion, err)
-	}
-	tenancyClient, err := client.New(loadClusterConfig(t, clusterName), client.Options{Scheme: scheme})
-	if err != nil {
-		t.Fatalf("failed to create a client: %v", err)
-	}
-	return tenancyClient
-}
-
-func createWorkspace(t *testing.T, clusterName logicalcluster.Path) client.Client {
-	t.Helper()
-	parent, ok := clusterName.Parent()
-	if !ok {
-		t.Fatalf("cluster %s has no parent", clusterName)
-	}
-	c := loadClient(t, parent)
-	t.Logf("creating workspace %s", clusterName)
-	if err := c.Create(context.TODO(), &tenancyv1alpha1.Workspace{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: clusterName.Base(),
-		},
-		Spec: tenancyv1alpha1.WorkspaceSpec{
-			Type: tenancyv1alpha1.WorkspaceTypeReference{
-				Name: "universal",
-				Path: "root",
-			},
-		},
-	}); err != nil {
-		t.Fatalf("failed to create workspace: %s: %v", clusterName, err)
-	}
-
-	t.Logf("waiting for workspace %s to be ready", clusterName)
-	var workspace tenancyv1alpha1.Workspace
-	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (done bool, err error) {
-		fetchErr := c.Get(context.TODO(), client.ObjectKey{Name: clusterName.Base()}, &workspace)
-		if fetchErr != nil {
-			t.Logf("failed to get workspace %s: %v", clusterName, err)
-			return false, fetchErr
-		}
-		var reason string
-		if actual, expected := workspace.Status.Phase, corev1alpha1.LogicalClusterPhaseReady; actual != expected {
-			reason = fmt.Sprintf("phase is %s, not %s", actual, expected)
-			t.Logf("not done waiting for workspace %s to be ready: %s", clusterName, reason)
-		}
-		return reason == "", nil
-	}); err != nil {
-		t.Fatalf("workspace %s never ready: %v", clusterName, err)
-	}
-
-	return createAPIBinding(t, clusterName)
-}
-
-func createAPIBinding(t *testing.T, workspaceCluster logicalcluster.Path) client.Client {
-	c := loadClient(t, workspaceCluster)
-	apiName := "controller-runtime-example-data.my.domain"
-	t.Logf("creating APIBinding %s|%s", workspaceCluster, apiName)
-	if err := c.Create(context.TODO(), &apisv1alpha1.APIBinding{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: apiName,
-		},
-		Spec: apisv1alpha1.APIBindingSpec{
-			Reference: apisv1alpha1.BindingReference{
-				Export: &apisv1alpha1.ExportBindingReference{
-					Path: parentWorkspace(t).String(),
-					Name: apiName,
-				},
-			},
-			PermissionClaims: []apisv1alpha1.AcceptablePermissionClaim{
-				{
-					PermissionClaim: apisv1alpha1.PermissionClaim{
-						GroupResource: apisv1alpha1.GroupResource{Resource: "configmaps"},
-						All:           true,
-					},
-					State: apisv1alpha1.ClaimAccepted,
-				},
-				{
-					PermissionClaim: apisv1alpha1.PermissionClaim{
-						GroupResource: apisv1alpha1.GroupResource{Resource: "secrets"},
-						All:           true,
-					},
-					State: apisv1alpha1.ClaimAccepted,
-				},
-				{
-					PermissionClaim: apisv1alpha1.PermissionClaim{
-						GroupResource: apisv1alpha1.GroupResource{Resource: "namespaces"},
-						All:           true,
-					},
-					State: apisv1alpha1.ClaimAccepted,
-				},
-			},
-		},
-	}); err != nil {
-		t.Fatalf("could not create APIBinding %s|%s: %v", workspaceCluster, apiName, err)
-	}
-
-	t.Logf("waiting for APIBinding %s|%s to be bound", workspaceCluster, apiName)
-	var apiBinding apisv1alpha1.APIBinding
-	if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (done bool, err error) {
-		fetchErr := c.Get(context.TODO(), client.ObjectKey{Name: apiName}, &apiBinding)
-		if fetchErr != nil {
-			t.Logf("failed to get APIBinding %s|%s: %v", workspaceCluster, apiName, err)
-			return false, fetchErr
-		}
-		var reason string
-		if !conditions.IsTrue(&apiBinding, apisv1alpha1.InitialBindingCompleted) {
-			condition := conditions.Get(&apiBinding, apisv1alpha1.InitialBindingCompleted)
-			if condition != nil {
-				reason = fmt.Sprintf("%s: %s", condition.Reason, condition.Message)
-			} else {
-				reason = "no condition present"
-			}
-			t.Logf("not done waiting for APIBinding %s|%s to be bound: %s", workspaceCluster, apiName, reason)
-		}
-		return conditions.IsTrue(&apiBinding, apisv1alpha1.InitialBindingCompleted), nil
-	}); err != nil {
-		t.Fatalf("APIBinding %s|%s never bound: %v", workspaceCluster, apiName, err)
-	}
-
-	return c
-}
-
-const characters = "abcdefghijklmnopqrstuvwxyz"
-
-func randomName() string {
-	b := make([]byte, 10)
-	for i := range b {
-		b[i] = characters[rand.Intn(len(characters))]
-	}
-	return string(b)
-}
+// We can then check that the controllers defined here are working as expected. See the framework package for the
+// flags the tests take.
 
 // TestConfigMapController verifies that our ConfigMap behavior works.
 func TestConfigMapController(t *testing.T) {
@@ -214,21 +33,15 @@ func TestConfigMapController(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		t.Run(fmt.Sprintf("attempt-%d", i), func(t *testing.T) {
 			t.Parallel()
-			workspaceCluster := parentWorkspace(t).Join(randomName())
-			c := createWorkspace(t, workspaceCluster)
+			workspace := framework.NewWorkspace(t)
+			c := workspace.Client
 
-			namespaceName := randomName()
-			t.Logf("creating namespace %s|%s", workspaceCluster, namespaceName)
-			if err := c.Create(context.TODO(), &corev1.Namespace{
-				ObjectMeta: metav1.ObjectMeta{Name: namespaceName},
-			}); err != nil {
-				t.Fatalf("failed to create a namespace: %v", err)
-			}
+			namespaceName := workspace.CreateNamespace(t)
 
-			otherNamespaceName := randomName()
-			data := randomName()
-			configmapName := randomName()
-			t.Logf("creating configmap %s|%s/%s", workspaceCluster, namespaceName, configmapName)
+			otherNamespaceName := framework.RandomName()
+			data := framework.RandomName()
+			configmapName := framework.RandomName()
+			t.Logf("creating configmap %s|%s/%s", workspace.Path, namespaceName, configmapName)
 			if err := c.Create(context.TODO(), &corev1.ConfigMap{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      configmapName,
@@ -245,82 +58,88 @@ func TestConfigMapController(t *testing.T) {
 				t.Fatalf("failed to create a configmap: %v", err)
 			}
 
-			t.Logf("waiting for configmap %s|%s to have a response", workspaceCluster, configmapName)
-			var configmap corev1.ConfigMap
-			if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (done bool, err error) {
-				fetchErr := c.Get(context.TODO(), client.ObjectKey{Namespace: namespaceName, Name: configmapName}, &configmap)
-				if fetchErr != nil {
-					t.Logf("failed to get configmap %s|%s/%s: %v", workspaceCluster, namespaceName, configmapName, err)
-					return false, fetchErr
-				}
+			framework.EventuallyObject(t, c, client.ObjectKey{Namespace: namespaceName, Name: configmapName}, &corev1.ConfigMap{}, func(configmap *corev1.ConfigMap) (bool, string) {
 				response, ok := configmap.Labels["response"]
 				if !ok {
-					t.Logf("configmap %s|%s/%s has no response set", workspaceCluster, namespaceName, configmapName)
+					return false, "no response set"
 				}
-				diff := cmp.Diff(response, "hello-timothy")
-				if ok && diff != "" {
-					t.Logf("configmap %s|%s/%s has an invalid response: %v", workspaceCluster, namespaceName, configmapName, diff)
+				if diff := cmp.Diff(response, "hello-timothy"); diff != "" {
+					return false, fmt.Sprintf("invalid response: %v", diff)
 				}
-				return diff == "", nil
-			}); err != nil {
-				t.Fatalf("configmap %s|%s/%s never got a response: %v", workspaceCluster, namespaceName, configmapName, err)
-			}
+				return true, ""
+			}, fmt.Sprintf("configmap %s|%s/%s to have a response", workspace.Path, namespaceName, configmapName))
 
-			t.Logf("waiting for namespace %s|%s to exist", workspaceCluster, otherNamespaceName)
-			var otherNamespace corev1.Namespace
-			if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (done bool, err error) {
-				fetchErr := c.Get(context.TODO(), client.ObjectKey{Name: otherNamespaceName}, &otherNamespace)
-				if fetchErr != nil && !apierrors.IsNotFound(fetchErr) {
-					t.Logf("failed to get namespace %s|%s: %v", workspaceCluster, otherNamespaceName, fetchErr)
-					return false, fetchErr
-				}
-				return fetchErr == nil, nil
-			}); err != nil {
-				t.Fatalf("namespace %s|%s never created: %v", workspaceCluster, otherNamespaceName, err)
-			}
+			framework.EventuallyExists(t, c, client.ObjectKey{Name: otherNamespaceName}, &corev1.Namespace{})
 
-			t.Logf("waiting for secret %s|%s/%s to exist and have correct data", workspaceCluster, namespaceName, configmapName)
-			var secret corev1.Secret
-			if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (done bool, err error) {
-				fetchErr := c.Get(context.TODO(), client.ObjectKey{Namespace: namespaceName, Name: configmapName}, &secret)
-				if fetchErr != nil && !apierrors.IsNotFound(fetchErr) {
-					t.Logf("failed to get secret %s|%s/%s: %v", workspaceCluster, namespaceName, configmapName, fetchErr)
-					return false, fetchErr
-				}
-				response, ok := secret.Data["dataFromCM"]
-				if !ok {
-					t.Logf("secret %s|%s/%s has no data set", workspaceCluster, namespaceName, configmapName)
-				}
-				diff := cmp.Diff(string(response), data)
-				if ok && diff != "" {
-					t.Logf("secret %s|%s/%s has invalid data: %v", workspaceCluster, namespaceName, configmapName, diff)
-				}
-				return diff == "", nil
-			}); err != nil {
-				t.Fatalf("secret %s|%s/%s never created: %v", workspaceCluster, namespaceName, configmapName, err)
-			}
+			framework.EventuallyObject(t, c, client.ObjectKey{Namespace: namespaceName, Name: configmapName}, &corev1.Secret{}, secretHasData(data),
+				fmt.Sprintf("secret %s|%s/%s to have correct data", workspace.Path, namespaceName, configmapName))
 		})
 	}
 }
 
-// TestWidgetController verifies that our ConfigMap behavior works.
+// TestConfigMapControllerSecretTarget verifies that a ConfigMap can publish its Secret into another namespace.
+func TestConfigMapControllerSecretTarget(t *testing.T) {
+	t.Parallel()
+	workspace := framework.NewWorkspace(t)
+	c := workspace.Client
+
+	namespaceName, targetNamespaceName := workspace.CreateNamespace(t), workspace.CreateNamespace(t)
+
+	data := framework.RandomName()
+	configmapName, secretName := framework.RandomName(), framework.RandomName()
+	t.Logf("creating configmap %s|%s/%s", workspace.Path, namespaceName, configmapName)
+	configmap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      configmapName,
+			Namespace: namespaceName,
+		},
+		Data: map[string]string{
+			"secretData":            data,
+			"secretTargetNamespace": targetNamespaceName,
+			"secretTargetName":      secretName,
+		},
+	}
+	if err := c.Create(context.TODO(), configmap); err != nil {
+		t.Fatalf("failed to create a configmap: %v", err)
+	}
+
+	secretKey := client.ObjectKey{Namespace: targetNamespaceName, Name: secretName}
+	framework.EventuallyObject(t, c, secretKey, &corev1.Secret{}, secretHasData(data),
+		fmt.Sprintf("secret %s|%s to have correct data", workspace.Path, secretKey))
+
+	t.Logf("deleting configmap %s|%s/%s", workspace.Path, namespaceName, configmapName)
+	if err := c.Delete(context.TODO(), configmap); err != nil {
+		t.Fatalf("failed to delete configmap: %v", err)
+	}
+
+	framework.EventuallyDeleted(t, c, secretKey, &corev1.Secret{})
+}
+
+func secretHasData(data string) func(*corev1.Secret) (bool, string) {
+	return func(secret *corev1.Secret) (bool, string) {
+		response, ok := secret.Data["dataFromCM"]
+		if !ok {
+			return false, "no data set"
+		}
+		if diff := cmp.Diff(string(response), data); diff != "" {
+			return false, fmt.Sprintf("invalid data: %v", diff)
+		}
+		return true, ""
+	}
+}
+
+// TestWidgetController verifies that our Widget behavior works.
 func TestWidgetController(t *testing.T) {
 	t.Parallel()
 	for i := 0; i < 3; i++ {
 		t.Run(fmt.Sprintf("attempt-%d", i), func(t *testing.T) {
 			t.Parallel()
-			workspaceCluster := parentWorkspace(t).Join(randomName())
-			c := createWorkspace(t, workspaceCluster)
+			workspace := framework.NewWorkspace(t)
+			c := workspace.Client
 
 			var totalWidgets int
 			for i := 0; i < 3; i++ {
-				namespaceName := randomName()
-				t.Logf("creating namespace %s|%s", workspaceCluster, namespaceName)
-				if err := c.Create(context.TODO(), &corev1.Namespace{
-					ObjectMeta: metav1.ObjectMeta{Name: namespaceName},
-				}); err != nil {
-					t.Fatalf("failed to create a namespace: %v", err)
-				}
+				namespaceName := workspace.CreateNamespace(t)
 				numWidgets := rand.Intn(10)
 				for i := 0; i < numWidgets; i++ {
 					if err := c.Create(context.TODO(), &datav1alpha1.Widget{
@@ -333,28 +152,22 @@ func TestWidgetController(t *testing.T) {
 				totalWidgets += numWidgets
 			}
 
-			t.Logf("waiting for all widgets in cluster %s to have a correct status", workspaceCluster)
-			var allWidgets datav1alpha1.WidgetList
-			if err := wait.PollImmediate(100*time.Millisecond, wait.ForeverTestTimeout, func() (done bool, err error) {
-				fetchErr := c.List(context.TODO(), &allWidgets)
-				if fetchErr != nil {
-					t.Logf("failed to get widgets in cluster %s: %v", workspaceCluster, err)
-					return false, fetchErr
+			framework.Eventually(t, func() (bool, string) {
+				var allWidgets datav1alpha1.WidgetList
+				if err := c.List(context.TODO(), &allWidgets); err != nil {
+					return false, fmt.Sprintf("failed to list widgets: %v", err)
 				}
 				var errs []error
 				for _, widget := range allWidgets.Items {
 					if actual, expected := widget.Status.Total, totalWidgets; actual != expected {
-						errs = append(errs, fmt.Errorf("widget %s|%s .status.total incorrect: %d != %d", workspaceCluster, widget.Name, actual, expected))
+						errs = append(errs, fmt.Errorf("widget %s .status.total incorrect: %d != %d", widget.Name, actual, expected))
 					}
 				}
-				validationErr := errors.NewAggregate(errs)
-				if validationErr != nil {
-					t.Logf("widgets in cluster %s invalid: %v", workspaceCluster, validationErr)
+				if err := errors.NewAggregate(errs); err != nil {
+					return false, err.Error()
 				}
-				return validationErr == nil, nil
-			}); err != nil {
-				t.Fatalf("widgets in cluster %s never got correct statuses: %v", workspaceCluster, err)
-			}
+				return true, ""
+			}, fmt.Sprintf("all widgets in cluster %s to have a correct status", workspace.Path))
 		})
 	}
 }
@@ -0,0 +1,243 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake provides in-memory stand-ins for kcp: a client.Client that is aware of logical clusters the way the
+// client of a kcp cluster-aware manager is, and a Server that serves logical clusters and APIExport virtual workspaces
+// over HTTP.
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/kontext"
+
+	"github.com/kcp-dev/controller-runtime-example/internal/scopedclient"
+)
+
+// ErrNoCluster is returned by every request but List when there is no logical cluster in the context.
+var ErrNoCluster = errors.New("no logical cluster in context")
+
+// ClusterClient is a client.Client backed by one fake client per logical cluster. Requests are routed to the
+// logical cluster in their context (see kontext.WithCluster):
+//
+//   - Get, Create, Update, Patch, Delete, DeleteAllOf and the status writer only ever touch the objects of that
+//     logical cluster, and return ErrNoCluster without one.
+//   - List returns the objects of that logical cluster or, without one, the objects of all logical clusters.
+//
+// Every object stored or returned carries its logical cluster in the logicalcluster.AnnotationKey annotation.
+// ForCluster makes the ClusterClient usable wherever the controllers expect a controllers.ClusterClient.
+type ClusterClient struct {
+	scheme *runtime.Scheme
+	mapper meta.RESTMapper
+
+	lock     sync.Mutex
+	clusters map[logicalcluster.Name]client.WithWatch
+}
+
+var _ client.Client = &ClusterClient{}
+
+// NewClusterClient returns a ClusterClient without any logical clusters.
+func NewClusterClient(scheme *runtime.Scheme) *ClusterClient {
+	return &ClusterClient{
+		scheme:   scheme,
+		mapper:   fake.NewClientBuilder().WithScheme(scheme).Build().RESTMapper(),
+		clusters: map[logicalcluster.Name]client.WithWatch{},
+	}
+}
+
+// WithObjects replaces the content of the logical cluster with the given objects.
+func (c *ClusterClient) WithObjects(cluster logicalcluster.Name, objs ...client.Object) *ClusterClient {
+	annotated := make([]client.Object, 0, len(objs))
+	for _, obj := range objs {
+		obj = obj.DeepCopyObject().(client.Object)
+		setCluster(obj, cluster)
+		annotated = append(annotated, obj)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.clusters[cluster] = fake.NewClientBuilder().WithScheme(c.scheme).WithObjects(annotated...).Build()
+	return c
+}
+
+// Clusters returns the logical clusters known to the client, sorted by name.
+func (c *ClusterClient) Clusters() []logicalcluster.Name {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	clusters := make([]logicalcluster.Name, 0, len(c.clusters))
+	for cluster := range c.clusters {
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i] < clusters[j] })
+	return clusters
+}
+
+// Cluster returns the client for a single logical cluster, creating an empty logical cluster if necessary.
+func (c *ClusterClient) Cluster(cluster logicalcluster.Name) client.WithWatch {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.clusters[cluster]; !ok {
+		c.clusters[cluster] = fake.NewClientBuilder().WithScheme(c.scheme).Build()
+	}
+	return c.clusters[cluster]
+}
+
+// ForCluster returns a client whose requests only ever touch the given logical cluster, whatever the logical cluster
+// in their context.
+func (c *ClusterClient) ForCluster(cluster logicalcluster.Name) client.Client {
+	return scopedclient.New(c, cluster)
+}
+
+func (c *ClusterClient) clusterFrom(ctx context.Context) (logicalcluster.Name, client.WithWatch, error) {
+	cluster, ok := kontext.ClusterFrom(ctx)
+	if !ok || cluster.Empty() {
+		return "", nil, ErrNoCluster
+	}
+	return cluster, c.Cluster(cluster), nil
+}
+
+// Get implements client.Client.
+func (c *ClusterClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	_, cl, err := c.clusterFrom(ctx)
+	if err != nil {
+		return err
+	}
+	return cl.Get(ctx, key, obj)
+}
+
+// List implements client.Client.
+func (c *ClusterClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if _, cl, err := c.clusterFrom(ctx); err == nil {
+		return cl.List(ctx, list, opts...)
+	}
+
+	var items []runtime.Object
+	for _, cluster := range c.Clusters() {
+		clusterList := list.DeepCopyObject().(client.ObjectList)
+		if err := c.Cluster(cluster).List(ctx, clusterList, opts...); err != nil {
+			return fmt.Errorf("failed to list in logical cluster %s: %w", cluster, err)
+		}
+		clusterItems, err := meta.ExtractList(clusterList)
+		if err != nil {
+			return err
+		}
+		items = append(items, clusterItems...)
+	}
+	return meta.SetList(list, items)
+}
+
+// Create implements client.Client.
+func (c *ClusterClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	cluster, cl, err := c.clusterFrom(ctx)
+	if err != nil {
+		return err
+	}
+	setCluster(obj, cluster)
+	return cl.Create(ctx, obj, opts...)
+}
+
+// Delete implements client.Client.
+func (c *ClusterClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	_, cl, err := c.clusterFrom(ctx)
+	if err != nil {
+		return err
+	}
+	return cl.Delete(ctx, obj, opts...)
+}
+
+// Update implements client.Client.
+func (c *ClusterClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	cluster, cl, err := c.clusterFrom(ctx)
+	if err != nil {
+		return err
+	}
+	setCluster(obj, cluster)
+	return cl.Update(ctx, obj, opts...)
+}
+
+// Patch implements client.Client.
+func (c *ClusterClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	_, cl, err := c.clusterFrom(ctx)
+	if err != nil {
+		return err
+	}
+	return cl.Patch(ctx, obj, patch, opts...)
+}
+
+// DeleteAllOf implements client.Client.
+func (c *ClusterClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) error {
+	_, cl, err := c.clusterFrom(ctx)
+	if err != nil {
+		return err
+	}
+	return cl.DeleteAllOf(ctx, obj, opts...)
+}
+
+// Status implements client.Client.
+func (c *ClusterClient) Status() client.StatusWriter {
+	return &statusWriter{c: c}
+}
+
+// Scheme implements client.Client.
+func (c *ClusterClient) Scheme() *runtime.Scheme {
+	return c.scheme
+}
+
+// RESTMapper implements client.Client.
+func (c *ClusterClient) RESTMapper() meta.RESTMapper {
+	return c.mapper
+}
+
+type statusWriter struct {
+	c *ClusterClient
+}
+
+func (w *statusWriter) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	cluster, cl, err := w.c.clusterFrom(ctx)
+	if err != nil {
+		return err
+	}
+	setCluster(obj, cluster)
+	return cl.Status().Update(ctx, obj, opts...)
+}
+
+func (w *statusWriter) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	_, cl, err := w.c.clusterFrom(ctx)
+	if err != nil {
+		return err
+	}
+	return cl.Status().Patch(ctx, obj, patch, opts...)
+}
+
+func setCluster(obj client.Object, cluster logicalcluster.Name) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[logicalcluster.AnnotationKey] = cluster.String()
+	obj.SetAnnotations(annotations)
+}
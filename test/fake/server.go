@@ -0,0 +1,807 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/kcp-dev/logicalcluster/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+)
+
+// Resource describes a resource served by a Server.
+type Resource struct {
+	schema.GroupVersionResource
+	Kind       string
+	Namespaced bool
+	// Status is true if the resource has a status subresource.
+	Status bool
+}
+
+// DefaultResources are the resources a Server serves unless told otherwise: the ones claimed or exported by this
+// repository's APIExport, plus APIResourceSchemas, APIExports and APIBindings.
+var DefaultResources = []Resource{
+	{GroupVersionResource: schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}, Kind: "ConfigMap", Namespaced: true},
+	{GroupVersionResource: schema.GroupVersionResource{Version: "v1", Resource: "secrets"}, Kind: "Secret", Namespaced: true},
+	{GroupVersionResource: schema.GroupVersionResource{Version: "v1", Resource: "events"}, Kind: "Event", Namespaced: true},
+	{GroupVersionResource: schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}, Kind: "Namespace", Status: true},
+	{GroupVersionResource: schema.GroupVersionResource{Group: "coordination.k8s.io", Version: "v1", Resource: "leases"}, Kind: "Lease", Namespaced: true},
+	{GroupVersionResource: schema.GroupVersionResource{Group: "data.my.domain", Version: "v1alpha1", Resource: "widgets"}, Kind: "Widget", Namespaced: true, Status: true},
+	{GroupVersionResource: schema.GroupVersionResource{Group: "data.my.domain", Version: "v1alpha1", Resource: "widgetquotas"}, Kind: "WidgetQuota", Status: true},
+	{GroupVersionResource: schema.GroupVersionResource{Group: "apis.kcp.io", Version: "v1alpha1", Resource: "apiresourceschemas"}, Kind: "APIResourceSchema"},
+	{GroupVersionResource: schema.GroupVersionResource{Group: "apis.kcp.io", Version: "v1alpha1", Resource: "apiexports"}, Kind: "APIExport", Status: true},
+	{GroupVersionResource: schema.GroupVersionResource{Group: "apis.kcp.io", Version: "v1alpha1", Resource: "apibindings"}, Kind: "APIBinding", Status: true},
+}
+
+// Server is an in-process, in-memory stand-in for kcp. It serves just enough of the Kubernetes API for clients,
+// informers and discovery to work:
+//
+//   - every logical cluster under /clusters/<name>/, with requests without that prefix going to the home logical
+//     cluster, and /clusters/*/ listing and watching across all logical clusters;
+//   - APIExport virtual workspaces under /services/apiexport/<cluster>/<export>/, which see the same logical
+//     clusters;
+//   - get, list, watch, create, update, JSON, merge, strategic merge and server-side apply patches (the latter two
+//     applied as merge patches, apply creating missing objects), delete with finalizers, and status subresources.
+//
+// Namespaces are not enforced, there is no garbage collection of owned objects, and every watch event is kept in
+// memory for the lifetime of the server.
+type Server struct {
+	// URL is the base URL of the server.
+	URL string
+
+	home       logicalcluster.Name
+	resources  []Resource
+	httpServer *httptest.Server
+
+	lock            sync.Mutex
+	changed         *sync.Cond
+	resourceVersion int64
+	objects         map[objectKey]*unstructured.Unstructured
+	events          []event
+}
+
+type objectKey struct {
+	cluster   logicalcluster.Name
+	resource  schema.GroupVersionResource
+	namespace string
+	name      string
+}
+
+type event struct {
+	key             objectKey
+	eventType       watch.EventType
+	object          *unstructured.Unstructured
+	resourceVersion int64
+}
+
+// NewServer starts a Server whose home logical cluster, where requests without a /clusters/ prefix go, is home. It
+// serves DefaultResources unless resources are given. The server must be closed with Close.
+func NewServer(home logicalcluster.Name, resources ...Resource) *Server {
+	if len(resources) == 0 {
+		resources = DefaultResources
+	}
+	s := &Server{
+		home:      home,
+		resources: resources,
+		objects:   map[objectKey]*unstructured.Unstructured{},
+		// Like a real server, never report resource version 0, which clients treat specially
+		resourceVersion: 1,
+	}
+	s.changed = sync.NewCond(&s.lock)
+	s.httpServer = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.httpServer.URL
+	return s
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.lock.Lock()
+	s.changed.Broadcast()
+	s.lock.Unlock()
+	s.httpServer.CloseClientConnections()
+	s.httpServer.Close()
+}
+
+// Config returns a *rest.Config for the home logical cluster. The server only speaks JSON, so the config does not
+// negotiate protobuf.
+func (s *Server) Config() *rest.Config {
+	return &rest.Config{Host: s.URL, ContentConfig: rest.ContentConfig{ContentType: "application/json"}}
+}
+
+// ClusterConfig returns a *rest.Config for the given logical cluster, which may be * to list and watch across all
+// logical clusters.
+func (s *Server) ClusterConfig(cluster logicalcluster.Name) *rest.Config {
+	cfg := s.Config()
+	cfg.Host += cluster.Path().RequestPath()
+	return cfg
+}
+
+// VirtualWorkspaceURL returns the URL of the virtual workspace of the APIExport with the given name in the home
+// logical cluster.
+func (s *Server) VirtualWorkspaceURL(apiExportName string) string {
+	return fmt.Sprintf("%s/services/apiexport/%s/%s", s.URL, s.home, apiExportName)
+}
+
+// PublishAPIExport creates or updates the APIExport with the given name in the home logical cluster, so that its
+// virtual workspace URL is ready, the way kcp does once the APIExport is bound for the first time.
+func (s *Server) PublishAPIExport(apiExportName string) error {
+	resource, ok := s.resource("apis.kcp.io", "v1alpha1", "apiexports")
+	if !ok {
+		return fmt.Errorf("apiexports are not served")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := objectKey{cluster: s.home, resource: resource.GroupVersionResource, name: apiExportName}
+	obj, exists := s.objects[key]
+	if !exists {
+		obj = &unstructured.Unstructured{Object: map[string]interface{}{}}
+		obj.SetAPIVersion("apis.kcp.io/v1alpha1")
+		obj.SetKind("APIExport")
+		obj.SetName(apiExportName)
+	} else {
+		obj = obj.DeepCopy()
+	}
+	obj.Object["status"] = map[string]interface{}{
+		"conditions": []interface{}{map[string]interface{}{
+			"type":               "VirtualWorkspaceURLsReady",
+			"status":             "True",
+			"lastTransitionTime": time.Now().UTC().Format(time.RFC3339),
+		}},
+		"virtualWorkspaces": []interface{}{map[string]interface{}{
+			"url": s.VirtualWorkspaceURL(apiExportName),
+		}},
+	}
+	if exists {
+		s.store(key, obj, watch.Modified)
+	} else {
+		s.initialize(key, obj)
+		s.store(key, obj, watch.Added)
+	}
+	return nil
+}
+
+func (s *Server) resource(group, version, plural string) (Resource, bool) {
+	for _, r := range s.resources {
+		if r.Group == group && r.Version == version && r.Resource == plural {
+			return r, true
+		}
+	}
+	return Resource{}, false
+}
+
+// request is a parsed resource request.
+type request struct {
+	cluster     logicalcluster.Name
+	resource    Resource
+	namespace   string
+	name        string
+	subresource string
+}
+
+func (r request) key() objectKey {
+	return objectKey{cluster: r.cluster, resource: r.resource.GroupVersionResource, namespace: r.namespace, name: r.name}
+}
+
+func (r request) groupResource() schema.GroupResource {
+	return r.resource.GroupResource()
+}
+
+// wildcard is the logical cluster used to list and watch across all logical clusters.
+const wildcard = logicalcluster.Name("*")
+
+func (s *Server) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	cluster, path := s.home, req.URL.Path
+	if rest, ok := trimSegments(path, "services", "apiexport"); ok {
+		// /services/apiexport/<cluster>/<export>
+		segments := strings.SplitN(strings.TrimPrefix(rest, "/"), "/", 3)
+		if len(segments) < 2 {
+			writeError(w, apierrors.NewNotFound(schema.GroupResource{}, path))
+			return
+		}
+		path = "/"
+		if len(segments) == 3 {
+			path += segments[2]
+		}
+	}
+	if rest, ok := trimSegments(path, "clusters"); ok {
+		segments := strings.SplitN(strings.TrimPrefix(rest, "/"), "/", 2)
+		cluster, path = logicalcluster.Name(segments[0]), "/"
+		if len(segments) == 2 {
+			path += segments[1]
+		}
+	}
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	var group, version string
+	switch {
+	case path == "/version":
+		writeJSON(w, http.StatusOK, map[string]string{"major": "1", "minor": "24", "gitVersion": "v1.24.0-fake"})
+		return
+	case segments[0] == "api" && len(segments) == 1:
+		writeJSON(w, http.StatusOK, &metav1.APIVersions{
+			TypeMeta: metav1.TypeMeta{Kind: "APIVersions"},
+			Versions: []string{"v1"},
+			ServerAddressByClientCIDRs: []metav1.ServerAddressByClientCIDR{{
+				ClientCIDR: "0.0.0.0/0", ServerAddress: req.Host,
+			}},
+		})
+		return
+	case segments[0] == "apis" && len(segments) == 1:
+		writeJSON(w, http.StatusOK, s.groupList())
+		return
+	case segments[0] == "api" && len(segments) >= 2:
+		version, segments = segments[1], segments[2:]
+	case segments[0] == "apis" && len(segments) >= 3:
+		group, version, segments = segments[1], segments[2], segments[3:]
+	default:
+		writeError(w, apierrors.NewNotFound(schema.GroupResource{}, path))
+		return
+	}
+
+	if len(segments) == 0 {
+		writeJSON(w, http.StatusOK, s.resourceList(group, version))
+		return
+	}
+
+	r := request{cluster: cluster}
+	if segments[0] == "namespaces" && len(segments) >= 3 {
+		if _, ok := s.resource(group, version, segments[2]); ok {
+			r.namespace, segments = segments[1], segments[2:]
+		}
+	}
+	resource, ok := s.resource(group, version, segments[0])
+	if !ok {
+		writeError(w, apierrors.NewNotFound(schema.GroupResource{Group: group, Resource: segments[0]}, ""))
+		return
+	}
+	r.resource = resource
+	if len(segments) >= 2 {
+		r.name = segments[1]
+	}
+	if len(segments) >= 3 {
+		r.subresource = segments[2]
+	}
+
+	if cluster == wildcard && !(req.Method == http.MethodGet && r.name == "") {
+		writeError(w, apierrors.NewMethodNotSupported(r.groupResource(), req.Method))
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodGet && r.name == "" && req.URL.Query().Get("watch") == "true":
+		s.watch(w, req, r)
+	case req.Method == http.MethodGet && r.name == "":
+		s.list(w, req, r)
+	case req.Method == http.MethodGet:
+		s.get(w, r)
+	case req.Method == http.MethodPost && r.name == "":
+		s.create(w, req, r)
+	case req.Method == http.MethodPut && r.name != "":
+		s.update(w, req, r)
+	case req.Method == http.MethodPatch && r.name != "":
+		s.patch(w, req, r)
+	case req.Method == http.MethodDelete && r.name != "":
+		s.delete(w, r)
+	default:
+		writeError(w, apierrors.NewMethodNotSupported(r.groupResource(), req.Method))
+	}
+}
+
+func trimSegments(path string, segments ...string) (string, bool) {
+	prefix := "/" + strings.Join(segments, "/")
+	if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(path, prefix), true
+}
+
+func (s *Server) groupList() *metav1.APIGroupList {
+	list := &metav1.APIGroupList{TypeMeta: metav1.TypeMeta{Kind: "APIGroupList", APIVersion: "v1"}}
+	indices := map[string]int{}
+	for _, r := range s.resources {
+		if r.Group == "" {
+			continue
+		}
+		gv := metav1.GroupVersionForDiscovery{GroupVersion: r.GroupVersion().String(), Version: r.Version}
+		i, ok := indices[r.Group]
+		if !ok {
+			indices[r.Group] = len(list.Groups)
+			list.Groups = append(list.Groups, metav1.APIGroup{Name: r.Group, PreferredVersion: gv})
+			i = len(list.Groups) - 1
+		}
+		found := false
+		for _, existing := range list.Groups[i].Versions {
+			found = found || existing == gv
+		}
+		if !found {
+			list.Groups[i].Versions = append(list.Groups[i].Versions, gv)
+		}
+	}
+	return list
+}
+
+func (s *Server) resourceList(group, version string) *metav1.APIResourceList {
+	list := &metav1.APIResourceList{
+		TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+		GroupVersion: schema.GroupVersion{Group: group, Version: version}.String(),
+	}
+	for _, r := range s.resources {
+		if r.Group != group || r.Version != version {
+			continue
+		}
+		list.APIResources = append(list.APIResources, metav1.APIResource{
+			Name:         r.Resource,
+			SingularName: strings.ToLower(r.Kind),
+			Namespaced:   r.Namespaced,
+			Kind:         r.Kind,
+			Verbs:        metav1.Verbs{"create", "delete", "get", "list", "patch", "update", "watch"},
+		})
+		if r.Status {
+			list.APIResources = append(list.APIResources, metav1.APIResource{
+				Name:       r.Resource + "/status",
+				Namespaced: r.Namespaced,
+				Kind:       r.Kind,
+				Verbs:      metav1.Verbs{"get", "patch", "update"},
+			})
+		}
+	}
+	return list
+}
+
+// matches reports whether the stored object with the given key is selected by a list or watch request.
+func (r request) matches(key objectKey, obj *unstructured.Unstructured, labelSelector labels.Selector, fieldSelector fields.Selector) bool {
+	if key.resource != r.resource.GroupVersionResource {
+		return false
+	}
+	if r.cluster != wildcard && key.cluster != r.cluster {
+		return false
+	}
+	if r.namespace != "" && key.namespace != r.namespace {
+		return false
+	}
+	if !labelSelector.Matches(labels.Set(obj.GetLabels())) {
+		return false
+	}
+	return fieldSelector.Matches(fields.Set{"metadata.name": key.name, "metadata.namespace": key.namespace})
+}
+
+func selectors(req *http.Request) (labels.Selector, fields.Selector, error) {
+	labelSelector, err := labels.Parse(req.URL.Query().Get("labelSelector"))
+	if err != nil {
+		return nil, nil, apierrors.NewBadRequest(err.Error())
+	}
+	fieldSelector, err := fields.ParseSelector(req.URL.Query().Get("fieldSelector"))
+	if err != nil {
+		return nil, nil, apierrors.NewBadRequest(err.Error())
+	}
+	return labelSelector, fieldSelector, nil
+}
+
+func (s *Server) list(w http.ResponseWriter, req *http.Request, r request) {
+	labelSelector, fieldSelector, err := selectors(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.lock.Lock()
+	var keys []objectKey
+	for key, obj := range s.objects {
+		if r.matches(key, obj, labelSelector, fieldSelector) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	items := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, s.objects[key].DeepCopy().Object)
+	}
+	resourceVersion := s.resourceVersion
+	s.lock.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"apiVersion": r.resource.GroupVersion().String(),
+		"kind":       r.resource.Kind + "List",
+		"metadata":   map[string]interface{}{"resourceVersion": strconv.FormatInt(resourceVersion, 10)},
+		"items":      items,
+	})
+}
+
+func (s *Server) watch(w http.ResponseWriter, req *http.Request, r request) {
+	labelSelector, fieldSelector, err := selectors(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, apierrors.NewInternalError(fmt.Errorf("streaming is not supported")))
+		return
+	}
+
+	ctx := req.Context()
+	if timeout := req.URL.Query().Get("timeoutSeconds"); timeout != "" {
+		if seconds, err := strconv.Atoi(timeout); err == nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+			defer cancel()
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		s.lock.Lock()
+		s.changed.Broadcast()
+		s.lock.Unlock()
+	}()
+
+	s.lock.Lock()
+	var pending []event
+	next := len(s.events)
+	switch rv := req.URL.Query().Get("resourceVersion"); rv {
+	case "", "0":
+		// Start with the current state, like a real server
+		for key, obj := range s.objects {
+			if r.matches(key, obj, labelSelector, fieldSelector) {
+				pending = append(pending, event{key: key, eventType: watch.Added, object: obj.DeepCopy()})
+			}
+		}
+	default:
+		since, err := strconv.ParseInt(rv, 10, 64)
+		if err != nil {
+			s.lock.Unlock()
+			writeError(w, apierrors.NewBadRequest(fmt.Sprintf("invalid resourceVersion %q", rv)))
+			return
+		}
+		next = sort.Search(len(s.events), func(i int) bool { return s.events[i].resourceVersion > since })
+	}
+	s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	for {
+		for _, e := range pending {
+			if err := encoder.Encode(map[string]interface{}{"type": e.eventType, "object": e.object.Object}); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		s.lock.Lock()
+		for next >= len(s.events) && ctx.Err() == nil {
+			s.changed.Wait()
+		}
+		if ctx.Err() != nil {
+			s.lock.Unlock()
+			return
+		}
+		pending = pending[:0]
+		for ; next < len(s.events); next++ {
+			e := s.events[next]
+			if r.matches(e.key, e.object, labelSelector, fieldSelector) {
+				pending = append(pending, e)
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (s *Server) get(w http.ResponseWriter, r request) {
+	s.lock.Lock()
+	obj, ok := s.objects[r.key()]
+	if ok {
+		obj = obj.DeepCopy()
+	}
+	s.lock.Unlock()
+
+	if !ok {
+		writeError(w, apierrors.NewNotFound(r.groupResource(), r.name))
+		return
+	}
+	writeJSON(w, http.StatusOK, obj.Object)
+}
+
+func (s *Server) create(w http.ResponseWriter, req *http.Request, r request) {
+	obj, err := decode(req.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if obj.GetName() == "" && obj.GetGenerateName() != "" {
+		obj.SetName(obj.GetGenerateName() + randomSuffix())
+	}
+	if obj.GetName() == "" {
+		writeError(w, apierrors.NewBadRequest("metadata.name is required"))
+		return
+	}
+	r.name = obj.GetName()
+	obj.SetNamespace(r.namespace)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, exists := s.objects[r.key()]; exists {
+		writeError(w, apierrors.NewAlreadyExists(r.groupResource(), r.name))
+		return
+	}
+	s.initialize(r.key(), obj)
+	s.store(r.key(), obj, watch.Added)
+	writeJSON(w, http.StatusCreated, obj.Object)
+}
+
+func (s *Server) update(w http.ResponseWriter, req *http.Request, r request) {
+	obj, err := decode(req.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	existing, ok := s.objects[r.key()]
+	if !ok {
+		writeError(w, apierrors.NewNotFound(r.groupResource(), r.name))
+		return
+	}
+	if rv := obj.GetResourceVersion(); rv != "" && rv != existing.GetResourceVersion() {
+		writeError(w, apierrors.NewConflict(r.groupResource(), r.name, fmt.Errorf("the object has been modified; please apply your changes to the latest version and try again")))
+		return
+	}
+	s.replace(w, r, existing, obj)
+}
+
+func (s *Server) patch(w http.ResponseWriter, req *http.Request, r request) {
+	patch, err := io.ReadAll(req.Body)
+	if err != nil {
+		writeError(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+
+	contentType := types.PatchType(strings.Split(req.Header.Get("Content-Type"), ";")[0])
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	existing, ok := s.objects[r.key()]
+	if !ok && contentType == types.ApplyPatchType && r.subresource == "" {
+		obj, err := decode(bytes.NewReader(patch))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		obj.SetName(r.name)
+		obj.SetNamespace(r.namespace)
+		s.initialize(r.key(), obj)
+		s.store(r.key(), obj, watch.Added)
+		writeJSON(w, http.StatusCreated, obj.Object)
+		return
+	}
+	if !ok {
+		writeError(w, apierrors.NewNotFound(r.groupResource(), r.name))
+		return
+	}
+	original, err := json.Marshal(existing.Object)
+	if err != nil {
+		writeError(w, apierrors.NewInternalError(err))
+		return
+	}
+
+	var patched []byte
+	switch contentType {
+	case types.MergePatchType, types.StrategicMergePatchType:
+		patched, err = jsonpatch.MergePatch(original, patch)
+	case types.ApplyPatchType:
+		// Fields that were applied before but are no longer are kept, as if another manager owned them
+		if patch, err = yaml.YAMLToJSON(patch); err == nil {
+			patched, err = jsonpatch.MergePatch(original, patch)
+		}
+	case types.JSONPatchType:
+		var decoded jsonpatch.Patch
+		if decoded, err = jsonpatch.DecodePatch(patch); err == nil {
+			patched, err = decoded.Apply(original)
+		}
+	default:
+		writeError(w, apierrors.NewBadRequest(fmt.Sprintf("unsupported patch type %q", contentType)))
+		return
+	}
+	if err != nil {
+		writeError(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(patched); err != nil {
+		writeError(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	s.replace(w, r, existing, obj)
+}
+
+// replace stores obj in place of existing, honouring the status subresource, and writes the result. It must be
+// called with the lock held.
+func (s *Server) replace(w http.ResponseWriter, r request, existing, obj *unstructured.Unstructured) {
+	updated := existing.DeepCopy()
+	switch {
+	case r.subresource == "status":
+		if !r.resource.Status {
+			writeError(w, apierrors.NewNotFound(r.groupResource(), r.name+"/status"))
+			return
+		}
+		updated.Object["status"] = obj.Object["status"]
+	case r.subresource != "":
+		writeError(w, apierrors.NewNotFound(r.groupResource(), r.name+"/"+r.subresource))
+		return
+	default:
+		updated = obj.DeepCopy()
+		if r.resource.Status {
+			// The status can only be changed through the status subresource
+			if status, ok := existing.Object["status"]; ok {
+				updated.Object["status"] = status
+			} else {
+				delete(updated.Object, "status")
+			}
+		}
+		// Server-owned metadata cannot be changed by clients
+		updated.SetName(existing.GetName())
+		updated.SetNamespace(existing.GetNamespace())
+		updated.SetUID(existing.GetUID())
+		updated.SetCreationTimestamp(existing.GetCreationTimestamp())
+		updated.SetDeletionTimestamp(existing.GetDeletionTimestamp())
+		updated.SetGeneration(existing.GetGeneration() + 1)
+		setClusterAnnotation(updated, r.cluster)
+	}
+
+	if updated.GetDeletionTimestamp() != nil && len(updated.GetFinalizers()) == 0 {
+		s.remove(r.key(), updated)
+		writeJSON(w, http.StatusOK, updated.Object)
+		return
+	}
+	s.store(r.key(), updated, watch.Modified)
+	writeJSON(w, http.StatusOK, updated.Object)
+}
+
+func (s *Server) delete(w http.ResponseWriter, r request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	existing, ok := s.objects[r.key()]
+	if !ok {
+		writeError(w, apierrors.NewNotFound(r.groupResource(), r.name))
+		return
+	}
+	if len(existing.GetFinalizers()) > 0 {
+		obj := existing.DeepCopy()
+		if obj.GetDeletionTimestamp() == nil {
+			now := metav1.Now()
+			obj.SetDeletionTimestamp(&now)
+			s.store(r.key(), obj, watch.Modified)
+		}
+		writeJSON(w, http.StatusOK, obj.Object)
+		return
+	}
+	s.remove(r.key(), existing.DeepCopy())
+	writeJSON(w, http.StatusOK, &metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusSuccess,
+	})
+}
+
+// initialize sets the server-owned metadata of a new object. It must be called with the lock held.
+func (s *Server) initialize(key objectKey, obj *unstructured.Unstructured) {
+	obj.SetUID(types.UID(fmt.Sprintf("%s-%d", key.cluster, s.resourceVersion+1)))
+	obj.SetCreationTimestamp(metav1.Now())
+	obj.SetGeneration(1)
+	obj.SetDeletionTimestamp(nil)
+	setClusterAnnotation(obj, key.cluster)
+}
+
+// store saves obj under key and records a watch event. It must be called with the lock held.
+func (s *Server) store(key objectKey, obj *unstructured.Unstructured, eventType watch.EventType) {
+	s.resourceVersion++
+	obj.SetResourceVersion(strconv.FormatInt(s.resourceVersion, 10))
+	s.objects[key] = obj
+	s.events = append(s.events, event{key: key, eventType: eventType, object: obj.DeepCopy(), resourceVersion: s.resourceVersion})
+	s.changed.Broadcast()
+}
+
+// remove deletes the object under key and records a watch event. It must be called with the lock held.
+func (s *Server) remove(key objectKey, obj *unstructured.Unstructured) {
+	s.resourceVersion++
+	obj.SetResourceVersion(strconv.FormatInt(s.resourceVersion, 10))
+	delete(s.objects, key)
+	s.events = append(s.events, event{key: key, eventType: watch.Deleted, object: obj, resourceVersion: s.resourceVersion})
+	s.changed.Broadcast()
+}
+
+func setClusterAnnotation(obj *unstructured.Unstructured, cluster logicalcluster.Name) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[logicalcluster.AnnotationKey] = cluster.String()
+	obj.SetAnnotations(annotations)
+}
+
+func decode(body io.Reader) (*unstructured.Unstructured, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	if data, err = yaml.YAMLToJSON(data); err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON(data); err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	return obj, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(obj)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status, ok := err.(apierrors.APIStatus)
+	if !ok {
+		status = apierrors.NewInternalError(err)
+	}
+	s := status.Status()
+	s.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	writeJSON(w, int(s.Code), s)
+}
+
+const suffixCharacters = "bcdfghjklmnpqrstvwxz2456789"
+
+func randomSuffix() string {
+	b := make([]byte, 5)
+	for i := range b {
+		b[i] = suffixCharacters[rand.Intn(len(suffixCharacters))]
+	}
+	return string(b)
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kcp-dev/logicalcluster/v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+)
+
+func newTestClient(t *testing.T, cfg *rest.Config) client.WithWatch {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to add client go to scheme: %v", err)
+	}
+	if err := datav1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to add %s to scheme: %v", datav1alpha1.GroupVersion, err)
+	}
+	c, err := client.NewWithWatch(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		t.Fatalf("failed to create a client: %v", err)
+	}
+	return c
+}
+
+func TestServerDiscovery(t *testing.T) {
+	s := NewServer("root")
+	defer s.Close()
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(s.ClusterConfig("root:tenant"))
+	if err != nil {
+		t.Fatalf("failed to create discovery client: %v", err)
+	}
+	resources, err := discoveryClient.ServerResourcesForGroupVersion(datav1alpha1.GroupVersion.String())
+	if err != nil {
+		t.Fatalf("failed to discover %s: %v", datav1alpha1.GroupVersion, err)
+	}
+	var names []string
+	for _, r := range resources.APIResources {
+		names = append(names, r.Name)
+	}
+	if diff := cmp.Diff([]string{"widgets", "widgets/status", "widgetquotas", "widgetquotas/status"}, names); diff != "" {
+		t.Errorf("unexpected resources for %s: %s", datav1alpha1.GroupVersion, diff)
+	}
+}
+
+func TestServerClusters(t *testing.T) {
+	s := NewServer("root")
+	defer s.Close()
+	ctx := context.Background()
+
+	for _, cluster := range []logicalcluster.Name{"tenant-a", "tenant-b"} {
+		c := newTestClient(t, s.ClusterConfig(cluster))
+		if err := c.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "shared"},
+			Data:       map[string]string{"cluster": cluster.String()},
+		}); err != nil {
+			t.Fatalf("failed to create configmap in %s: %v", cluster, err)
+		}
+	}
+
+	c := newTestClient(t, s.ClusterConfig("tenant-a"))
+	var cm corev1.ConfigMap
+	if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: "shared"}, &cm); err != nil {
+		t.Fatalf("failed to get configmap: %v", err)
+	}
+	if actual, expected := cm.Data["cluster"], "tenant-a"; actual != expected {
+		t.Errorf("got configmap from %s, expected %s", actual, expected)
+	}
+	if actual, expected := logicalcluster.From(&cm), logicalcluster.Name("tenant-a"); actual != expected {
+		t.Errorf("configmap is annotated with logical cluster %s, expected %s", actual, expected)
+	}
+
+	var all corev1.ConfigMapList
+	if err := newTestClient(t, s.ClusterConfig("*")).List(ctx, &all); err != nil {
+		t.Fatalf("failed to list configmaps across logical clusters: %v", err)
+	}
+	var clusters []logicalcluster.Name
+	for i := range all.Items {
+		clusters = append(clusters, logicalcluster.From(&all.Items[i]))
+	}
+	if diff := cmp.Diff([]logicalcluster.Name{"tenant-a", "tenant-b"}, clusters); diff != "" {
+		t.Errorf("unexpected logical clusters in wildcard list: %s", diff)
+	}
+}
+
+func TestServerWatch(t *testing.T) {
+	s := NewServer("root")
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var list datav1alpha1.WidgetList
+	if err := newTestClient(t, s.ClusterConfig("*")).List(ctx, &list); err != nil {
+		t.Fatalf("failed to list widgets: %v", err)
+	}
+	w, err := newTestClient(t, s.ClusterConfig("*")).Watch(ctx, &datav1alpha1.WidgetList{}, &client.ListOptions{Raw: &metav1.ListOptions{ResourceVersion: list.ResourceVersion}})
+	if err != nil {
+		t.Fatalf("failed to watch widgets: %v", err)
+	}
+	defer w.Stop()
+
+	c := newTestClient(t, s.ClusterConfig("tenant"))
+	widget := &datav1alpha1.Widget{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "widget", Finalizers: []string{"test"}}}
+	if err := c.Create(ctx, widget); err != nil {
+		t.Fatalf("failed to create widget: %v", err)
+	}
+	patch := client.MergeFrom(widget.DeepCopy())
+	widget.Status.Total = 1
+	if err := c.Status().Patch(ctx, widget, patch); err != nil {
+		t.Fatalf("failed to patch widget status: %v", err)
+	}
+	if err := c.Delete(ctx, widget); err != nil {
+		t.Fatalf("failed to delete widget: %v", err)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(widget), widget); err != nil {
+		t.Fatalf("expected widget with finalizer to still exist: %v", err)
+	}
+	patch = client.MergeFrom(widget.DeepCopy())
+	widget.Finalizers = nil
+	if err := c.Patch(ctx, widget, patch); err != nil {
+		t.Fatalf("failed to remove finalizer: %v", err)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(widget), widget); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected widget to be deleted, got %v", err)
+	}
+
+	var events []watch.EventType
+	for len(events) < 4 {
+		select {
+		case e := <-w.ResultChan():
+			events = append(events, e.Type)
+			if actual := logicalcluster.From(e.Object.(client.Object)); actual != "tenant" {
+				t.Errorf("got event for logical cluster %s", actual)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for events, got %v", events)
+		}
+	}
+	// create, status patch, deletion timestamp, and finalizer removal completing the deletion
+	if diff := cmp.Diff([]watch.EventType{watch.Added, watch.Modified, watch.Modified, watch.Deleted}, events); diff != "" {
+		t.Errorf("unexpected events: %s", diff)
+	}
+}
+
+func TestServerApply(t *testing.T) {
+	s := NewServer("root")
+	defer s.Close()
+	ctx := context.Background()
+	c := newTestClient(t, s.ClusterConfig("tenant"))
+
+	for _, data := range []map[string]string{{"a": "1"}, {"a": "2"}} {
+		cm := &corev1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "applied"},
+			Data:       data,
+		}
+		if err := c.Patch(ctx, cm, client.Apply, client.FieldOwner("test"), client.ForceOwnership); err != nil {
+			t.Fatalf("failed to apply configmap: %v", err)
+		}
+		var actual corev1.ConfigMap
+		if err := c.Get(ctx, client.ObjectKeyFromObject(cm), &actual); err != nil {
+			t.Fatalf("failed to get configmap: %v", err)
+		}
+		if diff := cmp.Diff(data, actual.Data); diff != "" {
+			t.Errorf("unexpected data after apply: %s", diff)
+		}
+	}
+}
+
+const timeout = 10 * time.Second
@@ -0,0 +1,269 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package framework
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+)
+
+// ArtifactDir returns the directory for the artifacts of the test, or an empty string without --artifact-dir.
+func ArtifactDir(t *testing.T) string {
+	if artifactDir == "" {
+		return ""
+	}
+	return filepath.Join(artifactDir, strings.NewReplacer("/", "_", ":", "_").Replace(t.Name()))
+}
+
+// DumpArtifacts writes the artifacts of the workspace into the artifact directory of the test:
+//
+//   - every object in the workspace, see DumpObjects;
+//   - the logs of the controller-manager since the workspace was created, if --controller-kubeconfig is set;
+//   - the requests made in the workspace since it was created, from the kcp audit log given by --audit-log.
+func (w *Workspace) DumpArtifacts(t *testing.T) {
+	t.Helper()
+	dir := ArtifactDir(t)
+	if dir == "" {
+		t.Logf("not dumping workspace %s: no artifact directory", w.Path)
+		return
+	}
+	workspaceDir := filepath.Join(dir, strings.ReplaceAll(w.Path.String(), ":", "_"))
+	if err := DumpObjects(context.TODO(), ClusterConfig(t, w.Path), workspaceDir); err != nil {
+		t.Logf("failed to dump workspace %s: %v", w.Path, err)
+	}
+
+	if controllerKubeconfig != "" {
+		cfg, err := clientcmd.BuildConfigFromFlags("", controllerKubeconfig)
+		if err == nil {
+			var clientset kubernetes.Interface
+			if clientset, err = kubernetes.NewForConfig(cfg); err == nil {
+				err = DumpControllerLogs(context.TODO(), clientset, filepath.Join(dir, "controller-manager"), w.created)
+			}
+		}
+		if err != nil {
+			t.Logf("failed to dump controller-manager logs: %v", err)
+		}
+	}
+
+	if auditLog != "" {
+		if err := DumpAuditLog(auditLog, filepath.Join(workspaceDir, "audit.log"), w.created, w.Path.String(), w.Cluster.String()); err != nil {
+			t.Logf("failed to dump audit log of workspace %s: %v", w.Path, err)
+		}
+	}
+	t.Logf("dumped artifacts of workspace %s into %s", w.Path, dir)
+}
+
+// artifactResources are dumped even when discovery does not report them, so that the objects the controllers work with
+// are in the artifacts of every failed test.
+var artifactResources = []schema.GroupVersionResource{
+	{Group: "data.my.domain", Version: "v1alpha1", Resource: "widgets"},
+	{Group: "data.my.domain", Version: "v1alpha1", Resource: "widgetquotas"},
+	{Version: "v1", Resource: "configmaps"},
+	{Version: "v1", Resource: "secrets"},
+	{Version: "v1", Resource: "namespaces"},
+	{Version: "v1", Resource: "events"},
+	{Group: "apis.kcp.io", Version: "v1alpha1", Resource: "apibindings"},
+}
+
+// DumpObjects writes every object that can be listed with the config into dir, with one file per resource. Resources
+// that cannot be discovered or listed are skipped, and reported in the returned error.
+func DumpObjects(ctx context.Context, cfg *rest.Config, dir string) error {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(cfg)
+	if err != nil {
+		return err
+	}
+	dynamicClient, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	var errs []string
+	resourceLists, err := discoveryClient.ServerPreferredResources()
+	if err != nil {
+		// The resources of the groups that could be discovered are still dumped
+		errs = append(errs, err.Error())
+	}
+	resources := map[schema.GroupResource]schema.GroupVersionResource{}
+	for _, resourceList := range resourceLists {
+		gv, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		for _, resource := range resourceList.APIResources {
+			if strings.Contains(resource.Name, "/") || !contains(resource.Verbs, "list") {
+				continue
+			}
+			resources[gv.WithResource(resource.Name).GroupResource()] = gv.WithResource(resource.Name)
+		}
+	}
+	for _, gvr := range artifactResources {
+		if _, ok := resources[gvr.GroupResource()]; !ok {
+			resources[gvr.GroupResource()] = gvr
+		}
+	}
+
+	for _, gvr := range resources {
+		list, err := dynamicClient.Resource(gvr).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to list %s: %v", gvr.GroupResource(), err))
+			continue
+		}
+		if len(list.Items) == 0 {
+			continue
+		}
+		data, err := yaml.Marshal(list.UnstructuredContent())
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to marshal %s: %v", gvr.GroupResource(), err))
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, gvr.GroupResource().String()+".yaml"), data, 0o644); err != nil {
+			return err
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("incomplete dump: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// DumpControllerLogs writes the logs of every container of the controller-manager pods since the given time into dir,
+// with one file per container.
+func DumpControllerLogs(ctx context.Context, clientset kubernetes.Interface, dir string, since time.Time) error {
+	pods, err := clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{LabelSelector: "control-plane=controller-manager"})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	sinceTime := metav1.NewTime(since)
+	var errs []string
+	for _, pod := range pods.Items {
+		for _, container := range pod.Spec.Containers {
+			logs, err := clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+				Container: container.Name,
+				SinceTime: &sinceTime,
+			}).DoRaw(ctx)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("failed to get logs of %s/%s/%s: %v", pod.Namespace, pod.Name, container.Name, err))
+				continue
+			}
+			file := filepath.Join(dir, fmt.Sprintf("%s_%s_%s.log", pod.Namespace, pod.Name, container.Name))
+			if err := os.WriteFile(file, logs, 0o644); err != nil {
+				return err
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("incomplete logs: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// auditEvent holds the fields of an audit event that DumpAuditLog selects events by.
+type auditEvent struct {
+	RequestURI     string           `json:"requestURI"`
+	StageTimestamp metav1.MicroTime `json:"stageTimestamp"`
+}
+
+// DumpAuditLog copies the events of the audit log at path for requests to any of the logical clusters, given by name
+// or path, since the given time into file.
+func DumpAuditLog(path, file string, since time.Time, clusters ...string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var prefixes []string
+	for _, cluster := range clusters {
+		if cluster != "" {
+			prefixes = append(prefixes, "/clusters/"+cluster+"/")
+		}
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		if event.StageTimestamp.Time.Before(since) || !containsAny(event.RequestURI, prefixes) {
+			continue
+		}
+		if _, err := out.Write(append(scanner.Bytes(), '\n')); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// containsAny reports whether s contains any of the substrings.
+func containsAny(s string, substrings []string) bool {
+	for _, substring := range substrings {
+		if strings.Contains(s, substring) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(s []string, v string) bool {
+	for _, item := range s {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package framework
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kcp-dev/logicalcluster/v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+func TestDumpObjects(t *testing.T) {
+	server := fake.NewServer("root")
+	defer server.Close()
+
+	scheme := Scheme(t)
+	for _, cluster := range []string{"dumped", "other"} {
+		c, err := client.New(server.ClusterConfig(logicalcluster.Name(cluster)), client.Options{Scheme: scheme})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obj := range []client.Object{
+			&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: cluster}},
+			&datav1alpha1.Widget{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: cluster}},
+		} {
+			if err := c.Create(context.TODO(), obj); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	dir := t.TempDir()
+	if err := DumpObjects(context.TODO(), server.ClusterConfig("dumped"), dir); err != nil {
+		t.Fatalf("failed to dump objects: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, entry := range entries {
+		files = append(files, entry.Name())
+	}
+	sort.Strings(files)
+	if diff := cmp.Diff([]string{"configmaps.yaml", "widgets.data.my.domain.yaml"}, files); diff != "" {
+		t.Errorf("unexpected files (-want +got):\n%s", diff)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "name: dumped") || strings.Contains(string(data), "name: other") {
+			t.Errorf("expected %s to contain only the objects of the dumped logical cluster, got:\n%s", file, data)
+		}
+	}
+}
+
+func TestDumpControllerLogs(t *testing.T) {
+	clientset := kubefake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "synced", Name: "manager", Labels: map[string]string{"control-plane": "controller-manager"}},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "manager"}, {Name: "kube-rbac-proxy"}}},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "synced", Name: "syncer"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "syncer"}}},
+		},
+	)
+
+	dir := t.TempDir()
+	if err := DumpControllerLogs(context.TODO(), clientset, dir, time.Now()); err != nil {
+		t.Fatalf("failed to dump logs: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, entry := range entries {
+		files = append(files, entry.Name())
+	}
+	if diff := cmp.Diff([]string{"synced_manager_kube-rbac-proxy.log", "synced_manager_manager.log"}, files); diff != "" {
+		t.Errorf("unexpected files (-want +got):\n%s", diff)
+	}
+}
+
+func TestDumpAuditLog(t *testing.T) {
+	since := time.Date(2022, time.June, 1, 12, 0, 0, 0, time.UTC)
+	events := []string{
+		`{"requestURI":"/clusters/root:org:ws/api/v1/namespaces/default/configmaps","stageTimestamp":"2022-06-01T12:00:01.000000Z"}`,
+		`{"requestURI":"/services/apiexport/root:org/export/clusters/abc123/api/v1/secrets","stageTimestamp":"2022-06-01T12:00:02.000000Z"}`,
+		`{"requestURI":"/clusters/root:org:ws/api/v1/namespaces","stageTimestamp":"2022-06-01T11:59:59.000000Z"}`,
+		`{"requestURI":"/clusters/root:org:wsother/api/v1/namespaces","stageTimestamp":"2022-06-01T12:00:03.000000Z"}`,
+		`{"requestURI":"/clusters/def456/api/v1/namespaces","stageTimestamp":"2022-06-01T12:00:04.000000Z"}`,
+		`not json`,
+	}
+	in := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(in, []byte(strings.Join(events, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(t.TempDir(), "ws", "audit.log")
+	if err := DumpAuditLog(in, out, since, "root:org:ws", "abc123"); err != nil {
+		t.Fatalf("failed to dump audit log: %v", err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(strings.Join(events[:2], "\n")+"\n", string(data)); diff != "" {
+		t.Errorf("unexpected audit log (-want +got):\n%s", diff)
+	}
+}
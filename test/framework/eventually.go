@@ -0,0 +1,87 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package framework
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const pollInterval = 100 * time.Millisecond
+
+// Eventually waits for condition to be done, and fails the test with the last reason it gave if it never is. The
+// description says what is waited for, such as "configmap default/foo to have a response".
+func Eventually(t *testing.T, condition func() (done bool, reason string), description string) {
+	t.Helper()
+	t.Logf("waiting for %s", description)
+	var lastReason string
+	if err := wait.PollImmediate(pollInterval, wait.ForeverTestTimeout, func() (bool, error) {
+		done, reason := condition()
+		if !done && reason != lastReason {
+			t.Logf("not done waiting for %s: %s", description, reason)
+		}
+		lastReason = reason
+		return done, nil
+	}); err != nil {
+		t.Fatalf("timed out waiting for %s: %s", description, lastReason)
+	}
+}
+
+// EventuallyObject waits for the object with the key to exist and to satisfy condition. obj holds the last state that
+// was seen.
+func EventuallyObject[T client.Object](t *testing.T, c client.Client, key client.ObjectKey, obj T, condition func(T) (done bool, reason string), description string) {
+	t.Helper()
+	Eventually(t, func() (bool, string) {
+		if err := c.Get(context.TODO(), key, obj); err != nil {
+			if apierrors.IsNotFound(err) {
+				return false, fmt.Sprintf("%s not found", key)
+			}
+			return false, fmt.Sprintf("failed to get %s: %v", key, err)
+		}
+		return condition(obj)
+	}, description)
+}
+
+// EventuallyExists waits for the object with the key to exist. obj holds the object afterwards.
+func EventuallyExists[T client.Object](t *testing.T, c client.Client, key client.ObjectKey, obj T) {
+	t.Helper()
+	EventuallyObject(t, c, key, obj, func(T) (bool, string) { return true, "" }, fmt.Sprintf("%T %s to exist", obj, key))
+}
+
+// EventuallyDeleted waits for the object with the key to be gone.
+func EventuallyDeleted[T client.Object](t *testing.T, c client.Client, key client.ObjectKey, obj T) {
+	t.Helper()
+	Eventually(t, func() (bool, string) {
+		err := c.Get(context.TODO(), key, obj)
+		switch {
+		case apierrors.IsNotFound(err):
+			return true, ""
+		case err != nil:
+			return false, fmt.Sprintf("failed to get %s: %v", key, err)
+		case !obj.GetDeletionTimestamp().IsZero():
+			return false, fmt.Sprintf("%s is being deleted, finalizers: %v", key, obj.GetFinalizers())
+		default:
+			return false, fmt.Sprintf("%s still exists", key)
+		}
+	}, fmt.Sprintf("%T %s to be deleted", obj, key))
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package framework provides the building blocks of the end-to-end tests: workspaces that are created, bound to the
+// APIExport of this repo and torn down with the test, typed helpers that wait for objects to reach a state, and
+// dumping of a failed test's workspace into the artifact directory.
+//
+// The package registers the --workspace, --artifact-dir, --controller-kubeconfig and --audit-log flags.
+package framework
+
+import (
+	"flag"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	kcpclienthelper "github.com/kcp-dev/apimachinery/v2/pkg/client"
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+	tenancyv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/tenancy/v1alpha1"
+	"github.com/kcp-dev/logicalcluster/v3"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+)
+
+var (
+	workspaceName        string
+	artifactDir          string
+	controllerKubeconfig string
+	auditLog             string
+)
+
+func init() {
+	rand.Seed(time.Now().Unix())
+	flag.StringVar(&workspaceName, "workspace", "", "Workspace in which to run these tests.")
+	flag.StringVar(&artifactDir, "artifact-dir", os.Getenv("ARTIFACT_DIR"), "Directory to dump the workspaces of failed tests into. Defaults to $ARTIFACT_DIR.")
+	flag.StringVar(&controllerKubeconfig, "controller-kubeconfig", "", "Kubeconfig of the cluster the controller-manager runs in, to collect its logs for failed tests.")
+	flag.StringVar(&auditLog, "audit-log", "", "Audit log of kcp, to collect the requests made in the workspaces of failed tests.")
+}
+
+// ParentWorkspace returns the workspace given by --workspace, in which the workspaces of the tests are created.
+func ParentWorkspace(t *testing.T) logicalcluster.Path {
+	t.Helper()
+	if workspaceName == "" {
+		t.Fatal("--workspace cannot be empty")
+	}
+
+	return logicalcluster.NewPath(workspaceName)
+}
+
+// Scheme returns a scheme with every type the tests use.
+func Scheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to add client go to scheme: %v", err)
+	}
+	if err := tenancyv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to add %s to scheme: %v", tenancyv1alpha1.SchemeGroupVersion, err)
+	}
+	if err := datav1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to add %s to scheme: %v", datav1alpha1.GroupVersion, err)
+	}
+	if err := apisv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to add %s to scheme: %v", apisv1alpha1.SchemeGroupVersion, err)
+	}
+	return scheme
+}
+
+// ClusterConfig returns a config for the logical cluster, from the "base" context of the kubeconfig.
+func ClusterConfig(t *testing.T, clusterName logicalcluster.Path) *rest.Config {
+	t.Helper()
+	restConfig, err := config.GetConfigWithContext("base")
+	if err != nil {
+		t.Fatalf("failed to load *rest.Config: %v", err)
+	}
+	return rest.AddUserAgent(kcpclienthelper.SetCluster(rest.CopyConfig(restConfig), clusterName), t.Name())
+}
+
+// Client returns a client for the logical cluster.
+func Client(t *testing.T, clusterName logicalcluster.Path) client.Client {
+	t.Helper()
+	c, err := client.New(ClusterConfig(t, clusterName), client.Options{Scheme: Scheme(t)})
+	if err != nil {
+		t.Fatalf("failed to create a client: %v", err)
+	}
+	return c
+}
+
+const characters = "abcdefghijklmnopqrstuvwxyz"
+
+// RandomName returns a random name that is valid for any object.
+func RandomName() string {
+	b := make([]byte, 10)
+	for i := range b {
+		b[i] = characters[rand.Intn(len(characters))]
+	}
+	return string(b)
+}
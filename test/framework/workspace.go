@@ -0,0 +1,196 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package framework
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+	corev1alpha1 "github.com/kcp-dev/kcp/pkg/apis/core/v1alpha1"
+	tenancyv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/tenancy/v1alpha1"
+	"github.com/kcp-dev/kcp/pkg/apis/third_party/conditions/util/conditions"
+	"github.com/kcp-dev/logicalcluster/v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// APIExportName is the name of the APIExport of this repo, in the workspace given by --workspace.
+const APIExportName = "controller-runtime-example-data.my.domain"
+
+// ClaimAll returns an accepted permission claim for all objects of the resource.
+func ClaimAll(group, resource string) apisv1alpha1.AcceptablePermissionClaim {
+	return apisv1alpha1.AcceptablePermissionClaim{
+		PermissionClaim: apisv1alpha1.PermissionClaim{
+			GroupResource: apisv1alpha1.GroupResource{Group: group, Resource: resource},
+			All:           true,
+		},
+		State: apisv1alpha1.ClaimAccepted,
+	}
+}
+
+// DefaultPermissionClaims returns the permission claims of the APIExport of this repo, all accepted.
+func DefaultPermissionClaims() []apisv1alpha1.AcceptablePermissionClaim {
+	return []apisv1alpha1.AcceptablePermissionClaim{
+		ClaimAll("", "configmaps"),
+		ClaimAll("", "secrets"),
+		ClaimAll("", "namespaces"),
+		ClaimAll("", "events"),
+		ClaimAll("apis.kcp.io", "apibindings"),
+	}
+}
+
+// Workspace is a workspace created for a single test.
+type Workspace struct {
+	// Path is the path of the logical cluster of the workspace.
+	Path logicalcluster.Path
+	// Cluster is the name of the logical cluster of the workspace.
+	Cluster logicalcluster.Name
+	// Client is a client for the logical cluster of the workspace.
+	Client client.Client
+
+	created time.Time
+}
+
+type workspaceOptions struct {
+	bind   bool
+	claims []apisv1alpha1.AcceptablePermissionClaim
+}
+
+// WorkspaceOption configures NewWorkspace.
+type WorkspaceOption func(*workspaceOptions)
+
+// WithPermissionClaims sets the permission claims the workspace accepts when it binds to the APIExport of this repo,
+// instead of DefaultPermissionClaims.
+func WithPermissionClaims(claims ...apisv1alpha1.AcceptablePermissionClaim) WorkspaceOption {
+	return func(o *workspaceOptions) {
+		o.claims = claims
+	}
+}
+
+// WithoutAPIBinding creates the workspace without binding it to the APIExport of this repo.
+func WithoutAPIBinding() WorkspaceOption {
+	return func(o *workspaceOptions) {
+		o.bind = false
+	}
+}
+
+// NewWorkspace creates a workspace with a random name in the workspace given by --workspace, waits for it to be ready
+// and binds it to the APIExport of this repo. The workspace is deleted when the test and its subtests complete, after
+// its artifacts have been dumped into the artifact directory if the test failed, see DumpArtifacts.
+func NewWorkspace(t *testing.T, opts ...WorkspaceOption) *Workspace {
+	t.Helper()
+	options := workspaceOptions{bind: true, claims: DefaultPermissionClaims()}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	parent := ParentWorkspace(t)
+	path := parent.Join(RandomName())
+	c := Client(t, parent)
+	created := time.Now()
+	t.Logf("creating workspace %s", path)
+	workspace := &tenancyv1alpha1.Workspace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: path.Base(),
+		},
+		Spec: tenancyv1alpha1.WorkspaceSpec{
+			Type: tenancyv1alpha1.WorkspaceTypeReference{
+				Name: "universal",
+				Path: "root",
+			},
+		},
+	}
+	if err := c.Create(context.TODO(), workspace); err != nil {
+		t.Fatalf("failed to create workspace: %s: %v", path, err)
+	}
+	t.Cleanup(func() {
+		t.Logf("deleting workspace %s", path)
+		if err := c.Delete(context.TODO(), workspace); err != nil && !apierrors.IsNotFound(err) {
+			t.Errorf("failed to delete workspace %s: %v", path, err)
+		}
+	})
+
+	EventuallyObject(t, c, client.ObjectKey{Name: path.Base()}, workspace, func(workspace *tenancyv1alpha1.Workspace) (bool, string) {
+		if actual, expected := workspace.Status.Phase, corev1alpha1.LogicalClusterPhaseReady; actual != expected {
+			return false, fmt.Sprintf("phase is %s, not %s", actual, expected)
+		}
+		return true, ""
+	}, fmt.Sprintf("workspace %s to be ready", path))
+
+	w := &Workspace{Path: path, Cluster: logicalcluster.Name(workspace.Spec.Cluster), Client: Client(t, path), created: created}
+	t.Cleanup(func() {
+		if t.Failed() {
+			w.DumpArtifacts(t)
+		}
+	})
+
+	if options.bind {
+		w.Bind(t, parent, APIExportName, options.claims...)
+	}
+	return w
+}
+
+// Bind binds the workspace to an APIExport, accepting the given permission claims, and waits for the binding to
+// complete.
+func (w *Workspace) Bind(t *testing.T, exportPath logicalcluster.Path, exportName string, claims ...apisv1alpha1.AcceptablePermissionClaim) *apisv1alpha1.APIBinding {
+	t.Helper()
+	t.Logf("creating APIBinding %s|%s", w.Path, exportName)
+	apiBinding := &apisv1alpha1.APIBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: exportName,
+		},
+		Spec: apisv1alpha1.APIBindingSpec{
+			Reference: apisv1alpha1.BindingReference{
+				Export: &apisv1alpha1.ExportBindingReference{
+					Path: exportPath.String(),
+					Name: exportName,
+				},
+			},
+			PermissionClaims: claims,
+		},
+	}
+	if err := w.Client.Create(context.TODO(), apiBinding); err != nil {
+		t.Fatalf("could not create APIBinding %s|%s: %v", w.Path, exportName, err)
+	}
+
+	EventuallyObject(t, w.Client, client.ObjectKey{Name: exportName}, apiBinding, func(apiBinding *apisv1alpha1.APIBinding) (bool, string) {
+		if conditions.IsTrue(apiBinding, apisv1alpha1.InitialBindingCompleted) {
+			return true, ""
+		}
+		if condition := conditions.Get(apiBinding, apisv1alpha1.InitialBindingCompleted); condition != nil {
+			return false, fmt.Sprintf("%s: %s", condition.Reason, condition.Message)
+		}
+		return false, "no condition present"
+	}, fmt.Sprintf("APIBinding %s|%s to be bound", w.Path, exportName))
+	return apiBinding
+}
+
+// CreateNamespace creates a namespace with a random name in the workspace.
+func (w *Workspace) CreateNamespace(t *testing.T) string {
+	t.Helper()
+	name := RandomName()
+	t.Logf("creating namespace %s|%s", w.Path, name)
+	if err := w.Client.Create(context.TODO(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}); err != nil {
+		t.Fatalf("failed to create namespace %s|%s: %v", w.Path, name, err)
+	}
+	return name
+}
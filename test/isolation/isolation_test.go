@@ -0,0 +1,260 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package isolation verifies that requests made by a cluster-aware client with one logical cluster in the context
+// never read or mutate the objects of another logical cluster.
+package isolation
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/kcp-dev/logicalcluster/v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/kontext"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+)
+
+const (
+	clusterA = logicalcluster.Name("cluster-a")
+	clusterB = logicalcluster.Name("cluster-b")
+)
+
+var key = client.ObjectKey{Namespace: "default", Name: "shared"}
+
+// newClient returns a cluster-aware client where both logical clusters hold a ConfigMap and a Widget with the same
+// namespace and name, each recording the logical cluster it was created in.
+func newClient(t *testing.T) client.Client {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to add client go to scheme: %v", err)
+	}
+	if err := datav1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to add %s to scheme: %v", datav1alpha1.GroupVersion, err)
+	}
+
+	c := fake.NewClusterClient(scheme)
+	for _, cluster := range []logicalcluster.Name{clusterA, clusterB} {
+		c.WithObjects(cluster,
+			&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+				Data:       map[string]string{"cluster": cluster.String()},
+			},
+			&datav1alpha1.Widget{
+				ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+				Spec:       datav1alpha1.WidgetSpec{Foo: cluster.String()},
+			},
+		)
+	}
+	return c
+}
+
+// expectUntouched fails the test if the objects of the logical cluster no longer hold their initial state.
+func expectUntouched(t *testing.T, c client.Client, cluster logicalcluster.Name) {
+	t.Helper()
+	ctx := kontext.WithCluster(context.Background(), cluster)
+
+	var cm corev1.ConfigMap
+	if err := c.Get(ctx, key, &cm); err != nil {
+		t.Fatalf("failed to get configmap %s|%s: %v", cluster, key, err)
+	}
+	if diff := cmp.Diff(map[string]string{"cluster": cluster.String()}, cm.Data); diff != "" {
+		t.Errorf("configmap %s|%s was mutated: %s", cluster, key, diff)
+	}
+
+	var widget datav1alpha1.Widget
+	if err := c.Get(ctx, key, &widget); err != nil {
+		t.Fatalf("failed to get widget %s|%s: %v", cluster, key, err)
+	}
+	if diff := cmp.Diff(datav1alpha1.WidgetSpec{Foo: cluster.String()}, widget.Spec); diff != "" {
+		t.Errorf("widget %s|%s spec was mutated: %s", cluster, key, diff)
+	}
+	if diff := cmp.Diff(datav1alpha1.WidgetStatus{}, widget.Status); diff != "" {
+		t.Errorf("widget %s|%s status was mutated: %s", cluster, key, diff)
+	}
+}
+
+func TestGet(t *testing.T) {
+	c := newClient(t)
+	for _, cluster := range []logicalcluster.Name{clusterA, clusterB} {
+		var cm corev1.ConfigMap
+		if err := c.Get(kontext.WithCluster(context.Background(), cluster), key, &cm); err != nil {
+			t.Fatalf("failed to get configmap %s|%s: %v", cluster, key, err)
+		}
+		if actual, expected := cm.Data["cluster"], cluster.String(); actual != expected {
+			t.Errorf("got configmap from logical cluster %s in %s", actual, expected)
+		}
+		if actual, expected := logicalcluster.From(&cm), cluster; actual != expected {
+			t.Errorf("configmap from %s is annotated with logical cluster %s", expected, actual)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	c := newClient(t)
+	for _, cluster := range []logicalcluster.Name{clusterA, clusterB} {
+		var list corev1.ConfigMapList
+		if err := c.List(kontext.WithCluster(context.Background(), cluster), &list); err != nil {
+			t.Fatalf("failed to list configmaps in %s: %v", cluster, err)
+		}
+		if len(list.Items) != 1 {
+			t.Fatalf("expected 1 configmap in %s, got %d", cluster, len(list.Items))
+		}
+		for _, cm := range list.Items {
+			if actual := logicalcluster.From(&cm); actual != cluster {
+				t.Errorf("list in %s returned configmap %s from %s", cluster, key, actual)
+			}
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	c := newClient(t)
+	created := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: "created"}}
+	if err := c.Create(kontext.WithCluster(context.Background(), clusterA), created); err != nil {
+		t.Fatalf("failed to create configmap in %s: %v", clusterA, err)
+	}
+	if actual := logicalcluster.From(created); actual != clusterA {
+		t.Errorf("configmap created in %s is annotated with logical cluster %s", clusterA, actual)
+	}
+
+	err := c.Get(kontext.WithCluster(context.Background(), clusterB), client.ObjectKeyFromObject(created), &corev1.ConfigMap{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected configmap created in %s not to exist in %s, got %v", clusterA, clusterB, err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	c := newClient(t)
+	ctx := kontext.WithCluster(context.Background(), clusterA)
+	var cm corev1.ConfigMap
+	if err := c.Get(ctx, key, &cm); err != nil {
+		t.Fatalf("failed to get configmap %s|%s: %v", clusterA, key, err)
+	}
+	cm.Data["cluster"] = "updated"
+	if err := c.Update(ctx, &cm); err != nil {
+		t.Fatalf("failed to update configmap %s|%s: %v", clusterA, key, err)
+	}
+	expectUntouched(t, c, clusterB)
+}
+
+func TestPatch(t *testing.T) {
+	c := newClient(t)
+	ctx := kontext.WithCluster(context.Background(), clusterA)
+	var widget datav1alpha1.Widget
+	if err := c.Get(ctx, key, &widget); err != nil {
+		t.Fatalf("failed to get widget %s|%s: %v", clusterA, key, err)
+	}
+	patch := client.MergeFrom(widget.DeepCopy())
+	widget.Spec.Foo = "patched"
+	if err := c.Patch(ctx, &widget, patch); err != nil {
+		t.Fatalf("failed to patch widget %s|%s: %v", clusterA, key, err)
+	}
+	expectUntouched(t, c, clusterB)
+}
+
+func TestStatusPatch(t *testing.T) {
+	c := newClient(t)
+	ctx := kontext.WithCluster(context.Background(), clusterA)
+	var widget datav1alpha1.Widget
+	if err := c.Get(ctx, key, &widget); err != nil {
+		t.Fatalf("failed to get widget %s|%s: %v", clusterA, key, err)
+	}
+	patch := client.MergeFrom(widget.DeepCopy())
+	widget.Status.Total = 42
+	if err := c.Status().Patch(ctx, &widget, patch); err != nil {
+		t.Fatalf("failed to patch widget status %s|%s: %v", clusterA, key, err)
+	}
+	expectUntouched(t, c, clusterB)
+}
+
+func TestDelete(t *testing.T) {
+	c := newClient(t)
+	ctx := kontext.WithCluster(context.Background(), clusterA)
+	if err := c.Delete(ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}}); err != nil {
+		t.Fatalf("failed to delete configmap %s|%s: %v", clusterA, key, err)
+	}
+	if err := c.Get(ctx, key, &corev1.ConfigMap{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected configmap %s|%s to be deleted, got %v", clusterA, key, err)
+	}
+	expectUntouched(t, c, clusterB)
+}
+
+// TestObjectFromOtherCluster verifies that the logical cluster in the context, not the one an object was read from,
+// decides where a request goes.
+func TestObjectFromOtherCluster(t *testing.T) {
+	c := newClient(t)
+	var cm corev1.ConfigMap
+	if err := c.Get(kontext.WithCluster(context.Background(), clusterA), key, &cm); err != nil {
+		t.Fatalf("failed to get configmap %s|%s: %v", clusterA, key, err)
+	}
+
+	ctx := kontext.WithCluster(context.Background(), clusterB)
+	cm.Data["cluster"] = "written-from-b"
+	cm.ResourceVersion = ""
+	if err := c.Update(ctx, &cm); err != nil {
+		t.Fatalf("failed to update configmap %s|%s: %v", clusterB, key, err)
+	}
+	if err := c.Delete(ctx, &cm); err != nil {
+		t.Fatalf("failed to delete configmap %s|%s: %v", clusterB, key, err)
+	}
+	expectUntouched(t, c, clusterA)
+}
+
+// TestWithoutCluster verifies the documented behaviour of requests without a logical cluster in the context: lists
+// span all logical clusters, every other request fails.
+func TestWithoutCluster(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+
+	var list corev1.ConfigMapList
+	if err := c.List(ctx, &list); err != nil {
+		t.Fatalf("failed to list configmaps across logical clusters: %v", err)
+	}
+	var clusters []logicalcluster.Name
+	for i := range list.Items {
+		clusters = append(clusters, logicalcluster.From(&list.Items[i]))
+	}
+	if diff := cmp.Diff([]logicalcluster.Name{clusterA, clusterB}, clusters); diff != "" {
+		t.Errorf("unexpected logical clusters in list across logical clusters: %s", diff)
+	}
+
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}}
+	for name, request := range map[string]func() error{
+		"Get":          func() error { return c.Get(ctx, key, &corev1.ConfigMap{}) },
+		"Create":       func() error { return c.Create(ctx, cm.DeepCopy()) },
+		"Update":       func() error { return c.Update(ctx, cm.DeepCopy()) },
+		"Patch":        func() error { return c.Patch(ctx, cm.DeepCopy(), client.MergeFrom(cm)) },
+		"Status.Patch": func() error { return c.Status().Patch(ctx, cm.DeepCopy(), client.MergeFrom(cm)) },
+		"Delete":       func() error { return c.Delete(ctx, cm.DeepCopy()) },
+	} {
+		if err := request(); !errors.Is(err, fake.ErrNoCluster) {
+			t.Errorf("%s without a logical cluster: expected %v, got %v", name, fake.ErrNoCluster, err)
+		}
+	}
+	expectUntouched(t, c, clusterA)
+	expectUntouched(t, c, clusterB)
+}
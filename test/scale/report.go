@@ -0,0 +1,189 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package scale holds a scale and soak test of the controllers across hundreds of logical clusters. The test is behind
+// the scale build tag, see `make test-scale`; this file holds the report it produces.
+package scale
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Report is the machine-readable result of a scale run. Durations are in seconds.
+type Report struct {
+	// Mode is "in-process" for a run against the in-process stand-in for kcp, or "kcp" for a run against a real kcp.
+	Mode                 string    `json:"mode"`
+	Clusters             int       `json:"clusters"`
+	WidgetsPerCluster    int       `json:"widgetsPerCluster"`
+	ConfigMapsPerCluster int       `json:"configMapsPerCluster"`
+	Rounds               int       `json:"rounds"`
+	Operations           int       `json:"operations"`
+	StartedAt            time.Time `json:"startedAt"`
+	DurationSeconds      float64   `json:"durationSeconds"`
+
+	// InitialConvergenceSeconds is how long the controllers took to act on the initial objects of every cluster.
+	InitialConvergenceSeconds float64 `json:"initialConvergenceSeconds"`
+	// ConvergenceSeconds is how long the controllers took to act on each round of churn, until every Widget had the
+	// right status.total and every ConfigMap had its response and secret.
+	ConvergenceSeconds Percentiles `json:"convergenceSeconds"`
+
+	// ReconcileSeconds and ReconcileErrors are by controller. They are only known when the controller's metrics are.
+	ReconcileSeconds map[string]Percentiles `json:"reconcileSeconds,omitempty"`
+	ReconcileErrors  map[string]float64     `json:"reconcileErrors,omitempty"`
+	// Memory is only known when the controller's metrics are.
+	Memory *Memory `json:"memory,omitempty"`
+}
+
+// Percentiles summarizes a distribution.
+type Percentiles struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// Memory is the peak memory use of the controller, sampled during the run.
+type Memory struct {
+	PeakResidentBytes  float64 `json:"peakResidentBytes"`
+	PeakHeapInuseBytes float64 `json:"peakHeapInuseBytes"`
+}
+
+// Write writes the report as JSON to path.
+func (r *Report) Write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Summarize returns the exact percentiles of the samples.
+func Summarize(samples []float64) Percentiles {
+	if len(samples) == 0 {
+		return Percentiles{}
+	}
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	quantile := func(q float64) float64 {
+		return sorted[int(math.Ceil(q*float64(len(sorted))))-1]
+	}
+	return Percentiles{
+		Count: len(sorted),
+		P50:   quantile(0.5),
+		P90:   quantile(0.9),
+		P99:   quantile(0.99),
+		Max:   sorted[len(sorted)-1],
+	}
+}
+
+// HistogramPercentiles estimates the percentiles of a histogram by linear interpolation within its buckets, the way
+// PromQL's histogram_quantile does. Max is the upper bound of the highest non-empty bucket, or of the highest bucket if
+// there are samples above it.
+func HistogramPercentiles(h *dto.Histogram) Percentiles {
+	count := h.GetSampleCount()
+	if count == 0 {
+		return Percentiles{}
+	}
+	buckets := h.GetBucket()
+	quantile := func(q float64) float64 {
+		rank := q * float64(count)
+		lowerBound, lowerCount := 0.0, uint64(0)
+		for _, b := range buckets {
+			if float64(b.GetCumulativeCount()) >= rank {
+				if b.GetCumulativeCount() == lowerCount {
+					return b.GetUpperBound()
+				}
+				return lowerBound + (b.GetUpperBound()-lowerBound)*(rank-float64(lowerCount))/float64(b.GetCumulativeCount()-lowerCount)
+			}
+			lowerBound, lowerCount = b.GetUpperBound(), b.GetCumulativeCount()
+		}
+		// The rank falls into the implicit +Inf bucket
+		return lowerBound
+	}
+	max := 0.0
+	var previous uint64
+	for _, b := range buckets {
+		if b.GetCumulativeCount() > previous {
+			max = b.GetUpperBound()
+		}
+		previous = b.GetCumulativeCount()
+	}
+	if count > previous && len(buckets) > 0 {
+		max = buckets[len(buckets)-1].GetUpperBound()
+	}
+	return Percentiles{
+		Count: int(count),
+		P50:   quantile(0.5),
+		P90:   quantile(0.9),
+		P99:   quantile(0.99),
+		Max:   max,
+	}
+}
+
+// ReconcileSeconds returns the percentiles of the controller-runtime reconcile time histogram, by controller.
+func ReconcileSeconds(families []*dto.MetricFamily) map[string]Percentiles {
+	percentiles := map[string]Percentiles{}
+	for _, m := range metricsNamed(families, "controller_runtime_reconcile_time_seconds") {
+		percentiles[label(m, "controller")] = HistogramPercentiles(m.GetHistogram())
+	}
+	return percentiles
+}
+
+// ReconcileErrors returns the controller-runtime reconcile error counts, by controller.
+func ReconcileErrors(families []*dto.MetricFamily) map[string]float64 {
+	errors := map[string]float64{}
+	for _, m := range metricsNamed(families, "controller_runtime_reconcile_errors_total") {
+		errors[label(m, "controller")] = m.GetCounter().GetValue()
+	}
+	return errors
+}
+
+// Gauge returns the value of the gauge without labels, or zero if there is none.
+func Gauge(families []*dto.MetricFamily, name string) float64 {
+	for _, m := range metricsNamed(families, name) {
+		return m.GetGauge().GetValue()
+	}
+	return 0
+}
+
+func metricsNamed(families []*dto.MetricFamily, name string) []*dto.Metric {
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()
+		}
+	}
+	return nil
+}
+
+func label(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
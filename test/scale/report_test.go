@@ -0,0 +1,105 @@
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scale
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSummarize(t *testing.T) {
+	var samples []float64
+	for i := 100; i > 0; i-- {
+		samples = append(samples, float64(i))
+	}
+	expected := Percentiles{Count: 100, P50: 50, P90: 90, P99: 99, Max: 100}
+	if diff := cmp.Diff(expected, Summarize(samples)); diff != "" {
+		t.Errorf("unexpected percentiles (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(Percentiles{}, Summarize(nil)); diff != "" {
+		t.Errorf("unexpected percentiles of no samples (-want +got):\n%s", diff)
+	}
+}
+
+func TestReconcileMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	reconcileTime := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "controller_runtime_reconcile_time_seconds",
+		Buckets: []float64{0.1, 0.2, 0.4, 0.8},
+	}, []string{"controller"})
+	reconcileErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "controller_runtime_reconcile_errors_total",
+	}, []string{"controller"})
+	resident := prometheus.NewGauge(prometheus.GaugeOpts{Name: "process_resident_memory_bytes"})
+	registry.MustRegister(reconcileTime, reconcileErrors, resident)
+
+	// 50 samples in (0, 0.1], 40 in (0.1, 0.2] and 10 in (0.4, 0.8]
+	for i := 0; i < 50; i++ {
+		reconcileTime.WithLabelValues("widget").Observe(0.05)
+	}
+	for i := 0; i < 40; i++ {
+		reconcileTime.WithLabelValues("widget").Observe(0.15)
+	}
+	for i := 0; i < 10; i++ {
+		reconcileTime.WithLabelValues("widget").Observe(0.5)
+	}
+	reconcileErrors.WithLabelValues("configmap").Add(3)
+	resident.Set(1024)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]Percentiles{"widget": {Count: 100, P50: 0.1, P90: 0.2, P99: 0.76, Max: 0.8}}
+	if diff := cmp.Diff(expected, ReconcileSeconds(families), cmp.Comparer(func(a, b float64) bool {
+		return a-b < 1e-9 && b-a < 1e-9
+	})); diff != "" {
+		t.Errorf("unexpected reconcile percentiles (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]float64{"configmap": 3}, ReconcileErrors(families)); diff != "" {
+		t.Errorf("unexpected reconcile errors (-want +got):\n%s", diff)
+	}
+	if actual := Gauge(families, "process_resident_memory_bytes"); actual != 1024 {
+		t.Errorf("expected resident memory 1024, got %v", actual)
+	}
+}
+
+func TestReportWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports", "scale-report.json")
+	report := &Report{Mode: "in-process", Clusters: 3, ConvergenceSeconds: Percentiles{Count: 1, P50: 1, P90: 1, P99: 1, Max: 1}}
+	if err := report.Write(path); err != nil {
+		t.Fatalf("failed to write report: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read Report
+	if err := json.Unmarshal(data, &read); err != nil {
+		t.Fatalf("report is not valid JSON: %v", err)
+	}
+	if diff := cmp.Diff(*report, read); diff != "" {
+		t.Errorf("unexpected report (-want +got):\n%s", diff)
+	}
+}
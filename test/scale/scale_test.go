@@ -0,0 +1,478 @@
+//go:build scale
+
+/*
+Copyright 2022 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scale
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kcp-dev/logicalcluster/v3"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/kcp"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	datav1alpha1 "github.com/kcp-dev/controller-runtime-example/api/v1alpha1"
+	"github.com/kcp-dev/controller-runtime-example/controllers"
+	"github.com/kcp-dev/controller-runtime-example/test/fake"
+	"github.com/kcp-dev/controller-runtime-example/test/framework"
+)
+
+var (
+	clusterCount    = flag.Int("scale-clusters", 200, "Number of logical clusters to spread the objects over.")
+	widgetCount     = flag.Int("scale-widgets", 5, "Number of Widgets created in each logical cluster up front.")
+	configMapCount  = flag.Int("scale-configmaps", 2, "Number of ConfigMaps created in each logical cluster up front.")
+	rounds          = flag.Int("scale-rounds", 10, "Number of rounds of churn.")
+	churn           = flag.Int("scale-churn", 200, "Number of create, update and delete operations in each round of churn.")
+	parallelism     = flag.Int("scale-parallelism", 20, "Number of logical clusters worked on in parallel.")
+	convergeTimeout = flag.Duration("scale-timeout", 10*time.Minute, "How long the controllers may take to act on a round of churn.")
+	useKCP          = flag.Bool("scale-kcp", false, "Run against the kcp of the kubeconfig, creating workspaces in --workspace, and the controller-manager deployed there, instead of against an in-process kcp and controller-manager.")
+	metricsURL      = flag.String("scale-metrics-url", "", "Metrics endpoint of the deployed controller-manager, with --scale-kcp. Without it, reconcile latencies and memory are not reported.")
+	reportPath      = flag.String("scale-report", "", "File to write the report to. Defaults to scale-report.json in $ARTIFACT_DIR.")
+)
+
+// environment is where a scale run happens.
+type environment struct {
+	mode     string
+	clusters []*clusterState
+	// gather returns the metrics of the controller-manager, if they are known.
+	gather func() ([]*dto.MetricFamily, error)
+}
+
+// TestScale creates Widgets and ConfigMaps in many logical clusters, churns them in rounds, and reports how long the
+// controllers take to act on every round.
+func TestScale(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var env *environment
+	if *useKCP {
+		env = kcpEnvironment(t)
+	} else {
+		env = inProcessEnvironment(ctx, t)
+	}
+
+	report := &Report{
+		Mode:                 env.mode,
+		Clusters:             len(env.clusters),
+		WidgetsPerCluster:    *widgetCount,
+		ConfigMapsPerCluster: *configMapCount,
+		Rounds:               *rounds,
+		StartedAt:            time.Now(),
+	}
+	memory := sampleMemory(ctx, env)
+
+	t.Logf("creating %d widgets and %d configmaps in each of %d logical clusters", *widgetCount, *configMapCount, len(env.clusters))
+	start := time.Now()
+	forEachCluster(t, env.clusters, func(c *clusterState) error {
+		for i := 0; i < *widgetCount; i++ {
+			if err := c.createWidget(ctx); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < *configMapCount; i++ {
+			if err := c.createConfigMap(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	report.InitialConvergenceSeconds = waitForConvergence(ctx, t, env.clusters).Seconds()
+	t.Logf("converged in %s", time.Since(start))
+
+	var convergence []float64
+	for round := 0; round < *rounds; round++ {
+		operations := map[*clusterState]int{}
+		for i := 0; i < *churn; i++ {
+			operations[env.clusters[rand.Intn(len(env.clusters))]]++
+		}
+		report.Operations += *churn
+
+		start := time.Now()
+		var churned []*clusterState
+		for c := range operations {
+			churned = append(churned, c)
+		}
+		forEachCluster(t, churned, func(c *clusterState) error {
+			for i := 0; i < operations[c]; i++ {
+				if err := c.churn(ctx); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		waitForConvergence(ctx, t, churned)
+		convergence = append(convergence, time.Since(start).Seconds())
+		t.Logf("round %d: %d operations in %d logical clusters converged in %s", round, *churn, len(churned), time.Since(start))
+	}
+	report.ConvergenceSeconds = Summarize(convergence)
+	report.DurationSeconds = time.Since(report.StartedAt).Seconds()
+
+	if env.gather != nil {
+		families, err := env.gather()
+		if err != nil {
+			t.Errorf("failed to gather controller-manager metrics: %v", err)
+		} else {
+			report.ReconcileSeconds = ReconcileSeconds(families)
+			report.ReconcileErrors = ReconcileErrors(families)
+		}
+		report.Memory = memory()
+	}
+
+	path := *reportPath
+	if path == "" {
+		path = filepath.Join(os.Getenv("ARTIFACT_DIR"), "scale-report.json")
+	}
+	if err := report.Write(path); err != nil {
+		t.Fatalf("failed to write report: %v", err)
+	}
+	t.Logf("wrote report to %s", path)
+}
+
+// inProcessEnvironment runs the controllers in a cluster-aware manager against the virtual workspace of an in-process
+// kcp.
+func inProcessEnvironment(ctx context.Context, t *testing.T) *environment {
+	s := fake.NewServer("root")
+	t.Cleanup(s.Close)
+
+	const apiExportName = "data.my.domain"
+	if err := s.PublishAPIExport(apiExportName); err != nil {
+		t.Fatalf("failed to publish APIExport: %v", err)
+	}
+	cfg := rest.CopyConfig(s.Config())
+	cfg.Host = s.VirtualWorkspaceURL(apiExportName)
+	cfg.QPS, cfg.Burst = -1, -1
+
+	scheme := framework.Scheme(t)
+	mgr, err := kcp.NewClusterAwareManager(cfg, ctrl.Options{
+		Scheme:                 scheme,
+		MetricsBindAddress:     "0",
+		HealthProbeBindAddress: "0",
+	})
+	if err != nil {
+		t.Fatalf("failed to create manager: %v", err)
+	}
+	if err := (&controllers.ConfigMapReconciler{
+		ClusterClient: controllers.NewClusterClient(mgr.GetClient()),
+		Recorder:      mgr.GetEventRecorderFor("configmap-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		t.Fatalf("failed to set up ConfigMap controller: %v", err)
+	}
+	if err := (&controllers.WidgetReconciler{
+		ClusterClient: controllers.NewClusterClient(mgr.GetClient()),
+		Scheme:        mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		t.Fatalf("failed to set up Widget controller: %v", err)
+	}
+	go func() {
+		if err := mgr.Start(ctx); err != nil {
+			t.Errorf("failed to run manager: %v", err)
+		}
+	}()
+
+	env := &environment{mode: "in-process", gather: metrics.Registry.Gather}
+	for i := 0; i < *clusterCount; i++ {
+		clusterCfg := s.ClusterConfig(logicalcluster.Name(fmt.Sprintf("scale-%04d", i)))
+		clusterCfg.QPS, clusterCfg.Burst = -1, -1
+		c, err := client.New(clusterCfg, client.Options{Scheme: scheme})
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		env.clusters = append(env.clusters, newClusterState(fmt.Sprintf("scale-%04d", i), c))
+	}
+	return env
+}
+
+// kcpEnvironment creates a workspace bound to the APIExport for every logical cluster, which the deployed
+// controller-manager acts on.
+func kcpEnvironment(t *testing.T) *environment {
+	env := &environment{mode: "kcp"}
+	if *metricsURL != "" {
+		env.gather = scrape(*metricsURL)
+	}
+	for i := 0; i < *clusterCount; i++ {
+		workspace := framework.NewWorkspace(t)
+		env.clusters = append(env.clusters, newClusterState(workspace.Path.String(), workspace.Client))
+	}
+	return env
+}
+
+// scrape returns a function that gathers the metrics served at url.
+func scrape(url string) func() ([]*dto.MetricFamily, error) {
+	return func() ([]*dto.MetricFamily, error) {
+		resp, err := http.Get(url)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+		}
+		var parser expfmt.TextParser
+		families, err := parser.TextToMetricFamilies(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		var list []*dto.MetricFamily
+		for _, family := range families {
+			list = append(list, family)
+		}
+		return list, nil
+	}
+}
+
+// sampleMemory samples the memory use of the controller-manager every second until ctx is done, and returns a
+// function that returns the peaks so far.
+func sampleMemory(ctx context.Context, env *environment) func() *Memory {
+	var lock sync.Mutex
+	peak := &Memory{}
+	if env.gather == nil {
+		return func() *Memory { return nil }
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			families, err := env.gather()
+			if err != nil {
+				continue
+			}
+			lock.Lock()
+			if resident := Gauge(families, "process_resident_memory_bytes"); resident > peak.PeakResidentBytes {
+				peak.PeakResidentBytes = resident
+			}
+			if heap := Gauge(families, "go_memstats_heap_inuse_bytes"); heap > peak.PeakHeapInuseBytes {
+				peak.PeakHeapInuseBytes = heap
+			}
+			lock.Unlock()
+		}
+	}()
+	return func() *Memory {
+		lock.Lock()
+		defer lock.Unlock()
+		copied := *peak
+		return &copied
+	}
+}
+
+// forEachCluster calls work for every logical cluster, --scale-parallelism at a time, and fails the test if any call
+// fails.
+func forEachCluster(t *testing.T, clusters []*clusterState, work func(*clusterState) error) {
+	t.Helper()
+	var (
+		wg       sync.WaitGroup
+		lock     sync.Mutex
+		firstErr error
+	)
+	semaphore := make(chan struct{}, *parallelism)
+	for _, c := range clusters {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(c *clusterState) {
+			defer func() { <-semaphore; wg.Done() }()
+			if err := work(c); err != nil {
+				lock.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("logical cluster %s: %w", c.name, err)
+				}
+				lock.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		t.Fatal(firstErr)
+	}
+}
+
+// waitForConvergence waits until the controllers have acted on every object of the logical clusters, and returns how
+// long that took.
+func waitForConvergence(ctx context.Context, t *testing.T, clusters []*clusterState) time.Duration {
+	t.Helper()
+	start := time.Now()
+	pending := clusters
+	var reason string
+	for len(pending) > 0 {
+		if time.Since(start) > *convergeTimeout {
+			t.Fatalf("%d logical clusters did not converge within %s, e.g. %s", len(pending), *convergeTimeout, reason)
+		}
+		var lock sync.Mutex
+		var notConverged []*clusterState
+		forEachCluster(t, pending, func(c *clusterState) error {
+			if r := c.converged(ctx); r != "" {
+				lock.Lock()
+				notConverged = append(notConverged, c)
+				reason = fmt.Sprintf("%s: %s", c.name, r)
+				lock.Unlock()
+			}
+			return nil
+		})
+		pending = notConverged
+		if len(pending) > 0 {
+			time.Sleep(250 * time.Millisecond)
+		}
+	}
+	return time.Since(start)
+}
+
+// clusterState is what a logical cluster is expected to contain.
+type clusterState struct {
+	name   string
+	client client.Client
+
+	// widgets are the names of the Widgets in the logical cluster.
+	widgets map[string]bool
+	// configMaps are the secret data of the ConfigMaps in the logical cluster, by name.
+	configMaps map[string]string
+	next       int
+}
+
+func newClusterState(name string, c client.Client) *clusterState {
+	return &clusterState{name: name, client: c, widgets: map[string]bool{}, configMaps: map[string]string{}}
+}
+
+func (c *clusterState) nextName(prefix string) string {
+	c.next++
+	return fmt.Sprintf("%s-%d", prefix, c.next)
+}
+
+func (c *clusterState) createWidget(ctx context.Context) error {
+	name := c.nextName("widget")
+	if err := c.client.Create(ctx, &datav1alpha1.Widget{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec:       datav1alpha1.WidgetSpec{Foo: name},
+	}); err != nil {
+		return err
+	}
+	c.widgets[name] = true
+	return nil
+}
+
+func (c *clusterState) createConfigMap(ctx context.Context) error {
+	name := c.nextName("config")
+	data := framework.RandomName()
+	if err := c.client.Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Labels: map[string]string{"name": name}},
+		Data:       map[string]string{"secretData": data},
+	}); err != nil {
+		return err
+	}
+	c.configMaps[name] = data
+	return nil
+}
+
+// churn makes a random change to the logical cluster.
+func (c *clusterState) churn(ctx context.Context) error {
+	switch rand.Intn(6) {
+	case 0:
+		return c.createWidget(ctx)
+	case 1:
+		for name := range c.widgets {
+			var widget datav1alpha1.Widget
+			if err := c.client.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, &widget); err != nil {
+				return err
+			}
+			widget.Spec.Foo = framework.RandomName()
+			return c.client.Update(ctx, &widget)
+		}
+		return c.createWidget(ctx)
+	case 2:
+		for name := range c.widgets {
+			delete(c.widgets, name)
+			return c.client.Delete(ctx, &datav1alpha1.Widget{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}})
+		}
+		return c.createWidget(ctx)
+	case 3:
+		return c.createConfigMap(ctx)
+	case 4:
+		for name := range c.configMaps {
+			var configMap corev1.ConfigMap
+			if err := c.client.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, &configMap); err != nil {
+				return err
+			}
+			data := framework.RandomName()
+			configMap.Data["secretData"] = data
+			if err := c.client.Update(ctx, &configMap); err != nil {
+				return err
+			}
+			c.configMaps[name] = data
+			return nil
+		}
+		return c.createConfigMap(ctx)
+	default:
+		for name := range c.configMaps {
+			delete(c.configMaps, name)
+			return c.client.Delete(ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}})
+		}
+		return c.createConfigMap(ctx)
+	}
+}
+
+// converged returns why the controllers have not acted on every object of the logical cluster yet, or an empty
+// string if they have.
+func (c *clusterState) converged(ctx context.Context) string {
+	var widgets datav1alpha1.WidgetList
+	if err := c.client.List(ctx, &widgets); err != nil {
+		return fmt.Sprintf("failed to list widgets: %v", err)
+	}
+	if len(widgets.Items) != len(c.widgets) {
+		return fmt.Sprintf("%d widgets, expected %d", len(widgets.Items), len(c.widgets))
+	}
+	for _, widget := range widgets.Items {
+		if widget.Status.Total != len(c.widgets) {
+			return fmt.Sprintf("widget %s has total %d, expected %d", widget.Name, widget.Status.Total, len(c.widgets))
+		}
+	}
+
+	for name, data := range c.configMaps {
+		var configMap corev1.ConfigMap
+		if err := c.client.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, &configMap); err != nil {
+			return fmt.Sprintf("failed to get configmap %s: %v", name, err)
+		}
+		if actual, expected := configMap.Labels["response"], "hello-"+name; actual != expected {
+			return fmt.Sprintf("configmap %s has response %q, expected %q", name, actual, expected)
+		}
+		var secret corev1.Secret
+		if err := c.client.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, &secret); err != nil {
+			return fmt.Sprintf("failed to get secret %s: %v", name, err)
+		}
+		if actual := string(secret.Data["dataFromCM"]); actual != data {
+			return fmt.Sprintf("secret %s has data %q, expected %q", name, actual, data)
+		}
+	}
+	return ""
+}